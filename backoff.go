@@ -0,0 +1,57 @@
+package streamsh
+
+import (
+	"math/rand/v2"
+	"time"
+)
+
+// Reconnection backoff defaults, used when the Client fields are zero.
+const (
+	DefaultReconnectInitialDelay = 500 * time.Millisecond
+	DefaultReconnectMaxDelay     = 60 * time.Second
+	DefaultReconnectMultiplier   = 1.5
+)
+
+// reconnectJitter is the fraction by which each delay is randomly varied,
+// so that clients of a restarted daemon don't all retry at once.
+const reconnectJitter = 0.2
+
+// backoff produces exponentially growing delays between retries.
+type backoff struct {
+	initial    time.Duration
+	max        time.Duration
+	multiplier float64
+	cur        time.Duration // next delay before jitter, zero before the first
+}
+
+func newBackoff(initial, max time.Duration, multiplier float64) *backoff {
+	if initial <= 0 {
+		initial = DefaultReconnectInitialDelay
+	}
+	if max <= 0 {
+		max = DefaultReconnectMaxDelay
+	}
+	if max < initial {
+		max = initial
+	}
+	if multiplier < 1 {
+		multiplier = DefaultReconnectMultiplier
+	}
+	return &backoff{initial: initial, max: max, multiplier: multiplier}
+}
+
+// next returns the delay before the next attempt, within ±20% of a base
+// that starts at the initial delay and grows by the multiplier up to max.
+func (b *backoff) next() time.Duration {
+	if b.cur == 0 {
+		b.cur = b.initial
+	}
+	d := b.cur
+	b.cur = min(time.Duration(float64(b.cur)*b.multiplier), b.max)
+	return time.Duration(float64(d) * (1 + reconnectJitter*(2*rand.Float64()-1)))
+}
+
+// reset starts the delays over from the initial delay.
+func (b *backoff) reset() {
+	b.cur = 0
+}
@@ -0,0 +1,25 @@
+package streamsh
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	b := newBackoff(time.Second, 3*time.Second, 2)
+	for i, base := range []time.Duration{time.Second, 2 * time.Second, 3 * time.Second, 3 * time.Second} {
+		d := b.next()
+		if d < base*8/10 || d > base*12/10 {
+			t.Errorf("delay %d = %v, want %v ±20%%", i, d, base)
+		}
+	}
+	b.reset()
+	if d := b.next(); d > 1200*time.Millisecond {
+		t.Errorf("after reset = %v, want about 1s", d)
+	}
+
+	b = newBackoff(0, 0, 0)
+	if b.initial != DefaultReconnectInitialDelay || b.max != DefaultReconnectMaxDelay || b.multiplier != DefaultReconnectMultiplier {
+		t.Errorf("defaults = %+v", b)
+	}
+}
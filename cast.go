@@ -0,0 +1,154 @@
+package streamsh
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// castRecorder writes a terminal session as an asciinema v2 recording: a
+// JSON header line followed by one [time, code, data] event per line.
+// Output keeps its ANSI escapes so playback looks like the original. Writes
+// are buffered until Close.
+type castRecorder struct {
+	mu         sync.Mutex
+	f          *os.File
+	w          *bufio.Writer
+	start      time.Time // monotonic reference for event times
+	cols       int
+	rows       int
+	partialOut []byte // trailing bytes of an incomplete UTF-8 sequence
+	partialIn  []byte
+}
+
+// castHeader is the first line of an asciinema v2 file.
+type castHeader struct {
+	Version   int               `json:"version"`
+	Width     int               `json:"width"`
+	Height    int               `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Title     string            `json:"title,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+// createCastRecorder creates path, replacing any existing file, and writes
+// the header for a cols x rows terminal.
+func createCastRecorder(path, title string, cols, rows int) (*castRecorder, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("creating recording: %w", err)
+	}
+	r := &castRecorder{f: f, w: bufio.NewWriter(f), start: time.Now(), cols: cols, rows: rows}
+	env := make(map[string]string)
+	for _, key := range []string{"SHELL", "TERM"} {
+		if v := os.Getenv(key); v != "" {
+			env[key] = v
+		}
+	}
+	header, _ := json.Marshal(castHeader{
+		Version:   2,
+		Width:     cols,
+		Height:    rows,
+		Timestamp: r.start.Unix(),
+		Title:     title,
+		Env:       env,
+	})
+	r.w.Write(header)
+	r.w.WriteByte('\n')
+	if err := r.w.Flush(); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("writing recording: %w", err)
+	}
+	return r, nil
+}
+
+// output records data written to the terminal.
+func (r *castRecorder) output(data []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.stream("o", &r.partialOut, data)
+}
+
+// input records keystrokes typed into the terminal.
+func (r *castRecorder) input(data []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.stream("i", &r.partialIn, data)
+}
+
+// stream records data as a code event. A multi-byte character split across
+// reads is held back in partial until its remaining bytes arrive, since
+// event data must be valid UTF-8.
+func (r *castRecorder) stream(code string, partial *[]byte, data []byte) error {
+	buf := append(*partial, data...)
+	cut := len(buf) - incompleteRuneSuffix(buf)
+	*partial = append([]byte(nil), buf[cut:]...)
+	if cut == 0 {
+		return nil
+	}
+	return r.event(code, string(buf[:cut]))
+}
+
+// resize records a change of terminal size. Unchanged sizes are ignored.
+func (r *castRecorder) resize(cols, rows int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if cols == r.cols && rows == r.rows {
+		return nil
+	}
+	r.cols, r.rows = cols, rows
+	return r.event("r", strconv.Itoa(cols)+"x"+strconv.Itoa(rows))
+}
+
+func (r *castRecorder) event(code, data string) error {
+	if r.f == nil {
+		return os.ErrClosed
+	}
+	elapsed := time.Since(r.start).Seconds()
+	line, err := json.Marshal([]any{json.Number(strconv.FormatFloat(elapsed, 'f', 6, 64)), code, data})
+	if err != nil {
+		return err
+	}
+	r.w.Write(line)
+	return r.w.WriteByte('\n')
+}
+
+func (r *castRecorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.f == nil {
+		return nil
+	}
+	if len(r.partialOut) > 0 {
+		r.event("o", string(r.partialOut))
+	}
+	if len(r.partialIn) > 0 {
+		r.event("i", string(r.partialIn))
+	}
+	err := r.w.Flush()
+	if cerr := r.f.Close(); err == nil {
+		err = cerr
+	}
+	r.f = nil
+	return err
+}
+
+// incompleteRuneSuffix returns how many bytes at the end of b begin a UTF-8
+// sequence that is not yet complete.
+func incompleteRuneSuffix(b []byte) int {
+	for i := 1; i <= utf8.UTFMax-1 && i <= len(b); i++ {
+		c := b[len(b)-i]
+		if utf8.RuneStart(c) {
+			if c >= utf8.RuneSelf && !utf8.FullRune(b[len(b)-i:]) {
+				return i
+			}
+			return 0
+		}
+	}
+	return 0
+}
@@ -0,0 +1,70 @@
+package streamsh
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCastRecorder(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "session.cast")
+	r, err := createCastRecorder(path, "build", 80, 24)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+
+	r.output([]byte("\x1b[32mok\x1b[0m\r\n"))
+	r.output([]byte("caf\xc3")) // é split across reads
+	r.output([]byte("\xa9\r\n"))
+	r.input([]byte("ls\r"))
+	r.resize(80, 24) // unchanged: not recorded
+	r.resize(120, 40)
+	r.Close()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+
+	scanner.Scan()
+	var header castHeader
+	if err := json.Unmarshal(scanner.Bytes(), &header); err != nil {
+		t.Fatalf("header: %v", err)
+	}
+	if header.Version != 2 || header.Width != 80 || header.Height != 24 || header.Title != "build" {
+		t.Errorf("header = %+v", header)
+	}
+
+	want := [][2]string{
+		{"o", "\x1b[32mok\x1b[0m\r\n"},
+		{"o", "caf"},
+		{"o", "é\r\n"},
+		{"i", "ls\r"},
+		{"r", "120x40"},
+	}
+	var last float64
+	for i, w := range want {
+		if !scanner.Scan() {
+			t.Fatalf("missing event %d", i)
+		}
+		var ev []any
+		if err := json.Unmarshal(scanner.Bytes(), &ev); err != nil || len(ev) != 3 {
+			t.Fatalf("event %d = %s", i, scanner.Bytes())
+		}
+		ts, _ := ev[0].(float64)
+		if ts < last {
+			t.Errorf("event %d time %v before %v", i, ts, last)
+		}
+		last = ts
+		if ev[1] != w[0] || ev[2] != w[1] {
+			t.Errorf("event %d = %v, want %v", i, ev[1:], w)
+		}
+	}
+	if scanner.Scan() {
+		t.Errorf("unexpected event %s", scanner.Bytes())
+	}
+}
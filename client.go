@@ -8,10 +8,14 @@ import (
 	"io"
 	"log/slog"
 	"net"
+	"net/url"
 	"os"
 	"os/exec"
 	"os/signal"
 	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -21,6 +25,7 @@ import (
 	"github.com/acarl005/stripansi"
 	"github.com/creack/pty"
 	"github.com/google/uuid"
+	"golang.org/x/sys/unix"
 	"golang.org/x/term"
 )
 
@@ -31,52 +36,149 @@ type Client struct {
 	SocketPath string
 	Logger     *slog.Logger
 	Collab     bool
+	Tags       []string
+	Token      string // the daemon's token, if it requires one
+
+	// TimestampLines prefixes each output line with the time it was read,
+	// as "[2006-01-02T15:04:05.000000000Z] ". The prefix becomes part of the
+	// stored text, so searches match against it too, and lines read together
+	// share a timestamp.
+	TimestampLines bool
+
+	// KeepANSI asks the daemon to store output with its ANSI escapes as well
+	// as stripped, so raw reads can show colors. Lines replayed from the
+	// local buffer after a reconnect are stripped.
+	KeepANSI bool
+
+	// Dedup collapses runs of identical output lines into one, read back as
+	// "<line> (xN)", in the daemon's buffer and the local one alike, so
+	// spinners and repeated log lines don't evict useful scrollback.
+	Dedup bool
+
+	// ReadOnly makes the client refuse input sent by the daemon, so agents
+	// can watch the session but not type into it. Collab sessions can still
+	// be signalled and killed.
+	ReadOnly bool
+
+	// TTL, if set, has the daemon remove the session this long after it
+	// disconnects and goes idle, instead of after the daemon's SessionTTL.
+	TTL time.Duration
+
+	// NoPrompt leaves the shell's startup files and prompt alone, so the
+	// streamsh tag is not shown. Without the prompt hooks, commands' exit
+	// statuses and the working directory are not tracked.
+	NoPrompt bool
+
+	// PromptColor is the color of the streamsh tag in the shell prompt: a
+	// name (red, green, yellow, blue, magenta, cyan, white) or raw ANSI SGR
+	// parameters such as "38;5;208". The default is magenta.
+	PromptColor string
+
+	// NoCommandDetection stops the client from reading command lines out of
+	// the keystrokes it forwards to the shell, so no commands are reported
+	// and the session's last command stays empty. The Exec command is
+	// still reported, as it doesn't come from the keyboard.
+	NoCommandDetection bool
+
+	// Exec, if set, is run with "Shell -c" in place of an interactive
+	// shell, and the session ends when it exits. It is also the default
+	// title, and is reported as the session's command with its exit code.
+	Exec string
+
+	// LogFile, if set, receives a copy of the session's output with ANSI
+	// escapes stripped, whether or not the daemon is reachable. It is
+	// rotated to LogFile + ".1" when it would exceed LogMaxSize, if set.
+	LogFile    string
+	LogMaxSize int64
+
+	// Record, if set, is the path of an asciinema v2 recording of the
+	// session, with colors and resizes, playable with "asciinema play".
+	Record string
+
+	// RecordInput also records keystrokes in Record. They are recorded as
+	// typed, including passwords entered at prompts that don't echo, so
+	// RedactPatterns are not applied and the recording should be treated
+	// as a secret.
+	RecordInput bool
+
+	// RedactPatterns are replaced with "[REDACTED]" in every output line
+	// before it is buffered, logged, or sent to the daemon, and likewise in
+	// command lines and environment values. A matching output line is sent
+	// with its ANSI escapes stripped, since they could otherwise split a
+	// secret so the pattern misses it in the raw line.
+	RedactPatterns []*regexp.Regexp
+
+	// While disconnected, the client retries the daemon after
+	// ReconnectInitialDelay, growing the delay by ReconnectMultiplier up to
+	// ReconnectMaxDelay. Zero values use the Default* constants.
+	ReconnectInitialDelay time.Duration
+	ReconnectMaxDelay     time.Duration
+	ReconnectMultiplier   float64
+
+	// CompressThreshold is the size in bytes above which output batches
+	// are gzipped, if the daemon supports it. Zero means
+	// DefaultCompressThreshold; negative disables compression.
+	CompressThreshold int
 
 	conn      net.Conn
 	enc       *json.Encoder
 	scanner   *bufio.Scanner
 	sessionID string
 	shortID   string
-	mu        sync.Mutex // protects conn, enc, scanner
-
-	localBuf    *RingBuffer          // local ring buffer, always receives output
-	connected   atomic.Bool          // whether currently connected to daemon
-	lastCommand atomic.Pointer[string] // last detected command, for replay
-	ptmx        *os.File             // PTY master, needed by reconnect for collab
-	stopReconn  chan struct{}         // signals reconnection goroutine to stop
+	gzip      bool       // the daemon accepts compressed payloads
+	mu        sync.Mutex // protects conn, enc, scanner, gzip
+
+	log         *rotatingFile                     // LogFile, if set
+	logFailing  atomic.Bool                       // the last write to log failed
+	rec         *castRecorder                     // Record, if set
+	localBuf    *RingBuffer                       // local ring buffer, always receives output
+	connected   atomic.Bool                       // whether currently connected to daemon
+	lastCommand atomic.Pointer[string]            // last detected command, for replay
+	pendingCmd  atomic.Pointer[string]            // command awaiting its exit status
+	typedCmd    atomic.Pointer[string]            // command line entered, awaiting its start mark
+	startMarks  atomic.Bool                       // the shell reports when commands start
+	winsize     atomic.Pointer[pty.Winsize]       // current PTY size, resent on reconnect
+	environment atomic.Pointer[map[string]string] // shell environment, resent on reconnect
+	cwd         atomic.Pointer[string]            // shell working directory, resent on reconnect
+	ptmx        *os.File                          // PTY master, needed by reconnect for collab
+	cmd         *exec.Cmd                         // the shell process
+	pid         int                               // the shell's PID, sent on register
+	killed      atomic.Bool                       // set when the daemon asked us to exit
+	paused      atomic.Bool                       // SIGUSR1 toggles: output, commands, and cwd are not captured
+	stopReconn  chan struct{}                     // signals reconnection goroutine to stop
 }
 
 // Run starts the shell session and streams output to the daemon.
 // It returns the shell's exit code.
 func (c *Client) Run() (int, error) {
-	// Check if already inside a streamsh session
-	if id := os.Getenv("STREAMSH"); id != "" {
+	// Check if already inside a streamsh session. Capturing a single
+	// command from inside one is fine.
+	if id := os.Getenv("STREAMSH"); id != "" && c.Exec == "" {
 		fmt.Fprintf(os.Stderr, "Already in a streamsh session [%s]\n", id)
 		return 1, nil
 	}
+	if c.Exec != "" && c.Title == "" {
+		c.Title = c.Exec
+	}
 
 	// Self-assign session identity
 	c.sessionID = uuid.New().String()
 	c.shortID = c.sessionID[:8]
 
 	// Create local ring buffer
+	// Deduplicated like the daemon's, so both number lines alike for replay
 	c.localBuf = NewRingBuffer(100000)
+	c.localBuf.SetDedup(c.Dedup)
 
-	// Initialize reconnection control
-	c.stopReconn = make(chan struct{})
-
-	// Attempt initial connection (non-fatal if fails)
-	if err := c.connect(); err != nil {
-		c.Logger.Warn("could not connect to daemon, will retry in background", "err", err)
+	if c.LogFile != "" {
+		log, err := openRotatingFile(c.LogFile, c.LogMaxSize)
+		if err != nil {
+			return 1, err
+		}
+		c.log = log
+		defer log.Close()
 	}
 
-	// Start background reconnection goroutine
-	go c.reconnectionLoop()
-	defer func() {
-		close(c.stopReconn)
-		c.disconnect()
-	}()
-
 	// Start shell in PTY
 	shell := c.Shell
 	if shell == "" {
@@ -87,14 +189,19 @@ func (c *Client) Run() (int, error) {
 	}
 
 	cmd := exec.Command(shell)
+	if c.Exec != "" {
+		cmd = exec.Command(shell, "-c", c.Exec)
+	}
 	streamshEnv := c.shortID
 	if c.Title != "" {
 		streamshEnv += " - " + c.Title
 	}
 	cmd.Env = append(os.Environ(), "STREAMSH="+streamshEnv)
 
-	cleanup := c.setupShellPrompt(shell, cmd)
-	defer cleanup()
+	if c.Exec == "" {
+		cleanup := c.setupShellPrompt(shell, cmd)
+		defer cleanup()
+	}
 
 	ptmx, err := pty.Start(cmd)
 	if err != nil {
@@ -102,6 +209,41 @@ func (c *Client) Run() (int, error) {
 	}
 	defer ptmx.Close()
 	c.ptmx = ptmx
+	c.cmd = cmd
+	c.pid = cmd.Process.Pid
+
+	if c.Record != "" {
+		cols, rows, err := term.GetSize(int(os.Stdin.Fd()))
+		if err != nil {
+			cols, rows = 80, 24
+		}
+		rec, err := createCastRecorder(c.Record, c.Title, cols, rows)
+		if err != nil {
+			return 1, err
+		}
+		c.rec = rec
+		defer rec.Close()
+	}
+
+	environ := environmentSnapshot(cmd.Env, c.RedactPatterns)
+	c.environment.Store(&environ)
+
+	// Initialize reconnection control
+	c.stopReconn = make(chan struct{})
+
+	// Attempt initial connection (non-fatal if fails). This waits until the
+	// shell has started so that registration carries its PID; its output
+	// isn't read until below, so none is missed.
+	if err := c.connect(); err != nil {
+		c.Logger.Warn("could not connect to daemon, will retry in background", "err", err)
+	}
+
+	// Start background reconnection goroutine
+	go c.reconnectionLoop()
+	defer func() {
+		close(c.stopReconn)
+		c.disconnect()
+	}()
 
 	// Handle terminal resize
 	ch := make(chan os.Signal, 1)
@@ -109,24 +251,53 @@ func (c *Client) Run() (int, error) {
 	go func() {
 		for range ch {
 			pty.InheritSize(os.Stdin, ptmx)
+			if size, err := pty.GetsizeFull(ptmx); err == nil {
+				c.winsize.Store(size)
+				c.sendResize()
+				if c.rec != nil {
+					c.rec.resize(int(size.Cols), int(size.Rows))
+				}
+			}
 		}
 	}()
 	ch <- syscall.SIGWINCH // initial size
 
-	// Set stdin to raw mode
-	oldState, err := term.MakeRaw(int(os.Stdin.Fd()))
-	if err != nil {
-		return 1, fmt.Errorf("setting raw mode: %w", err)
+	// Pass termination signals on to the shell, so it exits and runs its
+	// traps before we restore the terminal, rather than outliving us
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+	go forwardSignals(sigs, cmd.Process)
+
+	// SIGUSR1, e.g. "kill -USR1 $PPID" in the shell, pauses or resumes
+	// streaming
+	pauses := make(chan os.Signal, 1)
+	signal.Notify(pauses, syscall.SIGUSR1)
+	go func() {
+		for range pauses {
+			c.togglePause()
+		}
+	}()
+
+	// Set stdin to raw mode. With --exec, stdin may not be a terminal,
+	// e.g. in CI.
+	if c.Exec == "" || term.IsTerminal(int(os.Stdin.Fd())) {
+		oldState, err := term.MakeRaw(int(os.Stdin.Fd()))
+		if err != nil {
+			return 1, fmt.Errorf("setting raw mode: %w", err)
+		}
+		defer term.Restore(int(os.Stdin.Fd()), oldState)
+	}
+	if c.Exec != "" {
+		c.sendCommand(c.Exec, time.Now())
 	}
-	defer term.Restore(int(os.Stdin.Fd()), oldState)
 
 	var wg sync.WaitGroup
 
 	// stdin -> PTY (with command detection)
 	go c.copyStdinToPTY(ptmx)
 
-	// daemon -> PTY (collab mode: receive agent input)
-	if c.Collab && c.connected.Load() {
+	// daemon -> client: heartbeats, and agent input in collab mode
+	if c.connected.Load() {
 		go c.handleIncomingMessages(ptmx)
 	}
 
@@ -141,10 +312,29 @@ func (c *Client) Run() (int, error) {
 	err = cmd.Wait()
 	signal.Stop(ch)
 	close(ch)
+	signal.Stop(sigs)
+	close(sigs)
+	signal.Stop(pauses)
+	close(pauses)
+
+	// Let the copier drain output the shell wrote just before exiting. It
+	// stops once the PTY reports EOF, unless a background process still
+	// holds the terminal open, so close the PTY after a grace period.
+	drained := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-time.After(ptyDrainTimeout):
+		ptmx.Close()
+		<-drained
+	}
 
-	// Close PTY to unblock copiers
-	ptmx.Close()
-	wg.Wait()
+	if c.killed.Load() {
+		c.Logger.Warn("session killed by daemon request", "id", c.shortID)
+	}
 
 	exitCode := 0
 	if err != nil {
@@ -154,17 +344,48 @@ func (c *Client) Run() (int, error) {
 			exitCode = 1
 		}
 	}
+	if c.Exec != "" {
+		c.sendCommandResult(exitCode)
+	}
 	return exitCode, nil
 }
 
+// forwardSignals sends each signal received on sigs to proc. Interactive
+// shells ignore SIGTERM, so if one is still running forwardGrace after a
+// SIGTERM it is sent SIGHUP, as on a terminal hangup, which they honor.
+func forwardSignals(sigs <-chan os.Signal, proc *os.Process) {
+	for sig := range sigs {
+		proc.Signal(sig)
+		if sig == syscall.SIGTERM {
+			time.AfterFunc(forwardGrace, func() { proc.Signal(syscall.SIGHUP) })
+		}
+	}
+}
+
+// forwardGrace is how long a shell has to exit on SIGTERM before SIGHUP.
+const forwardGrace = 2 * time.Second
+
+// ptyDrainTimeout bounds how long Run waits for output after the shell exits.
+const ptyDrainTimeout = time.Second
+
 func (c *Client) connect() error {
-	conn, err := net.Dial("unix", c.SocketPath)
+	conn, err := dialDaemon(c.SocketPath)
 	if err != nil {
 		return err
 	}
+	var offer []string
+	if c.CompressThreshold >= 0 {
+		offer = []string{CapGzip}
+	}
+	caps, err := handshake(conn, offer, c.Token)
+	if err != nil {
+		conn.Close()
+		return err
+	}
 
 	c.mu.Lock()
 	c.conn = conn
+	c.gzip = slices.Contains(caps, CapGzip)
 	c.enc = json.NewEncoder(conn)
 	c.scanner = bufio.NewScanner(conn)
 	c.scanner.Buffer(make([]byte, 1024*1024), 1024*1024)
@@ -175,23 +396,44 @@ func (c *Client) connect() error {
 		Title:     c.Title,
 		Collab:    c.Collab,
 		SessionID: c.sessionID,
+		Tags:      c.Tags,
+		Pid:       c.pid,
+		KeepANSI:  c.KeepANSI,
+		ReadOnly:  c.ReadOnly,
+		Dedup:     c.Dedup,
+		Paused:    c.paused.Load(),
+		TTLMs:     c.TTL.Milliseconds(),
 	})
-	c.sendMsg(Envelope{Type: MsgRegister, Payload: payload})
+	c.sendMsg(Envelope{Type: MsgRegister, Token: c.Token, Payload: payload})
 
 	// Read ack
+	var resumeSeq uint64
 	if c.scanner.Scan() {
 		var env Envelope
-		if err := json.Unmarshal(c.scanner.Bytes(), &env); err == nil && env.Type == MsgAck {
-			var ack RegisterAck
-			json.Unmarshal(env.Payload, &ack)
-			c.Logger.Info("session registered", "id", ack.ShortID)
+		if err := json.Unmarshal(c.scanner.Bytes(), &env); err == nil {
+			switch env.Type {
+			case MsgAck:
+				var ack RegisterAck
+				json.Unmarshal(env.Payload, &ack)
+				resumeSeq = ack.ResumeSeq
+				c.Logger.Info("session registered", "id", ack.ShortID)
+			case MsgError:
+				// Registration refused (e.g. daemon quiesced); retry later
+				var ep ErrorPayload
+				json.Unmarshal(env.Payload, &ep)
+				c.closeConn()
+				return fmt.Errorf("registration rejected: %s", ep.Message)
+			}
 		}
 	}
 
 	c.connected.Store(true)
 
-	// Replay local buffer to daemon
-	c.replayBuffer()
+	// Replay whatever the daemon is missing from the local buffer
+	c.replayBuffer(resumeSeq)
+	c.sendResize()
+	c.sendEnvironment()
+	c.sendCwd()
 
 	return nil
 }
@@ -215,23 +457,30 @@ func (c *Client) disconnect() {
 	c.scanner = nil
 }
 
-func (c *Client) replayBuffer() {
-	lines := c.localBuf.AllLines()
-	if len(lines) == 0 {
-		return
+// closeConn drops the daemon connection without sending a disconnect message.
+func (c *Client) closeConn() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn = nil
+		c.enc = nil
+		c.scanner = nil
 	}
+}
 
+// replayBuffer sends local buffer lines from sequence number from onward.
+func (c *Client) replayBuffer(from uint64) {
 	const chunkSize = 500
-	for i := 0; i < len(lines); i += chunkSize {
-		end := i + chunkSize
-		if end > len(lines) {
-			end = len(lines)
+	sent := 0
+	for {
+		chunk, repeats, next, hasMore := c.localBuf.ReadRangeRepeats(from, chunkSize)
+		if len(chunk) == 0 {
+			break
 		}
-		chunk := lines[i:end]
-		isLast := end >= len(lines)
 
-		payload := ReplayPayload{Lines: chunk}
-		if isLast {
+		payload := ReplayPayload{Lines: chunk, Repeats: repeats, FromSeq: next - uint64(len(chunk))}
+		if !hasMore {
 			if cmd := c.getLastCommand(); cmd != "" {
 				payload.LastCommand = cmd
 			}
@@ -241,39 +490,49 @@ func (c *Client) replayBuffer() {
 			SessionID: c.sessionID,
 			Payload:   mustMarshal(payload),
 		})
+		sent += len(chunk)
+		from = next
+		if !hasMore {
+			break
+		}
+	}
+	if sent > 0 {
+		c.Logger.Debug("replayed buffer to daemon", "lines", sent)
 	}
-	c.Logger.Debug("replayed buffer to daemon", "lines", len(lines))
 }
 
+// reconnectionLoop reconnects to the daemon whenever the connection is lost,
+// backing off exponentially between failed attempts.
 func (c *Client) reconnectionLoop() {
-	ticker := time.NewTicker(3 * time.Second)
-	defer ticker.Stop()
+	b := newBackoff(c.ReconnectInitialDelay, c.ReconnectMaxDelay, c.ReconnectMultiplier)
+	timer := time.NewTimer(b.next())
+	defer timer.Stop()
 
 	for {
 		select {
 		case <-c.stopReconn:
 			return
-		case <-ticker.C:
+		case <-timer.C:
 			if c.connected.Load() {
+				b.reset()
+				timer.Reset(b.next())
 				continue
 			}
 
 			// Clean up old connection if any
-			c.mu.Lock()
-			if c.conn != nil {
-				c.conn.Close()
-				c.conn = nil
-				c.enc = nil
-				c.scanner = nil
-			}
-			c.mu.Unlock()
+			c.closeConn()
 
 			if err := c.connect(); err != nil {
+				delay := b.next()
+				c.Logger.Debug("reconnect failed", "err", err, "retry_in", delay)
+				timer.Reset(delay)
 				continue
 			}
 			c.Logger.Info("reconnected to daemon", "id", c.shortID)
+			b.reset()
+			timer.Reset(b.next())
 
-			if c.Collab && c.ptmx != nil {
+			if c.ptmx != nil {
 				go c.handleIncomingMessages(c.ptmx)
 			}
 		}
@@ -308,20 +567,125 @@ func (c *Client) handleIncomingMessages(ptmx *os.File) {
 			c.Logger.Debug("failed to parse incoming message", "err", err)
 			continue
 		}
-		if env.Type == MsgInput {
+		switch env.Type {
+		case MsgPing:
+			c.sendMsg(Envelope{Type: MsgPong})
+		case MsgInput:
 			var p InputPayload
 			if env.Payload != nil {
 				json.Unmarshal(env.Payload, &p)
 			}
-			if p.Text != "" {
-				ptmx.Write([]byte(p.Text))
+			if p.Text == "" {
+				break
+			}
+			if c.ReadOnly {
+				c.Logger.Warn("ignoring input to read-only session", "id", c.shortID, "bytes", len(p.Text))
+				break
+			}
+			ptmx.Write([]byte(p.Text))
+		case MsgKill:
+			c.kill(ptmx)
+		case MsgShutdown:
+			// Drop the connection; the reconnection loop finds the next daemon
+			c.Logger.Info("daemon shutting down", "id", c.shortID)
+			c.closeConn()
+		case MsgSignal:
+			var p SignalPayload
+			if env.Payload != nil {
+				json.Unmarshal(env.Payload, &p)
 			}
+			c.signal(ptmx, p.Signal)
 		}
 	}
 	// Scanner ended — connection lost
 	c.connected.Store(false)
 }
 
+// kill tears down the shell: closing the PTY master hangs up the terminal,
+// and SIGHUP covers shells that ignore the hangup.
+func (c *Client) kill(ptmx *os.File) {
+	c.killed.Store(true)
+	ptmx.Close()
+	if c.cmd != nil && c.cmd.Process != nil {
+		c.cmd.Process.Signal(syscall.SIGHUP)
+	}
+}
+
+// signal delivers a signal from the daemon to the PTY's foreground process
+// group, as typing Ctrl-C would, or to the shell if that is unknown.
+func (c *Client) signal(ptmx *os.File, name string) {
+	_, sig, err := parseSignal(name)
+	if err != nil {
+		c.Logger.Warn("ignoring signal from daemon", "err", err)
+		return
+	}
+	if err := signalForeground(ptmx, c.cmd, sig); err != nil {
+		c.Logger.Warn("sending signal failed", "signal", name, "err", err)
+	}
+}
+
+// signalForeground sends sig to the foreground process group of ptmx, or
+// to cmd's process if that is unknown.
+func signalForeground(ptmx *os.File, cmd *exec.Cmd, sig syscall.Signal) error {
+	pgrp := 0
+	// SyscallConn, unlike Fd, leaves the PTY in non-blocking mode
+	if rc, err := ptmx.SyscallConn(); err == nil {
+		rc.Control(func(fd uintptr) {
+			pgrp, _ = unix.IoctlGetInt(int(fd), unix.TIOCGPGRP)
+		})
+	}
+	if pgrp > 0 {
+		return syscall.Kill(-pgrp, sig)
+	}
+	if cmd != nil && cmd.Process != nil {
+		return cmd.Process.Signal(sig)
+	}
+	return nil
+}
+
+// promptColors maps the color names accepted for Client.PromptColor to
+// their ANSI SGR codes.
+var promptColors = map[string]string{
+	"red":     "31",
+	"green":   "32",
+	"yellow":  "33",
+	"blue":    "34",
+	"magenta": "35",
+	"cyan":    "36",
+	"white":   "37",
+}
+
+// sgrCode matches raw ANSI SGR parameters such as "1;31" or "38;5;208".
+var sgrCode = regexp.MustCompile(`^[0-9]{1,3}(;[0-9]{1,3})*$`)
+
+// ansiColor returns the SGR code for a color name or raw code, or "" if
+// name is neither.
+func ansiColor(name string) string {
+	if code, ok := promptColors[strings.ToLower(name)]; ok {
+		return code
+	}
+	if sgrCode.MatchString(name) {
+		return name
+	}
+	return ""
+}
+
+// CheckPromptColor reports whether name is usable as Client.PromptColor.
+func CheckPromptColor(name string) error {
+	if name == "" || ansiColor(name) != "" {
+		return nil
+	}
+	return fmt.Errorf("unknown prompt color %q (use red, green, yellow, blue, magenta, cyan, white, or an ANSI code like 38;5;208)", name)
+}
+
+// promptColor returns the SGR code for the prompt tag.
+func (c *Client) promptColor() string {
+	if code := ansiColor(c.PromptColor); code != "" {
+		return code
+	}
+	return promptColors["magenta"]
+}
+
 func (c *Client) promptTag() string {
 	if c.Title != "" {
 		return fmt.Sprintf("[streamsh - %s (%s)]", c.Title, c.shortID)
@@ -331,9 +695,10 @@ func (c *Client) promptTag() string {
 
 func (c *Client) setupShellPrompt(shell string, cmd *exec.Cmd) (cleanup func()) {
 	tag := c.promptTag()
+	color := c.promptColor()
 	noop := func() {}
 
-	if c.shortID == "" {
+	if c.shortID == "" || c.NoPrompt {
 		return noop
 	}
 
@@ -349,8 +714,10 @@ func (c *Client) setupShellPrompt(shell string, cmd *exec.Cmd) (cleanup func())
 			"[[ -f \"$HOME/.bashrc\" ]] && source \"$HOME/.bashrc\"\n"+
 				"_STREAMSH_ORIG_PS1=\"$PS1\"\n"+
 				"_STREAMSH_ORIG_PROMPT_COMMAND=\"$PROMPT_COMMAND\"\n"+
-				"PROMPT_COMMAND='eval \"$_STREAMSH_ORIG_PROMPT_COMMAND\"; PS1=\"\\[\\e[35m\\]%s\\[\\e[0m\\] $_STREAMSH_ORIG_PS1\"'\n",
-			tag,
+				"PS0=\"\\e]133;C\\a$PS0\"\n"+
+				"_streamsh_mark() { local ec=$?; printf '\\033]133;D;%%s\\007\\033]7;file://%%s%%s\\007' \"$ec\" \"$HOSTNAME\" \"$PWD\"; return $ec; }\n"+
+				"PROMPT_COMMAND='_streamsh_mark; eval \"$_STREAMSH_ORIG_PROMPT_COMMAND\"; PS1=\"\\[\\e[%sm\\]%s\\[\\e[0m\\] $_STREAMSH_ORIG_PS1\"'\n",
+			color, tag,
 		)
 		rcPath := filepath.Join(dir, ".bashrc")
 		if err := os.WriteFile(rcPath, []byte(content), 0644); err != nil {
@@ -370,9 +737,10 @@ func (c *Client) setupShellPrompt(shell string, cmd *exec.Cmd) (cleanup func())
 		content := fmt.Sprintf(
 			"[[ -f \"%s/.zshrc\" ]] && ZDOTDIR=\"%s\" source \"%s/.zshrc\"\n"+
 				"_streamsh_orig_ps1=\"$PS1\"\n"+
-				"_streamsh_precmd() { PS1=\"%%F{magenta}%s%%f $_streamsh_orig_ps1\" }\n"+
+				"_streamsh_color=$'\\e[%sm' _streamsh_reset=$'\\e[0m'\n"+
+				"_streamsh_precmd() { local ec=$?; printf '\\033]133;D;%%s\\007\\033]7;file://%%s%%s\\007' $ec \"$HOST\" \"$PWD\"; PS1=\"%%{$_streamsh_color%%}%s%%{$_streamsh_reset%%} $_streamsh_orig_ps1\"; return $ec }\n"+
 				"precmd_functions=(_streamsh_precmd $precmd_functions)\n",
-			home, home, home, escaped,
+			home, home, home, color, escaped,
 		)
 		rcPath := filepath.Join(dir, ".zshrc")
 		if err := os.WriteFile(rcPath, []byte(content), 0644); err != nil {
@@ -385,24 +753,63 @@ func (c *Client) setupShellPrompt(shell string, cmd *exec.Cmd) (cleanup func())
 	case base == "fish" || strings.HasPrefix(base, "fish"):
 		initScript := fmt.Sprintf(
 			"functions -c fish_prompt _streamsh_orig_prompt\n"+
+				"function _streamsh_status; return $argv[1]; end\n"+
 				"function fish_prompt\n"+
-				"    set_color magenta\n"+
+				"    set -l ec $status\n"+
+				"    printf '\\x1b]133;D;%%s\\x07\\x1b]7;file://%%s%%s\\x07' $ec $hostname $PWD\n"+
+				"    printf '\\e[%sm'\n"+
 				"    echo -n '%s '\n"+
 				"    set_color normal\n"+
+				"    _streamsh_status $ec\n"+
 				"    _streamsh_orig_prompt\n"+
 				"end\n",
-			tag,
+			color, tag,
 		)
 		cmd.Args = []string{shell, "-C", initScript}
 		return noop
 
+	case base == "nu":
+		// --execute runs after the user's own config, so it can wrap
+		// whatever prompt that set up
+		cmd.Args = []string{shell, "--execute", nushellPrompt(tag, color)}
+		return noop
+
+	case base == "elvish":
+		dir, err := os.MkdirTemp("", "streamsh-rc-*")
+		if err != nil {
+			return noop
+		}
+		// -rc replaces the user's rc.elv, so evaluate it first, and add
+		// the variables, functions, and modules it defines to the REPL,
+		// which eval would otherwise keep to itself
+		var userRC string
+		if home, err := os.UserHomeDir(); err == nil {
+			for _, p := range []string{filepath.Join(home, ".config", "elvish", "rc.elv"), filepath.Join(home, ".elvish", "rc.elv")} {
+				if _, err := os.Stat(p); err == nil {
+					userRC = fmt.Sprintf("eval (slurp < %s) &on-end={|ns| for k [(keys $ns)] { edit:add-var $k $ns[$k] } }\n", elvishQuote(p))
+					break
+				}
+			}
+		}
+		content := userRC +
+			"var _streamsh_prompt = $edit:prompt\n" +
+			fmt.Sprintf("set edit:prompt = { styled %s %s; put ' '; $_streamsh_prompt }\n", elvishQuote(tag), elvishStyle(color)) +
+			"set edit:before-readline = [$@edit:before-readline { print \"\\e]7;file://\"$pwd\"\\a\" }]\n"
+		rcPath := filepath.Join(dir, "rc.elv")
+		if err := os.WriteFile(rcPath, []byte(content), 0644); err != nil {
+			os.RemoveAll(dir)
+			return noop
+		}
+		cmd.Args = []string{shell, "-rc", rcPath}
+		return func() { os.RemoveAll(dir) }
+
 	default:
 		// POSIX fallback
 		dir, err := os.MkdirTemp("", "streamsh-rc-*")
 		if err != nil {
 			return noop
 		}
-		content := fmt.Sprintf("PS1='\\033[35m%s\\033[0m '$PS1\n", tag)
+		content := fmt.Sprintf("PS1='\\033[%sm%s\\033[0m '$PS1\n", color, tag)
 		rcPath := filepath.Join(dir, ".shrc")
 		if err := os.WriteFile(rcPath, []byte(content), 0644); err != nil {
 			os.RemoveAll(dir)
@@ -413,12 +820,57 @@ func (c *Client) setupShellPrompt(shell string, cmd *exec.Cmd) (cleanup func())
 	}
 }
 
+// elvishQuote quotes s as an elvish single-quoted string.
+func elvishQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+// elvishStyle returns the styled transformer for an SGR color code. Codes
+// elvish has no name for fall back to magenta.
+func elvishStyle(code string) string {
+	for name, c := range promptColors {
+		if c == code {
+			return name
+		}
+	}
+	if n, ok := strings.CutPrefix(code, "38;5;"); ok && !strings.Contains(n, ";") {
+		return "color" + n
+	}
+	return "magenta"
+}
+
+// nushellPrompt returns nushell commands that prefix the prompt with tag,
+// in the SGR color code, and add a pre_prompt hook printing the exit
+// status and cwd marks.
+func nushellPrompt(tag, color string) string {
+	return fmt.Sprintf(
+		"let streamsh_tag = %s\n"+
+			"let streamsh_prompt = $env.PROMPT_COMMAND?\n"+
+			"$env.PROMPT_COMMAND = {||\n"+
+			"    let orig = if ($streamsh_prompt | describe) =~ '^closure' { do $streamsh_prompt } else { $streamsh_prompt | default '' }\n"+
+			"    $\"(ansi --escape '%sm')($streamsh_tag)(ansi reset) ($orig)\"\n"+
+			"}\n"+
+			"let streamsh_hooks = ($env.config.hooks?.pre_prompt? | default [])\n"+
+			"$env.config.hooks.pre_prompt = ($streamsh_hooks | append {||\n"+
+			"    print -n $\"(char esc)]133;D;($env.LAST_EXIT_CODE)(char bel)(char esc)]7;file://($env.PWD)(char bel)\"\n"+
+			"})\n",
+		strconv.Quote(tag), color,
+	)
+}
+
 func (c *Client) sendMsg(env Envelope) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	if c.conn == nil {
 		return
 	}
+	if c.gzip && env.Type == MsgOutput {
+		threshold := c.CompressThreshold
+		if threshold == 0 {
+			threshold = DefaultCompressThreshold
+		}
+		env = compressPayload(env, threshold)
+	}
 	if err := c.enc.Encode(env); err != nil {
 		c.Logger.Debug("send error, marking disconnected", "err", err)
 		c.connected.Store(false)
@@ -430,9 +882,45 @@ func (c *Client) sendMsg(env Envelope) {
 }
 
 func (c *Client) sendOutput(lines []string) {
+	// While paused, output is not kept anywhere, not even locally, as the
+	// local buffer is replayed to the daemon
+	if c.paused.Load() {
+		return
+	}
 	// Always write to local buffer, regardless of connection state
-	for _, line := range lines {
-		c.localBuf.Append(stripansi.Strip(line))
+	stripped := make([]string, len(lines))
+	copied := false
+	for i, line := range lines {
+		stripped[i] = stripansi.Strip(line)
+		if redacted, ok := redact(c.RedactPatterns, stripped[i]); ok {
+			if !copied {
+				lines = slices.Clone(lines)
+				copied = true
+			}
+			stripped[i] = redacted
+			lines[i] = redacted
+		}
+	}
+	if c.TimestampLines {
+		if !copied {
+			lines = slices.Clone(lines)
+		}
+		prefix := "[" + time.Now().UTC().Format(lineTimestampLayout) + "] "
+		for i := range lines {
+			lines[i] = prefix + lines[i]
+			stripped[i] = prefix + stripped[i]
+		}
+	}
+	c.localBuf.AppendBatch(stripped)
+	if c.log != nil {
+		// Warn once per run of failures, as every batch would fail alike
+		if err := c.log.writeLines(stripped); err != nil {
+			if !c.logFailing.Swap(true) {
+				c.Logger.Warn("log file write failed", "path", c.LogFile, "err", err)
+			}
+		} else {
+			c.logFailing.Store(false)
+		}
 	}
 
 	if !c.connected.Load() || len(lines) == 0 {
@@ -445,11 +933,160 @@ func (c *Client) sendOutput(lines []string) {
 	})
 }
 
-func (c *Client) sendCommand(cmd string) {
+// togglePause pauses streaming, or resumes it if paused, and tells the
+// user and the daemon.
+func (c *Client) togglePause() {
+	paused := !c.paused.Load()
+	c.paused.Store(paused)
+	if paused {
+		fmt.Fprint(os.Stderr, "\r\n[streamsh: paused, output is not being captured]\r\n")
+	} else {
+		fmt.Fprint(os.Stderr, "\r\n[streamsh: resumed]\r\n")
+	}
+	if !c.connected.Load() {
+		return
+	}
+	c.sendMsg(Envelope{
+		Type:      MsgPause,
+		SessionID: c.sessionID,
+		Payload:   mustMarshal(PausePayload{Paused: paused}),
+	})
+}
+
+// sendResize tells the daemon the PTY's current dimensions, if known.
+func (c *Client) sendResize() {
+	size := c.winsize.Load()
+	if size == nil || !c.connected.Load() {
+		return
+	}
+	c.sendMsg(Envelope{
+		Type:      MsgResize,
+		SessionID: c.sessionID,
+		Payload:   mustMarshal(ResizePayload{Rows: int(size.Rows), Cols: int(size.Cols)}),
+	})
+}
+
+// sendEnvironment sends the shell's environment to the daemon, if known.
+func (c *Client) sendEnvironment() {
+	vars := c.environment.Load()
+	if vars == nil || !c.connected.Load() {
+		return
+	}
+	c.sendMsg(Envelope{
+		Type:      MsgEnvironment,
+		SessionID: c.sessionID,
+		Payload:   mustMarshal(EnvironmentPayload{Vars: *vars}),
+	})
+}
+
+// setCwd records the shell's working directory and, if it changed, sends it
+// to the daemon. Directories reported while paused are ignored.
+func (c *Client) setCwd(dir string) {
+	if c.paused.Load() {
+		return
+	}
+	if old := c.cwd.Load(); old != nil && *old == dir {
+		return
+	}
+	c.cwd.Store(&dir)
+	c.sendCwd()
+}
+
+// sendCwd sends the shell's working directory to the daemon, if known.
+func (c *Client) sendCwd() {
+	dir := c.cwd.Load()
+	if dir == nil || !c.connected.Load() {
+		return
+	}
+	c.sendMsg(Envelope{
+		Type:      MsgCwd,
+		SessionID: c.sessionID,
+		Payload:   mustMarshal(CwdPayload{Dir: *dir}),
+	})
+}
+
+// lineTimestampLayout is RFC 3339 with fixed nanoseconds, so prefixed lines
+// stay aligned.
+const lineTimestampLayout = "2006-01-02T15:04:05.000000000Z07:00"
+
+// redactedText replaces matches of RedactPatterns.
+const redactedText = "[REDACTED]"
+
+// redact replaces every match of patterns in line, reporting whether any
+// pattern matched.
+func redact(patterns []*regexp.Regexp, line string) (string, bool) {
+	matched := false
+	for _, re := range patterns {
+		if re.MatchString(line) {
+			line = re.ReplaceAllString(line, redactedText)
+			matched = true
+		}
+	}
+	return line, matched
+}
+
+// noisyEnvVars are left out of environment snapshots: long, and of no use
+// for debugging.
+var noisyEnvVars = []string{"LS_COLORS", "LSCOLORS", "TERMCAP", "PS1", "PS2", "PROMPT_COMMAND", "_"}
+
+// secretEnvMarkers flag variables whose values are redacted from
+// environment snapshots, matched against the upper-cased name.
+var secretEnvMarkers = []string{"TOKEN", "SECRET", "PASSWORD", "PASSWD", "API_KEY", "ACCESS_KEY", "PRIVATE_KEY", "CREDENTIAL"}
+
+// environmentSnapshot turns an environ list into the map sent to the
+// daemon, dropping noisy variables, redacting likely secrets, and replacing
+// matches of patterns in the remaining values.
+func environmentSnapshot(environ []string, patterns []*regexp.Regexp) map[string]string {
+	vars := make(map[string]string, len(environ))
+	for _, kv := range environ {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok || slices.Contains(noisyEnvVars, k) || strings.HasPrefix(k, "BASH_FUNC_") {
+			continue
+		}
+		upper := strings.ToUpper(k)
+		for _, marker := range secretEnvMarkers {
+			if strings.Contains(upper, marker) {
+				v = "[redacted]"
+				break
+			}
+		}
+		v, _ = redact(patterns, v)
+		vars[k] = v
+	}
+	return vars
+}
+
+// submitCommand handles a command line entered at the terminal. If the
+// shell reports command starts, the command is sent when it starts;
+// otherwise it is sent now. Commands entered while paused are dropped.
+func (c *Client) submitCommand(cmd string) {
+	if cmd == "" || c.paused.Load() {
+		return
+	}
+	if c.startMarks.Load() {
+		c.typedCmd.Store(&cmd)
+		return
+	}
+	c.sendCommand(cmd, time.Now())
+}
+
+// commandStarted handles a command start mark, sending the command line
+// entered before it. Lines entered while a program was reading the
+// terminal are replaced by the next one, and never reported.
+func (c *Client) commandStarted(at time.Time) {
+	c.startMarks.Store(true)
+	if cmd := c.typedCmd.Swap(nil); cmd != nil {
+		c.sendCommand(*cmd, at)
+	}
+}
+
+func (c *Client) sendCommand(cmd string, startedAt time.Time) {
 	if cmd == "" {
 		return
 	}
+	cmd, _ = redact(c.RedactPatterns, cmd)
 	c.setLastCommand(cmd)
+	c.pendingCmd.Store(&cmd)
 
 	if !c.connected.Load() {
 		return
@@ -457,32 +1094,28 @@ func (c *Client) sendCommand(cmd string) {
 	c.sendMsg(Envelope{
 		Type:      MsgCommand,
 		SessionID: c.sessionID,
-		Payload:   mustMarshal(CommandPayload{Command: cmd}),
+		Payload:   mustMarshal(CommandPayload{Command: cmd, StartedAt: startedAt.UnixNano()}),
 	})
 }
 
 func (c *Client) copyStdinToPTY(ptmx *os.File) {
-	var cmdBuf bytes.Buffer
+	var line commandLine
 	buf := make([]byte, 4096)
 
 	for {
 		n, err := os.Stdin.Read(buf)
 		if n > 0 {
 			ptmx.Write(buf[:n])
+			if c.rec != nil && c.RecordInput && !c.paused.Load() {
+				c.rec.input(buf[:n])
+			}
 
 			// Detect commands: look for carriage return
-			for _, b := range buf[:n] {
-				if b == '\r' || b == '\n' {
-					cmd := cmdBuf.String()
-					cmdBuf.Reset()
-					c.sendCommand(cmd)
-				} else if b == 127 || b == '\b' {
-					// Backspace: remove last byte from buffer
-					if cmdBuf.Len() > 0 {
-						cmdBuf.Truncate(cmdBuf.Len() - 1)
+			if !c.NoCommandDetection {
+				for _, b := range buf[:n] {
+					if cmd, ok := line.feed(b); ok {
+						c.submitCommand(cmd)
 					}
-				} else if b >= 32 { // printable
-					cmdBuf.WriteByte(b)
 				}
 			}
 		}
@@ -492,18 +1125,257 @@ func (c *Client) copyStdinToPTY(ptmx *os.File) {
 	}
 }
 
+// Bracketed paste markers, which terminals wrap pasted text in when the
+// shell asks for it.
+const (
+	pasteStart = "\x1b[200~"
+	pasteEnd   = "\x1b[201~"
+)
+
+// commandLine assembles the command lines typed on stdin, one byte at a
+// time. Newlines inside a bracketed paste are part of the command, so a
+// pasted snippet is reported as one multi-line command once Enter is
+// pressed, rather than as a command per line. Likewise, a line ending in a
+// backslash or opening a here-document is continued on the next, as the
+// shell would.
+type commandLine struct {
+	buf       bytes.Buffer
+	lineStart int       // where the line being typed begins in buf
+	heredocs  []heredoc // here-documents still open, in order
+	matched   int       // bytes of the next paste marker matched so far
+	pasting   bool      // between pasteStart and pasteEnd
+	lastCR    bool      // the last byte was a pasted '\r'
+}
+
+// heredoc is a here-document whose body is still being typed.
+type heredoc struct {
+	delim     string
+	stripTabs bool // <<-, which ignores leading tabs
+}
+
+// feed consumes one byte and returns the command line when it ends one.
+func (l *commandLine) feed(b byte) (string, bool) {
+	if l.feedPasteMark(b) {
+		// Drop the marker from the line; its leading ESC and final ~
+		// never reached it
+		l.buf.Truncate(max(l.buf.Len()-(len(pasteStart)-2), 0))
+		return "", false
+	}
+	lastCR := l.lastCR
+	l.lastCR = false
+	switch {
+	case (b == '\r' || b == '\n') && l.pasting:
+		l.lastCR = b == '\r'
+		if b == '\n' && lastCR {
+			break // a pasted CRLF is one newline
+		}
+		l.buf.WriteByte('\n')
+	case b == '\t' && l.pasting:
+		// A typed tab asks for completion, but a pasted one is text
+		l.buf.WriteByte(b)
+	case b == '\r' || b == '\n':
+		if l.continues() {
+			l.buf.WriteByte('\n')
+			l.lineStart = l.buf.Len()
+			break
+		}
+		cmd := l.buf.String()
+		l.reset()
+		return cmd, true
+	case b == 3:
+		// Ctrl-C: the shell abandons the command, continued or not
+		l.reset()
+	case b == 127 || b == '\b':
+		// Backspace: remove last byte from buffer, but not past the
+		// line being typed
+		if l.buf.Len() > l.lineStart {
+			l.buf.Truncate(l.buf.Len() - 1)
+		}
+	case b >= 32: // printable
+		l.buf.WriteByte(b)
+	}
+	return "", false
+}
+
+// continues scans the lines entered since the last Enter and reports
+// whether the command goes on past them: a here-document is still open, or
+// the last line ends in an unescaped backslash.
+func (l *commandLine) continues() bool {
+	lines := strings.Split(l.buf.String()[l.lineStart:], "\n")
+	for _, line := range lines {
+		if len(l.heredocs) == 0 {
+			l.heredocs = heredocsOpened(line)
+			continue
+		}
+		if l.heredocs[0].stripTabs {
+			line = strings.TrimLeft(line, "\t")
+		}
+		if line == l.heredocs[0].delim {
+			l.heredocs = l.heredocs[1:]
+		}
+	}
+	last := lines[len(lines)-1]
+	escapes := len(last) - len(strings.TrimRight(last, "\\"))
+	return len(l.heredocs) > 0 || escapes%2 == 1
+}
+
+func (l *commandLine) reset() {
+	l.buf.Reset()
+	l.lineStart = 0
+	l.heredocs = nil
+}
+
+// heredocsOpened returns the here-documents opened by the << operators on
+// line, skipping any quoted, escaped, or commented out, and shifts in
+// arithmetic such as $((1<<2)). It is no shell parser, only enough to
+// follow the usual cat <<EOF.
+func heredocsOpened(line string) []heredoc {
+	var docs []heredoc
+	var quote byte
+	arith := 0 // depth of (( )) and $(( ))
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			} else if c == '\\' && quote == '"' {
+				i++
+			}
+		case c == '\\':
+			i++
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return docs
+		case strings.HasPrefix(line[i:], "(("):
+			arith++
+			i++
+		case strings.HasPrefix(line[i:], "))") && arith > 0:
+			arith--
+			i++
+		case arith > 0:
+			// << in arithmetic is a shift
+		case strings.HasPrefix(line[i:], "<<<"):
+			i += 2 // a here-string, complete on its line
+		case strings.HasPrefix(line[i:], "<<"):
+			var doc heredoc
+			i += 2
+			if i < len(line) && line[i] == '-' {
+				doc.stripTabs = true
+				i++
+			}
+			for i < len(line) && (line[i] == ' ' || line[i] == '\t') {
+				i++
+			}
+			// The delimiter is the word that follows, unquoted
+			var delim strings.Builder
+			for ; i < len(line) && !strings.ContainsRune(" \t;&|<>()", rune(line[i])); i++ {
+				if c := line[i]; c != '\'' && c != '"' && c != '\\' {
+					delim.WriteByte(c)
+				}
+			}
+			i-- // look at the byte ending the word again
+			// Delimiters are words like EOF; in let x=1<<2 it's a shift
+			if delim.Len() > 0 && isWordStart(delim.String()[0]) {
+				doc.delim = delim.String()
+				docs = append(docs, doc)
+			}
+		}
+	}
+	return docs
+}
+
+func isWordStart(c byte) bool {
+	return c == '_' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
+// feedPasteMark consumes one byte and reports whether it completes the
+// paste marker expected next.
+func (l *commandLine) feedPasteMark(b byte) bool {
+	mark := pasteStart
+	if l.pasting {
+		mark = pasteEnd
+	}
+	if b == mark[l.matched] {
+		l.matched++
+		if l.matched == len(mark) {
+			l.matched = 0
+			l.pasting = !l.pasting
+			return true
+		}
+		return false
+	}
+	l.matched = 0
+	if b == mark[0] {
+		l.matched = 1
+	}
+	return false
+}
+
+// sendCommandResult reports the exit status of the pending command, if any.
+// Markers emitted by the prompt hook before any command ran are ignored, as
+// are results while paused.
+func (c *Client) sendCommandResult(code int) {
+	cmd := c.pendingCmd.Swap(nil)
+	if cmd == nil || c.paused.Load() || !c.connected.Load() {
+		return
+	}
+	c.sendMsg(Envelope{
+		Type:      MsgCommandResult,
+		SessionID: c.sessionID,
+		Payload:   mustMarshal(CommandResultPayload{Command: *cmd, ExitCode: code}),
+	})
+}
+
 func (c *Client) copyPTYToStdout(ptmx *os.File) {
 	buf := make([]byte, 4096)
 	var lineBuf bytes.Buffer
 	var batch []string
+	var marks exitMarkParser
+	var starts startMarkParser
+	var cwds cwdMarkParser
 
 	for {
 		n, err := ptmx.Read(buf)
 		if n > 0 {
 			os.Stdout.Write(buf[:n])
+			if c.rec != nil && !c.paused.Load() {
+				if err := c.rec.output(buf[:n]); err != nil {
+					c.Logger.Debug("failed to write recording", "err", err)
+				}
+			}
 
 			// Always assemble lines (local buffer + daemon if connected)
 			for _, b := range buf[:n] {
+				if code, ok := marks.feed(b); ok {
+					// Send the command's last lines first, so the daemon
+					// can tell where its output ends
+					if len(batch) > 0 {
+						c.sendOutput(batch)
+						batch = batch[:0]
+					}
+					c.sendCommandResult(code)
+					// Anything typed since went to the command, not the shell
+					c.typedCmd.Store(nil)
+				}
+				if starts.feed(b) {
+					// Likewise, the command line comes before its output
+					if len(batch) > 0 {
+						c.sendOutput(batch)
+						batch = batch[:0]
+					}
+					c.commandStarted(time.Now())
+				}
+				if dir, ok := cwds.feed(b); ok {
+					c.setCwd(dir)
+				}
+				if n := cwds.done - 1; n >= 0 && n <= lineBuf.Len() {
+					// Drop the marker from the line: stripansi only
+					// removes its first few bytes
+					lineBuf.Truncate(lineBuf.Len() - n)
+					continue
+				}
 				if b == '\n' {
 					batch = append(batch, lineBuf.String())
 					lineBuf.Reset()
@@ -528,3 +1400,163 @@ func (c *Client) copyPTYToStdout(ptmx *os.File) {
 		}
 	}
 }
+
+// exitMarkPrefix starts the OSC 133 "command finished" sequence that the
+// prompt hooks installed by setupShellPrompt print before each prompt.
+const exitMarkPrefix = "\x1b]133;D;"
+
+// exitMarkParser picks exit-status markers (ESC ] 133 ; D ; <code> BEL, or
+// terminated by ESC \) out of a PTY byte stream, one byte at a time.
+type exitMarkParser struct {
+	matched int  // bytes of exitMarkPrefix matched so far
+	inCode  bool // prefix matched, reading digits
+	sawEsc  bool // ESC seen after the digits, expecting '\'
+	code    []byte
+}
+
+// feed consumes one byte and reports the exit code when it completes a marker.
+func (p *exitMarkParser) feed(b byte) (int, bool) {
+	if p.inCode {
+		switch {
+		case p.sawEsc && b == '\\', !p.sawEsc && b == '\a':
+			code, err := strconv.Atoi(string(p.code))
+			p.reset()
+			return code, err == nil
+		case !p.sawEsc && b == 0x1b:
+			p.sawEsc = true
+			return 0, false
+		case !p.sawEsc && b >= '0' && b <= '9' && len(p.code) < 10:
+			p.code = append(p.code, b)
+			return 0, false
+		}
+		p.reset()
+	}
+	if b == exitMarkPrefix[p.matched] {
+		p.matched++
+		if p.matched == len(exitMarkPrefix) {
+			p.matched = 0
+			p.inCode = true
+		}
+		return 0, false
+	}
+	p.matched = 0
+	if b == exitMarkPrefix[0] {
+		p.matched = 1
+	}
+	return 0, false
+}
+
+func (p *exitMarkParser) reset() {
+	p.matched = 0
+	p.inCode = false
+	p.sawEsc = false
+	p.code = p.code[:0]
+}
+
+// cwdMarkPrefix starts the OSC 7 sequence reporting the working directory
+// as a file:// URL, which the prompt hooks print along with the exit status.
+const cwdMarkPrefix = "\x1b]7;"
+
+// startMark is the OSC 133 "command executed" sequence that the bash prompt
+// hook prints (via PS0) just before running a command.
+const startMark = "\x1b]133;C\a"
+
+// startMarkParser picks startMark out of a PTY byte stream, one byte at a
+// time.
+type startMarkParser struct {
+	matched int // bytes of startMark matched so far
+}
+
+// feed consumes one byte and reports whether it completes a start mark.
+func (p *startMarkParser) feed(b byte) bool {
+	if b == startMark[p.matched] {
+		p.matched++
+		if p.matched == len(startMark) {
+			p.matched = 0
+			return true
+		}
+		return false
+	}
+	p.matched = 0
+	if b == startMark[0] {
+		p.matched = 1
+	}
+	return false
+}
+
+// maxCwdMarkLen bounds the URL collected by cwdMarkParser.
+const maxCwdMarkLen = 4096
+
+// cwdMarkParser picks working-directory reports (ESC ] 7 ; file://host/path
+// BEL, or terminated by ESC \) out of a PTY byte stream, one byte at a time.
+type cwdMarkParser struct {
+	matched int  // bytes of cwdMarkPrefix matched so far
+	inURL   bool // prefix matched, reading the URL
+	sawEsc  bool // ESC seen in the URL, expecting '\'
+	url     []byte
+	done    int // length of the marker completed by the last byte fed, else 0
+}
+
+// feed consumes one byte and reports the directory when it completes a marker.
+func (p *cwdMarkParser) feed(b byte) (string, bool) {
+	p.done = 0
+	if p.inURL {
+		switch {
+		case p.sawEsc && b == '\\', !p.sawEsc && b == '\a':
+			dir, ok := parseCwdURL(string(p.url))
+			n := len(cwdMarkPrefix) + len(p.url) + 1
+			if p.sawEsc {
+				n++
+			}
+			p.reset()
+			p.done = n
+			return dir, ok
+		case !p.sawEsc && b == 0x1b:
+			p.sawEsc = true
+			return "", false
+		case !p.sawEsc && b >= 0x20 && len(p.url) < maxCwdMarkLen:
+			p.url = append(p.url, b)
+			return "", false
+		}
+		p.reset()
+	}
+	if b == cwdMarkPrefix[p.matched] {
+		p.matched++
+		if p.matched == len(cwdMarkPrefix) {
+			p.matched = 0
+			p.inURL = true
+		}
+		return "", false
+	}
+	p.matched = 0
+	if b == cwdMarkPrefix[0] {
+		p.matched = 1
+	}
+	return "", false
+}
+
+func (p *cwdMarkParser) reset() {
+	p.matched = 0
+	p.inURL = false
+	p.sawEsc = false
+	p.url = p.url[:0]
+}
+
+// parseCwdURL extracts the path from an OSC 7 file://host/path URL. Our
+// prompt hooks send the path as is, but other tools percent-encode it, so
+// it is decoded when that succeeds.
+func parseCwdURL(raw string) (string, bool) {
+	rest, ok := strings.CutPrefix(raw, "file://")
+	if !ok {
+		return "", false
+	}
+	i := strings.IndexByte(rest, '/')
+	if i < 0 {
+		return "", false
+	}
+	dir := rest[i:]
+	if decoded, err := url.PathUnescape(dir); err == nil {
+		dir = decoded
+	}
+	return dir, true
+}
@@ -0,0 +1,472 @@
+package streamsh
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestExitMarkParser(t *testing.T) {
+	var p exitMarkParser
+	stream := "ls\r\nfoo\x1b]133;D;0\x07$ \x1b]133;A\x07false\r\n\x1b]133;D;127\x1b\\$ \x1b]133;D;x\x07"
+	var got []int
+	for i := 0; i < len(stream); i++ {
+		if code, ok := p.feed(stream[i]); ok {
+			got = append(got, code)
+		}
+	}
+	if len(got) != 2 || got[0] != 0 || got[1] != 127 {
+		t.Errorf("codes = %v, want [0 127]", got)
+	}
+}
+
+func TestCwdMarkParser(t *testing.T) {
+	var p cwdMarkParser
+	stream := "cd api\r\n\x1b]133;D;0\x07\x1b]7;file://host/repo/my%20api\x07$ " +
+		"\x1b]7;file://host/tmp/x y\x1b\\\x1b]7;http://host/nope\x07\x1b]7;file://host/a\nb\x07"
+	var got []string
+	var kept []byte
+	for i := 0; i < len(stream); i++ {
+		if dir, ok := p.feed(stream[i]); ok {
+			got = append(got, dir)
+		}
+		if p.done > 0 {
+			kept = kept[:len(kept)-(p.done-1)]
+			continue
+		}
+		kept = append(kept, stream[i])
+	}
+	if len(got) != 2 || got[0] != "/repo/my api" || got[1] != "/tmp/x y" {
+		t.Errorf("dirs = %q, want [/repo/my api /tmp/x y]", got)
+	}
+	want := "cd api\r\n\x1b]133;D;0\x07$ \x1b]7;file://host/a\nb\x07"
+	if string(kept) != want {
+		t.Errorf("kept %q, want %q", kept, want)
+	}
+}
+
+func TestCommandLinePaste(t *testing.T) {
+	var l commandLine
+	stream := "ls -x\x7fl\r\x1b[200~echo a\r\nec\x1b[2ho b\x1b[201~ | wc\r\x1b[200~pwd\r\x1b[201~"
+	var got []string
+	for i := 0; i < len(stream); i++ {
+		if cmd, ok := l.feed(stream[i]); ok {
+			got = append(got, cmd)
+		}
+	}
+	want := []string{"ls -l", "echo a\nec[2ho b | wc"}
+	if !slices.Equal(got, want) {
+		t.Errorf("commands = %q, want %q", got, want)
+	}
+	// The trailing newline of a paste is held until Enter
+	if l.buf.String() != "pwd\n" {
+		t.Errorf("pending line = %q, want %q", l.buf.String(), "pwd\n")
+	}
+}
+
+func TestCommandLineContinuation(t *testing.T) {
+	var l commandLine
+	stream := "make \\\rCC=gc\x7fcc\r" +
+		"cat <<-'EOF' > a; cat <<END\r\x1b[200~\tEOF x\n\tEOF\x1b[201~\rEND\r" +
+		"echo '<<no' \\\\\r" +
+		"cat <<<here\r" +
+		"echo $((1<<2)) ((x = 1 << y))\r" +
+		"let x=1<<2\r" +
+		"cat <<EOF\rabandoned\x03ls\r" +
+		"\x1b[200~cat <<EOF\nhi\x1b[201~\rEOF\r"
+	var got []string
+	for i := 0; i < len(stream); i++ {
+		if cmd, ok := l.feed(stream[i]); ok {
+			got = append(got, cmd)
+		}
+	}
+	want := []string{
+		"make \\\nCC=gcc",
+		"cat <<-'EOF' > a; cat <<END\n\tEOF x\n\tEOF\nEND",
+		"echo '<<no' \\\\",
+		"cat <<<here",
+		"echo $((1<<2)) ((x = 1 << y))",
+		"let x=1<<2",
+		"ls",
+		"cat <<EOF\nhi\nEOF",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("commands = %q, want %q", got, want)
+	}
+}
+
+func TestNoCommandDetection(t *testing.T) {
+	for _, disabled := range []bool{false, true} {
+		r, w, err := os.Pipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		stdin := os.Stdin
+		os.Stdin = r
+		ptmx, err := os.CreateTemp(t.TempDir(), "pty")
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.WriteString("ls\r")
+		w.Close()
+		c := &Client{NoCommandDetection: disabled}
+		c.copyStdinToPTY(ptmx)
+		os.Stdin = stdin
+		r.Close()
+
+		want := "ls"
+		if disabled {
+			want = ""
+		}
+		if got := c.getLastCommand(); got != want {
+			t.Errorf("NoCommandDetection %v: last command = %q, want %q", disabled, got, want)
+		}
+		// The keystrokes reach the shell either way
+		if typed, _ := os.ReadFile(ptmx.Name()); string(typed) != "ls\r" {
+			t.Errorf("NoCommandDetection %v: forwarded %q", disabled, typed)
+		}
+		ptmx.Close()
+	}
+}
+
+func TestEnvironmentSnapshot(t *testing.T) {
+	vars := environmentSnapshot([]string{
+		"PATH=/usr/bin",
+		"LS_COLORS=di=01;34",
+		"GITHUB_TOKEN=ghp_abc",
+		"db_password=hunter2",
+		"BASH_FUNC_foo%%=() { :; }",
+		"EMPTY=",
+		"OPENAI_URL=https://x.test/?key=sk-abc123",
+	}, []*regexp.Regexp{regexp.MustCompile(`sk-[a-z0-9]+`)})
+	want := map[string]string{
+		"PATH":         "/usr/bin",
+		"GITHUB_TOKEN": "[redacted]",
+		"db_password":  "[redacted]",
+		"EMPTY":        "",
+		"OPENAI_URL":   "https://x.test/?key=[REDACTED]",
+	}
+	if len(vars) != len(want) {
+		t.Fatalf("got %v, want %v", vars, want)
+	}
+	for k, v := range want {
+		if vars[k] != v {
+			t.Errorf("%s = %q, want %q", k, vars[k], v)
+		}
+	}
+}
+
+func TestCommandStartMarks(t *testing.T) {
+	var p startMarkParser
+	stream := "$ make\r\n\x1b]133;C\x1b]133;C\acc main.c\r\n"
+	n := 0
+	for i := 0; i < len(stream); i++ {
+		if p.feed(stream[i]) {
+			n++
+		}
+	}
+	if n != 1 {
+		t.Errorf("start marks = %d, want 1", n)
+	}
+
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+	c := &Client{conn: local, enc: json.NewEncoder(local)}
+	c.connected.Store(true)
+	sent := make(chan CommandPayload, 4)
+	go func() {
+		dec := json.NewDecoder(remote)
+		for {
+			var env Envelope
+			if dec.Decode(&env) != nil {
+				return
+			}
+			var p CommandPayload
+			json.Unmarshal(env.Payload, &p)
+			sent <- p
+		}
+	}()
+
+	// Until the shell is seen to report starts, commands go out when entered
+	c.submitCommand("ls")
+	if p := <-sent; p.Command != "ls" || p.StartedAt == 0 {
+		t.Errorf("sent %+v, want ls", p)
+	}
+	c.commandStarted(time.Now())
+
+	// Then only the line entered before a start mark is a command
+	c.submitCommand("y")
+	c.submitCommand("make")
+	started := time.Unix(1700000000, 0)
+	c.commandStarted(started)
+	if p := <-sent; p.Command != "make" || p.StartedAt != started.UnixNano() {
+		t.Errorf("sent %+v, want make started at %v", p, started)
+	}
+	c.commandStarted(time.Now()) // nothing entered
+	select {
+	case p := <-sent:
+		t.Errorf("unexpected command %+v", p)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestSendOutputRedacts(t *testing.T) {
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+	c := &Client{
+		Logger:         slog.New(slog.DiscardHandler),
+		RedactPatterns: []*regexp.Regexp{regexp.MustCompile(`sk-[a-z0-9]+`)},
+		conn:           local,
+		enc:            json.NewEncoder(local),
+		localBuf:       NewRingBuffer(10),
+	}
+	c.connected.Store(true)
+
+	sent := make(chan Envelope, 2)
+	go func() {
+		dec := json.NewDecoder(remote)
+		for {
+			var env Envelope
+			if dec.Decode(&env) != nil {
+				return
+			}
+			sent <- env
+		}
+	}()
+	lines := []string{"\x1b[1mkey=sk-\x1b[0mabc123\r", "\x1b[32mok\x1b[0m"}
+	c.sendOutput(lines)
+
+	var p OutputPayload
+	json.Unmarshal((<-sent).Payload, &p)
+	want := []string{"key=[REDACTED]\r", "\x1b[32mok\x1b[0m"}
+	if !slices.Equal(p.Lines, want) {
+		t.Errorf("sent %q, want %q", p.Lines, want)
+	}
+	if stored, _, _ := c.localBuf.ReadRange(0, 10); stored[0] != "key=[REDACTED]\r" {
+		t.Errorf("buffered %q", stored[0])
+	}
+	if lines[0] != "\x1b[1mkey=sk-\x1b[0mabc123\r" {
+		t.Errorf("caller's slice modified: %q", lines[0])
+	}
+
+	// Command lines are redacted too
+	c.sendCommand("export KEY=sk-abc123", time.Now())
+	var cp CommandPayload
+	json.Unmarshal((<-sent).Payload, &cp)
+	if cp.Command != "export KEY=[REDACTED]" || c.getLastCommand() != cp.Command {
+		t.Errorf("sent command %q, last command %q", cp.Command, c.getLastCommand())
+	}
+}
+
+func TestPausedClient(t *testing.T) {
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+	c := &Client{
+		Logger:   slog.New(slog.DiscardHandler),
+		conn:     local,
+		enc:      json.NewEncoder(local),
+		localBuf: NewRingBuffer(10),
+	}
+	c.connected.Store(true)
+
+	sent := make(chan Envelope, 4)
+	go func() {
+		dec := json.NewDecoder(remote)
+		for {
+			var env Envelope
+			if dec.Decode(&env) != nil {
+				return
+			}
+			sent <- env
+		}
+	}()
+
+	running := "ssh prod"
+	c.pendingCmd.Store(&running)
+	c.togglePause()
+	if env := <-sent; env.Type != MsgPause || string(env.Payload) != `{"paused":true}` {
+		t.Errorf("sent %s %s, want pause", env.Type, env.Payload)
+	}
+	c.sendOutput([]string{"password: hunter2"})
+	c.submitCommand("mysql -p")
+	c.sendCommandResult(0)
+	c.setCwd("/srv/secret")
+	if c.localBuf.Len() != 0 || c.getLastCommand() != "" || c.cwd.Load() != nil {
+		t.Errorf("captured while paused: %q, last command %q, cwd %v", c.localBuf.LastN(1), c.getLastCommand(), c.cwd.Load())
+	}
+
+	c.togglePause()
+	if env := <-sent; env.Type != MsgPause || string(env.Payload) != `{"paused":false}` {
+		t.Errorf("sent %s %s, want resume", env.Type, env.Payload)
+	}
+	c.sendOutput([]string{"ok"})
+	if env := <-sent; env.Type != MsgOutput || c.localBuf.Len() != 1 {
+		t.Errorf("sent %s after resuming, buffered %d lines", env.Type, c.localBuf.Len())
+	}
+	select {
+	case env := <-sent:
+		t.Errorf("unexpected %s %s", env.Type, env.Payload)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestSendOutputTimestamps(t *testing.T) {
+	c := &Client{
+		Logger:         slog.New(slog.DiscardHandler),
+		TimestampLines: true,
+		localBuf:       NewRingBuffer(10),
+	}
+	lines := []string{"\x1b[1mbuilding\x1b[0m"}
+	c.sendOutput(lines)
+
+	got := c.localBuf.LastN(1)[0]
+	stamp, rest, ok := strings.Cut(strings.TrimPrefix(got, "["), "] ")
+	if !ok || rest != "building" {
+		t.Fatalf("line = %q", got)
+	}
+	if _, err := time.Parse(time.RFC3339Nano, stamp); err != nil || len(stamp) != len("2006-01-02T15:04:05.000000000Z") {
+		t.Errorf("timestamp %q: %v", stamp, err)
+	}
+	if lines[0] != "\x1b[1mbuilding\x1b[0m" {
+		t.Errorf("caller's slice modified: %q", lines[0])
+	}
+}
+
+func TestForwardSignals(t *testing.T) {
+	cmd := exec.Command("sh", "-c", `trap "" TERM; echo ready; while :; do sleep 0.1; done`)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Skipf("starting sh: %v", err)
+	}
+	if _, err := stdout.Read(make([]byte, 16)); err != nil {
+		t.Fatalf("waiting for trap: %v", err)
+	}
+	sigs := make(chan os.Signal, 1)
+	defer close(sigs)
+	go forwardSignals(sigs, cmd.Process)
+
+	// The shell ignores SIGTERM, so it should take the follow-up SIGHUP
+	sigs <- syscall.SIGTERM
+	err = cmd.Wait()
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		t.Fatalf("wait: %v", err)
+	}
+	if ws, ok := exitErr.Sys().(syscall.WaitStatus); !ok || ws.Signal() != syscall.SIGHUP {
+		t.Errorf("exit = %v, want killed by SIGHUP", err)
+	}
+}
+
+func TestNushellPrompt(t *testing.T) {
+	script := nushellPrompt(`[streamsh - it's "quoted" (abc)]`, "38;5;208")
+	if !strings.Contains(script, `let streamsh_tag = "[streamsh - it's \"quoted\" (abc)]"`) {
+		t.Errorf("tag not quoted as a nushell string:\n%s", script)
+	}
+
+	nu, err := exec.LookPath("nu")
+	if err != nil {
+		t.Skip("nu not installed")
+	}
+	if out, err := exec.Command(nu, "--commands", script).CombinedOutput(); err != nil {
+		t.Errorf("nu rejected the script: %v\n%s", err, out)
+	}
+}
+
+func TestAnsiColor(t *testing.T) {
+	for name, want := range map[string]string{
+		"magenta":  "35",
+		"Cyan":     "36",
+		"38;5;208": "38;5;208",
+		"1;31":     "1;31",
+		"orange":   "",
+		"31;":      "",
+		"\x1b[31":  "",
+	} {
+		if got := ansiColor(name); got != want {
+			t.Errorf("ansiColor(%q) = %q, want %q", name, got, want)
+		}
+	}
+	if err := CheckPromptColor("orange"); err == nil {
+		t.Error("expected error for unknown color")
+	}
+
+	c := &Client{PromptColor: "38;5;208", shortID: "abcd1234"}
+	cmd := exec.Command("/bin/sh")
+	defer c.setupShellPrompt("/bin/sh", cmd)()
+	var rc string
+	for _, kv := range cmd.Env {
+		if path, ok := strings.CutPrefix(kv, "ENV="); ok {
+			data, _ := os.ReadFile(path)
+			rc = string(data)
+		}
+	}
+	if !strings.Contains(rc, `\033[38;5;208m[streamsh - abcd1234]`) {
+		t.Errorf("sh rc = %q, want the tag in color 38;5;208", rc)
+	}
+}
+
+func TestNoPrompt(t *testing.T) {
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+
+	c := &Client{NoPrompt: true, shortID: "abcd1234"}
+	for _, shell := range []string{"/bin/bash", "/bin/zsh", "/usr/bin/fish", "/usr/bin/elvish", "/usr/bin/nu", "/bin/sh"} {
+		cmd := exec.Command(shell)
+		c.setupShellPrompt(shell, cmd)()
+		if len(cmd.Args) != 1 || cmd.Env != nil {
+			t.Errorf("%s: args = %q, env = %q, want unchanged", shell, cmd.Args, cmd.Env)
+		}
+	}
+	if entries, _ := os.ReadDir(tmp); len(entries) != 0 {
+		t.Errorf("temp files created: %v", entries)
+	}
+}
+
+func TestElvishPrompt(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	userRC := filepath.Join(home, ".elvish", "rc.elv")
+	os.MkdirAll(filepath.Dir(userRC), 0755)
+	os.WriteFile(userRC, nil, 0644)
+
+	c := &Client{Title: "it's mine", shortID: "abcd1234"}
+	cmd := exec.Command("/usr/bin/elvish")
+	cleanup := c.setupShellPrompt("/usr/bin/elvish", cmd)
+	if len(cmd.Args) != 3 || cmd.Args[1] != "-rc" {
+		t.Fatalf("args = %q", cmd.Args)
+	}
+	data, err := os.ReadFile(cmd.Args[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc := string(data)
+	for _, want := range []string{
+		"eval (slurp < '" + userRC + "') &on-end={|ns| for k [(keys $ns)] { edit:add-var $k $ns[$k] } }\n",
+		"set edit:prompt = { styled '[streamsh - it''s mine (abcd1234)]' magenta; put ' '; $_streamsh_prompt }\n",
+	} {
+		if !strings.Contains(rc, want) {
+			t.Errorf("rc missing %q:\n%s", want, rc)
+		}
+	}
+
+	cleanup()
+	if _, err := os.Stat(filepath.Dir(cmd.Args[2])); !os.IsNotExist(err) {
+		t.Errorf("rc dir not removed: %v", err)
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/arnavsurve/streamsh"
+	"golang.org/x/term"
+)
+
+// commands are the subcommands for reading sessions and managing the
+// daemon from a terminal. Each returns the process exit code.
+var commands = map[string]func(args []string) int{
+	"ls":        runList,
+	"cat":       runCat,
+	"search":    runSearch,
+	"attach":    runAttach,
+	"quiesce":   quiesceCommand(true),
+	"unquiesce": quiesceCommand(false),
+}
+
+// clientFlags registers the flags every subcommand shares and returns a
+// function that connects to the daemon once they are parsed.
+func clientFlags(fs *flag.FlagSet) func() (*streamsh.DaemonClient, error) {
+	socketPath := fs.String("socket", streamsh.SocketPathFromEnv(), "Unix socket path, or tcp://host:port of a daemon listening with --tcp-addr")
+	tokenFile := fs.String("token-file", "", "Read the daemon's token from this file (default $STREAMSH_TOKEN)")
+	return func() (*streamsh.DaemonClient, error) {
+		token, err := readToken(*tokenFile)
+		if err != nil {
+			return nil, err
+		}
+		return streamsh.NewDaemonClient(*socketPath, token)
+	}
+}
+
+// readToken returns the daemon token from tokenFile if set, else from
+// STREAMSH_TOKEN.
+func readToken(tokenFile string) (string, error) {
+	if tokenFile != "" {
+		return streamsh.ReadTokenFile(tokenFile)
+	}
+	return os.Getenv("STREAMSH_TOKEN"), nil
+}
+
+// fail prints err and returns the exit code for a failed command.
+func fail(err error) int {
+	fmt.Fprintf(os.Stderr, "streamsh: %v\n", err)
+	return 1
+}
+
+func runList(args []string) int {
+	fs := flag.NewFlagSet("ls", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: streamsh ls [flags]")
+		fs.PrintDefaults()
+	}
+	connect := clientFlags(fs)
+	var tags tagList
+	fs.Var(&tags, "tag", "Only list sessions with this tag (repeatable)")
+	fs.Parse(args)
+
+	dc, err := connect()
+	if err != nil {
+		return fail(err)
+	}
+	defer dc.Close()
+	infos, err := dc.ListSessions(context.Background(), streamsh.ListSessionsPayload{Tags: tags})
+	if err != nil {
+		return fail(err)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tTITLE\tSTATUS\tLINES\tCREATED\tIDLE\tLAST COMMAND")
+	for _, s := range infos {
+		status := "disconnected"
+		if s.Connected {
+			status = "connected"
+		}
+		if s.Collab {
+			status += " (collab)"
+		}
+		if s.ReadOnly {
+			status += " (read-only)"
+		}
+		if s.Paused {
+			status += " (paused)"
+		}
+		created := s.CreatedAt
+		if t, err := time.Parse(time.RFC3339, s.CreatedAt); err == nil {
+			created = t.Local().Format("Jan 2 15:04")
+		}
+		last := s.LastCommand
+		if s.LastExit != nil && *s.LastExit != 0 {
+			last += fmt.Sprintf(" [exit %d]", *s.LastExit)
+		}
+		idle := time.Duration(s.IdleSeconds) * time.Second
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\t%s\t%s\n", s.ID, s.Title, status, s.LineCount, created, idle, last)
+	}
+	tw.Flush()
+	return 0
+}
+
+// quiesceCommand returns the quiesce subcommand if quiesced is set, else
+// unquiesce.
+func quiesceCommand(quiesced bool) func(args []string) int {
+	name := "unquiesce"
+	if quiesced {
+		name = "quiesce"
+	}
+	return func(args []string) int {
+		fs := flag.NewFlagSet(name, flag.ExitOnError)
+		fs.Usage = func() {
+			fmt.Fprintf(fs.Output(), "usage: streamsh %s [flags]\n", name)
+			fs.PrintDefaults()
+		}
+		connect := clientFlags(fs)
+		fs.Parse(args)
+		if fs.NArg() != 0 {
+			fs.Usage()
+			return 2
+		}
+
+		dc, err := connect()
+		if err != nil {
+			return fail(err)
+		}
+		defer dc.Close()
+		got, err := dc.SetQuiesced(context.Background(), quiesced)
+		if err != nil {
+			return fail(err)
+		}
+		if got {
+			fmt.Println("daemon quiesced: new sessions are rejected, reconnects are still accepted")
+		} else {
+			fmt.Println("daemon accepting new sessions")
+		}
+		return 0
+	}
+}
+
+func runCat(args []string) int {
+	fs := flag.NewFlagSet("cat", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: streamsh cat [flags] <session>")
+		fs.PrintDefaults()
+	}
+	connect := clientFlags(fs)
+	lastN := fs.Int("n", 0, "Only print the last n lines")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	session := fs.Arg(0)
+
+	dc, err := connect()
+	if err != nil {
+		return fail(err)
+	}
+	defer dc.Close()
+
+	ctx := context.Background()
+	if *lastN > 0 {
+		resp, err := dc.QuerySession(ctx, streamsh.QuerySessionPayload{Session: session, LastN: *lastN})
+		if err != nil {
+			return fail(err)
+		}
+		for _, line := range resp.Lines {
+			fmt.Println(line)
+		}
+		return 0
+	}
+	// Keep colors for a terminal, but not in files and pipes
+	stripANSI := !term.IsTerminal(int(os.Stdout.Fd()))
+	if err := dc.ExportSession(ctx, streamsh.ExportSessionPayload{Session: session, StripANSI: stripANSI}, os.Stdout); err != nil {
+		return fail(err)
+	}
+	return 0
+}
+
+func runSearch(args []string) int {
+	fs := flag.NewFlagSet("search", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: streamsh search [flags] <session> <pattern>")
+		fs.PrintDefaults()
+	}
+	connect := clientFlags(fs)
+	regex := fs.Bool("E", false, "Treat pattern as a regular expression")
+	contextLines := fs.Int("C", 0, "Print this many lines of context around each match")
+	maxResults := fs.Int("m", 50, "Stop after this many matches")
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return 2
+	}
+
+	dc, err := connect()
+	if err != nil {
+		return fail(err)
+	}
+	defer dc.Close()
+
+	p := streamsh.QuerySessionPayload{Session: fs.Arg(0), Context: *contextLines, MaxResults: *maxResults}
+	if *regex {
+		p.SearchRegex = fs.Arg(1)
+	} else {
+		p.Search = fs.Arg(1)
+	}
+	resp, err := dc.QuerySession(context.Background(), p)
+	if err != nil {
+		return fail(err)
+	}
+
+	for i, m := range resp.Matches {
+		if i > 0 {
+			fmt.Println("--")
+		}
+		for _, line := range m.Before {
+			fmt.Println(line)
+		}
+		fmt.Printf("[%d] %s\n", m.Seq, m.Line)
+		for _, line := range m.After {
+			fmt.Println(line)
+		}
+	}
+	fmt.Print(strings.Join(resp.Lines, "\n"))
+	if len(resp.Lines) > 0 {
+		fmt.Println()
+	}
+	// Like grep, exit 1 when nothing matched
+	if len(resp.Matches) == 0 && len(resp.Lines) == 0 {
+		return 1
+	}
+	return 0
+}
+
+func runAttach(args []string) int {
+	fs := flag.NewFlagSet("attach", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: streamsh attach [flags] <session>")
+		fs.PrintDefaults()
+	}
+	connect := clientFlags(fs)
+	lastN := fs.Int("n", 20, "Start with the last n lines for context")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	dc, err := connect()
+	if err != nil {
+		return fail(err)
+	}
+	defer dc.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	events, err := dc.Subscribe(ctx, streamsh.SubscribePayload{Session: fs.Arg(0), LastN: *lastN})
+	if err != nil {
+		return fail(err)
+	}
+	fmt.Fprintf(os.Stderr, "streamsh: attached to %s (read-only), Ctrl-C to detach\n", fs.Arg(0))
+
+	for ev := range events {
+		switch ev.Kind {
+		case "":
+			for _, line := range ev.Lines {
+				fmt.Println(line)
+			}
+		case streamsh.SessionDisconnected:
+			fmt.Fprintln(os.Stderr, "streamsh: session disconnected")
+			return 0
+		}
+	}
+	if ctx.Err() == nil {
+		fmt.Fprintln(os.Stderr, "streamsh: session ended")
+	}
+	return 0
+}
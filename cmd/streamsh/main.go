@@ -5,25 +5,131 @@ import (
 	"fmt"
 	"log/slog"
 	"os"
+	"regexp"
+	"strings"
+	"time"
 
 	"github.com/arnavsurve/streamsh"
 )
 
 func main() {
-	socketPath := flag.String("socket", streamsh.SocketPathFromEnv(), "Unix socket path")
+	if len(os.Args) > 1 {
+		if cmd, ok := commands[os.Args[1]]; ok {
+			os.Exit(cmd(os.Args[2:]))
+		}
+	}
+
+	socketPath := flag.String("socket", streamsh.SocketPathFromEnv(), "Unix socket path, or tcp://host:port of a daemon listening with --tcp-addr")
 	title := flag.String("title", "", "Session title (auto-generated if empty)")
 	shell := flag.String("shell", "", "Shell to launch (defaults to $SHELL)")
+	execCmd := flag.String("exec", "", "Run this command instead of an interactive shell, and exit with its status")
 	collab := flag.Bool("collab", false, "Allow agents to send input to this session")
+	tokenFile := flag.String("token-file", "", "Read the daemon's token from this file (default $STREAMSH_TOKEN)")
+	logFile := flag.String("log-file", "", "Also write the session's output, without colors, to this file")
+	logMaxSize := flag.Int64("log-max-size", 0, "Rotate --log-file to <file>.1 when it would exceed this many bytes (0 never rotates)")
+	timestamps := flag.Bool("timestamps", false, "Prefix each output line with the time it was printed (searches see the prefix too)")
+	dedup := flag.Bool("dedup", false, "Collapse runs of identical output lines into one, shown as \"line (x12)\", to keep more scrollback")
+	keepANSI := flag.Bool("keep-ansi", false, "Have the daemon keep output's colors for raw reads, alongside the plain text")
+	promptColor := flag.String("prompt-color", "magenta", "Color of the streamsh tag in the prompt: red, green, yellow, blue, magenta, cyan, white, or an ANSI code like 38;5;208")
+	noPrompt := flag.Bool("no-prompt", false, "Don't show the streamsh tag in the prompt (also disables exit status and cwd tracking)")
+	noCommandDetection := flag.Bool("no-command-detection", false, "Don't read commands out of your keystrokes; sessions then report no last command")
+	readOnly := flag.Bool("read-only", false, "Refuse input from agents, even with --collab")
+	ttl := flag.Duration("ttl", 0, "Have the daemon remove this session this long after it disconnects, instead of after its --session-ttl (0 uses the daemon's)")
+	compressThreshold := flag.Int("compress-threshold", streamsh.DefaultCompressThreshold, "Gzip output batches larger than this many bytes before sending them to the daemon (-1 never compresses)")
+	record := flag.String("record", "", "Record the session to this file in asciinema v2 format")
+	recordInput := flag.Bool("record-input", false, "Also record keystrokes with --record, including passwords typed at prompts that don't echo")
+	redactFile := flag.String("redact-file", "", "Read --redact patterns from this file, one per line")
+	var tags, redactions tagList
+	flag.Var(&tags, "tag", "Label this session (repeatable)")
+	flag.Var(&redactions, "redact", "Replace matches of this regexp in the output, commands, and environment with [REDACTED] (repeatable)")
+	flag.Usage = func() {
+		out := flag.CommandLine.Output()
+		fmt.Fprintln(out, "usage: streamsh [flags]                     launch a tracked shell")
+		fmt.Fprintln(out, "       streamsh --exec <command> [flags]    capture a single command")
+		fmt.Fprintln(out, "       streamsh ls [flags]                  list sessions")
+		fmt.Fprintln(out, "       streamsh cat [flags] <session>       print a session's output")
+		fmt.Fprintln(out, "       streamsh search [flags] <session> <pattern>")
+		fmt.Fprintln(out, "       streamsh attach [flags] <session>    follow a session's live output")
+		fmt.Fprintln(out)
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 
 	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelWarn}))
 
+	if err := streamsh.CheckPromptColor(*promptColor); err != nil {
+		os.Exit(fail(err))
+	}
+
+	if *recordInput && *record == "" {
+		os.Exit(fail(fmt.Errorf("--record-input needs --record")))
+	}
+	if *ttl < 0 {
+		os.Exit(fail(fmt.Errorf("--ttl must not be negative")))
+	}
+
+	token, err := readToken(*tokenFile)
+	if err != nil {
+		os.Exit(fail(err))
+	}
+
+	if *redactFile != "" {
+		data, err := os.ReadFile(*redactFile)
+		if err != nil {
+			os.Exit(fail(err))
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			if line = strings.TrimSuffix(line, "\r"); line != "" {
+				redactions = append(redactions, line)
+			}
+		}
+	}
+	var redactPatterns []*regexp.Regexp
+	for _, expr := range redactions {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			logger.Warn("ignoring invalid redact pattern", "pattern", expr, "err", err)
+			continue
+		}
+		redactPatterns = append(redactPatterns, re)
+	}
+
+	reconnectInit, err := envDuration("STREAMSH_RECONNECT_INIT")
+	if err != nil {
+		os.Exit(fail(err))
+	}
+	reconnectMax, err := envDuration("STREAMSH_RECONNECT_MAX")
+	if err != nil {
+		os.Exit(fail(err))
+	}
+
 	client := &streamsh.Client{
-		Shell:      *shell,
-		Title:      *title,
-		SocketPath: *socketPath,
-		Logger:     logger,
-		Collab:     *collab,
+		Shell:       *shell,
+		Exec:        *execCmd,
+		Title:       *title,
+		SocketPath:  *socketPath,
+		Logger:      logger,
+		Collab:      *collab,
+		Tags:        tags,
+		Token:       token,
+		LogFile:     *logFile,
+		LogMaxSize:  *logMaxSize,
+		Record:      *record,
+		RecordInput: *recordInput,
+		KeepANSI:    *keepANSI,
+		ReadOnly:    *readOnly,
+		Dedup:       *dedup,
+		TTL:         *ttl,
+
+		NoPrompt:           *noPrompt,
+		PromptColor:        *promptColor,
+		NoCommandDetection: *noCommandDetection,
+		TimestampLines:     *timestamps,
+		RedactPatterns:     redactPatterns,
+
+		ReconnectInitialDelay: reconnectInit,
+		ReconnectMaxDelay:     reconnectMax,
+		CompressThreshold:     *compressThreshold,
 	}
 
 	exitCode, err := client.Run()
@@ -33,3 +139,27 @@ func main() {
 	}
 	os.Exit(exitCode)
 }
+
+// envDuration parses the duration in the environment variable key, or
+// returns zero if it is unset.
+func envDuration(key string) (time.Duration, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("parsing %s: %w", key, err)
+	}
+	return d, nil
+}
+
+// tagList collects the values of a repeatable flag.
+type tagList []string
+
+func (t *tagList) String() string { return strings.Join(*t, ",") }
+
+func (t *tagList) Set(v string) error {
+	*t = append(*t, v)
+	return nil
+}
@@ -2,21 +2,46 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"flag"
 	"log/slog"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/arnavsurve/streamsh"
 	"github.com/modelcontextprotocol/go-sdk/mcp"
 )
 
 func main() {
-	socketPath := flag.String("socket", streamsh.SocketPathFromEnv(), "Unix socket path")
+	socketPath := flag.String("socket", streamsh.SocketPathFromEnv(), "Unix socket path, or tcp://host:port to proxy MCP to a daemon listening with --tcp-addr")
 	bufferSize := flag.Int("buffer-size", 100000, "Lines per session ring buffer")
+	maxBytes := flag.Int("max-bytes", 0, "Bytes per session ring buffer (overrides --buffer-size)")
+	maxSessions := flag.Int("max-sessions", 0, "Maximum number of sessions; the least recently active disconnected session is evicted to make room (0 is unlimited)")
+	historySize := flag.Int("history-size", streamsh.MaxCommandHistory, "Commands kept in each session's history, for get_command_history")
 	logLevel := flag.String("log-level", "info", "Log level (debug, info, warn, error)")
+	stateFile := flag.String("state-file", "", "Save sessions here on shutdown and restore them on startup")
+	stateDir := flag.String("state-dir", "", "Periodically save each session to a file in this directory and restore them on startup")
+	stateInterval := flag.Duration("state-interval", 30*time.Second, "How often to save sessions to --state-dir")
+	sessionTTL := flag.Duration("session-ttl", time.Hour, "Remove disconnected sessions after this long without activity (0 keeps them)")
+	pruneInterval := flag.Duration("prune-interval", 10*time.Minute, "How often to check for expired sessions")
+	pingInterval := flag.Duration("ping-interval", streamsh.DefaultPingInterval, "How often to ping session clients")
+	pingTimeout := flag.Duration("ping-timeout", streamsh.DefaultPingTimeout, "Disconnect a session client that does not answer a ping within this long")
+	tcpAddr := flag.String("tcp-addr", "", "Also accept connections on this TCP address, e.g. 0.0.0.0:7891 inside a container (disabled if empty)")
+	allowedCIDRs := flag.String("allowed-cidrs", "127.0.0.0/8,::1/128", "Comma-separated networks allowed to connect over --tcp-addr")
+	httpAddr := flag.String("http-addr", "", "Serve a JSON HTTP API for sessions on this address, e.g. 127.0.0.1:7890 (disabled if empty)")
+	token := flag.String("token", "", "Require clients to present this token (default $STREAMSH_TOKEN; visible in ps, so prefer --token-file)")
+	tokenFile := flag.String("token-file", "", "Read the client token from this file")
+	requireAuth := flag.Bool("require-auth", false, "Require a token; one is generated and logged if --token and --token-file are not given")
+	maxConnections := flag.Int("max-connections", 0, "Maximum concurrent client connections; more are refused (0 is unlimited)")
+	shutdownTimeout := flag.Duration("shutdown-timeout", streamsh.DefaultShutdownTimeout, "On shutdown, how long to wait for clients to disconnect before closing their connections")
+	mcpConns := flag.Int("mcp-conns", streamsh.DefaultMaxDaemonConns, "Connections to the daemon for MCP tool calls; concurrent calls beyond this wait their turn")
+	allowSpawn := flag.Bool("allow-spawn", false, "Let clients, such as an agent's create_session tool, start shells run by the daemon")
+	startQuiesced := flag.Bool("start-quiesced", false, "Reject new sessions until un-quiesced (reconnects still allowed)")
 	flag.Parse()
 
 	var level slog.Level
@@ -44,13 +69,65 @@ func main() {
 		cancel()
 	}()
 
+	if *historySize <= 0 {
+		logger.Error("--history-size must be positive", "history-size", *historySize)
+		os.Exit(1)
+	}
+
+	if *token == "" {
+		*token = os.Getenv("STREAMSH_TOKEN")
+	}
+	if *tokenFile != "" {
+		t, err := streamsh.ReadTokenFile(*tokenFile)
+		if err != nil {
+			logger.Error("failed to read token", "err", err)
+			os.Exit(1)
+		}
+		*token = t
+	}
+	generatedToken := false
+	if *token == "" && *requireAuth {
+		b := make([]byte, 32)
+		rand.Read(b)
+		*token = hex.EncodeToString(b)
+		generatedToken = true
+		// stdout carries MCP, so the token goes to the log
+		logger.Info("generated client token; pass it to streamsh with STREAMSH_TOKEN", "token", *token)
+	}
+
 	// Try to start daemon — non-fatal if one is already running
+	store := streamsh.NewStore()
+	store.MaxBytes = *maxBytes
+	store.MaxSessions = *maxSessions
+	store.HistorySize = *historySize
 	daemon := &streamsh.Daemon{
-		Store:      streamsh.NewStore(),
+		Store:      store,
 		BufferSize: *bufferSize,
 		Logger:     logger,
+		StateFile:  *stateFile,
+
+		StateDir:        *stateDir,
+		StateInterval:   *stateInterval,
+		SessionTTL:      *sessionTTL,
+		PruneInterval:   *pruneInterval,
+		PingInterval:    *pingInterval,
+		PingTimeout:     *pingTimeout,
+		ShutdownTimeout: *shutdownTimeout,
+		MaxConnections:  *maxConnections,
+		TCPAddr:         *tcpAddr,
+		AllowedCIDRs:    strings.Split(*allowedCIDRs, ","),
+		HTTPAddr:        *httpAddr,
+		Token:           *token,
+		AllowSpawn:      *allowSpawn,
+	}
+	daemon.SetQuiesced(*startQuiesced)
+	var err error
+	if strings.HasPrefix(*socketPath, "tcp://") {
+		// A remote daemon: there is no local socket to own, only proxy MCP
+		err = streamsh.ErrDaemonAlreadyRunning
+	} else {
+		err = daemon.Listen(ctx, *socketPath)
 	}
-	err := daemon.Listen(ctx, *socketPath)
 	if err != nil && !errors.Is(err, streamsh.ErrDaemonAlreadyRunning) {
 		logger.Error("failed to start daemon", "err", err)
 		os.Exit(1)
@@ -64,18 +141,22 @@ func main() {
 		}()
 	} else {
 		logger.Info("daemon already running, connecting as MCP proxy")
+		if generatedToken {
+			logger.Error("a generated token cannot authenticate to an existing daemon; pass --token or --token-file")
+			os.Exit(1)
+		}
 	}
 
 	// Connect to daemon for MCP operations
-	dc, err := streamsh.NewDaemonClient(*socketPath)
+	pool, err := streamsh.NewDaemonClientPool(*socketPath, *token, *mcpConns)
 	if err != nil {
 		logger.Error("failed to connect to daemon", "err", err)
 		os.Exit(1)
 	}
-	defer dc.Close()
+	defer pool.Close()
 
-	// Run MCP server on stdio using DaemonClient
-	server := streamsh.NewMCPServer(dc)
+	// Run MCP server on stdio using DaemonClients from the pool
+	server := streamsh.NewMCPServer(pool)
 	if err := server.Run(ctx, &mcp.StdioTransport{}); err != nil {
 		if ctx.Err() == nil {
 			logger.Error("mcp server error", "err", err)
@@ -3,14 +3,21 @@ package streamsh
 import (
 	"bufio"
 	"context"
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net"
+	"net/http"
+	"net/netip"
 	"os"
 	"path/filepath"
+	"slices"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/acarl005/stripansi"
@@ -22,11 +29,68 @@ type Daemon struct {
 	Store      *Store
 	BufferSize int
 	Logger     *slog.Logger
+	StateFile  string // if set, sessions are loaded on Listen and saved on Close
 
-	listener net.Listener
-	wg       sync.WaitGroup
+	// StateDir, if set, holds one file per session. Sessions are loaded from
+	// it on Listen, saved every StateInterval (default 30s), and on Close.
+	StateDir      string
+	StateInterval time.Duration
+
+	// SessionTTL, if set, is how long a disconnected session is kept after
+	// its last activity. Sessions are pruned every PruneInterval (default
+	// 10m); sessions with their own TTL are pruned even if SessionTTL is 0.
+	SessionTTL    time.Duration
+	PruneInterval time.Duration
+
+	// Session clients are pinged every PingInterval; one that does not
+	// answer within PingTimeout is disconnected. Zero means the defaults.
+	PingInterval time.Duration
+	PingTimeout  time.Duration
+
+	// MaxConnections, if positive, caps concurrent client connections.
+	// Connections past the cap are sent MsgError and closed.
+	MaxConnections int
+
+	// ShutdownTimeout is how long Close waits for clients to disconnect
+	// after sending them MsgShutdown before closing their connections.
+	// Zero means DefaultShutdownTimeout.
+	ShutdownTimeout time.Duration
+
+	// TCPAddr, if set, is a TCP address Listen also accepts protocol
+	// connections on, e.g. for a daemon inside a container. Peers must be
+	// in AllowedCIDRs, which defaults to loopback only.
+	TCPAddr      string
+	AllowedCIDRs []string
+
+	// Token, if set, must be presented by every connection in its first
+	// message (normally MsgHello), and by HTTP API requests as a bearer
+	// token. Connections that fail to are sent MsgError and closed.
+	Token string
+
+	// HTTPAddr, if set, is the TCP address of a read/write HTTP API for
+	// scripts that don't speak MCP, e.g. "127.0.0.1:7890". See HTTPHandler.
+	HTTPAddr string
+
+	// AllowSpawn lets MsgSpawnSession start shells owned by the daemon,
+	// e.g. for the create_session MCP tool. Off by default, since it runs
+	// arbitrary commands for anything that can reach the daemon.
+	AllowSpawn bool
+
+	metrics     metrics
+	activeConns atomic.Int64
+	listener    net.Listener
+	connsMu     sync.Mutex
+	conns       map[net.Conn]*ConnWriter // open client connections
+	closing     bool                     // set once Close starts draining
+	tcpListener net.Listener
+	httpServer  *http.Server
+	wg          sync.WaitGroup
+	quiesced    atomic.Bool // reject new (non-reconnect) registrations
 }
 
+// DefaultShutdownTimeout is the default for Daemon.ShutdownTimeout.
+const DefaultShutdownTimeout = 5 * time.Second
+
 // DefaultSocketPath returns the default Unix socket path.
 func DefaultSocketPath() string {
 	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
@@ -47,6 +111,20 @@ func (d *Daemon) Listen(ctx context.Context, socketPath string) error {
 		os.Remove(socketPath)
 	}
 
+	if d.StateFile != "" {
+		if err := d.Store.Load(d.StateFile); err != nil {
+			d.Logger.Error("failed to load sessions", "path", d.StateFile, "err", err)
+		} else {
+			d.Logger.Info("loaded sessions", "path", d.StateFile, "count", len(d.Store.List()))
+		}
+	}
+	if d.StateDir != "" {
+		if err := d.Store.LoadDir(d.StateDir); err != nil {
+			d.Logger.Error("failed to load sessions", "dir", d.StateDir, "err", err)
+		}
+		d.Logger.Info("loaded sessions", "dir", d.StateDir, "count", len(d.Store.List()))
+	}
+
 	// Ensure parent directory exists with restricted permissions
 	dir := filepath.Dir(socketPath)
 	if err := os.MkdirAll(dir, 0700); err != nil {
@@ -65,56 +143,338 @@ func (d *Daemon) Listen(ctx context.Context, socketPath string) error {
 		ln.Close()
 	}()
 
+	if d.TCPAddr != "" {
+		if err := d.ListenTCP(ctx, d.TCPAddr); err != nil {
+			ln.Close()
+			return err
+		}
+	}
+	if d.HTTPAddr != "" {
+		if err := d.listenHTTP(ctx); err != nil {
+			ln.Close()
+			return err
+		}
+	}
+
+	if d.StateDir != "" {
+		go d.saveLoop(ctx)
+	}
+	go d.pruneLoop(ctx)
+	go d.serve(ctx, ln, nil)
+
+	return nil
+}
+
+// defaultAllowedCIDRs is the TCP allow-list used when AllowedCIDRs is empty.
+var defaultAllowedCIDRs = []string{"127.0.0.0/8", "::1/128"}
+
+// ListenTCP starts accepting connections on a TCP address, alongside the
+// Unix socket. Connections from peers outside AllowedCIDRs are closed
+// immediately.
+func (d *Daemon) ListenTCP(ctx context.Context, addr string) error {
+	cidrs := d.AllowedCIDRs
+	if len(cidrs) == 0 {
+		cidrs = defaultAllowedCIDRs
+	}
+	allowed := make([]netip.Prefix, len(cidrs))
+	for i, c := range cidrs {
+		prefix, err := netip.ParsePrefix(c)
+		if err != nil {
+			return fmt.Errorf("parsing allowed CIDR: %w", err)
+		}
+		allowed[i] = prefix
+	}
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("listening on %s: %w", addr, err)
+	}
+	d.tcpListener = ln
+	d.Logger.Info("listening", "addr", ln.Addr().String(), "allowed", cidrs)
+
 	go func() {
-		for {
-			conn, err := ln.Accept()
-			if err != nil {
-				if ctx.Err() != nil {
-					return
-				}
-				d.Logger.Error("accept error", "err", err)
-				continue
+		<-ctx.Done()
+		ln.Close()
+	}()
+	go d.serve(ctx, ln, func(conn net.Conn) bool {
+		peer, err := netip.ParseAddrPort(conn.RemoteAddr().String())
+		if err != nil {
+			return false
+		}
+		ip := peer.Addr().Unmap()
+		return slices.ContainsFunc(allowed, func(p netip.Prefix) bool { return p.Contains(ip) })
+	})
+	return nil
+}
+
+// serve accepts connections on ln until ctx is done, handling each one
+// allow accepts, or every one if allow is nil.
+func (d *Daemon) serve(ctx context.Context, ln net.Listener, allow func(net.Conn) bool) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				return
 			}
-			d.wg.Add(1)
-			go func() {
-				defer d.wg.Done()
-				d.handleConn(ctx, conn)
-			}()
+			d.Logger.Error("accept error", "err", err)
+			continue
 		}
-	}()
+		if allow != nil && !allow(conn) {
+			d.Logger.Warn("rejected connection", "peer", conn.RemoteAddr().String())
+			conn.Close()
+			continue
+		}
+		if n := d.activeConns.Add(1); d.MaxConnections > 0 && n > int64(d.MaxConnections) {
+			d.activeConns.Add(-1)
+			d.metrics.connectionRejected()
+			d.Logger.Warn("rejected connection over limit", "max", d.MaxConnections)
+			conn.SetWriteDeadline(time.Now().Add(time.Second))
+			json.NewEncoder(conn).Encode(Envelope{
+				Type:    MsgError,
+				Payload: mustMarshal(ErrorPayload{Message: "too many connections"}),
+			})
+			conn.Close()
+			continue
+		}
+		d.wg.Add(1)
+		go func() {
+			defer d.wg.Done()
+			defer d.activeConns.Add(-1)
+			d.handleConn(ctx, conn)
+		}()
+	}
+}
 
-	return nil
+// saveLoop periodically writes all sessions to StateDir until ctx is done.
+func (d *Daemon) saveLoop(ctx context.Context) {
+	interval := d.StateInterval
+	if interval <= 0 {
+		interval = 30 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := d.Store.SaveDir(d.StateDir); err != nil {
+				d.Logger.Error("failed to save sessions", "dir", d.StateDir, "err", err)
+			} else {
+				d.Logger.Debug("saved sessions", "dir", d.StateDir)
+			}
+		}
+	}
+}
+
+// pruneLoop periodically removes expired sessions until ctx is done.
+func (d *Daemon) pruneLoop(ctx context.Context) {
+	interval := d.PruneInterval
+	if interval <= 0 {
+		interval = 10 * time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for _, sess := range d.Store.Prune(d.SessionTTL) {
+				d.Logger.Info("reaped disconnected session", "id", sess.ShortID, "title", sess.Title(),
+					"last_activity", sess.LastActivity())
+			}
+		}
+	}
+}
+
+// SetQuiesced enables or disables quiesce mode. While quiesced, the daemon
+// rejects registrations of new sessions but still accepts reconnections and
+// serves all read and write requests for existing sessions.
+func (d *Daemon) SetQuiesced(quiesced bool) {
+	d.quiesced.Store(quiesced)
+}
+
+// Quiesced reports whether the daemon is in quiesce mode.
+func (d *Daemon) Quiesced() bool {
+	return d.quiesced.Load()
 }
 
 // Close shuts down the listener and waits for connections to finish.
+// If StateFile or StateDir is set, sessions are saved once all connections
+// are done.
 func (d *Daemon) Close() {
 	if d.listener != nil {
 		d.listener.Close()
 	}
-	d.wg.Wait()
+	if d.tcpListener != nil {
+		d.tcpListener.Close()
+	}
+	if d.httpServer != nil {
+		d.httpServer.Close()
+	}
+	d.drainConns()
+
+	if d.StateFile != "" {
+		if err := d.Store.Save(d.StateFile); err != nil {
+			d.Logger.Error("failed to save sessions", "path", d.StateFile, "err", err)
+		} else {
+			d.Logger.Info("saved sessions", "path", d.StateFile)
+		}
+	}
+	if d.StateDir != "" {
+		if err := d.Store.SaveDir(d.StateDir); err != nil {
+			d.Logger.Error("failed to save sessions", "dir", d.StateDir, "err", err)
+		} else {
+			d.Logger.Info("saved sessions", "dir", d.StateDir)
+		}
+	}
+}
+
+// trackConn records an open client connection, so Close can reach it.
+func (d *Daemon) trackConn(conn net.Conn, out *ConnWriter) {
+	d.connsMu.Lock()
+	defer d.connsMu.Unlock()
+	if d.closing {
+		// Accepted just before the listener closed; the handler sees EOF
+		conn.Close()
+		return
+	}
+	if d.conns == nil {
+		d.conns = make(map[net.Conn]*ConnWriter)
+	}
+	d.conns[conn] = out
+}
+
+func (d *Daemon) untrackConn(conn net.Conn) {
+	d.connsMu.Lock()
+	defer d.connsMu.Unlock()
+	delete(d.conns, conn)
+}
+
+// drainConns sends MsgShutdown to every client, waits up to
+// ShutdownTimeout for them to disconnect, then closes the connections of
+// those that haven't and waits for their handlers to finish. Messages go
+// through each connection's ConnWriter, so none is cut off mid-write.
+func (d *Daemon) drainConns() {
+	timeout := d.ShutdownTimeout
+	if timeout <= 0 {
+		timeout = DefaultShutdownTimeout
+	}
+
+	d.connsMu.Lock()
+	d.closing = true
+	for _, out := range d.conns {
+		// A client that isn't reading could block the write
+		go out.Write(Envelope{Type: MsgShutdown})
+	}
+	d.connsMu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return
+	case <-time.After(timeout):
+	}
+
+	d.connsMu.Lock()
+	if n := len(d.conns); n > 0 {
+		d.Logger.Warn("closing connections still open after shutdown timeout", "count", n)
+	}
+	for conn := range d.conns {
+		conn.Close()
+	}
+	d.connsMu.Unlock()
+	<-done
 }
 
+// daemonCapabilities lists the optional protocol features this daemon
+// offers in the handshake.
+var daemonCapabilities = []string{CapSubscribe, CapGzip}
+
 func (d *Daemon) handleConn(ctx context.Context, conn net.Conn) {
 	defer conn.Close()
 
 	scanner := bufio.NewScanner(conn)
 	scanner.Buffer(make([]byte, 1024*1024), 1024*1024)
-	enc := json.NewEncoder(conn)
+	out := NewConnWriter(conn)
+	enc := &replyEncoder{out: out}
+	d.trackConn(conn, out)
+	defer d.untrackConn(conn)
+
+	subs := newSubscriptions()
+	defer subs.stopAll()
 
 	var sessionID uuid.UUID
+	pongs := make(chan struct{}, 1)
+	var lastSeen atomic.Int64 // UnixNano of the last message from the client
+	hbCtx, stopHeartbeat := context.WithCancel(ctx)
+	defer stopHeartbeat()
+	heartbeating := false
+	authenticated := d.Token == ""
 
 	for scanner.Scan() {
 		if ctx.Err() != nil {
 			return
 		}
 
+		lastSeen.Store(time.Now().UnixNano())
+
 		var env Envelope
 		if err := json.Unmarshal(scanner.Bytes(), &env); err != nil {
 			d.Logger.Error("bad message", "err", err)
 			continue
 		}
+		if env.Compressed {
+			if err := decompressPayload(&env); err != nil {
+				d.Logger.Error("bad message", "type", env.Type, "err", err)
+				continue
+			}
+		}
+		enc.setRequest(env.RequestID)
+
+		if !authenticated {
+			if !d.validToken(env.Token) {
+				d.Logger.Warn("rejecting connection with invalid token", "type", env.Type)
+				enc.Encode(Envelope{
+					Type:    MsgError,
+					Payload: mustMarshal(ErrorPayload{Message: "invalid or missing token"}),
+				})
+				return
+			}
+			authenticated = true
+		}
 
 		switch env.Type {
+		case MsgHello:
+			var p HelloPayload
+			if env.Payload != nil {
+				json.Unmarshal(env.Payload, &p)
+			}
+			if protocolMajor(p.Version) != protocolMajor(ProtocolVersion) {
+				d.Logger.Warn("rejecting client with incompatible protocol version", "version", p.Version)
+				enc.Encode(Envelope{
+					Type: MsgError,
+					Payload: mustMarshal(ErrorPayload{
+						Message: fmt.Sprintf("incompatible protocol version %q (daemon speaks %s)", p.Version, ProtocolVersion),
+					}),
+				})
+				return
+			}
+			enc.Encode(Envelope{
+				Type: MsgHelloAck,
+				Payload: mustMarshal(HelloPayload{
+					Version:      ProtocolVersion,
+					Capabilities: sharedCapabilities(p.Capabilities, daemonCapabilities),
+				}),
+			})
+
 		case MsgRegister:
 			var p RegisterPayload
 			if env.Payload != nil {
@@ -122,15 +482,16 @@ func (d *Daemon) handleConn(ctx context.Context, conn net.Conn) {
 			}
 			bufSize := d.BufferSize
 			if p.BufferSize > 0 {
-				bufSize = p.BufferSize
+				bufSize = min(p.BufferSize, MaxBufferCapacity)
 			}
-			var clientConn net.Conn
+			var client *ConnWriter
 			if p.Collab {
-				clientConn = conn
+				client = out
 			}
 
 			var sess *Session
 			var reconnected bool
+			var createErr error
 
 			if p.SessionID != "" {
 				id, err := uuid.Parse(p.SessionID)
@@ -142,18 +503,43 @@ func (d *Daemon) handleConn(ctx context.Context, conn net.Conn) {
 					})
 					continue
 				}
-				sess, reconnected = d.Store.CreateOrUpdate(id, p.Title, bufSize, p.Collab, clientConn)
+				if _, ok := d.Store.Get(id); !ok && d.Quiesced() {
+					d.rejectQuiesced(enc, p.Title)
+					continue
+				}
+				sess, reconnected, createErr = d.Store.CreateOrUpdate(id, p.Title, bufSize, p.Collab, client)
 			} else {
-				sess = d.Store.Create(p.Title, bufSize, p.Collab, clientConn)
+				if d.Quiesced() {
+					d.rejectQuiesced(enc, p.Title)
+					continue
+				}
+				sess, createErr = d.Store.Create(p.Title, bufSize, p.Collab, client)
+			}
+			if createErr != nil {
+				d.Logger.Warn("rejected registration", "title", p.Title, "err", createErr)
+				enc.Encode(Envelope{
+					Type:    MsgError,
+					Payload: mustMarshal(ErrorPayload{Message: createErr.Error()}),
+				})
+				continue
 			}
 
 			sessionID = sess.ID
+			sess.register(p)
+			if p.Dedup && !reconnected {
+				sess.Buffer.SetDedup(true)
+			}
+			d.Store.notify(sess.ID, SessionEvent{Kind: SessionConnected, Session: sess})
+			if !heartbeating {
+				heartbeating = true
+				go d.heartbeat(hbCtx, conn, out, pongs, &lastSeen, sess.ShortID)
+			}
 
 			if reconnected {
-				sess.Buffer.Clear()
 				d.Logger.Info("session reconnected", "id", sess.ShortID, "title", p.Title)
 			} else {
 				d.Logger.Info("session registered", "id", sess.ShortID, "title", p.Title, "collab", p.Collab)
+				d.metrics.sessionCreated()
 			}
 
 			enc.Encode(Envelope{
@@ -161,6 +547,7 @@ func (d *Daemon) handleConn(ctx context.Context, conn net.Conn) {
 				Payload: mustMarshal(RegisterAck{
 					SessionID: sess.ID.String(),
 					ShortID:   sess.ShortID,
+					ResumeSeq: sess.clientSeq(sess.Buffer.TotalSeq()),
 				}),
 			})
 
@@ -173,10 +560,20 @@ func (d *Daemon) handleConn(ctx context.Context, conn net.Conn) {
 			if !ok {
 				continue
 			}
-			for _, line := range p.Lines {
-				sess.Buffer.Append(stripansi.Strip(line))
+			stripped := make([]string, len(p.Lines))
+			for i, line := range p.Lines {
+				stripped[i] = stripansi.Strip(line)
+			}
+			if sess.KeepANSI() {
+				sess.Buffer.AppendBatchANSI(p.Lines)
+			} else {
+				sess.Buffer.AppendBatch(stripped)
+			}
+			d.metrics.linesAppended(len(p.Lines))
+			sess.rate.add(len(p.Lines), sess.touch())
+			for _, line := range stripped {
+				d.Store.notify(sess.ID, SessionEvent{Kind: SessionNewLine, Session: sess, Line: line})
 			}
-			sess.LastActivity = time.Now()
 
 		case MsgReplay:
 			var p ReplayPayload
@@ -187,13 +584,70 @@ func (d *Daemon) handleConn(ctx context.Context, conn net.Conn) {
 			if !ok {
 				continue
 			}
-			for _, line := range p.Lines {
-				sess.Buffer.Append(line)
+			// Skip lines the buffer already holds; if the client's
+			// replay starts past them, lines were lost in between.
+			lines, repeats := p.Lines, p.Repeats
+			if total := sess.clientSeq(sess.Buffer.TotalSeq()); p.FromSeq < total {
+				skip := min(total-p.FromSeq, uint64(len(lines)))
+				lines = lines[skip:]
+				repeats = repeats[min(skip, uint64(len(repeats))):]
+			} else if p.FromSeq > total {
+				// Note the gap, keeping what the daemon already has, and
+				// line the replay up with the client's numbering from here
+				d.Logger.Warn("gap in replayed output", "id", sess.ShortID, "from", total, "to", p.FromSeq)
+				sess.Buffer.Append(fmt.Sprintf("[streamsh: %d lines lost while disconnected]", p.FromSeq-total))
+				sess.setClientSeqOffset(p.FromSeq - sess.Buffer.TotalSeq())
 			}
+			// Each replayed line has its own seq in the client's buffer,
+			// even if it repeats the one before
+			sess.Buffer.AppendRepeats(lines, repeats)
+			d.metrics.linesAppended(len(lines))
 			if p.LastCommand != "" {
-				sess.LastCommand = p.LastCommand
+				sess.setLastCommand(p.LastCommand)
+			}
+			sess.touch()
+
+		case MsgResizeBuffer:
+			var p ResizeBufferPayload
+			if env.Payload != nil {
+				json.Unmarshal(env.Payload, &p)
+			}
+			var sess *Session
+			if p.Session != "" {
+				var err error
+				if sess, err = d.Store.Resolve(p.Session); err != nil {
+					enc.Encode(Envelope{
+						Type:    MsgError,
+						Payload: mustMarshal(ErrorPayload{Message: err.Error()}),
+					})
+					continue
+				}
+			} else {
+				var ok bool
+				if sess, ok = d.Store.Get(sessionID); !ok {
+					enc.Encode(Envelope{
+						Type:    MsgError,
+						Payload: mustMarshal(ErrorPayload{Message: "no session registered on this connection"}),
+					})
+					continue
+				}
 			}
-			sess.LastActivity = time.Now()
+			if err := sess.Buffer.Resize(p.Capacity); err != nil {
+				enc.Encode(Envelope{
+					Type:    MsgError,
+					Payload: mustMarshal(ErrorPayload{Message: err.Error()}),
+				})
+				continue
+			}
+			d.Logger.Info("session buffer resized", "id", sess.ShortID, "capacity", p.Capacity)
+			enc.Encode(Envelope{
+				Type: MsgAck,
+				Payload: mustMarshal(ResizeBufferResponse{
+					SessionID: sess.ShortID,
+					Capacity:  sess.Buffer.Cap(),
+					Lines:     sess.Buffer.Len(),
+				}),
+			})
 
 		case MsgCommand:
 			var p CommandPayload
@@ -204,44 +658,122 @@ func (d *Daemon) handleConn(ctx context.Context, conn net.Conn) {
 			if !ok {
 				continue
 			}
-			sess.LastCommand = p.Command
-			sess.LastActivity = time.Now()
+			started := sess.touch()
+			if p.StartedAt != 0 {
+				started = time.Unix(0, p.StartedAt)
+			}
+			sess.AddCommand(p.Command, started)
+			d.Store.notify(sess.ID, SessionEvent{Kind: SessionNewCommand, Session: sess, Line: p.Command})
+
+		case MsgEnvironment:
+			var p EnvironmentPayload
+			if err := json.Unmarshal(env.Payload, &p); err != nil {
+				continue
+			}
+			sess, ok := d.Store.Get(sessionID)
+			if !ok {
+				continue
+			}
+			sess.setEnvironment(p.Vars)
+
+		case MsgCwd:
+			var p CwdPayload
+			if err := json.Unmarshal(env.Payload, &p); err != nil {
+				continue
+			}
+			sess, ok := d.Store.Get(sessionID)
+			if !ok {
+				continue
+			}
+			sess.setCwd(p.Dir)
+
+		case MsgPause:
+			var p PausePayload
+			if err := json.Unmarshal(env.Payload, &p); err != nil {
+				continue
+			}
+			sess, ok := d.Store.Get(sessionID)
+			if !ok {
+				continue
+			}
+			sess.setPaused(p.Paused)
+			d.Logger.Info("session streaming paused", "id", sess.ShortID, "paused", p.Paused)
+
+		case MsgResize:
+			var p ResizePayload
+			if err := json.Unmarshal(env.Payload, &p); err != nil {
+				continue
+			}
+			sess, ok := d.Store.Get(sessionID)
+			if !ok {
+				continue
+			}
+			sess.setSize(p.Rows, p.Cols)
+
+		case MsgCommandResult:
+			var p CommandResultPayload
+			if err := json.Unmarshal(env.Payload, &p); err != nil {
+				continue
+			}
+			sess, ok := d.Store.Get(sessionID)
+			if !ok {
+				continue
+			}
+			sess.SetExitCode(p.ExitCode)
+			sess.touch()
+			cmd, _, _ := sess.LastCommand()
+			d.Store.notify(sess.ID, SessionEvent{Kind: SessionExited, Session: sess, Line: cmd, ExitCode: p.ExitCode})
 
 		case MsgDisconnect:
 			sess, ok := d.Store.Get(sessionID)
 			if ok {
-				sess.Connected = false
+				sess.touch()
 				sess.ClearConn()
-				sess.LastActivity = time.Now()
+				d.Store.notify(sess.ID, SessionEvent{Kind: SessionDisconnected, Session: sess})
 				d.Logger.Info("session disconnected", "id", sess.ShortID)
 			}
 			return
 
 		case MsgListSessions:
-			sessions := d.Store.List()
+			var p ListSessionsPayload
+			if env.Payload != nil {
+				json.Unmarshal(env.Payload, &p)
+			}
+			sessions := d.Store.Filter(p)
 			infos := make([]SessionInfo, len(sessions))
 			for i, s := range sessions {
-				infos[i] = SessionInfo{
-					ID:          s.ShortID,
-					Title:       s.Title,
-					LastCommand: s.LastCommand,
-					LineCount:   s.Buffer.Len(),
-					CreatedAt:   s.CreatedAt.Format(time.RFC3339),
-					Connected:   s.Connected,
-					Collab:      s.Collab,
-				}
+				infos[i] = sessionInfo(s)
 			}
 			enc.Encode(Envelope{
 				Type:    MsgAck,
 				Payload: mustMarshal(ListSessionsResponse{Sessions: infos}),
 			})
 
+		case MsgSearchAll:
+			var p SearchAllPayload
+			if env.Payload != nil {
+				json.Unmarshal(env.Payload, &p)
+			}
+			sessions := d.Store.Filter(ListSessionsPayload{Tags: p.Tags, ConnectedOnly: p.ConnectedOnly})
+			resp, err := searchAll(sessions, p)
+			if err != nil {
+				enc.Encode(Envelope{
+					Type:    MsgError,
+					Payload: mustMarshal(ErrorPayload{Message: err.Error()}),
+				})
+				continue
+			}
+			enc.Encode(Envelope{
+				Type:    MsgAck,
+				Payload: mustMarshal(resp),
+			})
+
 		case MsgQuerySession:
 			var p QuerySessionPayload
 			if env.Payload != nil {
 				json.Unmarshal(env.Payload, &p)
 			}
-			sess, err := d.Store.Resolve(p.Session)
+			sess, err := d.Store.ResolveWithTags(p.Session, p.Tags)
 			if err != nil {
 				enc.Encode(Envelope{
 					Type:    MsgError,
@@ -249,33 +781,13 @@ func (d *Daemon) handleConn(ctx context.Context, conn net.Conn) {
 				})
 				continue
 			}
-			resp := QuerySessionResponse{
-				SessionID:  sess.ShortID,
-				Title:      sess.Title,
-				TotalLines: sess.Buffer.Len(),
-			}
-			switch {
-			case p.Search != "":
-				maxResults := p.MaxResults
-				if maxResults <= 0 {
-					maxResults = 50
-				}
-				results := sess.Buffer.Search(p.Search, maxResults)
-				resp.Lines = make([]string, len(results))
-				for i, r := range results {
-					resp.Lines[i] = fmt.Sprintf("[%d] %s", r.Seq, r.Line)
-				}
-			case p.LastN > 0:
-				resp.Lines = sess.Buffer.LastN(p.LastN)
-			default:
-				count := p.Count
-				if count <= 0 {
-					count = 100
-				}
-				lines, nextCursor, hasMore := sess.Buffer.ReadRange(p.Cursor, count)
-				resp.Lines = lines
-				resp.NextCursor = nextCursor
-				resp.HasMore = hasMore
+			resp, err := querySession(sess, p)
+			if err != nil {
+				enc.Encode(Envelope{
+					Type:    MsgError,
+					Payload: mustMarshal(ErrorPayload{Message: err.Error()}),
+				})
+				continue
 			}
 			enc.Encode(Envelope{
 				Type:    MsgAck,
@@ -295,40 +807,774 @@ func (d *Daemon) handleConn(ctx context.Context, conn net.Conn) {
 				})
 				continue
 			}
-			if err := sess.SendInput(p.Text); err != nil {
+			text, err := inputText(p.Text, p.Keys)
+			from := sess.Buffer.TotalSeq()
+			if err == nil {
+				err = sess.SendInput(text)
+			}
+			if err != nil {
 				enc.Encode(Envelope{
 					Type:    MsgError,
 					Payload: mustMarshal(ErrorPayload{Message: err.Error()}),
 				})
 				continue
 			}
-			enc.Encode(Envelope{
-				Type: MsgAck,
-				Payload: mustMarshal(WriteSessionResponse{
-					Success:   true,
-					SessionID: sess.ShortID,
-					BytesSent: len(p.Text),
-				}),
-			})
-		}
-	}
-
-	// Connection closed without disconnect message
-	if sess, ok := d.Store.Get(sessionID); ok {
-		sess.Connected = false
-		sess.ClearConn()
-		sess.LastActivity = time.Now()
-	}
-}
+			resp := WriteSessionResponse{
+				Success:   true,
+				SessionID: sess.ShortID,
+				BytesSent: len(text),
+			}
+			if p.WaitMs <= 0 {
+				enc.Encode(Envelope{Type: MsgAck, Payload: mustMarshal(resp)})
+				continue
+			}
+			// Collect the output in the background so other requests
+			// on this connection aren't held up
+			wait := min(time.Duration(p.WaitMs)*time.Millisecond, maxWriteWait)
+			go func(requestID string) {
+				resp.Lines, resp.NextCursor = collectOutput(hbCtx, sess.Buffer, from, wait)
+				enc.Encode(Envelope{Type: MsgAck, RequestID: requestID, Payload: mustMarshal(resp)})
+			}(env.RequestID)
 
-// SocketPathFromEnv returns the socket path from the STREAMSH_SOCKET env var,
-// or the default path.
-func SocketPathFromEnv() string {
-	if p := os.Getenv("STREAMSH_SOCKET"); p != "" {
-		return p
-	}
-	return DefaultSocketPath()
-}
+		case MsgSendSignal:
+			var p SendSignalPayload
+			if env.Payload != nil {
+				json.Unmarshal(env.Payload, &p)
+			}
+			sess, err := d.Store.Resolve(p.Session)
+			if err != nil {
+				enc.Encode(Envelope{
+					Type:    MsgError,
+					Payload: mustMarshal(ErrorPayload{Message: err.Error()}),
+				})
+				continue
+			}
+			sig, err := sess.Signal(p.Signal)
+			if err != nil {
+				enc.Encode(Envelope{
+					Type:    MsgError,
+					Payload: mustMarshal(ErrorPayload{Message: err.Error()}),
+				})
+				continue
+			}
+			d.Logger.Info("signal sent", "id", sess.ShortID, "signal", sig)
+			enc.Encode(Envelope{
+				Type:    MsgAck,
+				Payload: mustMarshal(SendSignalResponse{SessionID: sess.ShortID, Signal: sig}),
+			})
+
+		case MsgKillSession:
+			var p KillSessionPayload
+			if env.Payload != nil {
+				json.Unmarshal(env.Payload, &p)
+			}
+			sess, err := d.Store.Resolve(p.Session)
+			if err != nil {
+				enc.Encode(Envelope{
+					Type:    MsgError,
+					Payload: mustMarshal(ErrorPayload{Message: err.Error()}),
+				})
+				continue
+			}
+			resp := KillSessionResponse{SessionID: sess.ShortID, Connected: sess.Connected()}
+			if sess.Collab() && resp.Connected {
+				if err := sess.Kill(); err != nil {
+					d.Logger.Warn("failed to signal session", "id", sess.ShortID, "err", err)
+				} else {
+					resp.Signaled = true
+				}
+			}
+			d.Store.Remove(sess.ID)
+			sess.expire()
+			d.Logger.Info("session killed", "id", sess.ShortID, "title", sess.Title(), "signaled", resp.Signaled)
+			enc.Encode(Envelope{
+				Type:    MsgAck,
+				Payload: mustMarshal(resp),
+			})
+
+		case MsgSpawnSession:
+			var p SpawnPayload
+			if env.Payload != nil {
+				json.Unmarshal(env.Payload, &p)
+			}
+			ack, err := d.spawnSession(ctx, p)
+			if err != nil {
+				d.Logger.Warn("spawning session failed", "title", p.Title, "err", err)
+				enc.Encode(Envelope{
+					Type:    MsgError,
+					Payload: mustMarshal(ErrorPayload{Message: err.Error()}),
+				})
+				continue
+			}
+			enc.Encode(Envelope{Type: MsgAck, SessionID: ack.ShortID, Payload: mustMarshal(ack)})
+
+		case MsgDeleteSession:
+			var p DeleteSessionPayload
+			if env.Payload != nil {
+				json.Unmarshal(env.Payload, &p)
+			}
+			sess, err := d.Store.Resolve(p.Session)
+			if err == nil && sess.Connected() && !p.Force {
+				err = fmt.Errorf("session %s is connected; set force to delete it anyway", sess.ShortID)
+			}
+			if err != nil {
+				enc.Encode(Envelope{
+					Type:    MsgError,
+					Payload: mustMarshal(ErrorPayload{Message: err.Error()}),
+				})
+				continue
+			}
+			// A connected client is left alone; its output is dropped
+			// from now on, since the session is gone
+			d.Store.Remove(sess.ID)
+			sess.expire()
+			d.Logger.Info("session deleted", "id", sess.ShortID, "title", sess.Title(), "connected", sess.Connected())
+			enc.Encode(Envelope{
+				Type: MsgAck,
+				Payload: mustMarshal(DeleteSessionResponse{
+					SessionID: sess.ShortID,
+					Title:     sess.Title(),
+					Connected: sess.Connected(),
+				}),
+			})
+
+		case MsgCommandHistory:
+			var p CommandHistoryPayload
+			if env.Payload != nil {
+				json.Unmarshal(env.Payload, &p)
+			}
+			sess, err := d.Store.Resolve(p.Session)
+			if err != nil {
+				enc.Encode(Envelope{
+					Type:    MsgError,
+					Payload: mustMarshal(ErrorPayload{Message: err.Error()}),
+				})
+				continue
+			}
+			enc.Encode(Envelope{
+				Type: MsgAck,
+				Payload: mustMarshal(CommandHistoryResponse{
+					SessionID: sess.ShortID,
+					Title:     sess.Title(),
+					Commands:  sess.RecentCommands(p.Limit),
+				}),
+			})
+
+		case MsgSessionInfo:
+			var p SessionInfoPayload
+			if env.Payload != nil {
+				json.Unmarshal(env.Payload, &p)
+			}
+			sess, err := d.Store.Resolve(p.Session)
+			if err != nil {
+				enc.Encode(Envelope{
+					Type:    MsgError,
+					Payload: mustMarshal(ErrorPayload{Message: err.Error()}),
+				})
+				continue
+			}
+			enc.Encode(Envelope{
+				Type:    MsgAck,
+				Payload: mustMarshal(sessionDetails(sess)),
+			})
+
+		case MsgQueryStats:
+			var p QueryStatsPayload
+			if env.Payload != nil {
+				json.Unmarshal(env.Payload, &p)
+			}
+			sess, err := d.Store.Resolve(p.Session)
+			if err != nil {
+				enc.Encode(Envelope{
+					Type:    MsgError,
+					Payload: mustMarshal(ErrorPayload{Message: err.Error()}),
+				})
+				continue
+			}
+			enc.Encode(Envelope{
+				Type:    MsgAck,
+				Payload: mustMarshal(sessionStats(sess)),
+			})
+
+		case MsgGetEnvironment:
+			var p GetEnvironmentPayload
+			if env.Payload != nil {
+				json.Unmarshal(env.Payload, &p)
+			}
+			sess, err := d.Store.Resolve(p.Session)
+			if err != nil {
+				enc.Encode(Envelope{
+					Type:    MsgError,
+					Payload: mustMarshal(ErrorPayload{Message: err.Error()}),
+				})
+				continue
+			}
+			environment := sess.Environment()
+			vars := environment
+			if len(p.Keys) > 0 {
+				vars = make(map[string]string, len(p.Keys))
+				for _, k := range p.Keys {
+					if v, ok := environment[k]; ok {
+						vars[k] = v
+					}
+				}
+			}
+			enc.Encode(Envelope{
+				Type:    MsgAck,
+				Payload: mustMarshal(GetEnvironmentResponse{SessionID: sess.ShortID, Vars: vars}),
+			})
+
+		case MsgRename:
+			var p RenameSessionPayload
+			if env.Payload != nil {
+				json.Unmarshal(env.Payload, &p)
+			}
+			sess, err := d.Store.Resolve(p.Session)
+			if err != nil {
+				enc.Encode(Envelope{
+					Type:    MsgError,
+					Payload: mustMarshal(ErrorPayload{Message: err.Error()}),
+				})
+				continue
+			}
+			old, err := d.Store.Rename(sess.ID, p.Title)
+			if err != nil {
+				enc.Encode(Envelope{
+					Type:    MsgError,
+					Payload: mustMarshal(ErrorPayload{Message: err.Error()}),
+				})
+				continue
+			}
+			d.Logger.Info("session renamed", "id", sess.ShortID, "old", old, "new", p.Title)
+			enc.Encode(Envelope{
+				Type: MsgAck,
+				Payload: mustMarshal(RenameSessionResponse{
+					SessionID: sess.ShortID,
+					OldTitle:  old,
+					NewTitle:  p.Title,
+				}),
+			})
+
+		case MsgExportSession:
+			var p ExportSessionPayload
+			if env.Payload != nil {
+				json.Unmarshal(env.Payload, &p)
+			}
+			sess, err := d.Store.Resolve(p.Session)
+			if err != nil {
+				enc.Encode(Envelope{
+					Type:    MsgError,
+					Payload: mustMarshal(ErrorPayload{Message: err.Error()}),
+				})
+				continue
+			}
+			write := sess.Buffer.WriteLines
+			switch p.Format {
+			case "", "text":
+			case "jsonl":
+				write = sess.Buffer.WriteJSONLines
+			default:
+				enc.Encode(Envelope{
+					Type:    MsgError,
+					Payload: mustMarshal(ErrorPayload{Message: fmt.Sprintf("unknown export format %q (want text or jsonl)", p.Format)}),
+				})
+				continue
+			}
+			cw := bufio.NewWriterSize(exportChunkWriter{enc}, 64*1024)
+			n, err := write(cw, p.StripANSI)
+			if err == nil {
+				err = cw.Flush()
+			}
+			if err != nil {
+				d.Logger.Debug("export failed", "id", sess.ShortID, "err", err)
+				return
+			}
+			enc.Encode(Envelope{
+				Type:    MsgAck,
+				Payload: mustMarshal(ExportSessionResponse{SessionID: sess.ShortID, Bytes: n}),
+			})
+
+		case MsgSubscribe:
+			var p SubscribePayload
+			if env.Payload != nil {
+				json.Unmarshal(env.Payload, &p)
+			}
+			if p.AllSessions {
+				enc.Encode(Envelope{Type: MsgAck})
+				subs.start(ctx, env.RequestID, func(ctx context.Context) {
+					d.streamAllSessions(ctx, enc, env.RequestID)
+				})
+				continue
+			}
+			sess, err := d.Store.Resolve(p.Session)
+			if err != nil {
+				enc.Encode(Envelope{
+					Type:    MsgError,
+					Payload: mustMarshal(ErrorPayload{Message: err.Error()}),
+				})
+				continue
+			}
+			enc.Encode(Envelope{Type: MsgAck, SessionID: sess.ShortID})
+			var from uint64
+			if p.FromSeq != nil {
+				from = *p.FromSeq
+			} else {
+				total := sess.Buffer.TotalSeq()
+				from = total - min(total, uint64(max(p.LastN, 0)))
+			}
+			subs.start(ctx, env.RequestID, func(ctx context.Context) {
+				d.streamSession(ctx, enc, sess, env.RequestID, from)
+			})
+
+		case MsgUnsubscribe:
+			var p UnsubscribePayload
+			if env.Payload != nil {
+				json.Unmarshal(env.Payload, &p)
+			}
+			if !subs.stop(p.SubscriptionID) {
+				enc.Encode(Envelope{
+					Type:    MsgError,
+					Payload: mustMarshal(ErrorPayload{Message: fmt.Sprintf("no subscription %q", p.SubscriptionID)}),
+				})
+				continue
+			}
+			enc.Encode(Envelope{Type: MsgAck})
+
+		case MsgPing:
+			enc.Encode(Envelope{Type: MsgPong})
+
+		case MsgPong:
+			select {
+			case pongs <- struct{}{}:
+			default:
+			}
+
+		case MsgQuiesce, MsgUnquiesce:
+			d.SetQuiesced(env.Type == MsgQuiesce)
+			d.Logger.Info("quiesce mode changed", "quiesced", d.Quiesced())
+			enc.Encode(Envelope{
+				Type:    MsgAck,
+				Payload: mustMarshal(QuiesceResponse{Quiesced: d.Quiesced()}),
+			})
+		}
+	}
+
+	// Connection closed without disconnect message
+	if sess, ok := d.Store.Get(sessionID); ok {
+		sess.touch()
+		sess.ClearConn()
+		d.Store.notify(sess.ID, SessionEvent{Kind: SessionDisconnected, Session: sess})
+	}
+}
+
+// heartbeat pings a session client every PingInterval and closes conn, which
+// marks the session disconnected, if a client that has answered before stops
+// answering within PingTimeout. Any other message received in that time
+// also counts as a sign of life, since a busy client's pong may be queued
+// behind its output. Clients that never answer predate heartbeats and are
+// left alone.
+func (d *Daemon) heartbeat(ctx context.Context, conn net.Conn, out *ConnWriter, pongs <-chan struct{}, lastSeen *atomic.Int64, id string) {
+	interval := d.PingInterval
+	if interval <= 0 {
+		interval = DefaultPingInterval
+	}
+	timeout := d.PingTimeout
+	if timeout <= 0 {
+		timeout = DefaultPingTimeout
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	answered := false
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		sent := time.Now()
+		if err := out.Write(Envelope{Type: MsgPing}); err != nil {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-pongs:
+			answered = true
+		case <-time.After(timeout):
+			if answered && lastSeen.Load() < sent.UnixNano() {
+				d.Logger.Warn("session missed heartbeat, disconnecting", "id", id)
+				conn.Close()
+				return
+			}
+		}
+	}
+}
+
+// Limits on the output returned by a write_session with wait_ms.
+const (
+	maxWriteWait      = 10 * time.Second       // longest wait, well within DefaultRequestTimeout
+	writeOutputSettle = 300 * time.Millisecond // stop once output has been quiet this long
+	maxWriteLines     = 1000                   // lines returned; the cursor points past them
+)
+
+// collectOutput gathers lines appended to buf from sequence number from on,
+// until wait elapses, output has been quiet for writeOutputSettle after at
+// least one line, maxWriteLines are collected, or ctx is done. It returns
+// the lines and the sequence number following the last of them.
+func collectOutput(ctx context.Context, buf *RingBuffer, from uint64, wait time.Duration) ([]string, uint64) {
+	ctx, cancel := context.WithTimeout(ctx, wait)
+	defer cancel()
+	results := buf.TailFrom(ctx, from)
+
+	var lines []string
+	next := from
+	var settle <-chan time.Time
+	for len(lines) < maxWriteLines {
+		select {
+		case r, ok := <-results:
+			if !ok {
+				return lines, next
+			}
+			lines = append(lines, r.Line)
+			next = r.Seq + 1
+			settle = time.After(writeOutputSettle)
+		case <-settle:
+			return lines, next
+		}
+	}
+	return lines, next
+}
+
+// subscriptions are the active subscriptions on a connection, keyed by the
+// RequestID of their MsgSubscribe. Each is removed when its stream ends,
+// whether cancelled or because its session expired.
+type subscriptions struct {
+	mu   sync.Mutex
+	subs map[string]*subscription
+}
+
+type subscription struct {
+	cancel context.CancelFunc
+}
+
+func newSubscriptions() *subscriptions {
+	return &subscriptions{subs: make(map[string]*subscription)}
+}
+
+// start runs stream in a goroutine until ctx is done or the subscription
+// is stopped, replacing any subscription with the same id.
+func (s *subscriptions) start(ctx context.Context, id string, stream func(context.Context)) {
+	ctx, cancel := context.WithCancel(ctx)
+	sub := &subscription{cancel: cancel}
+	s.mu.Lock()
+	if old, ok := s.subs[id]; ok {
+		old.cancel()
+	}
+	s.subs[id] = sub
+	s.mu.Unlock()
+
+	go func() {
+		defer s.remove(id, sub)
+		stream(ctx)
+	}()
+}
+
+// remove forgets sub once its stream has ended, unless it was replaced.
+func (s *subscriptions) remove(id string, sub *subscription) {
+	sub.cancel()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.subs[id] == sub {
+		delete(s.subs, id)
+	}
+}
+
+// stop cancels the subscription with id, reporting whether there was one.
+func (s *subscriptions) stop(id string) bool {
+	s.mu.Lock()
+	sub, ok := s.subs[id]
+	delete(s.subs, id)
+	s.mu.Unlock()
+	if ok {
+		sub.cancel()
+	}
+	return ok
+}
+
+// stopAll cancels every subscription.
+func (s *subscriptions) stopAll() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, sub := range s.subs {
+		sub.cancel()
+		delete(s.subs, id)
+	}
+}
+
+// streamSession sends a subscribed session's output from sequence number
+// fromSeq on, and its state changes, as MsgEvent messages tagged with
+// requestID, until ctx is cancelled, the session expires, or a write fails.
+func (d *Daemon) streamSession(ctx context.Context, enc *replyEncoder, sess *Session, requestID string, fromSeq uint64) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	d.Logger.Debug("subscriber attached", "id", sess.ShortID)
+	lines := sess.Buffer.TailFrom(ctx, fromSeq)
+	expired := sess.Expired()
+	events, stopWatch, err := d.Store.Watch(sess.ID)
+	if err == nil {
+		defer stopWatch()
+	}
+	send := func(typ MsgType, p any) bool {
+		return enc.Encode(Envelope{
+			Type:      typ,
+			SessionID: sess.ShortID,
+			RequestID: requestID,
+			Payload:   mustMarshal(p),
+		}) == nil
+	}
+	for {
+		var line SearchResult
+		var ok bool
+		select {
+		case line, ok = <-lines:
+		case ev := <-events:
+			// Output lines arrive in order through TailFrom instead
+			if ev.Kind == SessionNewLine {
+				continue
+			}
+			if !send(MsgEvent, stateEvent(ev)) {
+				return
+			}
+			continue
+		case <-expired:
+			send(MsgExpired, ExpiredPayload{SessionID: sess.ShortID})
+			d.Logger.Debug("subscriber detached, session expired", "id", sess.ShortID)
+			return
+		}
+		if !ok {
+			break
+		}
+		p := EventPayload{SessionID: sess.ShortID, Lines: []string{line.Line}, Seqs: []uint64{line.Seq}}
+		// Coalesce whatever else is already queued into one event
+	drain:
+		for len(p.Lines) < 500 {
+			select {
+			case l, ok := <-lines:
+				if !ok {
+					break drain
+				}
+				p.Lines = append(p.Lines, l.Line)
+				p.Seqs = append(p.Seqs, l.Seq)
+			default:
+				break drain
+			}
+		}
+		if !send(MsgEvent, p) {
+			return
+		}
+	}
+	d.Logger.Debug("subscriber detached", "id", sess.ShortID)
+}
+
+// streamAllSessions sends the state changes of every session to a
+// MsgSubscribe with AllSessions until ctx is done.
+func (d *Daemon) streamAllSessions(ctx context.Context, enc *replyEncoder, requestID string) {
+	events, stopWatch := d.Store.WatchAll()
+	defer stopWatch()
+	for {
+		select {
+		case ev := <-events:
+			err := enc.Encode(Envelope{
+				Type:      MsgEvent,
+				SessionID: ev.Session.ShortID,
+				RequestID: requestID,
+				Payload:   mustMarshal(stateEvent(ev)),
+			})
+			if err != nil {
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// stateEvent converts a session state change for a subscriber.
+func stateEvent(ev SessionEvent) EventPayload {
+	p := EventPayload{SessionID: ev.Session.ShortID, Kind: ev.Kind}
+	switch ev.Kind {
+	case SessionNewCommand:
+		p.Command = ev.Line
+	case SessionExited:
+		p.Command = ev.Line
+		p.ExitCode = &ev.ExitCode
+	}
+	return p
+}
+
+// sessionInfo summarizes a session for MsgListSessions and the HTTP API.
+func sessionInfo(s *Session) SessionInfo {
+	lastCommand, _, lastExit := s.LastCommand()
+	rows, cols := s.Size()
+	return SessionInfo{
+		ID:           s.ShortID,
+		Title:        s.Title(),
+		LastCommand:  lastCommand,
+		LastExit:     lastExit,
+		LineCount:    s.Buffer.Len(),
+		CreatedAt:    s.CreatedAt.Format(time.RFC3339),
+		LastActivity: s.LastActivity().Format(time.RFC3339),
+		IdleSeconds:  int64(time.Since(s.LastActivity()).Seconds()),
+		Connected:    s.Connected(),
+		Collab:       s.Collab(),
+		ReadOnly:     s.ReadOnly(),
+		Paused:       s.Paused(),
+		Tags:         s.Tags(),
+		Rows:         rows,
+		Cols:         cols,
+		Cwd:          s.Cwd(),
+		Pid:          s.Pid(),
+	}
+}
+
+// sessionDetails describes a session in full for MsgSessionInfo.
+func sessionDetails(s *Session) SessionDetails {
+	details := SessionDetails{
+		SessionInfo:    sessionInfo(s),
+		UUID:           s.ID.String(),
+		KeepANSI:       s.KeepANSI(),
+		BufferCapacity: s.Buffer.Cap(),
+		BufferMaxBytes: s.Buffer.MaxBytes(),
+		BufferBytes:    s.Buffer.Bytes(),
+		TotalLines:     s.Buffer.TotalSeq(),
+		OldestSeq:      s.Buffer.FirstSeq(),
+		LinesPerMinute: s.rate.perMinute(time.Now()),
+		CommandCount:   len(s.RecentCommands(0)),
+	}
+	if _, started, _ := s.LastCommand(); !started.IsZero() {
+		details.CommandStarted = started.Format(time.RFC3339Nano)
+	}
+	if ttl := s.TTL(); ttl > 0 {
+		details.TTL = ttl.String()
+	}
+	return details
+}
+
+// sessionStats reports a session's buffer use and throughput for
+// MsgQueryStats.
+func sessionStats(s *Session) SessionStats {
+	lastCommand, _, _ := s.LastCommand()
+	rows, cols := s.Size()
+	stats := SessionStats{
+		SessionID:         s.ShortID,
+		BufferCapacity:    s.Buffer.Cap(),
+		BufferUsed:        s.Buffer.Len(),
+		TotalLinesEver:    s.Buffer.TotalSeq(),
+		OldestSeq:         s.Buffer.FirstSeq(),
+		Connected:         s.Connected(),
+		Collab:            s.Collab(),
+		CreatedAt:         s.CreatedAt.Format(time.RFC3339),
+		LastActivity:      s.LastActivity().Format(time.RFC3339),
+		LastCommand:       lastCommand,
+		Rows:              rows,
+		Cols:              cols,
+		AvgLinesPerMinute: s.rate.average(time.Now()),
+	}
+	if stats.TotalLinesEver > 0 {
+		newest := stats.TotalLinesEver - 1
+		stats.NewestSeq = &newest
+	}
+	return stats
+}
+
+// replyEncoder writes messages to a client connection through its
+// ConnWriter, tagging each with the RequestID of the request being handled
+// so pipelining clients can match responses to requests.
+type replyEncoder struct {
+	out *ConnWriter
+
+	mu        sync.Mutex // protects requestID
+	requestID string
+}
+
+// setRequest sets the RequestID for messages that don't carry their own.
+func (r *replyEncoder) setRequest(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.requestID = id
+}
+
+func (r *replyEncoder) Encode(env Envelope) error {
+	if env.RequestID == "" {
+		r.mu.Lock()
+		env.RequestID = r.requestID
+		r.mu.Unlock()
+	}
+	return r.out.Write(env)
+}
+
+// exportChunkWriter sends each write as a MsgExportChunk envelope.
+type exportChunkWriter struct {
+	enc *replyEncoder
+}
+
+func (w exportChunkWriter) Write(p []byte) (int, error) {
+	err := w.enc.Encode(Envelope{
+		Type:    MsgExportChunk,
+		Payload: mustMarshal(ExportChunkPayload{Data: string(p)}),
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// rejectQuiesced refuses a new session registration while quiesced.
+func (d *Daemon) rejectQuiesced(enc *replyEncoder, title string) {
+	d.Logger.Info("rejected registration while quiesced", "title", title)
+	enc.Encode(Envelope{
+		Type:    MsgError,
+		Payload: mustMarshal(ErrorPayload{Message: "daemon is quiesced and not accepting new sessions"}),
+	})
+}
+
+// validToken reports whether token matches d.Token.
+func (d *Daemon) validToken(token string) bool {
+	return subtle.ConstantTimeCompare([]byte(token), []byte(d.Token)) == 1
+}
+
+// ReadTokenFile reads a token from a file, ignoring surrounding whitespace.
+func ReadTokenFile(path string) (string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("reading token file: %w", err)
+	}
+	token := strings.TrimSpace(string(b))
+	if token == "" {
+		return "", fmt.Errorf("token file %s is empty", path)
+	}
+	return token, nil
+}
+
+// dialDaemon connects to a daemon at addr, which is a Unix socket path or,
+// for a daemon listening with ListenTCP, "tcp://host:port".
+func dialDaemon(addr string) (net.Conn, error) {
+	if hostPort, ok := strings.CutPrefix(addr, "tcp://"); ok {
+		return net.Dial("tcp", hostPort)
+	}
+	return net.Dial("unix", addr)
+}
+
+// SocketPathFromEnv returns the socket path from the STREAMSH_SOCKET env var,
+// or the default path.
+func SocketPathFromEnv() string {
+	if p := os.Getenv("STREAMSH_SOCKET"); p != "" {
+		return p
+	}
+	return DefaultSocketPath()
+}
 
 func mustMarshal(v any) json.RawMessage {
 	b, err := json.Marshal(v)
@@ -343,4 +1589,3 @@ func mustMarshal(v any) json.RawMessage {
 func GetUid() string {
 	return strconv.Itoa(os.Getuid())
 }
-
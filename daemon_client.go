@@ -2,109 +2,567 @@ package streamsh
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net"
+	"os"
+	"slices"
 	"sync"
+	"time"
+
+	"github.com/google/uuid"
 )
 
 // DaemonClient connects to the daemon over a Unix socket and provides
-// request-response methods for MCP tool operations.
+// request-response methods for MCP tool operations. It is safe for
+// concurrent use: requests are tagged with a RequestID and may be in flight
+// at the same time on one connection.
 type DaemonClient struct {
 	socketPath string
-	conn       net.Conn
-	enc        *json.Encoder
-	scanner    *bufio.Scanner
-	mu         sync.Mutex // serializes request-response pairs
+	token      string      // sent in every envelope, see Daemon.Token
+	mu         sync.Mutex  // protects conn
+	conn       *daemonConn // current connection, replaced once it fails
+
+	pingOnce  sync.Once
+	closeOnce sync.Once
+	done      chan struct{} // closed by Close to stop pinging
+}
+
+// daemonConn is a single connection to the daemon. A reader goroutine
+// routes each response to the pending request with the same RequestID.
+type daemonConn struct {
+	conn  net.Conn
+	caps  []string // capabilities negotiated in the handshake
+	token string
+
+	mu      sync.Mutex // serializes writes; protects pending and err
+	enc     *json.Encoder
+	pending map[string]*pendingRequest
+	err     error // set once the connection has failed
 }
 
-// NewDaemonClient dials the daemon Unix socket and returns a client.
-func NewDaemonClient(socketPath string) (*DaemonClient, error) {
-	dc := &DaemonClient{socketPath: socketPath}
-	if err := dc.dial(); err != nil {
+// pendingRequest collects the responses to one in-flight request.
+type pendingRequest struct {
+	id        string
+	responses chan Envelope // closed if the connection fails, or a subscription's queue overflows
+	done      chan struct{} // closed when the caller stops reading
+	bounded   bool          // a subscription: the reader drops it rather than wait for room in responses
+}
+
+// subscriptionQueue is how many events a subscription may fall behind
+// before it is ended, so a slow subscriber can't hold up the responses to
+// other requests on its connection.
+const subscriptionQueue = 1024
+
+// errConnLost is wrapped by errors caused by a failed connection, as opposed
+// to errors reported by the daemon. Only the former are worth retrying.
+var errConnLost = errors.New("connection to daemon lost")
+
+// DefaultRequestTimeout bounds how long a request waits for the daemon's
+// response, so a hung daemon surfaces as an error instead of a stuck call.
+const DefaultRequestTimeout = 30 * time.Second
+
+// NewDaemonClient dials the daemon and returns a client. token is the
+// daemon's Token, or empty if it has none.
+func NewDaemonClient(socketPath, token string) (*DaemonClient, error) {
+	dc := &DaemonClient{socketPath: socketPath, token: token, done: make(chan struct{})}
+	if _, err := dc.connection(); err != nil {
 		return nil, err
 	}
 	return dc, nil
 }
 
-// dial connects (or reconnects) to the daemon socket.
-func (dc *DaemonClient) dial() error {
+// connection returns the current connection, dialing a new one if there is
+// none or the last one failed.
+func (dc *DaemonClient) connection() (*daemonConn, error) {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	if dc.conn != nil && dc.conn.alive() {
+		return dc.conn, nil
+	}
 	if dc.conn != nil {
-		dc.conn.Close()
+		dc.conn.conn.Close()
+		dc.conn = nil
+	}
+
+	conn, err := dialDaemon(dc.socketPath)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to daemon: %w", err)
 	}
-	conn, err := net.Dial("unix", dc.socketPath)
+	caps, err := handshake(conn, []string{CapSubscribe}, dc.token)
 	if err != nil {
-		dc.conn = nil
-		dc.enc = nil
-		dc.scanner = nil
-		return fmt.Errorf("connecting to daemon: %w", err)
-	}
-	dc.conn = conn
-	dc.enc = json.NewEncoder(conn)
-	dc.scanner = bufio.NewScanner(conn)
-	dc.scanner.Buffer(make([]byte, 1024*1024), 1024*1024)
-	return nil
+		conn.Close()
+		return nil, err
+	}
+	c := &daemonConn{
+		conn:    conn,
+		caps:    caps,
+		token:   dc.token,
+		enc:     json.NewEncoder(conn),
+		pending: make(map[string]*pendingRequest),
+	}
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 1024*1024), 1024*1024)
+	go c.readLoop(scanner)
+
+	dc.conn = c
+	dc.pingOnce.Do(func() { go dc.pingLoop() })
+	return c, nil
 }
 
-// Close closes the connection to the daemon.
-func (dc *DaemonClient) Close() error {
-	if dc.conn != nil {
-		return dc.conn.Close()
+// helloTimeout bounds the wait for MsgHelloAck. Daemons that predate the
+// handshake never answer, so a timeout means baseline behavior.
+const helloTimeout = 2 * time.Second
+
+// handshake sends MsgHello on a fresh connection and returns the
+// capabilities both sides support. It must run before the caller starts
+// reading from conn.
+func handshake(conn net.Conn, caps []string, token string) ([]string, error) {
+	err := json.NewEncoder(conn).Encode(Envelope{
+		Type:    MsgHello,
+		Token:   token,
+		Payload: mustMarshal(HelloPayload{Version: ProtocolVersion, Capabilities: caps}),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("sending hello: %w", err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(helloTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+	line, err := readLine(conn)
+	if err != nil {
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("reading hello: %w", err)
+	}
+	var resp Envelope
+	if err := json.Unmarshal(line, &resp); err != nil {
+		return nil, fmt.Errorf("parsing hello: %w", err)
+	}
+	switch resp.Type {
+	case MsgHelloAck:
+		var ack HelloPayload
+		json.Unmarshal(resp.Payload, &ack)
+		return ack.Capabilities, nil
+	case MsgError:
+		var ep ErrorPayload
+		json.Unmarshal(resp.Payload, &ep)
+		return nil, fmt.Errorf("handshake rejected: %s", ep.Message)
+	default:
+		return nil, fmt.Errorf("unexpected %s message during handshake", resp.Type)
 	}
-	return nil
 }
 
-// roundTrip sends a request and reads back a single response.
-// On connection failure, it reconnects and retries once.
-func (dc *DaemonClient) roundTrip(req Envelope) (Envelope, error) {
-	dc.mu.Lock()
-	defer dc.mu.Unlock()
+// readLine reads one newline-terminated message a byte at a time, so that
+// nothing past it is consumed before the caller sets up its own scanner.
+func readLine(conn net.Conn) ([]byte, error) {
+	var line []byte
+	b := make([]byte, 1)
+	for {
+		if _, err := conn.Read(b); err != nil {
+			return nil, err
+		}
+		if b[0] == '\n' {
+			return line, nil
+		}
+		line = append(line, b[0])
+	}
+}
 
-	resp, err := dc.doRoundTrip(req)
+// HasCapability reports whether the daemon agreed to an optional protocol
+// feature on the current connection.
+func (dc *DaemonClient) HasCapability(name string) bool {
+	c, err := dc.connection()
 	if err != nil {
-		// Connection may be stale — reconnect and retry once
-		if dialErr := dc.dial(); dialErr != nil {
-			return Envelope{}, fmt.Errorf("reconnect failed: %w (original: %w)", dialErr, err)
+		return false
+	}
+	return slices.Contains(c.caps, name)
+}
+
+// readLoop dispatches responses until the connection fails, then fails all
+// requests still waiting on it.
+func (c *daemonConn) readLoop(scanner *bufio.Scanner) {
+	for scanner.Scan() {
+		var env Envelope
+		if err := json.Unmarshal(scanner.Bytes(), &env); err != nil {
+			continue
+		}
+		if env.Type == MsgShutdown {
+			// The next request reconnects, possibly to a restarted daemon
+			break
+		}
+		c.mu.Lock()
+		p := c.pending[env.RequestID]
+		if env.RequestID == "" && len(c.pending) == 1 {
+			// Daemons that predate request IDs answer in order
+			for _, p = range c.pending {
+			}
+		}
+		c.mu.Unlock()
+		if p == nil {
+			continue
+		}
+		if p.bounded {
+			select {
+			case p.responses <- env:
+			case <-p.done:
+			default:
+				c.drop(p)
+			}
+			continue
+		}
+		select {
+		case p.responses <- env:
+		case <-p.done:
 		}
-		return dc.doRoundTrip(req)
 	}
-	return resp, nil
+
+	err := scanner.Err()
+	if err == nil {
+		err = errors.New("connection closed")
+	}
+	c.fail(err)
+
+	// Only this goroutine sends on responses, so they can be closed now
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for id, p := range c.pending {
+		close(p.responses)
+		delete(c.pending, id)
+	}
 }
 
-// doRoundTrip performs a single send+receive without reconnection.
-func (dc *DaemonClient) doRoundTrip(req Envelope) (Envelope, error) {
-	if dc.enc == nil {
-		return Envelope{}, fmt.Errorf("not connected")
+// drop stops routing responses to p and closes its responses, ending a
+// subscription whose reader fell too far behind. Only readLoop may call it.
+func (c *daemonConn) drop(p *pendingRequest) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.pending[p.id] == p {
+		delete(c.pending, p.id)
+		close(p.responses)
 	}
+}
+
+// fail marks the connection broken and closes it, which ends readLoop.
+func (c *daemonConn) fail(err error) {
+	c.mu.Lock()
+	if c.err == nil {
+		c.err = fmt.Errorf("%w: %w", errConnLost, err)
+	}
+	c.mu.Unlock()
+	c.conn.Close()
+}
+
+func (c *daemonConn) alive() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err == nil
+}
 
-	if err := dc.enc.Encode(req); err != nil {
-		return Envelope{}, fmt.Errorf("sending request: %w", err)
+// start assigns req a RequestID, registers it as pending, and sends it.
+// The send gives up at ctx's deadline, if any, so a daemon that stops
+// reading can't block the caller forever. The caller must call finish
+// when it stops reading responses.
+func (c *daemonConn) start(ctx context.Context, req Envelope) (*pendingRequest, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("sending request: %w", err)
+	}
+	p := &pendingRequest{
+		id:        uuid.NewString(),
+		responses: make(chan Envelope, 1),
+		done:      make(chan struct{}),
+	}
+	if req.Type == MsgSubscribe {
+		p.responses = make(chan Envelope, subscriptionQueue)
+		p.bounded = true
 	}
+	req.RequestID = p.id
+	req.Token = c.token
 
-	if !dc.scanner.Scan() {
-		if err := dc.scanner.Err(); err != nil {
-			return Envelope{}, fmt.Errorf("reading response: %w", err)
+	c.mu.Lock()
+	if c.err != nil {
+		err := c.err
+		c.mu.Unlock()
+		return nil, err
+	}
+	c.pending[p.id] = p
+	deadline, hasDeadline := ctx.Deadline()
+	if hasDeadline {
+		c.conn.SetWriteDeadline(deadline)
+	}
+	err := c.enc.Encode(req)
+	if hasDeadline {
+		c.conn.SetWriteDeadline(time.Time{})
+	}
+	c.mu.Unlock()
+	if err != nil {
+		c.fail(fmt.Errorf("sending request: %w", err))
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			// Out of time: not worth retrying on a new connection
+			return nil, fmt.Errorf("sending request: %w", context.DeadlineExceeded)
 		}
-		return Envelope{}, fmt.Errorf("connection closed")
+		return nil, fmt.Errorf("%w: sending request: %w", errConnLost, err)
 	}
+	return p, nil
+}
 
-	var resp Envelope
-	if err := json.Unmarshal(dc.scanner.Bytes(), &resp); err != nil {
-		return Envelope{}, fmt.Errorf("parsing response: %w", err)
+// finish stops routing responses to p.
+func (c *daemonConn) finish(p *pendingRequest) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.pending[p.id]; ok {
+		delete(c.pending, p.id)
+		close(p.done)
 	}
+}
 
+// next waits for the next response to p, turning MsgError into an error.
+// If ctx is done first, it gives up; a late response is discarded by the
+// reader once the caller finishes p.
+func (c *daemonConn) next(ctx context.Context, p *pendingRequest) (Envelope, error) {
+	var resp Envelope
+	var ok bool
+	select {
+	case resp, ok = <-p.responses:
+	case <-ctx.Done():
+		return Envelope{}, fmt.Errorf("waiting for daemon response: %w", ctx.Err())
+	}
+	if !ok {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return Envelope{}, c.err
+	}
 	if resp.Type == MsgError {
 		var ep ErrorPayload
 		json.Unmarshal(resp.Payload, &ep)
 		return Envelope{}, fmt.Errorf("%s", ep.Message)
 	}
-
 	return resp, nil
 }
 
+// pingLoop pings the daemon every DefaultPingInterval so a dead connection
+// is noticed and replaced before the next request needs it.
+func (dc *DaemonClient) pingLoop() {
+	ticker := time.NewTicker(DefaultPingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-dc.done:
+			return
+		case <-ticker.C:
+		}
+		c, err := dc.connection()
+		if err != nil {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), DefaultPingTimeout)
+		p, err := c.start(ctx, Envelope{Type: MsgPing})
+		if err != nil {
+			cancel()
+			dc.connection()
+			continue
+		}
+		select {
+		case _, ok := <-p.responses:
+			if !ok {
+				dc.connection()
+			}
+		case <-ctx.Done():
+			c.fail(errors.New("ping timed out"))
+			dc.connection()
+		}
+		cancel()
+		c.finish(p)
+	}
+}
+
+// Close closes the connection to the daemon.
+func (dc *DaemonClient) Close() error {
+	dc.closeOnce.Do(func() { close(dc.done) })
+	dc.mu.Lock()
+	c := dc.conn
+	dc.mu.Unlock()
+	if c != nil {
+		return c.conn.Close()
+	}
+	return nil
+}
+
+// alive reports whether the client's connection is still usable.
+func (dc *DaemonClient) alive() bool {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	return dc.conn != nil && dc.conn.alive()
+}
+
+// DefaultMaxDaemonConns is the number of connections a DaemonClientPool
+// opens if not told otherwise.
+const DefaultMaxDaemonConns = 4
+
+// DaemonClientPool hands out DaemonClients, each with its own connection,
+// up to MaxConns at a time. One DaemonClient can carry concurrent requests,
+// but the daemon handles the requests on a connection in order, so a slow
+// regex search would hold up everything behind it. Callers that may run
+// concurrently, like MCP tool calls, check a client out instead.
+type DaemonClientPool struct {
+	socketPath string
+	token      string
+	slots      chan struct{} // holds a token per checked-out client
+
+	mu     sync.Mutex // protects idle and closed
+	idle   []*DaemonClient
+	closed bool
+	done   chan struct{} // closed by Close
+}
+
+// NewDaemonClientPool returns a pool of up to maxConns clients, or
+// DefaultMaxDaemonConns if maxConns is not positive. It dials the first
+// client right away, so an unreachable daemon is reported here.
+func NewDaemonClientPool(socketPath, token string, maxConns int) (*DaemonClientPool, error) {
+	if maxConns <= 0 {
+		maxConns = DefaultMaxDaemonConns
+	}
+	dc, err := NewDaemonClient(socketPath, token)
+	if err != nil {
+		return nil, err
+	}
+	return &DaemonClientPool{
+		socketPath: socketPath,
+		token:      token,
+		slots:      make(chan struct{}, maxConns),
+		idle:       []*DaemonClient{dc},
+		done:       make(chan struct{}),
+	}, nil
+}
+
+// MaxConns returns the most clients the pool hands out at once.
+func (p *DaemonClientPool) MaxConns() int {
+	return cap(p.slots)
+}
+
+// Get checks out an idle client, dialing a new one if there is none. If
+// MaxConns clients are checked out, it waits for one to be put back or for
+// ctx to be done. The caller must Put the client back when finished.
+func (p *DaemonClientPool) Get(ctx context.Context) (*DaemonClient, error) {
+	select {
+	case p.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, fmt.Errorf("waiting for a daemon connection: %w", ctx.Err())
+	}
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		<-p.slots
+		return nil, errors.New("daemon client pool closed")
+	}
+	if n := len(p.idle); n > 0 {
+		dc := p.idle[n-1]
+		p.idle = p.idle[:n-1]
+		p.mu.Unlock()
+		return dc, nil
+	}
+	p.mu.Unlock()
+
+	dc, err := NewDaemonClient(p.socketPath, p.token)
+	if err != nil {
+		<-p.slots
+		return nil, err
+	}
+	return dc, nil
+}
+
+// Put returns a client checked out by Get. A client whose connection has
+// failed is closed rather than kept, so the next Get dials a fresh one.
+func (p *DaemonClientPool) Put(dc *DaemonClient) {
+	p.mu.Lock()
+	if p.closed || !dc.alive() {
+		p.mu.Unlock()
+		dc.Close()
+	} else {
+		p.idle = append(p.idle, dc)
+		p.mu.Unlock()
+	}
+	<-p.slots
+}
+
+// Close closes the idle clients. Clients still checked out are closed when
+// they are put back.
+func (p *DaemonClientPool) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.closed {
+		close(p.done)
+	}
+	p.closed = true
+	var errs []error
+	for _, dc := range p.idle {
+		errs = append(errs, dc.Close())
+	}
+	p.idle = nil
+	return errors.Join(errs...)
+}
+
+// roundTrip sends a request and waits for its response, for at most
+// DefaultRequestTimeout unless ctx has an earlier deadline.
+// If the connection has failed, it reconnects and retries once, unless
+// ctx is already done.
+func (dc *DaemonClient) roundTrip(ctx context.Context, req Envelope) (Envelope, error) {
+	ctx, cancel := context.WithTimeout(ctx, DefaultRequestTimeout)
+	defer cancel()
+	resp, err := dc.doRoundTrip(ctx, req)
+	if errors.Is(err, errConnLost) && ctx.Err() == nil {
+		// Connection may be stale — reconnect and retry once
+		resp, err = dc.doRoundTrip(ctx, req)
+	}
+	return resp, err
+}
+
+// start sends a request whose responses the caller reads with next,
+// reconnecting and retrying once if the connection has failed.
+func (dc *DaemonClient) start(ctx context.Context, req Envelope) (*daemonConn, *pendingRequest, error) {
+	c, err := dc.connection()
+	if err != nil {
+		return nil, nil, err
+	}
+	p, err := c.start(ctx, req)
+	if errors.Is(err, errConnLost) && ctx.Err() == nil {
+		// Connection may be stale — reconnect and retry once
+		if c, err = dc.connection(); err != nil {
+			return nil, nil, err
+		}
+		p, err = c.start(ctx, req)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return c, p, nil
+}
+
+// doRoundTrip performs a single send+receive without retrying.
+func (dc *DaemonClient) doRoundTrip(ctx context.Context, req Envelope) (Envelope, error) {
+	c, err := dc.connection()
+	if err != nil {
+		return Envelope{}, err
+	}
+	p, err := c.start(ctx, req)
+	if err != nil {
+		return Envelope{}, err
+	}
+	defer c.finish(p)
+	return c.next(ctx, p)
+}
+
 // ListSessions returns all sessions from the daemon.
-func (dc *DaemonClient) ListSessions() ([]SessionInfo, error) {
-	resp, err := dc.roundTrip(Envelope{Type: MsgListSessions})
+func (dc *DaemonClient) ListSessions(ctx context.Context, p ListSessionsPayload) ([]SessionInfo, error) {
+	resp, err := dc.roundTrip(ctx, Envelope{
+		Type:    MsgListSessions,
+		Payload: mustMarshal(p),
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -116,8 +574,8 @@ func (dc *DaemonClient) ListSessions() ([]SessionInfo, error) {
 }
 
 // QuerySession queries a specific session on the daemon.
-func (dc *DaemonClient) QuerySession(p QuerySessionPayload) (*QuerySessionResponse, error) {
-	resp, err := dc.roundTrip(Envelope{
+func (dc *DaemonClient) QuerySession(ctx context.Context, p QuerySessionPayload) (*QuerySessionResponse, error) {
+	resp, err := dc.roundTrip(ctx, Envelope{
 		Type:    MsgQuerySession,
 		Payload: mustMarshal(p),
 	})
@@ -131,9 +589,25 @@ func (dc *DaemonClient) QuerySession(p QuerySessionPayload) (*QuerySessionRespon
 	return &result, nil
 }
 
+// SearchAll searches the output of every session on the daemon.
+func (dc *DaemonClient) SearchAll(ctx context.Context, p SearchAllPayload) (*SearchAllResponse, error) {
+	resp, err := dc.roundTrip(ctx, Envelope{
+		Type:    MsgSearchAll,
+		Payload: mustMarshal(p),
+	})
+	if err != nil {
+		return nil, err
+	}
+	var result SearchAllResponse
+	if err := json.Unmarshal(resp.Payload, &result); err != nil {
+		return nil, fmt.Errorf("parsing search response: %w", err)
+	}
+	return &result, nil
+}
+
 // WriteSession sends input to a collaborative session via the daemon.
-func (dc *DaemonClient) WriteSession(p WriteSessionPayload) (*WriteSessionResponse, error) {
-	resp, err := dc.roundTrip(Envelope{
+func (dc *DaemonClient) WriteSession(ctx context.Context, p WriteSessionPayload) (*WriteSessionResponse, error) {
+	resp, err := dc.roundTrip(ctx, Envelope{
 		Type:    MsgWriteSession,
 		Payload: mustMarshal(p),
 	})
@@ -146,3 +620,358 @@ func (dc *DaemonClient) WriteSession(p WriteSessionPayload) (*WriteSessionRespon
 	}
 	return &result, nil
 }
+
+// KillSession terminates a session on the daemon.
+func (dc *DaemonClient) KillSession(ctx context.Context, session string) (*KillSessionResponse, error) {
+	resp, err := dc.roundTrip(ctx, Envelope{
+		Type:    MsgKillSession,
+		Payload: mustMarshal(KillSessionPayload{Session: session}),
+	})
+	if err != nil {
+		return nil, err
+	}
+	var result KillSessionResponse
+	if err := json.Unmarshal(resp.Payload, &result); err != nil {
+		return nil, fmt.Errorf("parsing kill response: %w", err)
+	}
+	return &result, nil
+}
+
+// DeleteSession removes a session and its output from the daemon without
+// signaling its shell. A connected session is only deleted with p.Force.
+func (dc *DaemonClient) DeleteSession(ctx context.Context, p DeleteSessionPayload) (*DeleteSessionResponse, error) {
+	resp, err := dc.roundTrip(ctx, Envelope{
+		Type:    MsgDeleteSession,
+		Payload: mustMarshal(p),
+	})
+	if err != nil {
+		return nil, err
+	}
+	var result DeleteSessionResponse
+	if err := json.Unmarshal(resp.Payload, &result); err != nil {
+		return nil, fmt.Errorf("parsing delete response: %w", err)
+	}
+	return &result, nil
+}
+
+// SpawnSession asks the daemon to start a shell of its own in a new
+// session. The daemon must allow spawning.
+func (dc *DaemonClient) SpawnSession(ctx context.Context, p SpawnPayload) (*RegisterAck, error) {
+	resp, err := dc.roundTrip(ctx, Envelope{
+		Type:    MsgSpawnSession,
+		Payload: mustMarshal(p),
+	})
+	if err != nil {
+		return nil, err
+	}
+	var result RegisterAck
+	if err := json.Unmarshal(resp.Payload, &result); err != nil {
+		return nil, fmt.Errorf("parsing spawn response: %w", err)
+	}
+	return &result, nil
+}
+
+// SendSignal sends a signal to the foreground process of a collaborative
+// session.
+func (dc *DaemonClient) SendSignal(ctx context.Context, p SendSignalPayload) (*SendSignalResponse, error) {
+	resp, err := dc.roundTrip(ctx, Envelope{
+		Type:    MsgSendSignal,
+		Payload: mustMarshal(p),
+	})
+	if err != nil {
+		return nil, err
+	}
+	var result SendSignalResponse
+	if err := json.Unmarshal(resp.Payload, &result); err != nil {
+		return nil, fmt.Errorf("parsing send signal response: %w", err)
+	}
+	return &result, nil
+}
+
+// GetEnvironment returns the environment a session's shell started with.
+func (dc *DaemonClient) GetEnvironment(ctx context.Context, p GetEnvironmentPayload) (*GetEnvironmentResponse, error) {
+	resp, err := dc.roundTrip(ctx, Envelope{
+		Type:    MsgGetEnvironment,
+		Payload: mustMarshal(p),
+	})
+	if err != nil {
+		return nil, err
+	}
+	var result GetEnvironmentResponse
+	if err := json.Unmarshal(resp.Payload, &result); err != nil {
+		return nil, fmt.Errorf("parsing environment response: %w", err)
+	}
+	return &result, nil
+}
+
+// RenameSession changes a session's title on the daemon.
+func (dc *DaemonClient) RenameSession(ctx context.Context, p RenameSessionPayload) (*RenameSessionResponse, error) {
+	resp, err := dc.roundTrip(ctx, Envelope{
+		Type:    MsgRename,
+		Payload: mustMarshal(p),
+	})
+	if err != nil {
+		return nil, err
+	}
+	var result RenameSessionResponse
+	if err := json.Unmarshal(resp.Payload, &result); err != nil {
+		return nil, fmt.Errorf("parsing rename response: %w", err)
+	}
+	return &result, nil
+}
+
+// ResizeBuffer changes a session's buffer capacity on the daemon.
+func (dc *DaemonClient) ResizeBuffer(ctx context.Context, p ResizeBufferPayload) (*ResizeBufferResponse, error) {
+	resp, err := dc.roundTrip(ctx, Envelope{
+		Type:    MsgResizeBuffer,
+		Payload: mustMarshal(p),
+	})
+	if err != nil {
+		return nil, err
+	}
+	var result ResizeBufferResponse
+	if err := json.Unmarshal(resp.Payload, &result); err != nil {
+		return nil, fmt.Errorf("parsing resize buffer response: %w", err)
+	}
+	return &result, nil
+}
+
+// SessionInfo returns the full metadata of one session.
+func (dc *DaemonClient) SessionInfo(ctx context.Context, session string) (*SessionDetails, error) {
+	resp, err := dc.roundTrip(ctx, Envelope{
+		Type:    MsgSessionInfo,
+		Payload: mustMarshal(SessionInfoPayload{Session: session}),
+	})
+	if err != nil {
+		return nil, err
+	}
+	var result SessionDetails
+	if err := json.Unmarshal(resp.Payload, &result); err != nil {
+		return nil, fmt.Errorf("parsing session info response: %w", err)
+	}
+	return &result, nil
+}
+
+// GetSessionStats returns a session's buffer utilization and throughput.
+func (dc *DaemonClient) GetSessionStats(ctx context.Context, session string) (*SessionStats, error) {
+	resp, err := dc.roundTrip(ctx, Envelope{
+		Type:    MsgQueryStats,
+		Payload: mustMarshal(QueryStatsPayload{Session: session}),
+	})
+	if err != nil {
+		return nil, err
+	}
+	var result SessionStats
+	if err := json.Unmarshal(resp.Payload, &result); err != nil {
+		return nil, fmt.Errorf("parsing session stats response: %w", err)
+	}
+	return &result, nil
+}
+
+// CommandHistory returns the most recent commands run in a session.
+func (dc *DaemonClient) CommandHistory(ctx context.Context, p CommandHistoryPayload) (*CommandHistoryResponse, error) {
+	resp, err := dc.roundTrip(ctx, Envelope{
+		Type:    MsgCommandHistory,
+		Payload: mustMarshal(p),
+	})
+	if err != nil {
+		return nil, err
+	}
+	var result CommandHistoryResponse
+	if err := json.Unmarshal(resp.Payload, &result); err != nil {
+		return nil, fmt.Errorf("parsing command history response: %w", err)
+	}
+	return &result, nil
+}
+
+// SetQuiesced enables or disables quiesce mode on the daemon and returns the
+// resulting state.
+func (dc *DaemonClient) SetQuiesced(ctx context.Context, quiesced bool) (bool, error) {
+	typ := MsgUnquiesce
+	if quiesced {
+		typ = MsgQuiesce
+	}
+	resp, err := dc.roundTrip(ctx, Envelope{Type: typ})
+	if err != nil {
+		return false, err
+	}
+	var result QuiesceResponse
+	if err := json.Unmarshal(resp.Payload, &result); err != nil {
+		return false, fmt.Errorf("parsing quiesce response: %w", err)
+	}
+	return result.Quiesced, nil
+}
+
+// ExportSession streams a session's entire buffer to w in ep.Format, one
+// newline-terminated line per buffered line, without holding the whole
+// buffer in memory.
+func (dc *DaemonClient) ExportSession(ctx context.Context, ep ExportSessionPayload, w io.Writer) error {
+	c, p, err := dc.start(ctx, Envelope{
+		Type:    MsgExportSession,
+		Payload: mustMarshal(ep),
+	})
+	if err != nil {
+		return err
+	}
+	defer c.finish(p)
+
+	for {
+		env, err := c.next(ctx, p)
+		if err != nil {
+			return err
+		}
+		switch env.Type {
+		case MsgExportChunk:
+			var chunk ExportChunkPayload
+			json.Unmarshal(env.Payload, &chunk)
+			if _, err := io.WriteString(w, chunk.Data); err != nil {
+				// The reader discards the remaining chunks once p is finished
+				return err
+			}
+		case MsgAck:
+			return nil
+		}
+	}
+}
+
+// Subscribe streams a session's events: output lines as they are appended,
+// plus connects, disconnects, and commands. Retained lines selected by
+// sp.FromSeq or sp.LastN are replayed first. Output lines arrive
+// in order, but not necessarily in order relative to the other events.
+// Events share dc's connection with other requests, so the caller should
+// keep draining the channel: the subscription ends if it falls
+// subscriptionQueue events behind. The returned channel is closed when ctx
+// is cancelled, the session expires, the subscription falls behind, or the
+// connection fails.
+func (dc *DaemonClient) Subscribe(ctx context.Context, sp SubscribePayload) (<-chan EventPayload, error) {
+	if !dc.HasCapability(CapSubscribe) {
+		return nil, fmt.Errorf("daemon does not support subscribe; upgrade streamshd")
+	}
+	c, p, err := dc.start(ctx, Envelope{
+		Type:    MsgSubscribe,
+		Payload: mustMarshal(sp),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := c.next(ctx, p); err != nil {
+		c.finish(p)
+		return nil, err
+	}
+
+	ch := make(chan EventPayload, 64)
+	go func() {
+		defer close(ch)
+		// Stop routing events before unsubscribing, so the reader is
+		// never stuck delivering to this goroutine while it waits
+		defer c.unsubscribe(p)
+		for {
+			var env Envelope
+			var ok bool
+			select {
+			case env, ok = <-p.responses:
+			case <-ctx.Done():
+				return
+			}
+			if !ok || env.Type == MsgExpired {
+				return
+			}
+			if env.Type != MsgEvent {
+				continue
+			}
+			var ev EventPayload
+			json.Unmarshal(env.Payload, &ev)
+			select {
+			case ch <- ev:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
+
+// unsubscribe ends the subscription started by p.
+func (c *daemonConn) unsubscribe(p *pendingRequest) {
+	c.finish(p)
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultRequestTimeout)
+	defer cancel()
+	req, err := c.start(ctx, Envelope{
+		Type:    MsgUnsubscribe,
+		Payload: mustMarshal(UnsubscribePayload{SubscriptionID: p.id}),
+	})
+	if err != nil {
+		return
+	}
+	c.next(ctx, req)
+	c.finish(req)
+}
+
+// WaitForPattern polls a session's output every interval, from sequence
+// number fromSeq on, until a line satisfies match, and returns that line.
+// It returns ctx's error once ctx is done.
+func (dc *DaemonClient) WaitForPattern(ctx context.Context, session string, fromSeq uint64, interval time.Duration, match func(string) bool) (*SearchResult, error) {
+	return pollForPattern(ctx, dc.QuerySession, session, fromSeq, interval, match)
+}
+
+// pollForPattern is WaitForPattern, reading the session with query.
+func pollForPattern(ctx context.Context, query func(context.Context, QuerySessionPayload) (*QuerySessionResponse, error), session string, fromSeq uint64, interval time.Duration, match func(string) bool) (*SearchResult, error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	cursor := fromSeq
+	for {
+		resp, err := query(ctx, QuerySessionPayload{Session: session, Cursor: cursor, Count: 1000})
+		if err != nil {
+			return nil, err
+		}
+		// The lines run up to NextCursor without gaps
+		first := resp.NextCursor - uint64(len(resp.Lines))
+		for i, line := range resp.Lines {
+			if match(line) {
+				return &SearchResult{Seq: first + uint64(i), Line: line}, nil
+			}
+		}
+		if len(resp.Lines) > 0 {
+			cursor = resp.NextCursor
+		}
+		if resp.HasMore {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// TailSession streams a session's output to fn until ctx is cancelled or
+// the session expires. Lines from fromCursor on, e.g. the NextCursor of the
+// last query_session, are sent first so nothing between polling and tailing
+// is missed; nil means only new output. fn is called with each batch of
+// lines and the cursor to resume from. The error is non-nil only if the
+// tail could not be started.
+func (dc *DaemonClient) TailSession(ctx context.Context, session string, fromCursor *uint64, fn func(lines []string, cursor uint64)) error {
+	events, err := dc.Subscribe(ctx, SubscribePayload{Session: session, FromSeq: fromCursor})
+	if err != nil {
+		return err
+	}
+
+	var cursor uint64
+	if fromCursor != nil {
+		cursor = *fromCursor
+	}
+	for ev := range events {
+		if ev.Kind != "" || len(ev.Lines) == 0 {
+			continue
+		}
+		if len(ev.Seqs) == len(ev.Lines) {
+			cursor = ev.Seqs[len(ev.Seqs)-1] + 1
+		} else {
+			cursor += uint64(len(ev.Lines))
+		}
+		fn(ev.Lines, cursor)
+	}
+	return nil
+}
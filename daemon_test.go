@@ -0,0 +1,1702 @@
+package streamsh
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// startTestDaemon runs a daemon on a socket in a temp directory. Each
+// configure func is applied to the daemon before it starts listening.
+func startTestDaemon(t *testing.T, configure ...func(*Daemon)) (*Daemon, string) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	d := &Daemon{
+		Store:  NewStore(),
+		Logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+	for _, f := range configure {
+		f(d)
+	}
+	sock := filepath.Join(t.TempDir(), "streamsh.sock")
+	if err := d.Listen(ctx, sock); err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() {
+		cancel()
+		d.Close()
+	})
+	return d, sock
+}
+
+// testConn is a raw protocol connection to a test daemon.
+type testConn struct {
+	net.Conn
+	enc     *json.Encoder
+	scanner *bufio.Scanner
+}
+
+func dialTestDaemon(t *testing.T, sock string) *testConn {
+	t.Helper()
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &testConn{Conn: conn, enc: json.NewEncoder(conn), scanner: bufio.NewScanner(conn)}
+}
+
+func (c *testConn) send(t *testing.T, typ MsgType, payload any) {
+	t.Helper()
+	if err := c.trySend(typ, payload); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// trySend is like send, but returns the error, for use off the test's
+// goroutine.
+func (c *testConn) trySend(typ MsgType, payload any) error {
+	if err := c.enc.Encode(Envelope{Type: typ, Payload: mustMarshal(payload)}); err != nil {
+		return fmt.Errorf("send %s: %w", typ, err)
+	}
+	return nil
+}
+
+func (c *testConn) recv(t *testing.T) Envelope {
+	t.Helper()
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if !c.scanner.Scan() {
+		t.Fatalf("recv: %v", c.scanner.Err())
+	}
+	var env Envelope
+	if err := json.Unmarshal(c.scanner.Bytes(), &env); err != nil {
+		t.Fatalf("recv: %v", err)
+	}
+	return env
+}
+
+// registerTestSession registers a session and returns its connection and ack.
+func registerTestSession(t *testing.T, sock string, p RegisterPayload) (*testConn, RegisterAck) {
+	t.Helper()
+	c := dialTestDaemon(t, sock)
+	c.send(t, MsgRegister, p)
+	env := c.recv(t)
+	if env.Type != MsgAck {
+		t.Fatalf("register: got %s: %s", env.Type, env.Payload)
+	}
+	var ack RegisterAck
+	json.Unmarshal(env.Payload, &ack)
+	return c, ack
+}
+
+func TestDaemonTailSession(t *testing.T) {
+	_, sock := startTestDaemon(t)
+	client, ack := registerTestSession(t, sock, RegisterPayload{Title: "tail-test"})
+	client.send(t, MsgOutput, OutputPayload{Lines: []string{"old", "missed"}})
+
+	dc, err := NewDaemonClient(sock, "")
+	if err != nil {
+		t.Fatalf("daemon client: %v", err)
+	}
+	defer dc.Close()
+
+	// Tailing from cursor 1 picks up the line after the last poll
+	from := uint64(1)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	lines := make(chan string, 10)
+	var cursor atomic.Uint64
+	errc := make(chan error, 1)
+	go func() {
+		errc <- dc.TailSession(ctx, ack.ShortID, &from, func(batch []string, next uint64) {
+			for _, line := range batch {
+				lines <- line
+			}
+			cursor.Store(next)
+		})
+	}()
+
+	client.send(t, MsgOutput, OutputPayload{Lines: []string{"\x1b[31mbuild failed\x1b[0m", "exit 1"}})
+	for _, want := range []string{"missed", "build failed", "exit 1"} {
+		select {
+		case got := <-lines:
+			if got != want {
+				t.Errorf("got %q, want %q", got, want)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timed out waiting for %q", want)
+		}
+	}
+	waitFor(t, func() bool { return cursor.Load() == 4 })
+
+	cancel()
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Errorf("tail returned %v after cancel", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("tail did not return after cancel")
+	}
+
+	if err := dc.TailSession(context.Background(), "nonexistent", nil, func([]string, uint64) {}); err == nil {
+		t.Error("expected error tailing unknown session")
+	}
+}
+
+func TestDaemonClientWaitForPattern(t *testing.T) {
+	_, sock := startTestDaemon(t)
+	client, ack := registerTestSession(t, sock, RegisterPayload{Title: "server"})
+	client.send(t, MsgOutput, OutputPayload{Lines: []string{"listening on :8080", "GET /"}})
+
+	dc, err := NewDaemonClient(sock, "")
+	if err != nil {
+		t.Fatalf("daemon client: %v", err)
+	}
+	defer dc.Close()
+
+	// Output before fromSeq doesn't count, so this waits for the restart
+	sent := make(chan error, 1)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		sent <- client.trySend(MsgOutput, OutputPayload{Lines: []string{"restarting", "Listening on :8081"}})
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	got, err := dc.WaitForPattern(ctx, ack.ShortID, 1, 20*time.Millisecond, SubstringMatcher("listening on"))
+	if err := <-sent; err != nil {
+		t.Fatal(err)
+	}
+	if err != nil {
+		t.Fatalf("wait: %v", err)
+	}
+	if got.Seq != 3 || got.Line != "Listening on :8081" {
+		t.Errorf("matched %+v, want seq 3", got)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := dc.WaitForPattern(ctx, ack.ShortID, 4, 20*time.Millisecond, SubstringMatcher("listening on")); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("wait without a match: err = %v, want deadline exceeded", err)
+	}
+
+	// wait_for_pattern checks a client out per poll, so even a pool of
+	// one serves other requests while it waits
+	pool, err := NewDaemonClientPool(sock, "", 1)
+	if err != nil {
+		t.Fatalf("daemon client pool: %v", err)
+	}
+	defer pool.Close()
+	res, err := waitForPattern(context.Background(), pool, WaitForPatternInput{Session: "server", Pattern: `^GET /$`, UseRegex: true, TimeoutS: 1})
+	if err != nil || res.Seq == nil || *res.Seq != 1 || res.TimedOut {
+		t.Errorf("wait_for_pattern = %+v, %v", res, err)
+	}
+	waited := make(chan error, 1)
+	go func() {
+		_, err := waitForPattern(context.Background(), pool, WaitForPatternInput{Session: "server", Pattern: "never printed", TimeoutS: 1, PollIntervalMs: 50})
+		waited <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	getCtx, cancelGet := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancelGet()
+	if pdc, err := pool.Get(getCtx); err != nil {
+		t.Errorf("pool exhausted while waiting for a pattern: %v", err)
+	} else {
+		pool.Put(pdc)
+	}
+	if err := <-waited; err != nil {
+		t.Errorf("wait_for_pattern without a match: %v", err)
+	}
+	if _, err := waitForPattern(context.Background(), pool, WaitForPatternInput{Session: "server", Pattern: "(", UseRegex: true}); err == nil {
+		t.Error("expected error for an invalid regex")
+	}
+}
+
+func TestDaemonExportSession(t *testing.T) {
+	d, sock := startTestDaemon(t)
+	_, ack := registerTestSession(t, sock, RegisterPayload{Title: "export-test"})
+
+	sess, _ := d.Store.Resolve(ack.ShortID)
+	var want bytes.Buffer
+	for i := range 5000 {
+		line := fmt.Sprintf("line %d %s", i, bytes.Repeat([]byte("x"), 40))
+		sess.Buffer.Append(line)
+		want.WriteString(line + "\n")
+	}
+
+	dc, err := NewDaemonClient(sock, "")
+	if err != nil {
+		t.Fatalf("daemon client: %v", err)
+	}
+	defer dc.Close()
+
+	var got bytes.Buffer
+	if err := dc.ExportSession(t.Context(), ExportSessionPayload{Session: ack.ShortID}, &got); err != nil {
+		t.Fatalf("export: %v", err)
+	}
+	if got.String() != want.String() {
+		t.Errorf("export mismatch: got %d bytes, want %d", got.Len(), want.Len())
+	}
+
+	// The connection remains usable for regular requests
+	if _, err := dc.ListSessions(t.Context(), ListSessionsPayload{}); err != nil {
+		t.Errorf("list after export: %v", err)
+	}
+	if err := dc.ExportSession(t.Context(), ExportSessionPayload{Session: "nonexistent"}, &got); err == nil {
+		t.Error("expected error exporting unknown session")
+	}
+	if err := dc.ExportSession(t.Context(), ExportSessionPayload{Session: ack.ShortID, Format: "csv"}, &got); err == nil {
+		t.Error("expected error for an unknown format")
+	}
+
+	got.Reset()
+	if err := dc.ExportSession(t.Context(), ExportSessionPayload{Session: ack.ShortID, Format: "jsonl"}, &got); err != nil {
+		t.Fatalf("export jsonl: %v", err)
+	}
+	lines := strings.Split(strings.TrimSuffix(got.String(), "\n"), "\n")
+	var last SearchResult
+	if err := json.Unmarshal([]byte(lines[len(lines)-1]), &last); err != nil || len(lines) != 5000 || last.Seq != 4999 {
+		t.Errorf("jsonl export: %d lines, last %+v (%v)", len(lines), last, err)
+	}
+}
+
+func TestDaemonReconnectMergesReplay(t *testing.T) {
+	d, sock := startTestDaemon(t)
+	id := uuid.New()
+	client, ack := registerTestSession(t, sock, RegisterPayload{Title: "merge-test", SessionID: id.String()})
+	if ack.ResumeSeq != 0 {
+		t.Errorf("new session ResumeSeq = %d, want 0", ack.ResumeSeq)
+	}
+	client.send(t, MsgOutput, OutputPayload{Lines: []string{"one", "two"}})
+	sess, _ := d.Store.Get(id)
+	waitFor(t, func() bool { return sess.Buffer.TotalSeq() == 2 })
+	client.Close()
+
+	// The client missed nothing the daemon has, and replays from the start
+	// of its own buffer; the overlap must not be duplicated.
+	client, ack = registerTestSession(t, sock, RegisterPayload{Title: "merge-test", SessionID: id.String()})
+	if ack.ResumeSeq != 2 {
+		t.Errorf("reconnect ResumeSeq = %d, want 2", ack.ResumeSeq)
+	}
+	client.send(t, MsgReplay, ReplayPayload{Lines: []string{"one", "two", "three"}})
+	waitFor(t, func() bool { return sess.Buffer.TotalSeq() == 3 })
+	if got := fmt.Sprint(sess.Buffer.AllLines()); got != "[one two three]" {
+		t.Errorf("after replay got %s", got)
+	}
+}
+
+func TestDaemonReconnectDedup(t *testing.T) {
+	d, sock := startTestDaemon(t)
+	id := uuid.New()
+	client, _ := registerTestSession(t, sock, RegisterPayload{Title: "dedup", SessionID: id.String(), Dedup: true})
+	client.send(t, MsgOutput, OutputPayload{Lines: []string{"tick", "tick", "done"}})
+	sess, _ := d.Store.Get(id)
+	waitFor(t, func() bool { return sess.Buffer.TotalSeq() == 2 })
+	client.Close()
+
+	// The client's buffer, deduplicated alike, saw more while disconnected:
+	// tick (x2), done, poll (x3). Replayed lines keep the client's numbering,
+	// so later repeats still land on the same seq in both.
+	client, ack := registerTestSession(t, sock, RegisterPayload{Title: "dedup", SessionID: id.String(), Dedup: true})
+	if ack.ResumeSeq != 2 {
+		t.Errorf("reconnect ResumeSeq = %d, want 2", ack.ResumeSeq)
+	}
+	client.send(t, MsgReplay, ReplayPayload{Lines: []string{"tick", "done", "poll"}, Repeats: []int{2, 1, 3}})
+	client.send(t, MsgOutput, OutputPayload{Lines: []string{"poll"}})
+	waitFor(t, func() bool { return strings.HasSuffix(fmt.Sprint(sess.Buffer.AllLines()), "(x4)]") })
+	if got := sess.Buffer.TotalSeq(); got != 3 {
+		t.Errorf("TotalSeq = %d, want 3 as in the client", got)
+	}
+	if got := fmt.Sprint(sess.Buffer.AllLines()); got != "[tick (x2) done poll (x4)]" {
+		t.Errorf("after replay got %s", got)
+	}
+}
+
+func TestDaemonReconnectKeepsHistory(t *testing.T) {
+	d, sock := startTestDaemon(t)
+	id := uuid.New()
+	client, _ := registerTestSession(t, sock, RegisterPayload{Title: "keep", SessionID: id.String()})
+	client.send(t, MsgOutput, OutputPayload{Lines: []string{"one", "two"}})
+	sess, _ := d.Store.Get(id)
+	waitFor(t, func() bool { return sess.Buffer.TotalSeq() == 2 })
+	client.Close()
+
+	// A client that dies before replaying anything loses nothing.
+	client, _ = registerTestSession(t, sock, RegisterPayload{Title: "keep", SessionID: id.String()})
+	client.Close()
+	waitFor(t, func() bool { return !sess.Connected() })
+	if got := fmt.Sprint(sess.Buffer.AllLines()); got != "[one two]" {
+		t.Errorf("after aborted reconnect got %s", got)
+	}
+
+	// A client whose own buffer no longer reaches back to what the daemon
+	// has leaves a marker for the gap, and the daemon keeps its history.
+	client, _ = registerTestSession(t, sock, RegisterPayload{Title: "keep", SessionID: id.String()})
+	client.send(t, MsgReplay, ReplayPayload{Lines: []string{"six", "seven"}, FromSeq: 6})
+	waitFor(t, func() bool { return sess.Buffer.TotalSeq() == 5 })
+	want := "[one two [streamsh: 4 lines lost while disconnected] six seven]"
+	if got := fmt.Sprint(sess.Buffer.AllLines()); got != want {
+		t.Errorf("after gap got %s, want %s", got, want)
+	}
+	client.Close()
+	waitFor(t, func() bool { return !sess.Connected() })
+
+	// The next reconnect resumes in the client's numbering, so lines it
+	// replays again are still skipped
+	client, ack := registerTestSession(t, sock, RegisterPayload{Title: "keep", SessionID: id.String()})
+	if ack.ResumeSeq != 8 {
+		t.Errorf("after gap ResumeSeq = %d, want 8", ack.ResumeSeq)
+	}
+	client.send(t, MsgReplay, ReplayPayload{Lines: []string{"seven", "eight"}, FromSeq: 7})
+	waitFor(t, func() bool { return sess.Buffer.TotalSeq() == 6 })
+	want = "[one two [streamsh: 4 lines lost while disconnected] six seven eight]"
+	if got := fmt.Sprint(sess.Buffer.AllLines()); got != want {
+		t.Errorf("after second replay got %s, want %s", got, want)
+	}
+}
+
+// waitFor polls cond until it holds or two seconds pass.
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for condition")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestDaemonTailSessionExpired(t *testing.T) {
+	d, sock := startTestDaemon(t)
+	client, ack := registerTestSession(t, sock, RegisterPayload{Title: "expire-test"})
+
+	dc, err := NewDaemonClient(sock, "")
+	if err != nil {
+		t.Fatalf("daemon client: %v", err)
+	}
+	defer dc.Close()
+	done := make(chan error, 1)
+	go func() {
+		done <- dc.TailSession(context.Background(), ack.ShortID, nil, func([]string, uint64) {})
+	}()
+
+	sess, _ := d.Store.Resolve(ack.ShortID)
+	waitFor(t, func() bool { return d.Store.watching(sess.ID) > 0 })
+	client.Close()
+	waitFor(t, func() bool { return !sess.Connected() })
+	sess.mu.Lock()
+	sess.lastActivity = time.Now().Add(-time.Hour)
+	sess.mu.Unlock()
+	if pruned := d.Store.Prune(time.Minute); len(pruned) != 1 {
+		t.Fatalf("pruned %d sessions, want 1", len(pruned))
+	}
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("tail returned %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("tail not closed after session expired")
+	}
+}
+
+func TestDaemonKillSession(t *testing.T) {
+	d, sock := startTestDaemon(t)
+	collab, collabAck := registerTestSession(t, sock, RegisterPayload{Title: "collab", Collab: true})
+	_, plainAck := registerTestSession(t, sock, RegisterPayload{Title: "plain"})
+
+	dc, err := NewDaemonClient(sock, "")
+	if err != nil {
+		t.Fatalf("daemon client: %v", err)
+	}
+	defer dc.Close()
+
+	resp, err := dc.KillSession(t.Context(), collabAck.ShortID)
+	if err != nil {
+		t.Fatalf("kill: %v", err)
+	}
+	if !resp.Connected || !resp.Signaled {
+		t.Errorf("collab kill = %+v, want connected and signaled", resp)
+	}
+	if env := collab.recv(t); env.Type != MsgKill {
+		t.Errorf("collab client got %s, want %s", env.Type, MsgKill)
+	}
+
+	resp, err = dc.KillSession(t.Context(), plainAck.ShortID)
+	if err != nil {
+		t.Fatalf("kill: %v", err)
+	}
+	if resp.Signaled {
+		t.Errorf("non-collab session should not be signaled: %+v", resp)
+	}
+
+	if n := len(d.Store.List()); n != 0 {
+		t.Errorf("%d sessions left after kill, want 0", n)
+	}
+	if _, err := dc.KillSession(t.Context(), plainAck.ShortID); err == nil {
+		t.Error("expected error killing a removed session")
+	}
+}
+
+func TestDaemonDeleteSession(t *testing.T) {
+	d, sock := startTestDaemon(t)
+	live, liveAck := registerTestSession(t, sock, RegisterPayload{Title: "live", Collab: true})
+	done, doneAck := registerTestSession(t, sock, RegisterPayload{Title: "done"})
+	done.Close()
+	doneSess, _ := d.Store.Resolve(doneAck.ShortID)
+	waitFor(t, func() bool { return !doneSess.Connected() })
+
+	dc, err := NewDaemonClient(sock, "")
+	if err != nil {
+		t.Fatalf("daemon client: %v", err)
+	}
+	defer dc.Close()
+
+	resp, err := dc.DeleteSession(t.Context(), DeleteSessionPayload{Session: "done"})
+	if err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if resp.SessionID != doneAck.ShortID || resp.Title != "done" || resp.Connected {
+		t.Errorf("delete = %+v", resp)
+	}
+
+	// Connected sessions need force, and their client is not signaled
+	if _, err := dc.DeleteSession(t.Context(), DeleteSessionPayload{Session: "live"}); err == nil || !strings.Contains(err.Error(), "connected") {
+		t.Errorf("delete connected session without force: err = %v", err)
+	}
+	resp, err = dc.DeleteSession(t.Context(), DeleteSessionPayload{Session: "live", Force: true})
+	if err != nil {
+		t.Fatalf("forced delete: %v", err)
+	}
+	if resp.SessionID != liveAck.ShortID || !resp.Connected {
+		t.Errorf("forced delete = %+v", resp)
+	}
+	live.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if live.scanner.Scan() {
+		t.Errorf("client of deleted session got %s", live.scanner.Bytes())
+	}
+
+	if n := len(d.Store.List()); n != 0 {
+		t.Errorf("%d sessions left after delete, want 0", n)
+	}
+}
+
+func TestDaemonRenameSession(t *testing.T) {
+	d, sock := startTestDaemon(t)
+	_, ack := registerTestSession(t, sock, RegisterPayload{})
+
+	dc, err := NewDaemonClient(sock, "")
+	if err != nil {
+		t.Fatalf("daemon client: %v", err)
+	}
+	defer dc.Close()
+
+	resp, err := dc.RenameSession(t.Context(), RenameSessionPayload{Session: ack.ShortID, Title: "backend tests"})
+	if err != nil {
+		t.Fatalf("rename: %v", err)
+	}
+	if resp.NewTitle != "backend tests" {
+		t.Errorf("rename = %+v", resp)
+	}
+	if sess, err := d.Store.FindByTitle("Backend Tests"); err != nil || sess.ShortID != ack.ShortID {
+		t.Errorf("find by new title = %v, %v", sess, err)
+	}
+	infos, err := dc.ListSessions(t.Context(), ListSessionsPayload{})
+	if err != nil || len(infos) != 1 || infos[0].Title != "backend tests" {
+		t.Errorf("list after rename = %+v, %v", infos, err)
+	}
+}
+
+func TestDaemonSubscribeEvents(t *testing.T) {
+	_, sock := startTestDaemon(t)
+	client, ack := registerTestSession(t, sock, RegisterPayload{Title: "events-test"})
+
+	dc, err := NewDaemonClient(sock, "")
+	if err != nil {
+		t.Fatalf("daemon client: %v", err)
+	}
+	defer dc.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events, err := dc.Subscribe(ctx, SubscribePayload{Session: ack.ShortID})
+	if err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+
+	client.send(t, MsgCommand, CommandPayload{Command: "go test ./..."})
+	client.send(t, MsgOutput, OutputPayload{Lines: []string{"ok"}})
+	client.send(t, MsgDisconnect, nil)
+
+	var got []string
+	for len(got) < 3 {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				t.Fatalf("stream ended early, got %v", got)
+			}
+			switch ev.Kind {
+			case SessionNewCommand:
+				got = append(got, "command:"+ev.Command)
+			case "":
+				got = append(got, "lines:"+fmt.Sprint(ev.Lines))
+			default:
+				got = append(got, string(ev.Kind))
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timed out, got %v", got)
+		}
+	}
+	// Output and state events travel separately and may interleave
+	slices.Sort(got)
+	if want := "[command:go test ./... disconnected lines:[ok]]"; fmt.Sprint(got) != want {
+		t.Errorf("got %v, want %s", got, want)
+	}
+}
+
+func TestDaemonHeartbeat(t *testing.T) {
+	d, sock := startTestDaemon(t, func(d *Daemon) {
+		d.PingInterval = 20 * time.Millisecond
+		d.PingTimeout = 50 * time.Millisecond
+	})
+	client, ack := registerTestSession(t, sock, RegisterPayload{Title: "heartbeat"})
+	legacy, legacyAck := registerTestSession(t, sock, RegisterPayload{Title: "legacy"})
+
+	// Answer one ping, then go quiet
+	if env := client.recv(t); env.Type != MsgPing {
+		t.Fatalf("got %s, want ping", env.Type)
+	}
+	client.send(t, MsgPong, nil)
+
+	sess, _ := d.Store.Resolve(ack.ShortID)
+	waitFor(t, func() bool { return !sess.Connected() })
+
+	// A client that never answered is assumed not to support heartbeats
+	if env := legacy.recv(t); env.Type != MsgPing {
+		t.Fatalf("got %s, want ping", env.Type)
+	}
+	legacySess, _ := d.Store.Resolve(legacyAck.ShortID)
+	if !legacySess.Connected() {
+		t.Error("client that never answered a ping was disconnected")
+	}
+}
+
+func TestDaemonCommandExitCode(t *testing.T) {
+	_, sock := startTestDaemon(t)
+	client, _ := registerTestSession(t, sock, RegisterPayload{Title: "exit-test"})
+
+	dc, err := NewDaemonClient(sock, "")
+	if err != nil {
+		t.Fatalf("daemon client: %v", err)
+	}
+	defer dc.Close()
+	exitCode := func() *int {
+		t.Helper()
+		infos, err := dc.ListSessions(t.Context(), ListSessionsPayload{})
+		if err != nil || len(infos) != 1 {
+			t.Fatalf("list: %v %v", infos, err)
+		}
+		return infos[0].LastExit
+	}
+
+	client.send(t, MsgCommand, CommandPayload{Command: "false"})
+	client.send(t, MsgCommandResult, CommandResultPayload{Command: "false", ExitCode: 1})
+	waitFor(t, func() bool { return exitCode() != nil })
+	if got := *exitCode(); got != 1 {
+		t.Errorf("exit code = %d, want 1", got)
+	}
+
+	// A new command clears the previous status until it finishes.
+	client.send(t, MsgCommand, CommandPayload{Command: "sleep 10"})
+	waitFor(t, func() bool { return exitCode() == nil })
+}
+
+func TestDaemonHandshake(t *testing.T) {
+	_, sock := startTestDaemon(t)
+
+	c := dialTestDaemon(t, sock)
+	c.send(t, MsgHello, HelloPayload{Version: "1.3", Capabilities: []string{"compress", CapSubscribe}})
+	env := c.recv(t)
+	if env.Type != MsgHelloAck {
+		t.Fatalf("hello: got %s: %s", env.Type, env.Payload)
+	}
+	var ack HelloPayload
+	json.Unmarshal(env.Payload, &ack)
+	if ack.Version != ProtocolVersion || fmt.Sprint(ack.Capabilities) != "[subscribe]" {
+		t.Errorf("hello ack = %+v", ack)
+	}
+
+	c = dialTestDaemon(t, sock)
+	c.send(t, MsgHello, HelloPayload{Version: "2"})
+	if env := c.recv(t); env.Type != MsgError {
+		t.Errorf("incompatible hello: got %s, want %s", env.Type, MsgError)
+	}
+	if c.scanner.Scan() {
+		t.Error("connection should be closed after a rejected hello")
+	}
+
+	dc, err := NewDaemonClient(sock, "")
+	if err != nil {
+		t.Fatalf("daemon client: %v", err)
+	}
+	defer dc.Close()
+	if !dc.HasCapability(CapSubscribe) {
+		t.Error("daemon client did not negotiate subscribe")
+	}
+}
+
+func TestDaemonCompressedOutput(t *testing.T) {
+	d, sock := startTestDaemon(t)
+
+	c := dialTestDaemon(t, sock)
+	c.send(t, MsgHello, HelloPayload{Version: ProtocolVersion, Capabilities: []string{CapGzip}})
+	var ack HelloPayload
+	json.Unmarshal(c.recv(t).Payload, &ack)
+	if !slices.Contains(ack.Capabilities, CapGzip) {
+		t.Fatalf("hello ack = %+v, want gzip", ack)
+	}
+	c.send(t, MsgRegister, RegisterPayload{Title: "big"})
+	c.recv(t)
+
+	lines := make([]string, 2000)
+	for i := range lines {
+		lines[i] = fmt.Sprintf("PASS: TestSomething/case_%d (0.00s)", i)
+	}
+	env := compressPayload(Envelope{Type: MsgOutput, Payload: mustMarshal(OutputPayload{Lines: lines})}, DefaultCompressThreshold)
+	if !env.Compressed || len(env.Payload) >= DefaultCompressThreshold {
+		t.Fatalf("payload not compressed: %d bytes, compressed %v", len(env.Payload), env.Compressed)
+	}
+	// A payload that doesn't decompress is dropped, not stored
+	c.enc.Encode(Envelope{Type: MsgOutput, Payload: mustMarshal([]byte("not gzip")), Compressed: true})
+	c.enc.Encode(env)
+
+	sess, err := d.Store.Resolve("big")
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return sess.Buffer.TotalSeq() >= 2000 })
+	if got := sess.Buffer.TotalSeq(); got != 2000 {
+		t.Errorf("stored %d lines, want 2000", got)
+	}
+	if got := sess.Buffer.LastN(1); len(got) != 1 || got[0] != lines[1999] {
+		t.Errorf("last line = %q", got)
+	}
+
+	// Small payloads are sent as is
+	small := compressPayload(Envelope{Type: MsgOutput, Payload: mustMarshal(OutputPayload{Lines: lines[:3]})}, DefaultCompressThreshold)
+	if small.Compressed {
+		t.Error("small payload was compressed")
+	}
+}
+
+func TestDaemonClientConcurrentRequests(t *testing.T) {
+	_, sock := startTestDaemon(t)
+	for i := range 4 {
+		registerTestSession(t, sock, RegisterPayload{Title: fmt.Sprintf("s%d", i)})
+	}
+
+	dc, err := NewDaemonClient(sock, "")
+	if err != nil {
+		t.Fatalf("daemon client: %v", err)
+	}
+	defer dc.Close()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 40)
+	for i := range 40 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			title := fmt.Sprintf("s%d", i%4)
+			resp, err := dc.QuerySession(t.Context(), QuerySessionPayload{Session: title})
+			if err == nil && resp.Title != title {
+				err = fmt.Errorf("asked for %s, got %s", title, resp.Title)
+			}
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestDaemonReapsDisconnectedSessions(t *testing.T) {
+	d, sock := startTestDaemon(t, func(d *Daemon) {
+		d.SessionTTL = 50 * time.Millisecond
+		d.PruneInterval = 10 * time.Millisecond
+	})
+	idle, _ := registerTestSession(t, sock, RegisterPayload{Title: "idle"})
+	registerTestSession(t, sock, RegisterPayload{Title: "live"})
+
+	idle.send(t, MsgDisconnect, nil)
+	waitFor(t, func() bool { return len(d.Store.List()) == 1 })
+
+	// Connected sessions stay regardless of activity.
+	time.Sleep(100 * time.Millisecond)
+	sessions := d.Store.List()
+	if len(sessions) != 1 || sessions[0].Title() != "live" {
+		t.Errorf("sessions after reaping = %v", sessions)
+	}
+}
+
+func TestDaemonReapsSessionByOwnTTL(t *testing.T) {
+	d, sock := startTestDaemon(t, func(d *Daemon) {
+		d.PruneInterval = 10 * time.Millisecond
+	})
+	short, _ := registerTestSession(t, sock, RegisterPayload{Title: "short", TTLMs: 50})
+	kept, _ := registerTestSession(t, sock, RegisterPayload{Title: "kept"})
+
+	// Without a SessionTTL, only the session registered with a TTL goes.
+	short.send(t, MsgDisconnect, nil)
+	kept.send(t, MsgDisconnect, nil)
+	waitFor(t, func() bool { return len(d.Store.List()) == 1 })
+	time.Sleep(100 * time.Millisecond)
+	sessions := d.Store.List()
+	if len(sessions) != 1 || sessions[0].Title() != "kept" {
+		t.Errorf("sessions after reaping = %v", sessions)
+	}
+}
+
+func TestDaemonSubscribeFromSeq(t *testing.T) {
+	d, sock := startTestDaemon(t)
+	client, ack := registerTestSession(t, sock, RegisterPayload{Title: "replay"})
+	client.send(t, MsgOutput, OutputPayload{Lines: []string{"zero", "one", "two"}})
+	sess, _ := d.Store.Resolve(ack.ShortID)
+	waitFor(t, func() bool { return sess.Buffer.TotalSeq() == 3 })
+
+	dc, err := NewDaemonClient(sock, "")
+	if err != nil {
+		t.Fatalf("daemon client: %v", err)
+	}
+	defer dc.Close()
+	// Replaying from seq 0 is not mistaken for new output only
+	from := uint64(0)
+	ctx, cancel := context.WithCancel(context.Background())
+	events, err := dc.Subscribe(ctx, SubscribePayload{Session: ack.ShortID, FromSeq: &from})
+	if err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+
+	// Requests keep working on the connection while the stream is open.
+	if _, err := dc.ListSessions(t.Context(), ListSessionsPayload{}); err != nil {
+		t.Fatalf("list during subscription: %v", err)
+	}
+	client.send(t, MsgOutput, OutputPayload{Lines: []string{"three"}})
+
+	var lines []string
+	var seqs []uint64
+	for len(lines) < 4 {
+		select {
+		case ev := <-events:
+			lines = append(lines, ev.Lines...)
+			seqs = append(seqs, ev.Seqs...)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timed out; got %v", lines)
+		}
+	}
+	if fmt.Sprint(lines, seqs) != "[zero one two three] [0 1 2 3]" {
+		t.Errorf("got %v %v", lines, seqs)
+	}
+
+	cancel()
+	for range events {
+	}
+	if _, err := dc.ListSessions(t.Context(), ListSessionsPayload{}); err != nil {
+		t.Errorf("list after unsubscribe: %v", err)
+	}
+}
+
+func TestDaemonCollabWritesStayFramed(t *testing.T) {
+	d, sock := startTestDaemon(t)
+	id := uuid.New()
+	client, _ := registerTestSession(t, sock, RegisterPayload{Title: "collab", Collab: true, SessionID: id.String()})
+	sess, _ := d.Store.Get(id)
+
+	const inputs, acks = 200, 200
+	text := strings.Repeat("x", 4096)
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range inputs / 4 {
+				if err := sess.SendInput(text); err != nil {
+					t.Errorf("send input: %v", err)
+					return
+				}
+			}
+		}()
+	}
+	// Re-registering makes the connection handler write acks meanwhile
+	for range acks {
+		client.send(t, MsgRegister, RegisterPayload{Title: "collab", Collab: true, SessionID: id.String()})
+	}
+
+	var gotInputs, gotAcks int
+	for gotInputs < inputs || gotAcks < acks {
+		env := client.recv(t) // fails on any corrupted line
+		switch env.Type {
+		case MsgInput:
+			var p InputPayload
+			if err := json.Unmarshal(env.Payload, &p); err != nil || p.Text != text {
+				t.Fatalf("corrupted input: %v", err)
+			}
+			gotInputs++
+		case MsgAck:
+			gotAcks++
+		}
+	}
+	wg.Wait()
+}
+
+func TestDaemonResize(t *testing.T) {
+	_, sock := startTestDaemon(t)
+	client, ack := registerTestSession(t, sock, RegisterPayload{Title: "resize"})
+	client.send(t, MsgResize, ResizePayload{Rows: 40, Cols: 120})
+
+	dc, err := NewDaemonClient(sock, "")
+	if err != nil {
+		t.Fatalf("daemon client: %v", err)
+	}
+	defer dc.Close()
+	waitFor(t, func() bool {
+		infos, err := dc.ListSessions(t.Context(), ListSessionsPayload{})
+		return err == nil && infos[0].Cols == 120 && infos[0].Rows == 40
+	})
+	resp, err := dc.QuerySession(t.Context(), QuerySessionPayload{Session: ack.ShortID})
+	if err != nil {
+		t.Fatalf("query: %v", err)
+	}
+	if resp.Rows != 40 || resp.Cols != 120 {
+		t.Errorf("query size = %dx%d, want 40x120", resp.Rows, resp.Cols)
+	}
+}
+
+func TestDaemonCwd(t *testing.T) {
+	_, sock := startTestDaemon(t)
+	client, _ := registerTestSession(t, sock, RegisterPayload{Title: "api"})
+	client.send(t, MsgCwd, CwdPayload{Dir: "/repo/api"})
+
+	dc, err := NewDaemonClient(sock, "")
+	if err != nil {
+		t.Fatalf("daemon client: %v", err)
+	}
+	defer dc.Close()
+	waitFor(t, func() bool {
+		infos, err := dc.ListSessions(t.Context(), ListSessionsPayload{})
+		return err == nil && infos[0].Cwd == "/repo/api"
+	})
+}
+
+func TestDaemonSessionPid(t *testing.T) {
+	_, sock := startTestDaemon(t)
+	registerTestSession(t, sock, RegisterPayload{Title: "pid", Pid: 4242})
+
+	dc, err := NewDaemonClient(sock, "")
+	if err != nil {
+		t.Fatalf("daemon client: %v", err)
+	}
+	defer dc.Close()
+	infos, err := dc.ListSessions(t.Context(), ListSessionsPayload{})
+	if err != nil {
+		t.Fatalf("list: %v", err)
+	}
+	if infos[0].Pid != 4242 {
+		t.Errorf("pid = %d, want 4242", infos[0].Pid)
+	}
+}
+
+func TestDaemonKeepANSI(t *testing.T) {
+	_, sock := startTestDaemon(t)
+	colored, _ := registerTestSession(t, sock, RegisterPayload{Title: "colored", KeepANSI: true})
+	colored.send(t, MsgOutput, OutputPayload{Lines: []string{"\x1b[31mFAIL\x1b[0m"}})
+	plain, _ := registerTestSession(t, sock, RegisterPayload{Title: "plain"})
+	plain.send(t, MsgOutput, OutputPayload{Lines: []string{"\x1b[31mFAIL\x1b[0m"}})
+
+	dc, err := NewDaemonClient(sock, "")
+	if err != nil {
+		t.Fatalf("daemon client: %v", err)
+	}
+	defer dc.Close()
+	for title, want := range map[string]string{"colored": "\x1b[31mFAIL\x1b[0m", "plain": "FAIL"} {
+		var resp *QuerySessionResponse
+		waitFor(t, func() bool {
+			resp, err = dc.QuerySession(t.Context(), QuerySessionPayload{Session: title, LastN: 1, Raw: true})
+			return err == nil && len(resp.Lines) == 1
+		})
+		if resp.Lines[0] != want {
+			t.Errorf("%s raw = %q, want %q", title, resp.Lines[0], want)
+		}
+	}
+}
+
+func TestDaemonDedup(t *testing.T) {
+	d, sock := startTestDaemon(t)
+	client, ack := registerTestSession(t, sock, RegisterPayload{Title: "health", Dedup: true})
+	client.send(t, MsgOutput, OutputPayload{Lines: []string{"starting", "ok", "ok", "ok"}})
+	client.send(t, MsgOutput, OutputPayload{Lines: []string{"ok", "stopped"}})
+	sess, _ := d.Store.Resolve(ack.ShortID)
+	waitFor(t, func() bool { return sess.Buffer.TotalSeq() == 3 })
+
+	if got := fmt.Sprint(sess.Buffer.AllLines()); got != "[starting ok (x4) stopped]" {
+		t.Errorf("lines = %s", got)
+	}
+}
+
+func TestDaemonWriteSessionWait(t *testing.T) {
+	_, sock := startTestDaemon(t)
+	client, _ := registerTestSession(t, sock, RegisterPayload{Title: "shell", Collab: true})
+	client.send(t, MsgOutput, OutputPayload{Lines: []string{"$ "}})
+
+	// Answer the input like a shell would
+	go func() {
+		for client.scanner.Scan() {
+			var env Envelope
+			json.Unmarshal(client.scanner.Bytes(), &env)
+			if env.Type == MsgInput {
+				client.enc.Encode(Envelope{
+					Type:    MsgOutput,
+					Payload: mustMarshal(OutputPayload{Lines: []string{"$ ls", "go.mod", "main.go"}}),
+				})
+			}
+		}
+	}()
+
+	dc, err := NewDaemonClient(sock, "")
+	if err != nil {
+		t.Fatalf("daemon client: %v", err)
+	}
+	defer dc.Close()
+	start := time.Now()
+	resp, err := dc.WriteSession(t.Context(), WriteSessionPayload{Session: "shell", Text: "ls\n", WaitMs: 5000})
+	if err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if fmt.Sprint(resp.Lines) != "[$ ls go.mod main.go]" || resp.NextCursor != 4 {
+		t.Errorf("lines = %q, next_cursor = %d", resp.Lines, resp.NextCursor)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("took %v, want an early return once output settled", elapsed)
+	}
+}
+
+func TestDaemonResizeBufferByName(t *testing.T) {
+	d, sock := startTestDaemon(t)
+	id := uuid.New()
+	client, _ := registerTestSession(t, sock, RegisterPayload{Title: "build", SessionID: id.String()})
+	client.send(t, MsgOutput, OutputPayload{Lines: []string{"a", "b", "c", "d"}})
+	sess, _ := d.Store.Get(id)
+	waitFor(t, func() bool { return sess.Buffer.Len() == 4 })
+
+	dc, err := NewDaemonClient(sock, "")
+	if err != nil {
+		t.Fatalf("daemon client: %v", err)
+	}
+	defer dc.Close()
+	resp, err := dc.ResizeBuffer(t.Context(), ResizeBufferPayload{Session: "build", Capacity: 2})
+	if err != nil {
+		t.Fatalf("resize: %v", err)
+	}
+	if resp.SessionID != sess.ShortID || resp.Capacity != 2 || resp.Lines != 2 {
+		t.Errorf("resp = %+v", resp)
+	}
+	if got := fmt.Sprint(sess.Buffer.AllLines()); got != "[c d]" {
+		t.Errorf("lines = %s, want the newest two", got)
+	}
+	if _, err := dc.ResizeBuffer(t.Context(), ResizeBufferPayload{Session: "nonexistent", Capacity: 2}); err == nil {
+		t.Error("expected error for unknown session")
+	}
+	// A huge capacity is refused rather than allocated
+	if _, err := dc.ResizeBuffer(t.Context(), ResizeBufferPayload{Session: sess.ShortID, Capacity: 1 << 40}); err == nil || sess.Buffer.Cap() != 2 {
+		t.Errorf("oversized resize: err = %v, cap = %d", err, sess.Buffer.Cap())
+	}
+}
+
+func TestDaemonSessionInfo(t *testing.T) {
+	_, sock := startTestDaemon(t)
+	id := uuid.New()
+	client, _ := registerTestSession(t, sock, RegisterPayload{Title: "build", Collab: true, SessionID: id.String(), Pid: 4242})
+	client.send(t, MsgResize, ResizePayload{Rows: 40, Cols: 120})
+	client.send(t, MsgCommand, CommandPayload{Command: "make"})
+	client.send(t, MsgOutput, OutputPayload{Lines: []string{"cc main.c", "ok"}})
+
+	dc, err := NewDaemonClient(sock, "")
+	if err != nil {
+		t.Fatalf("daemon client: %v", err)
+	}
+	defer dc.Close()
+	var info *SessionDetails
+	waitFor(t, func() bool {
+		info, err = dc.SessionInfo(t.Context(), "build")
+		return err == nil && info.TotalLines == 2
+	})
+	if info.UUID != id.String() || !info.Collab || info.Pid != 4242 || info.Rows != 40 || info.Cols != 120 ||
+		info.LastCommand != "make" || info.CommandCount != 1 || info.LastActivity == "" || info.OldestSeq != 0 {
+		t.Errorf("info = %+v", info)
+	}
+
+	if _, err := dc.SessionInfo(t.Context(), "nonexistent"); err == nil {
+		t.Error("expected error for unknown session")
+	}
+}
+
+func TestDaemonSessionStats(t *testing.T) {
+	_, sock := startTestDaemon(t)
+	client, _ := registerTestSession(t, sock, RegisterPayload{Title: "build", Collab: true})
+	client.send(t, MsgResize, ResizePayload{Rows: 40, Cols: 120})
+
+	dc, err := NewDaemonClient(sock, "")
+	if err != nil {
+		t.Fatalf("daemon client: %v", err)
+	}
+	defer dc.Close()
+	stats, err := dc.GetSessionStats(t.Context(), "build")
+	if err != nil {
+		t.Fatalf("stats: %v", err)
+	}
+	if stats.NewestSeq != nil || stats.TotalLinesEver != 0 || stats.BufferUsed != 0 {
+		t.Errorf("stats before output = %+v", stats)
+	}
+
+	client.send(t, MsgCommand, CommandPayload{Command: "make"})
+	client.send(t, MsgOutput, OutputPayload{Lines: []string{"cc main.c", "cc util.c", "ok"}})
+	waitFor(t, func() bool {
+		stats, err = dc.GetSessionStats(t.Context(), "build")
+		return err == nil && stats.TotalLinesEver == 3
+	})
+	if stats.NewestSeq == nil || *stats.NewestSeq != 2 || stats.OldestSeq != 0 || stats.BufferUsed != 3 ||
+		stats.BufferCapacity == 0 || !stats.Connected || !stats.Collab || stats.LastCommand != "make" ||
+		stats.Rows != 40 || stats.Cols != 120 || stats.CreatedAt == "" || stats.AvgLinesPerMinute != 3 {
+		t.Errorf("stats = %+v", stats)
+	}
+
+	if _, err := dc.GetSessionStats(t.Context(), "nonexistent"); err == nil {
+		t.Error("expected error for unknown session")
+	}
+}
+
+func TestSessionInfoIdle(t *testing.T) {
+	sess, _ := NewStore().Create("server", 100, false, nil)
+	sess.lastActivity = time.Now().Add(-90 * time.Second)
+	info := sessionInfo(sess)
+	if info.IdleSeconds < 90 || info.IdleSeconds > 91 {
+		t.Errorf("idle_seconds = %d, want 90", info.IdleSeconds)
+	}
+	if info.LastActivity != sess.LastActivity().Format(time.RFC3339) {
+		t.Errorf("last_activity = %q", info.LastActivity)
+	}
+}
+
+func TestDaemonReadOnly(t *testing.T) {
+	_, sock := startTestDaemon(t)
+	registerTestSession(t, sock, RegisterPayload{Title: "demo", Collab: true, ReadOnly: true})
+
+	dc, err := NewDaemonClient(sock, "")
+	if err != nil {
+		t.Fatalf("daemon client: %v", err)
+	}
+	defer dc.Close()
+	_, err = dc.WriteSession(t.Context(), WriteSessionPayload{Session: "demo", Text: "ls\n"})
+	if err == nil || !strings.Contains(err.Error(), "read-only") {
+		t.Errorf("write err = %v, want read-only error", err)
+	}
+	infos, err := dc.ListSessions(t.Context(), ListSessionsPayload{})
+	if err != nil {
+		t.Fatalf("list: %v", err)
+	}
+	if len(infos) != 1 || !infos[0].ReadOnly {
+		t.Errorf("sessions = %+v, want one read-only", infos)
+	}
+}
+
+func TestDaemonPause(t *testing.T) {
+	d, sock := startTestDaemon(t)
+	client, _ := registerTestSession(t, sock, RegisterPayload{Title: "secret", Paused: true})
+	sess, err := d.Store.Resolve("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sess.Paused() {
+		t.Error("session registered paused is not paused")
+	}
+
+	dc, err := NewDaemonClient(sock, "")
+	if err != nil {
+		t.Fatalf("daemon client: %v", err)
+	}
+	defer dc.Close()
+	client.send(t, MsgPause, PausePayload{Paused: false})
+	waitFor(t, func() bool {
+		infos, err := dc.ListSessions(t.Context(), ListSessionsPayload{})
+		return err == nil && len(infos) == 1 && !infos[0].Paused
+	})
+	client.send(t, MsgPause, PausePayload{Paused: true})
+	waitFor(t, func() bool {
+		infos, err := dc.ListSessions(t.Context(), ListSessionsPayload{})
+		return err == nil && len(infos) == 1 && infos[0].Paused
+	})
+}
+
+func TestDaemonSendSignal(t *testing.T) {
+	_, sock := startTestDaemon(t)
+	collab, collabAck := registerTestSession(t, sock, RegisterPayload{Title: "collab", Collab: true})
+	_, plainAck := registerTestSession(t, sock, RegisterPayload{Title: "plain"})
+
+	dc, err := NewDaemonClient(sock, "")
+	if err != nil {
+		t.Fatalf("daemon client: %v", err)
+	}
+	defer dc.Close()
+
+	resp, err := dc.SendSignal(t.Context(), SendSignalPayload{Session: collabAck.ShortID, Signal: "int"})
+	if err != nil {
+		t.Fatalf("send signal: %v", err)
+	}
+	if resp.Signal != "SIGINT" {
+		t.Errorf("signal = %q, want SIGINT", resp.Signal)
+	}
+	env := collab.recv(t)
+	var p SignalPayload
+	json.Unmarshal(env.Payload, &p)
+	if env.Type != MsgSignal || p.Signal != "SIGINT" {
+		t.Errorf("collab client got %s %+v", env.Type, p)
+	}
+
+	for _, sig := range []string{"9", "SIGSEGV", ""} {
+		if _, err := dc.SendSignal(t.Context(), SendSignalPayload{Session: collabAck.ShortID, Signal: sig}); err == nil {
+			t.Errorf("signal %q should be refused", sig)
+		}
+	}
+	if _, err := dc.SendSignal(t.Context(), SendSignalPayload{Session: plainAck.ShortID, Signal: "SIGTERM"}); err == nil {
+		t.Error("expected error signaling a non-collab session")
+	}
+}
+
+func TestDaemonHeartbeatCountsActivity(t *testing.T) {
+	d, sock := startTestDaemon(t, func(d *Daemon) {
+		d.PingInterval = 20 * time.Millisecond
+		d.PingTimeout = 50 * time.Millisecond
+	})
+	client, ack := registerTestSession(t, sock, RegisterPayload{Title: "busy"})
+	if env := client.recv(t); env.Type != MsgPing {
+		t.Fatalf("got %s, want ping", env.Type)
+	}
+	client.send(t, MsgPong, nil)
+
+	// Output without pongs keeps the session alive
+	sess, _ := d.Store.Resolve(ack.ShortID)
+	for range 20 {
+		client.send(t, MsgOutput, OutputPayload{Lines: []string{"working"}})
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !sess.Connected() {
+		t.Fatal("busy client was disconnected")
+	}
+
+	// Silence does not
+	waitFor(t, func() bool { return !sess.Connected() })
+}
+
+func TestDaemonSessionEnvironment(t *testing.T) {
+	d, sock := startTestDaemon(t)
+	client, ack := registerTestSession(t, sock, RegisterPayload{Title: "env"})
+	client.send(t, MsgEnvironment, EnvironmentPayload{Vars: map[string]string{
+		"PATH": "/usr/bin",
+		"HOME": "/home/dev",
+	}})
+	sess, _ := d.Store.Resolve(ack.ShortID)
+	waitFor(t, func() bool { return sess.Environment() != nil })
+
+	dc, err := NewDaemonClient(sock, "")
+	if err != nil {
+		t.Fatalf("daemon client: %v", err)
+	}
+	defer dc.Close()
+
+	resp, err := dc.GetEnvironment(t.Context(), GetEnvironmentPayload{Session: ack.ShortID})
+	if err != nil {
+		t.Fatalf("get environment: %v", err)
+	}
+	if len(resp.Vars) != 2 {
+		t.Errorf("vars = %v, want 2 entries", resp.Vars)
+	}
+
+	resp, err = dc.GetEnvironment(t.Context(), GetEnvironmentPayload{Session: ack.ShortID, Keys: []string{"PATH", "MISSING"}})
+	if err != nil {
+		t.Fatalf("get environment: %v", err)
+	}
+	if len(resp.Vars) != 1 || resp.Vars["PATH"] != "/usr/bin" {
+		t.Errorf("filtered vars = %v, want only PATH", resp.Vars)
+	}
+}
+
+func TestDaemonClientRequestTimeout(t *testing.T) {
+	// A daemon that completes the handshake and then never answers
+	sock := filepath.Join(t.TempDir(), "hung.sock")
+	ln, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		scanner := bufio.NewScanner(conn)
+		scanner.Scan()
+		json.NewEncoder(conn).Encode(Envelope{Type: MsgHelloAck, Payload: mustMarshal(HelloPayload{Version: ProtocolVersion})})
+		for scanner.Scan() {
+		}
+	}()
+
+	dc, err := NewDaemonClient(sock, "")
+	if err != nil {
+		t.Fatalf("daemon client: %v", err)
+	}
+	defer dc.Close()
+
+	ctx, cancel := context.WithTimeout(t.Context(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = dc.ListSessions(ctx, ListSessionsPayload{})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("err = %v, want deadline exceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("request took %v to time out", elapsed)
+	}
+}
+
+func TestDaemonClientSendTimeout(t *testing.T) {
+	// A daemon that completes the handshake and then stops reading, so a
+	// large enough request fills the socket buffer and blocks
+	sock := filepath.Join(t.TempDir(), "stuck.sock")
+	ln, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	release := make(chan struct{})
+	defer close(release)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		bufio.NewReader(conn).ReadString('\n')
+		json.NewEncoder(conn).Encode(Envelope{Type: MsgHelloAck, Payload: mustMarshal(HelloPayload{Version: ProtocolVersion})})
+		<-release
+	}()
+
+	dc, err := NewDaemonClient(sock, "")
+	if err != nil {
+		t.Fatalf("daemon client: %v", err)
+	}
+	defer dc.Close()
+
+	ctx, cancel := context.WithTimeout(t.Context(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = dc.WriteSession(ctx, WriteSessionPayload{Session: "x", Text: strings.Repeat("x", 8<<20)})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("err = %v, want deadline exceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("request took %v to time out", elapsed)
+	}
+}
+
+func TestDaemonClientSlowSubscriber(t *testing.T) {
+	// A daemon that floods a subscription with more events than its queue
+	// holds, then answers another request
+	sock := filepath.Join(t.TempDir(), "flood.sock")
+	ln, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	unsubscribed := make(chan struct{})
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		scanner := bufio.NewScanner(conn)
+		enc := json.NewEncoder(conn)
+		scanner.Scan()
+		enc.Encode(Envelope{Type: MsgHelloAck, Payload: mustMarshal(HelloPayload{Version: ProtocolVersion, Capabilities: []string{CapSubscribe}})})
+		for scanner.Scan() {
+			var env Envelope
+			json.Unmarshal(scanner.Bytes(), &env)
+			switch env.Type {
+			case MsgSubscribe:
+				enc.Encode(Envelope{Type: MsgAck, RequestID: env.RequestID})
+				for i := range subscriptionQueue + 100 {
+					enc.Encode(Envelope{Type: MsgEvent, RequestID: env.RequestID, Payload: mustMarshal(EventPayload{Lines: []string{fmt.Sprint(i)}})})
+				}
+			case MsgQuiesce:
+				enc.Encode(Envelope{Type: MsgAck, RequestID: env.RequestID, Payload: mustMarshal(QuiesceResponse{Quiesced: true})})
+			case MsgUnsubscribe:
+				enc.Encode(Envelope{Type: MsgAck, RequestID: env.RequestID})
+				close(unsubscribed)
+			}
+		}
+	}()
+
+	dc, err := NewDaemonClient(sock, "")
+	if err != nil {
+		t.Fatalf("daemon client: %v", err)
+	}
+	defer dc.Close()
+	events, err := dc.Subscribe(t.Context(), SubscribePayload{Session: "x"})
+	if err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+
+	// Nobody reads events, yet other requests are still answered
+	ctx, cancel := context.WithTimeout(t.Context(), 2*time.Second)
+	defer cancel()
+	if _, err := dc.SetQuiesced(ctx, true); err != nil {
+		t.Fatalf("request behind a stalled subscription: %v", err)
+	}
+
+	// The subscription was ended rather than left to block the reader
+	n := 0
+	for range events {
+		n++
+	}
+	if n >= subscriptionQueue+100 {
+		t.Errorf("got all %d events; the subscription should have been dropped", n)
+	}
+	select {
+	case <-unsubscribed:
+	case <-time.After(2 * time.Second):
+		t.Error("dropped subscription was not unsubscribed")
+	}
+}
+
+func TestSubscriptionsRemoveEnded(t *testing.T) {
+	s := newSubscriptions()
+	count := func() int {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return len(s.subs)
+	}
+
+	// A stream that ends on its own, e.g. as its session expired
+	s.start(t.Context(), "expired", func(context.Context) {})
+	waitFor(t, func() bool { return count() == 0 })
+
+	// Replacing a subscription doesn't let the old one remove the new one
+	s.start(t.Context(), "sub", func(ctx context.Context) { <-ctx.Done() })
+	s.start(t.Context(), "sub", func(ctx context.Context) { <-ctx.Done() })
+	time.Sleep(10 * time.Millisecond)
+	if count() != 1 {
+		t.Errorf("%d subscriptions after replacing one", count())
+	}
+	if !s.stop("sub") || s.stop("sub") {
+		t.Error("stop should succeed once")
+	}
+	if count() != 0 {
+		t.Errorf("%d subscriptions after stopping", count())
+	}
+}
+
+func TestDaemonClientPool(t *testing.T) {
+	_, sock := startTestDaemon(t)
+	pool, err := NewDaemonClientPool(sock, "", 2)
+	if err != nil {
+		t.Fatalf("pool: %v", err)
+	}
+	defer pool.Close()
+
+	a, err := pool.Get(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := pool.Get(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a == b {
+		t.Fatal("pool handed out the same client twice")
+	}
+
+	// Both are checked out, so a third caller waits
+	ctx, cancel := context.WithTimeout(t.Context(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := pool.Get(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("get from exhausted pool: err = %v", err)
+	}
+
+	pool.Put(a)
+	if c, err := pool.Get(t.Context()); err != nil || c != a {
+		t.Fatalf("get after put = %p, %v; want the returned client %p", c, err, a)
+	}
+
+	// A client whose connection failed is dropped, not reused
+	a.conn.fail(errors.New("test"))
+	pool.Put(a)
+	c, err := pool.Get(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c == a {
+		t.Error("pool reused a client with a failed connection")
+	}
+	if _, err := c.ListSessions(t.Context(), ListSessionsPayload{}); err != nil {
+		t.Errorf("list with fresh client: %v", err)
+	}
+	pool.Put(b)
+	pool.Put(c)
+}
+
+func TestDaemonListenTCP(t *testing.T) {
+	d, _ := startTestDaemon(t, func(d *Daemon) { d.TCPAddr = "127.0.0.1:0" })
+	addr := "tcp://" + d.tcpListener.Addr().String()
+
+	dc, err := NewDaemonClient(addr, "")
+	if err != nil {
+		t.Fatalf("daemon client: %v", err)
+	}
+	defer dc.Close()
+	if _, err := dc.ListSessions(t.Context(), ListSessionsPayload{}); err != nil {
+		t.Fatalf("list over tcp: %v", err)
+	}
+
+	// Peers outside the allow-list are hung up on
+	d2, _ := startTestDaemon(t, func(d *Daemon) {
+		d.TCPAddr = "127.0.0.1:0"
+		d.AllowedCIDRs = []string{"10.0.0.0/8"}
+	})
+	conn, err := dialDaemon("tcp://" + d2.tcpListener.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("read from rejected connection: %v, want EOF", err)
+	}
+
+	if err := (&Daemon{AllowedCIDRs: []string{"bogus"}}).ListenTCP(t.Context(), "127.0.0.1:0"); err == nil {
+		t.Error("expected error for an invalid CIDR")
+	}
+}
+
+func TestDaemonToken(t *testing.T) {
+	_, sock := startTestDaemon(t, func(d *Daemon) { d.Token = "s3cret" })
+
+	if _, err := NewDaemonClient(sock, "wrong"); err == nil {
+		t.Error("expected handshake to fail with the wrong token")
+	}
+	dc, err := NewDaemonClient(sock, "s3cret")
+	if err != nil {
+		t.Fatalf("daemon client: %v", err)
+	}
+	defer dc.Close()
+	if _, err := dc.ListSessions(t.Context(), ListSessionsPayload{}); err != nil {
+		t.Errorf("list with token: %v", err)
+	}
+
+	// A client that skips the token is refused and disconnected
+	c := dialTestDaemon(t, sock)
+	c.send(t, MsgRegister, RegisterPayload{Title: "sneaky"})
+	if env := c.recv(t); env.Type != MsgError {
+		t.Errorf("got %s, want error", env.Type)
+	}
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if c.scanner.Scan() {
+		t.Error("connection still open after a missing token")
+	}
+}
+
+func TestDaemonSubscribeLastN(t *testing.T) {
+	_, sock := startTestDaemon(t)
+	client, ack := registerTestSession(t, sock, RegisterPayload{Title: "attach"})
+	client.send(t, MsgOutput, OutputPayload{Lines: []string{"a", "b", "c"}})
+
+	dc, err := NewDaemonClient(sock, "")
+	if err != nil {
+		t.Fatalf("daemon client: %v", err)
+	}
+	defer dc.Close()
+	waitFor(t, func() bool {
+		resp, err := dc.QuerySession(t.Context(), QuerySessionPayload{Session: ack.ShortID, LastN: 3})
+		return err == nil && len(resp.Lines) == 3
+	})
+
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+	events, err := dc.Subscribe(ctx, SubscribePayload{Session: ack.ShortID, LastN: 2})
+	if err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+	client.send(t, MsgOutput, OutputPayload{Lines: []string{"d"}})
+
+	var lines []string
+	for len(lines) < 3 {
+		select {
+		case ev := <-events:
+			lines = append(lines, ev.Lines...)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timed out; got %v", lines)
+		}
+	}
+	if fmt.Sprint(lines) != "[b c d]" {
+		t.Errorf("got %v, want [b c d]", lines)
+	}
+}
+
+func TestDaemonGracefulShutdown(t *testing.T) {
+	d, sock := startTestDaemon(t, func(d *Daemon) { d.ShutdownTimeout = 200 * time.Millisecond })
+	polite, _ := registerTestSession(t, sock, RegisterPayload{Title: "polite"})
+	stubborn, _ := registerTestSession(t, sock, RegisterPayload{Title: "stubborn"})
+
+	closed := make(chan time.Duration, 1)
+	start := time.Now()
+	go func() {
+		d.Close()
+		closed <- time.Since(start)
+	}()
+
+	// Both clients are told; the polite one hangs up
+	for _, c := range []*testConn{polite, stubborn} {
+		if env := c.recv(t); env.Type != MsgShutdown {
+			t.Fatalf("got %s, want shutdown", env.Type)
+		}
+	}
+	polite.Close()
+
+	// The stubborn one is cut off after the timeout
+	select {
+	case elapsed := <-closed:
+		if elapsed < 200*time.Millisecond {
+			t.Errorf("Close returned after %v, before the shutdown timeout", elapsed)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Close did not return")
+	}
+	stubborn.SetReadDeadline(time.Now().Add(time.Second))
+	if stubborn.scanner.Scan() {
+		t.Error("stubborn connection still open after Close")
+	}
+}
+
+func TestDaemonMaxConnections(t *testing.T) {
+	const limit = 3
+	d, sock := startTestDaemon(t, func(d *Daemon) { d.MaxConnections = limit })
+	var conns []*testConn
+	for range limit {
+		c := dialTestDaemon(t, sock)
+		c.send(t, MsgPing, nil)
+		if env := c.recv(t); env.Type != MsgPong {
+			t.Fatalf("got %s, want pong", env.Type)
+		}
+		conns = append(conns, c)
+	}
+
+	extra := dialTestDaemon(t, sock)
+	env := extra.recv(t)
+	var ep ErrorPayload
+	json.Unmarshal(env.Payload, &ep)
+	if env.Type != MsgError || ep.Message != "too many connections" {
+		t.Errorf("got %s %q, want too many connections", env.Type, ep.Message)
+	}
+	if extra.scanner.Scan() {
+		t.Error("rejected connection still open")
+	}
+	if got := scrapeMetric(t, d, "streamsh_connections_rejected_total"); got != 1 {
+		t.Errorf("rejected_total = %d, want 1", got)
+	}
+	if got := scrapeMetric(t, d, "streamsh_connections_active"); got != limit {
+		t.Errorf("connections_active = %d, want %d", got, limit)
+	}
+
+	// Closing one makes room again
+	conns[0].Close()
+	waitFor(t, func() bool { return scrapeMetric(t, d, "streamsh_connections_active") == limit-1 })
+	c := dialTestDaemon(t, sock)
+	c.send(t, MsgPing, nil)
+	if env := c.recv(t); env.Type != MsgPong {
+		t.Errorf("got %s after making room, want pong", env.Type)
+	}
+}
+
+func TestDaemonQuiesce(t *testing.T) {
+	d, sock := startTestDaemon(t)
+	id := uuid.New()
+	client, ack := registerTestSession(t, sock, RegisterPayload{Title: "existing", SessionID: id.String()})
+	client.send(t, MsgOutput, OutputPayload{Lines: []string{"before"}})
+	sess, _ := d.Store.Get(id)
+	waitFor(t, func() bool { return sess.Buffer.Len() == 1 })
+
+	dc, err := NewDaemonClient(sock, "")
+	if err != nil {
+		t.Fatalf("daemon client: %v", err)
+	}
+	defer dc.Close()
+	ctx := t.Context()
+	if quiesced, err := dc.SetQuiesced(ctx, true); err != nil || !quiesced {
+		t.Fatalf("quiesce = %v, %v", quiesced, err)
+	}
+
+	// New sessions are refused, with or without an ID of their own
+	for _, p := range []RegisterPayload{{Title: "new"}, {Title: "new", SessionID: uuid.NewString()}} {
+		c := dialTestDaemon(t, sock)
+		c.send(t, MsgRegister, p)
+		if env := c.recv(t); env.Type != MsgError || !strings.Contains(string(env.Payload), "quiesced") {
+			t.Errorf("register %+v while quiesced: got %s %s", p, env.Type, env.Payload)
+		}
+	}
+	if n := len(d.Store.List()); n != 1 {
+		t.Errorf("sessions while quiesced = %d, want 1", n)
+	}
+
+	// A known session can reconnect and keep streaming
+	client.Close()
+	waitFor(t, func() bool { return !sess.Connected() })
+	client, _ = registerTestSession(t, sock, RegisterPayload{Title: "existing", SessionID: id.String()})
+	client.send(t, MsgOutput, OutputPayload{Lines: []string{"after"}})
+	waitFor(t, func() bool { return sess.Buffer.Len() == 2 })
+
+	// Reads keep working
+	resp, err := dc.QuerySession(ctx, QuerySessionPayload{Session: ack.ShortID, LastN: 10})
+	if err != nil || fmt.Sprint(resp.Lines) != "[before after]" {
+		t.Errorf("query while quiesced = %v, %v", resp, err)
+	}
+
+	// Un-quiescing lets new sessions register again
+	if quiesced, err := dc.SetQuiesced(ctx, false); err != nil || quiesced {
+		t.Fatalf("unquiesce = %v, %v", quiesced, err)
+	}
+	registerTestSession(t, sock, RegisterPayload{Title: "new"})
+	if n := len(d.Store.List()); n != 2 {
+		t.Errorf("sessions after unquiesce = %d, want 2", n)
+	}
+}
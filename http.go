@@ -0,0 +1,312 @@
+package streamsh
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// listenHTTP starts serving HTTPHandler on d.HTTPAddr until ctx is done.
+func (d *Daemon) listenHTTP(ctx context.Context) error {
+	ln, err := net.Listen("tcp", d.HTTPAddr)
+	if err != nil {
+		return fmt.Errorf("listening on %s: %w", d.HTTPAddr, err)
+	}
+	d.httpServer = &http.Server{
+		Handler:     d.HTTPHandler(),
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+	d.Logger.Info("http api listening", "addr", ln.Addr().String())
+
+	go func() {
+		<-ctx.Done()
+		d.httpServer.Close()
+	}()
+	go func() {
+		if err := d.httpServer.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			d.Logger.Error("http server error", "err", err)
+		}
+	}()
+	return nil
+}
+
+// HTTPHandler returns the daemon's HTTP API, which offers session listing,
+// output queries, and input without MCP:
+//
+//	GET  /sessions                 JSON array of SessionInfo
+//	GET  /sessions/{id}/output     QuerySessionResponse; see below
+//	POST /sessions/{id}/input      body {"text": "...", "keys": [...]}, WriteSessionResponse
+//	GET  /sessions/{id}/stream     WebSocket of StreamLine messages
+//	GET  /metrics                  Prometheus metrics, see WriteMetrics
+//
+// The output endpoint takes the query_session parameters last_n, search,
+// search_regex, cursor, count, max_results, context, and raw as query
+// parameters. Errors are returned as {"message": "..."}.
+//
+// If d.Token is set, requests must send it as "Authorization: Bearer
+// <token>", or for WebSocket requests, which browsers can't add headers to,
+// as a token query parameter; pages on any origin that have the token may
+// then stream. Without a token, requests must be addressed to localhost or
+// an IP address and come from no Origin or the same one, so web pages can't
+// reach the API through cross-site requests or DNS rebinding. Input must be
+// sent as application/json, which browsers won't send cross-site without a
+// preflight.
+func (d *Daemon) HTTPHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /sessions", d.httpListSessions)
+	mux.HandleFunc("GET /sessions/{id}/output", d.httpSessionOutput)
+	mux.HandleFunc("POST /sessions/{id}/input", d.httpSessionInput)
+	mux.HandleFunc("GET /sessions/{id}/stream", d.httpSessionStream)
+	mux.HandleFunc("GET /metrics", d.httpMetrics)
+	if d.Token == "" {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if err := checkSameSite(r); err != nil {
+				writeJSONError(w, http.StatusForbidden, err)
+				return
+			}
+			mux.ServeHTTP(w, r)
+		})
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if token == "" && isWebSocketUpgrade(r) {
+			// Browsers can't set headers on WebSocket requests
+			token = r.URL.Query().Get("token")
+		}
+		if !d.validToken(token) {
+			writeJSONError(w, http.StatusUnauthorized, errors.New("invalid or missing token"))
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// checkSameSite rejects requests a web page could have made on a visitor's
+// behalf: those naming a host other than localhost or an IP address, as
+// after DNS rebinding, and those whose Origin isn't the host they were sent
+// to.
+func checkSameSite(r *http.Request) error {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if host != "localhost" && !strings.HasSuffix(host, ".localhost") && net.ParseIP(host) == nil {
+		return fmt.Errorf("host %q is not allowed without a token", r.Host)
+	}
+	if !sameOrigin(r) {
+		return fmt.Errorf("origin %q is not allowed without a token", r.Header.Get("Origin"))
+	}
+	return nil
+}
+
+// sameOrigin reports whether r has no Origin header or one naming the host
+// it was sent to.
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == r.Host
+}
+
+func (d *Daemon) httpListSessions(w http.ResponseWriter, r *http.Request) {
+	sessions := d.Store.List()
+	infos := make([]SessionInfo, len(sessions))
+	for i, s := range sessions {
+		infos[i] = sessionInfo(s)
+	}
+	writeJSON(w, http.StatusOK, infos)
+}
+
+func (d *Daemon) httpSessionOutput(w http.ResponseWriter, r *http.Request) {
+	sess, err := d.Store.Resolve(r.PathValue("id"))
+	if err != nil {
+		writeJSONError(w, http.StatusNotFound, err)
+		return
+	}
+
+	q := r.URL.Query()
+	p := QuerySessionPayload{
+		Search:      q.Get("search"),
+		SearchRegex: q.Get("search_regex"),
+	}
+	for _, param := range []struct {
+		name string
+		dst  *int
+	}{
+		{"last_n", &p.LastN},
+		{"count", &p.Count},
+		{"max_results", &p.MaxResults},
+		{"context", &p.Context},
+	} {
+		if v := q.Get(param.name); v != "" {
+			if *param.dst, err = strconv.Atoi(v); err != nil {
+				writeJSONError(w, http.StatusBadRequest, fmt.Errorf("invalid %s: %q", param.name, v))
+				return
+			}
+		}
+	}
+	if v := q.Get("cursor"); v != "" {
+		if p.Cursor, err = strconv.ParseUint(v, 10, 64); err != nil {
+			writeJSONError(w, http.StatusBadRequest, fmt.Errorf("invalid cursor: %q", v))
+			return
+		}
+	}
+	for _, param := range []struct {
+		name string
+		dst  *bool
+	}{
+		{"raw", &p.Raw},
+		{"commands", &p.IncludeCommands},
+		{"last_command", &p.LastCommandOutput},
+	} {
+		if v := q.Get(param.name); v != "" {
+			if *param.dst, err = strconv.ParseBool(v); err != nil {
+				writeJSONError(w, http.StatusBadRequest, fmt.Errorf("invalid %s: %q", param.name, v))
+				return
+			}
+		}
+	}
+
+	resp, err := querySession(sess, p)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (d *Daemon) httpSessionInput(w http.ResponseWriter, r *http.Request) {
+	sess, err := d.Store.Resolve(r.PathValue("id"))
+	if err != nil {
+		writeJSONError(w, http.StatusNotFound, err)
+		return
+	}
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/json" {
+		writeJSONError(w, http.StatusUnsupportedMediaType, errors.New("body must be sent as application/json"))
+		return
+	}
+	var body struct {
+		Text string   `json:"text"`
+		Keys []string `json:"keys"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Errorf("parsing body: %w", err))
+		return
+	}
+	text, err := inputText(body.Text, body.Keys)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := sess.SendInput(text); err != nil {
+		writeJSONError(w, http.StatusConflict, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, WriteSessionResponse{
+		Success:   true,
+		SessionID: sess.ShortID,
+		BytesSent: len(text),
+	})
+}
+
+// StreamLine is a WebSocket message from /sessions/{id}/stream.
+type StreamLine struct {
+	Seq  uint64 `json:"seq"`
+	Line string `json:"line"`
+}
+
+// streamReplayLines is how many retained lines a new stream starts with.
+const streamReplayLines = 200
+
+// httpSessionStream upgrades to a WebSocket and sends the session's recent
+// and new output lines, one StreamLine per message, until the session
+// disconnects, the browser goes away, or the daemon shuts down.
+func (d *Daemon) httpSessionStream(w http.ResponseWriter, r *http.Request) {
+	sess, err := d.Store.Resolve(r.PathValue("id"))
+	if err != nil {
+		writeJSONError(w, http.StatusNotFound, err)
+		return
+	}
+	ws, err := upgradeWebSocket(w, r)
+	if err != nil {
+		d.Logger.Debug("websocket upgrade failed", "id", sess.ShortID, "err", err)
+		return
+	}
+	defer ws.conn.Close() // also ends readLoop if a send fails
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	go func() {
+		ws.readLoop()
+		cancel()
+	}()
+
+	disconnected := sess.Disconnected()
+	from := sess.Buffer.TotalSeq()
+	from -= min(from, streamReplayLines)
+	lines := sess.Buffer.TailFrom(ctx, from)
+	expired := sess.Expired()
+	next := from // sequence number of the next line to send
+	send := func(line SearchResult) error {
+		next = line.Seq + 1
+		return ws.WriteText(mustMarshal(StreamLine{Seq: line.Seq, Line: line.Line}))
+	}
+	// flush sends the lines appended before the session went away, so
+	// closing doesn't cut off the end of its output
+	flush := func() {
+		end := sess.Buffer.TotalSeq()
+		timeout := time.After(time.Second)
+		for next < end {
+			select {
+			case line, ok := <-lines:
+				if !ok || send(line) != nil {
+					return
+				}
+			case <-timeout:
+				return
+			}
+		}
+	}
+
+	d.Logger.Debug("websocket stream attached", "id", sess.ShortID)
+	defer d.Logger.Debug("websocket stream detached", "id", sess.ShortID)
+	for {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				ws.Close(wsCloseGoingAway, "")
+				return
+			}
+			if err := send(line); err != nil {
+				return
+			}
+		case <-disconnected:
+			flush()
+			ws.Close(wsCloseNormal, "session disconnected")
+			return
+		case <-expired:
+			flush()
+			ws.Close(wsCloseNormal, "session expired")
+			return
+		}
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeJSONError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, ErrorPayload{Message: err.Error()})
+}
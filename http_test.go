@@ -0,0 +1,274 @@
+package streamsh
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHTTPAPI(t *testing.T) {
+	d, sock := startTestDaemon(t)
+	client, ack := registerTestSession(t, sock, RegisterPayload{Title: "ci", Collab: true})
+	client.send(t, MsgOutput, OutputPayload{Lines: []string{"build ok", "test failed: foo", "done"}})
+	sess, _ := d.Store.Resolve(ack.ShortID)
+	waitFor(t, func() bool { return sess.Buffer.Len() == 3 })
+
+	srv := httptest.NewServer(d.HTTPHandler())
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/sessions")
+	if err != nil {
+		t.Fatalf("list: %v", err)
+	}
+	var infos []SessionInfo
+	json.NewDecoder(resp.Body).Decode(&infos)
+	resp.Body.Close()
+	if len(infos) != 1 || infos[0].ID != ack.ShortID {
+		t.Fatalf("sessions = %+v", infos)
+	}
+
+	resp, err = http.Get(srv.URL + "/sessions/ci/output?search=failed")
+	if err != nil {
+		t.Fatalf("output: %v", err)
+	}
+	var out QuerySessionResponse
+	json.NewDecoder(resp.Body).Decode(&out)
+	resp.Body.Close()
+	if len(out.Lines) != 1 || !strings.Contains(out.Lines[0], "test failed: foo") {
+		t.Errorf("search lines = %q", out.Lines)
+	}
+
+	resp, err = http.Get(srv.URL + "/sessions/ci/output?last_n=2")
+	if err != nil {
+		t.Fatalf("output: %v", err)
+	}
+	out = QuerySessionResponse{}
+	json.NewDecoder(resp.Body).Decode(&out)
+	resp.Body.Close()
+	if len(out.Lines) != 2 || out.Lines[1] != "done" {
+		t.Errorf("last_n lines = %q", out.Lines)
+	}
+
+	resp, err = http.Post(srv.URL+"/sessions/ci/input", "application/json", strings.NewReader(`{"text":"make\n"}`))
+	if err != nil {
+		t.Fatalf("input: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("input status = %d", resp.StatusCode)
+	}
+	env := client.recv(t)
+	var in InputPayload
+	json.Unmarshal(env.Payload, &in)
+	if env.Type != MsgInput || in.Text != "make\n" {
+		t.Errorf("client got %s %+v", env.Type, in)
+	}
+
+	for _, c := range []struct {
+		url    string
+		status int
+	}{
+		{"/sessions/nope/output", http.StatusNotFound},
+		{"/sessions/ci/output?last_n=x", http.StatusBadRequest},
+	} {
+		resp, err := http.Get(srv.URL + c.url)
+		if err != nil {
+			t.Fatalf("%s: %v", c.url, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != c.status {
+			t.Errorf("%s: status = %d, want %d", c.url, resp.StatusCode, c.status)
+		}
+	}
+}
+
+func TestHTTPSessionStream(t *testing.T) {
+	d, sock := startTestDaemon(t)
+	client, ack := registerTestSession(t, sock, RegisterPayload{Title: "ci"})
+	client.send(t, MsgOutput, OutputPayload{Lines: []string{"one", "two"}})
+	sess, _ := d.Store.Resolve(ack.ShortID)
+	waitFor(t, func() bool { return sess.Buffer.Len() == 2 })
+
+	srv := httptest.NewServer(d.HTTPHandler())
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "GET /sessions/ci/stream HTTP/1.1\r\nHost: %s\r\n"+
+		"Connection: Upgrade\r\nUpgrade: websocket\r\n"+
+		"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n", srv.Listener.Addr())
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("handshake: %v", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("handshake: %s %v", resp.Status, resp.Header)
+	}
+
+	readFrame := func() (byte, []byte) {
+		t.Helper()
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		var hdr [2]byte
+		if _, err := io.ReadFull(br, hdr[:]); err != nil {
+			t.Fatalf("read frame: %v", err)
+		}
+		payload := make([]byte, hdr[1]&0x7F)
+		if _, err := io.ReadFull(br, payload); err != nil {
+			t.Fatalf("read frame: %v", err)
+		}
+		return hdr[0] & 0x0F, payload
+	}
+	wantLine := func(seq uint64, line string) {
+		t.Helper()
+		op, payload := readFrame()
+		var got StreamLine
+		json.Unmarshal(payload, &got)
+		if op != wsOpText || got != (StreamLine{Seq: seq, Line: line}) {
+			t.Errorf("got op %d %s, want %d %q", op, payload, seq, line)
+		}
+	}
+
+	// Retained lines are replayed, then new ones follow
+	wantLine(0, "one")
+	wantLine(1, "two")
+	client.send(t, MsgOutput, OutputPayload{Lines: []string{"three"}})
+	wantLine(2, "three")
+
+	// Disconnecting the session closes the stream after its last output
+	client.send(t, MsgOutput, OutputPayload{Lines: []string{"bye"}})
+	client.Close()
+	wantLine(3, "bye")
+	op, payload := readFrame()
+	if op != wsOpClose || len(payload) < 2 || binary.BigEndian.Uint16(payload) != wsCloseNormal {
+		t.Errorf("got op %d %q, want normal close", op, payload)
+	}
+}
+
+func TestHTTPToken(t *testing.T) {
+	d, _ := startTestDaemon(t, func(d *Daemon) { d.Token = "s3cret" })
+	srv := httptest.NewServer(d.HTTPHandler())
+	defer srv.Close()
+
+	for token, want := range map[string]int{"": http.StatusUnauthorized, "wrong": http.StatusUnauthorized, "s3cret": http.StatusOK} {
+		req, _ := http.NewRequest("GET", srv.URL+"/sessions", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("request: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("token %q: status %d, want %d", token, resp.StatusCode, want)
+		}
+	}
+}
+
+func TestHTTPRejectsCrossSite(t *testing.T) {
+	d, sock := startTestDaemon(t)
+	registerTestSession(t, sock, RegisterPayload{Title: "ci", Collab: true})
+	srv := httptest.NewServer(d.HTTPHandler())
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+
+	for _, c := range []struct {
+		name, method, host, origin, contentType string
+		status                                  int
+	}{
+		{"same origin", "GET", host, srv.URL, "", http.StatusOK},
+		{"localhost", "GET", "localhost:7890", "", "", http.StatusOK},
+		{"rebound host", "GET", "evil.example:7890", "", "", http.StatusForbidden},
+		{"foreign origin", "GET", host, "http://evil.example", "", http.StatusForbidden},
+		{"form post", "POST", host, "", "text/plain", http.StatusUnsupportedMediaType},
+		{"foreign json post", "POST", host, "http://evil.example", "application/json", http.StatusForbidden},
+	} {
+		url := srv.URL + "/sessions"
+		if c.method == "POST" {
+			url = srv.URL + "/sessions/ci/input"
+		}
+		req, _ := http.NewRequest(c.method, url, strings.NewReader(`{"text":"ls\n"}`))
+		req.Host = c.host
+		if c.origin != "" {
+			req.Header.Set("Origin", c.origin)
+		}
+		if c.contentType != "" {
+			req.Header.Set("Content-Type", c.contentType)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != c.status {
+			t.Errorf("%s: status = %d, want %d", c.name, resp.StatusCode, c.status)
+		}
+	}
+}
+
+func TestHTTPStreamAuth(t *testing.T) {
+	d, _ := startTestDaemon(t, func(d *Daemon) { d.Token = "s3cret" })
+	d.Store.Create("ci", 10, false, nil)
+	srv := httptest.NewServer(d.HTTPHandler())
+	defer srv.Close()
+	host := srv.Listener.Addr().String()
+
+	handshake := func(path, origin string) int {
+		t.Helper()
+		conn, err := net.Dial("tcp", host)
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		defer conn.Close()
+		fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: %s\r\n"+
+			"Connection: Upgrade\r\nUpgrade: websocket\r\n"+
+			"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n", path, host)
+		if origin != "" {
+			fmt.Fprintf(conn, "Origin: %s\r\n", origin)
+		}
+		fmt.Fprintf(conn, "\r\n")
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatalf("handshake: %v", err)
+		}
+		return resp.StatusCode
+	}
+
+	for _, c := range []struct {
+		path, origin string
+		status       int
+	}{
+		{"/sessions/ci/stream", "", http.StatusUnauthorized},
+		{"/sessions/ci/stream?token=wrong", "", http.StatusUnauthorized},
+		{"/sessions/ci/stream?token=s3cret", "", http.StatusSwitchingProtocols},
+		{"/sessions/ci/stream?token=s3cret", "http://" + host, http.StatusSwitchingProtocols},
+		{"/sessions/ci/stream?token=s3cret", "https://dashboard.example", http.StatusSwitchingProtocols},
+		{"/sessions/ci/stream", "https://dashboard.example", http.StatusUnauthorized},
+	} {
+		if got := handshake(c.path, c.origin); got != c.status {
+			t.Errorf("%s from %q: status %d, want %d", c.path, c.origin, got, c.status)
+		}
+	}
+
+	// The query parameter is only for WebSockets
+	resp, err := http.Get(srv.URL + "/sessions?token=s3cret")
+	if err != nil {
+		t.Fatalf("request: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("token query on /sessions: status %d, want %d", resp.StatusCode, http.StatusUnauthorized)
+	}
+}
@@ -0,0 +1,98 @@
+package streamsh
+
+import (
+	"fmt"
+	"strings"
+)
+
+// namedKeys maps key names accepted by write_session, lower-cased, to the
+// bytes a terminal sends for them.
+var namedKeys = map[string]string{
+	"enter":     "\r",
+	"return":    "\r",
+	"tab":       "\t",
+	"escape":    "\x1b",
+	"esc":       "\x1b",
+	"space":     " ",
+	"backspace": "\x7f",
+	"bspace":    "\x7f",
+	"delete":    "\x1b[3~",
+	"dc":        "\x1b[3~",
+	"insert":    "\x1b[2~",
+	"ic":        "\x1b[2~",
+	"up":        "\x1b[A",
+	"down":      "\x1b[B",
+	"right":     "\x1b[C",
+	"left":      "\x1b[D",
+	"home":      "\x1b[H",
+	"end":       "\x1b[F",
+	"pageup":    "\x1b[5~",
+	"pgup":      "\x1b[5~",
+	"pagedown":  "\x1b[6~",
+	"pgdn":      "\x1b[6~",
+	"f1":        "\x1bOP",
+	"f2":        "\x1bOQ",
+	"f3":        "\x1bOR",
+	"f4":        "\x1bOS",
+	"f5":        "\x1b[15~",
+	"f6":        "\x1b[17~",
+	"f7":        "\x1b[18~",
+	"f8":        "\x1b[19~",
+	"f9":        "\x1b[20~",
+	"f10":       "\x1b[21~",
+	"f11":       "\x1b[23~",
+	"f12":       "\x1b[24~",
+}
+
+// keySequence translates a key name to the bytes a terminal sends for it.
+// Names are those in namedKeys, case-insensitive; "C-x" for Ctrl plus a
+// letter or one of @[\]^_ (also "C-Space"); "M-x" for Meta (ESC prefix)
+// plus any other key; or a single character, sent as is.
+func keySequence(name string) (string, error) {
+	if seq, ok := namedKeys[strings.ToLower(name)]; ok {
+		return seq, nil
+	}
+	if len([]rune(name)) == 1 {
+		return name, nil
+	}
+	if len(name) > 2 && (name[:2] == "C-" || name[:2] == "c-") {
+		rest := name[2:]
+		if strings.EqualFold(rest, "space") {
+			return "\x00", nil
+		}
+		if len(rest) == 1 {
+			c := rest[0]
+			switch {
+			case c >= 'a' && c <= 'z':
+				return string(rune(c - 'a' + 1)), nil
+			case c >= '@' && c <= '_':
+				return string(rune(c - '@')), nil
+			case c == '?':
+				return "\x7f", nil
+			}
+		}
+	}
+	if len(name) > 2 && (name[:2] == "M-" || name[:2] == "m-") {
+		seq, err := keySequence(name[2:])
+		if err != nil {
+			return "", err
+		}
+		return "\x1b" + seq, nil
+	}
+	return "", fmt.Errorf("unknown key %q", name)
+}
+
+// inputText returns the bytes to write for a write_session request: text
+// followed by each of keys, translated by keySequence.
+func inputText(text string, keys []string) (string, error) {
+	var b strings.Builder
+	b.WriteString(text)
+	for _, key := range keys {
+		seq, err := keySequence(key)
+		if err != nil {
+			return "", err
+		}
+		b.WriteString(seq)
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,35 @@
+package streamsh
+
+import "testing"
+
+func TestKeySequence(t *testing.T) {
+	for name, want := range map[string]string{
+		"Enter":   "\r",
+		"escape":  "\x1b",
+		"Up":      "\x1b[A",
+		"F5":      "\x1b[15~",
+		"C-c":     "\x03",
+		"C-D":     "\x04",
+		"C-[":     "\x1b",
+		"C-Space": "\x00",
+		"M-b":     "\x1bb",
+		"M-Left":  "\x1b\x1b[D",
+		"q":       "q",
+		"é":       "é",
+	} {
+		got, err := keySequence(name)
+		if err != nil || got != want {
+			t.Errorf("keySequence(%q) = %q, %v; want %q", name, got, err, want)
+		}
+	}
+	for _, name := range []string{"Ctrl-C", "C-", "C-1", "M-Nope", ""} {
+		if got, err := keySequence(name); err == nil {
+			t.Errorf("keySequence(%q) = %q, want error", name, got)
+		}
+	}
+
+	text, err := inputText(":wq", []string{"Enter"})
+	if err != nil || text != ":wq\r" {
+		t.Errorf("inputText = %q, %v", text, err)
+	}
+}
@@ -0,0 +1,96 @@
+package streamsh
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// rotatingFile appends lines to a file. If maxSize is positive, a write
+// that would grow the file past it first renames the file to path + ".1",
+// replacing any previous one, and starts a new file.
+type rotatingFile struct {
+	path    string
+	maxSize int64
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+func openRotatingFile(path string, maxSize int64) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, maxSize: maxSize}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("opening log file: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("opening log file: %w", err)
+	}
+	r.f = f
+	r.size = info.Size()
+	return nil
+}
+
+// writeLines appends lines, each followed by a newline. The carriage
+// returns a terminal puts before newlines are dropped.
+func (r *rotatingFile) writeLines(lines []string) error {
+	if len(lines) == 0 {
+		return nil
+	}
+	var b strings.Builder
+	for _, line := range lines {
+		b.WriteString(strings.TrimSuffix(line, "\r"))
+		b.WriteByte('\n')
+	}
+	data := b.String()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.f == nil {
+		return os.ErrClosed
+	}
+	var rotateErr error
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(data)) > r.maxSize {
+		rotateErr = r.rotate()
+		if r.f == nil {
+			return rotateErr
+		}
+	}
+	n, err := r.f.WriteString(data)
+	r.size += int64(n)
+	return errors.Join(rotateErr, err)
+}
+
+// rotate moves the file aside and starts a new one. If it can't be moved,
+// the original file is reopened so writing carries on past maxSize.
+func (r *rotatingFile) rotate() error {
+	r.f.Close()
+	r.f = nil
+	if err := os.Rename(r.path, r.path+".1"); err != nil {
+		return errors.Join(fmt.Errorf("rotating log file: %w", err), r.open())
+	}
+	return r.open()
+}
+
+func (r *rotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.f == nil {
+		return nil
+	}
+	err := r.f.Close()
+	r.f = nil
+	return err
+}
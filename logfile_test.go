@@ -0,0 +1,56 @@
+package streamsh
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "session.log")
+	r, err := openRotatingFile(path, 20)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer r.Close()
+
+	r.writeLines([]string{"first line\r", "second"}) // 18 bytes
+	r.writeLines([]string{"third"})                  // would pass 20: rotates
+
+	got, _ := os.ReadFile(path + ".1")
+	if string(got) != "first line\nsecond\n" {
+		t.Errorf("rotated file = %q", got)
+	}
+	got, _ = os.ReadFile(path)
+	if string(got) != "third\n" {
+		t.Errorf("current file = %q", got)
+	}
+
+	// Reopening appends and keeps counting from the existing size
+	r.Close()
+	r, err = openRotatingFile(path, 20)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	r.writeLines([]string{"fourth"})
+	got, _ = os.ReadFile(path)
+	if string(got) != "third\nfourth\n" {
+		t.Errorf("after reopen = %q", got)
+	}
+
+	// If the file can't be moved aside, writing carries on in place
+	os.Remove(path + ".1")
+	if err := os.MkdirAll(filepath.Join(path+".1", "blocker"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.writeLines([]string{"fifth line"}); err == nil {
+		t.Error("expected an error for the failed rotation")
+	}
+	if err := r.writeLines([]string{"sixth"}); err == nil {
+		t.Error("expected the rotation to be retried and fail again")
+	}
+	got, _ = os.ReadFile(path)
+	if string(got) != "third\nfourth\nfifth line\nsixth\n" {
+		t.Errorf("after failed rotation = %q", got)
+	}
+}
@@ -0,0 +1,235 @@
+package streamsh
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/creack/pty"
+	"github.com/google/uuid"
+)
+
+// ErrSpawnDisabled is returned for MsgSpawnSession unless Daemon.AllowSpawn
+// is set.
+var ErrSpawnDisabled = errors.New("spawning sessions is disabled (start streamshd with --allow-spawn)")
+
+// spawnedSessionSize is the terminal size of a DaemonManagedSession, which
+// has no terminal of its own to inherit one from.
+var spawnedSessionSize = pty.Winsize{Rows: 24, Cols: 80}
+
+// DaemonManagedSession is a shell the daemon runs itself, in a PTY, at a
+// MsgSpawnSession request. It talks to the daemon over an in-memory
+// connection just as a streamsh client would, so the session is queried,
+// written to, signaled, and killed like any other.
+type DaemonManagedSession struct {
+	cmd     *exec.Cmd
+	ptmx    *os.File
+	conn    net.Conn // the session's end of the connection
+	scanner *bufio.Scanner
+	out     *ConnWriter
+	logger  *slog.Logger
+	id      string
+	once    sync.Once // guards kill
+}
+
+// spawnSession starts a DaemonManagedSession and registers it in the
+// store, as if its client had connected.
+func (d *Daemon) spawnSession(ctx context.Context, p SpawnPayload) (*RegisterAck, error) {
+	if !d.AllowSpawn {
+		return nil, ErrSpawnDisabled
+	}
+	shell := p.Shell
+	if shell == "" {
+		shell = os.Getenv("SHELL")
+		if shell == "" {
+			shell = "/bin/sh"
+		}
+	}
+	id := uuid.New().String()
+	streamshEnv := id[:8]
+	if p.Title != "" {
+		streamshEnv += " - " + p.Title
+	}
+	cmd := exec.Command(shell)
+	cmd.Env = append(os.Environ(), "STREAMSH="+streamshEnv)
+	ptmx, err := pty.StartWithSize(cmd, &spawnedSessionSize)
+	if err != nil {
+		return nil, fmt.Errorf("starting pty: %w", err)
+	}
+
+	daemonEnd, sessEnd := net.Pipe()
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		d.handleConn(ctx, daemonEnd)
+	}()
+	ms := &DaemonManagedSession{
+		cmd:     cmd,
+		ptmx:    ptmx,
+		conn:    sessEnd,
+		scanner: bufio.NewScanner(sessEnd),
+		out:     NewConnWriter(sessEnd),
+		logger:  d.Logger,
+		id:      id[:8],
+	}
+	ack, err := ms.register(RegisterPayload{
+		Title:     p.Title,
+		Collab:    p.Collab,
+		SessionID: id,
+		Tags:      p.Tags,
+		Pid:       cmd.Process.Pid,
+	}, d.Token)
+	if err != nil {
+		ms.kill()
+		cmd.Wait()
+		sessEnd.Close()
+		return nil, err
+	}
+	go ms.run()
+	d.Logger.Info("spawned session", "id", ack.ShortID, "shell", shell)
+	return ack, nil
+}
+
+// register sends MsgRegister and waits for the daemon's ack.
+func (ms *DaemonManagedSession) register(p RegisterPayload, token string) (*RegisterAck, error) {
+	err := ms.out.Write(Envelope{Type: MsgRegister, Token: token, Payload: mustMarshal(p)})
+	if err != nil {
+		return nil, err
+	}
+	if !ms.scanner.Scan() {
+		return nil, fmt.Errorf("registering session: %w", cmp.Or(ms.scanner.Err(), io.ErrUnexpectedEOF))
+	}
+	var env Envelope
+	if err := json.Unmarshal(ms.scanner.Bytes(), &env); err != nil {
+		return nil, fmt.Errorf("registering session: %w", err)
+	}
+	switch env.Type {
+	case MsgAck:
+		var ack RegisterAck
+		if err := json.Unmarshal(env.Payload, &ack); err != nil {
+			return nil, fmt.Errorf("registering session: %w", err)
+		}
+		// Only now: the connection is unbuffered, and the daemon answers
+		// each message before reading the next
+		ms.out.Write(Envelope{Type: MsgResize, Payload: mustMarshal(ResizePayload{
+			Rows: int(spawnedSessionSize.Rows),
+			Cols: int(spawnedSessionSize.Cols),
+		})})
+		return &ack, nil
+	case MsgError:
+		var e ErrorPayload
+		json.Unmarshal(env.Payload, &e)
+		return nil, errors.New(e.Message)
+	}
+	return nil, fmt.Errorf("registering session: unexpected %s", env.Type)
+}
+
+// run streams the shell's output to the daemon and handles its messages
+// until the shell exits, then disconnects.
+func (ms *DaemonManagedSession) run() {
+	defer ms.conn.Close()
+	go ms.handleMessages()
+
+	copied := make(chan struct{})
+	go func() {
+		defer close(copied)
+		ms.copyOutput()
+	}()
+	ms.cmd.Wait()
+	// As in Client.Run, a background process may hold the PTY open
+	select {
+	case <-copied:
+	case <-time.After(ptyDrainTimeout):
+		ms.ptmx.Close()
+		<-copied
+	}
+	ms.ptmx.Close()
+	ms.out.Write(Envelope{Type: MsgDisconnect})
+	ms.logger.Info("spawned session exited", "id", ms.id)
+}
+
+// copyOutput sends the PTY's output to the daemon a line at a time.
+func (ms *DaemonManagedSession) copyOutput() {
+	buf := make([]byte, 4096)
+	var lineBuf bytes.Buffer
+	for {
+		n, err := ms.ptmx.Read(buf)
+		var lines []string
+		for _, b := range buf[:n] {
+			if b == '\n' {
+				lines = append(lines, lineBuf.String())
+				lineBuf.Reset()
+			} else {
+				lineBuf.WriteByte(b)
+			}
+		}
+		if err != nil && lineBuf.Len() > 0 {
+			lines = append(lines, lineBuf.String())
+		}
+		if len(lines) > 0 {
+			ms.out.Write(Envelope{Type: MsgOutput, Payload: mustMarshal(OutputPayload{Lines: lines})})
+		}
+		if err != nil {
+			if err != io.EOF {
+				ms.logger.Debug("pty read error", "id", ms.id, "err", err)
+			}
+			return
+		}
+	}
+}
+
+// handleMessages answers the daemon's pings and carries out its input,
+// signal, and kill requests until the connection closes.
+func (ms *DaemonManagedSession) handleMessages() {
+	for ms.scanner.Scan() {
+		var env Envelope
+		if err := json.Unmarshal(ms.scanner.Bytes(), &env); err != nil {
+			continue
+		}
+		switch env.Type {
+		case MsgPing:
+			ms.out.Write(Envelope{Type: MsgPong})
+		case MsgInput:
+			var p InputPayload
+			if env.Payload != nil {
+				json.Unmarshal(env.Payload, &p)
+			}
+			ms.ptmx.Write([]byte(p.Text))
+		case MsgSignal:
+			var p SignalPayload
+			if env.Payload != nil {
+				json.Unmarshal(env.Payload, &p)
+			}
+			_, sig, err := parseSignal(p.Signal)
+			if err == nil {
+				err = signalForeground(ms.ptmx, ms.cmd, sig)
+			}
+			if err != nil {
+				ms.logger.Warn("sending signal failed", "id", ms.id, "signal", p.Signal, "err", err)
+			}
+		case MsgKill, MsgShutdown:
+			// The shell is the daemon's child, so it goes with the daemon
+			ms.kill()
+		}
+	}
+}
+
+// kill hangs up the shell, as Client.kill does.
+func (ms *DaemonManagedSession) kill() {
+	ms.once.Do(func() {
+		ms.ptmx.Close()
+		ms.cmd.Process.Signal(syscall.SIGHUP)
+	})
+}
@@ -0,0 +1,68 @@
+package streamsh
+
+import (
+	"context"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestDaemonSpawnSession(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, sock := startTestDaemon(t)
+	dc, err := NewDaemonClient(sock, "")
+	if err != nil {
+		t.Fatalf("daemon client: %v", err)
+	}
+	defer dc.Close()
+	if _, err := dc.SpawnSession(ctx, SpawnPayload{Shell: "/bin/sh"}); err == nil || err.Error() != ErrSpawnDisabled.Error() {
+		t.Fatalf("spawn without AllowSpawn: err = %v, want %v", err, ErrSpawnDisabled)
+	}
+
+	d, sock := startTestDaemon(t, func(d *Daemon) { d.AllowSpawn = true })
+	dc, err = NewDaemonClient(sock, "")
+	if err != nil {
+		t.Fatalf("daemon client: %v", err)
+	}
+	defer dc.Close()
+	ack, err := dc.SpawnSession(ctx, SpawnPayload{Title: "scratch", Shell: "/bin/sh", Collab: true, Tags: []string{"agent"}})
+	if err != nil {
+		t.Fatalf("spawn: %v", err)
+	}
+	sess, err := d.Store.Resolve("scratch")
+	if err != nil {
+		t.Fatalf("resolve spawned session: %v", err)
+	}
+	if sess.ShortID != ack.ShortID || !sess.Connected() || !sess.Collab() || !sess.HasTag("agent") || sess.Pid() == 0 {
+		t.Errorf("spawned session = %+v, ack = %+v", sess, ack)
+	}
+
+	if _, err := dc.WriteSession(ctx, WriteSessionPayload{Session: ack.ShortID, Text: "echo spawned-$((1+1))\n"}); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	waitFor(t, func() bool { return len(sess.Buffer.Search("spawned-2", 10)) == 1 })
+
+	if _, err := dc.KillSession(ctx, ack.ShortID); err != nil {
+		t.Fatalf("kill: %v", err)
+	}
+	// The shell has exited and been reaped
+	waitFor(t, func() bool { return syscall.Kill(sess.Pid(), 0) != nil })
+
+	// A spawned shell that is still running ends with the daemon
+	ack, err = dc.SpawnSession(ctx, SpawnPayload{Shell: "/bin/sh"})
+	if err != nil {
+		t.Fatalf("spawn: %v", err)
+	}
+	closed := make(chan struct{})
+	go func() {
+		d.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(3 * time.Second):
+		t.Fatalf("daemon close waited on spawned session %s", ack.ShortID)
+	}
+}
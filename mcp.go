@@ -1,50 +1,324 @@
 package streamsh
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/modelcontextprotocol/go-sdk/mcp"
 )
 
 // SessionInfo is the JSON representation of a session in list_sessions output.
 type SessionInfo struct {
-	ID          string `json:"id"`
-	Title       string `json:"title"`
-	LastCommand string `json:"last_command"`
-	LineCount   int    `json:"line_count"`
-	CreatedAt   string `json:"created_at"`
-	Connected   bool   `json:"connected"`
-	Collab      bool   `json:"collab"`
+	ID           string   `json:"id"`
+	Title        string   `json:"title"`
+	LastCommand  string   `json:"last_command"`
+	LastExit     *int     `json:"last_exit_code,omitempty"`
+	LineCount    int      `json:"line_count"`
+	CreatedAt    string   `json:"created_at"`
+	LastActivity string   `json:"last_activity"` // when the client last sent output, a command, etc.
+	IdleSeconds  int64    `json:"idle_seconds"`  // time since LastActivity
+	Connected    bool     `json:"connected"`
+	Collab       bool     `json:"collab"`
+	ReadOnly     bool     `json:"read_only,omitempty"`
+	Paused       bool     `json:"paused,omitempty"` // the user paused streaming; no output or commands arrive meanwhile
+	Tags         []string `json:"tags,omitempty"`
+	Rows         int      `json:"rows,omitempty"`
+	Cols         int      `json:"cols,omitempty"`
+	Cwd          string   `json:"cwd,omitempty"`
+	Pid          int      `json:"shell_pid,omitempty"` // on the client's host, not the daemon's
+}
+
+// SessionDetails is the full metadata of one session, as returned by
+// get_session_info: its SessionInfo plus what list_sessions leaves out.
+type SessionDetails struct {
+	SessionInfo
+	UUID           string `json:"uuid"`
+	CommandStarted string `json:"last_command_started,omitempty"` // when LastCommand started running
+	KeepANSI       bool   `json:"keep_ansi,omitempty"`
+	TTL            string `json:"ttl,omitempty"`              // idle time after disconnecting before the session is pruned
+	BufferCapacity int    `json:"buffer_capacity"`            // lines, or the current backing size if bounded by bytes
+	BufferMaxBytes int    `json:"buffer_max_bytes,omitempty"` // set if the buffer is bounded by bytes
+	BufferBytes    int    `json:"buffer_bytes"`
+	TotalLines     uint64 `json:"total_lines"`      // ever received, including evicted lines
+	OldestSeq      uint64 `json:"oldest_seq"`       // of the oldest line still buffered
+	LinesPerMinute int64  `json:"lines_per_minute"` // received in the last whole minute
+	CommandCount   int    `json:"command_count"`
+}
+
+// SessionStats is a session's buffer utilization and throughput, as
+// returned by session_stats.
+type SessionStats struct {
+	SessionID         string  `json:"session_id"`
+	BufferCapacity    int     `json:"buffer_capacity"` // lines, or the current backing size if bounded by bytes
+	BufferUsed        int     `json:"buffer_used"`     // lines currently buffered
+	TotalLinesEver    uint64  `json:"total_lines_ever"`
+	OldestSeq         uint64  `json:"oldest_seq"`           // of the oldest line still buffered
+	NewestSeq         *uint64 `json:"newest_seq,omitempty"` // of the newest line, nil before the first
+	Connected         bool    `json:"connected"`
+	Collab            bool    `json:"collab"`
+	CreatedAt         string  `json:"created_at"`
+	LastActivity      string  `json:"last_activity"`
+	LastCommand       string  `json:"last_command"`
+	Rows              int     `json:"rows,omitempty"`
+	Cols              int     `json:"cols,omitempty"`
+	AvgLinesPerMinute float64 `json:"avg_lines_per_minute"` // rolling average over the last 60 seconds
 }
 
 // ListSessionsInput is the input for the list_sessions tool.
-type ListSessionsInput struct{}
+type ListSessionsInput struct {
+	Tags          []string `json:"tags,omitempty" jsonschema:"Only list sessions labeled with any of these tags"`
+	MatchAll      bool     `json:"match_all,omitempty" jsonschema:"Require sessions to have all of tags instead of any"`
+	ConnectedOnly bool     `json:"connected_only,omitempty" jsonschema:"Only list sessions whose terminal is still connected"`
+	TitleContains string   `json:"title_contains,omitempty" jsonschema:"Only list sessions whose title contains this text (case-insensitive)"`
+	Limit         int      `json:"limit,omitempty" jsonschema:"Return at most this many sessions"`
+}
 
 // QuerySessionInput is the input for the query_session tool.
 type QuerySessionInput struct {
-	Session    string `json:"session" jsonschema:"required,Session identifier: short ID, UUID, or title"`
-	Search     string `json:"search,omitempty" jsonschema:"Fuzzy/substring search pattern to match against output lines"`
-	LastN      int    `json:"last_n,omitempty" jsonschema:"Return the last N lines of output"`
-	Cursor     uint64 `json:"cursor,omitempty" jsonschema:"Start reading from this sequence number for pagination"`
-	Count      int    `json:"count,omitempty" jsonschema:"Number of lines to return with cursor mode (default 100)"`
-	MaxResults int    `json:"max_results,omitempty" jsonschema:"Max results for search mode (default 50)"`
+	Session           string   `json:"session,omitempty" jsonschema:"Session identifier: short ID, UUID, or title. May be omitted if tags identify exactly one session"`
+	Tags              []string `json:"tags,omitempty" jsonschema:"Select the one session labeled with all of these tags, instead of session"`
+	Search            string   `json:"search,omitempty" jsonschema:"Fuzzy/substring search pattern to match against output lines"`
+	SearchRegex       string   `json:"search_regex,omitempty" jsonschema:"Regular expression (RE2 syntax) to match against output lines. Use (?i) for case-insensitive matching"`
+	LastN             int      `json:"last_n,omitempty" jsonschema:"Return the last N lines of output"`
+	Cursor            uint64   `json:"cursor,omitempty" jsonschema:"Start reading from this sequence number for pagination"`
+	Count             int      `json:"count,omitempty" jsonschema:"Number of lines to return with cursor mode (default 100)"`
+	MaxResults        int      `json:"max_results,omitempty" jsonschema:"Max results for search mode (default 50)"`
+	Context           int      `json:"context,omitempty" jsonschema:"Search mode: include this many lines before and after each match (e.g. for stack traces)"`
+	Before            int      `json:"before,omitempty" jsonschema:"Search mode: lines to include before each match (overrides context)"`
+	After             int      `json:"after,omitempty" jsonschema:"Search mode: lines to include after each match (overrides context)"`
+	Since             string   `json:"since,omitempty" jsonschema:"Only return lines produced at or after this time (RFC3339 or unix seconds). Useful for reading exactly the output of a command you just ran"`
+	Until             string   `json:"until,omitempty" jsonschema:"Only return lines produced at or before this time (RFC3339 or unix seconds)"`
+	NewestFirst       bool     `json:"newest_first,omitempty" jsonschema:"Search mode: return the most recent matches first instead of the oldest. Use this when debugging something that just failed"`
+	Exclude           string   `json:"exclude,omitempty" jsonschema:"Drop lines containing this substring (case-insensitive), e.g. DEBUG to hide noisy logs. Applies to search, last_n, and cursor reads"`
+	ExcludeRegex      string   `json:"exclude_regex,omitempty" jsonschema:"Drop lines matching this regular expression. Applies to search, last_n, and cursor reads"`
+	IncludeTimestamps bool     `json:"include_timestamps,omitempty" jsonschema:"Also return when each line was produced, as a timestamps array parallel to lines, or a timestamp on each match when context is requested"`
+	CountOnly         bool     `json:"count_only,omitempty" jsonschema:"Search mode: return only match_count, the total number of matching lines, instead of the lines themselves"`
+	Raw               bool     `json:"raw,omitempty" jsonschema:"Return lines with their ANSI color codes, for sessions started with --keep-ansi. Only useful for showing output to a human; leave unset to read plain text"`
+	LastCommandOutput bool     `json:"last_command_output,omitempty" jsonschema:"Return the output of the most recent command the user ran (including output so far if it is still running) along with the command and its exit_code. The easiest way to see what just happened. Falls back to the last 50 lines if the shell doesn't report command boundaries. Page through long output with cursor set to next_cursor"`
+	IncludeCommands   bool     `json:"include_commands,omitempty" jsonschema:"Also return commands, an index of the commands whose output is in the buffer: command, start_seq, end_seq (exclusive, absent while running), and exit_code. To read only one command's output, query again with cursor=start_seq and count=end_seq-start_seq"`
+}
+
+// SearchAllSessionsInput is the input for the search_all_sessions tool.
+type SearchAllSessionsInput struct {
+	Search               string   `json:"search,omitempty" jsonschema:"Fuzzy/substring search pattern to match against output lines"`
+	SearchRegex          string   `json:"search_regex,omitempty" jsonschema:"Regular expression (RE2 syntax) to match against output lines, instead of search. Use (?i) for case-insensitive matching"`
+	Tags                 []string `json:"tags,omitempty" jsonschema:"Only search sessions labeled with any of these tags"`
+	ConnectedOnly        bool     `json:"connected_only,omitempty" jsonschema:"Only search sessions whose terminal is still connected"`
+	MaxResults           int      `json:"max_results,omitempty" jsonschema:"Max matches to return across all sessions (default 50)"`
+	MaxResultsPerSession int      `json:"max_results_per_session,omitempty" jsonschema:"Max matches to return from any one session, so a noisy session doesn't crowd out the rest"`
+	NewestFirst          bool     `json:"newest_first,omitempty" jsonschema:"Return each session's most recent matches first instead of the oldest"`
+}
+
+// WatchSessionInput is the input for the watch_session tool.
+type WatchSessionInput struct {
+	Session  string  `json:"session" jsonschema:"required,Session identifier: short ID, UUID, or title"`
+	FromSeq  *uint64 `json:"from_seq,omitempty" jsonschema:"Start from this sequence number, e.g. the next_cursor of an earlier query_session, so output printed in between is not missed; 0 replays the whole buffer. Default: only new output"`
+	TimeoutS int     `json:"timeout_s,omitempty" jsonschema:"Return after this many seconds (default 30, max 300)"`
+}
+
+// WatchedLine is an output line seen by watch_session. Each is sent as a
+// progress notification when it arrives, and collected in the result.
+type WatchedLine struct {
+	Seq  uint64 `json:"seq"`
+	Line string `json:"line"`
+}
+
+// WatchSessionResult is the JSON output of the watch_session tool. Ended
+// says why the watch stopped: "timeout", "disconnected" (the terminal
+// went away), or "closed" (the session was removed or the daemon
+// connection was lost).
+type WatchSessionResult struct {
+	Session    string        `json:"session"`
+	Lines      []WatchedLine `json:"lines"`
+	NextCursor uint64        `json:"next_cursor,omitempty"`
+	Truncated  bool          `json:"truncated,omitempty"` // only the newest maxWatchLines are included
+	Ended      string        `json:"ended"`
+}
+
+// watch_session limits: how long it waits by default and at most, and how
+// many lines its result holds.
+const (
+	defaultWatchTimeout = 30 * time.Second
+	maxWatchTimeout     = 5 * time.Minute
+	maxWatchLines       = 1000
+)
+
+// WaitForPatternInput is the input for the wait_for_pattern tool.
+type WaitForPatternInput struct {
+	Session        string `json:"session" jsonschema:"required,Session identifier: short ID, UUID, or title"`
+	Pattern        string `json:"pattern" jsonschema:"required,Text to wait for: a case-insensitive substring, or a regular expression with use_regex"`
+	UseRegex       bool   `json:"use_regex,omitempty" jsonschema:"Treat pattern as a regular expression (RE2 syntax). Use (?i) for case-insensitive matching"`
+	FromSeq        uint64 `json:"from_seq,omitempty" jsonschema:"Only match lines from this sequence number on, e.g. the next_cursor of write_session or query_session, so output of earlier commands doesn't match. Default: the oldest line in the buffer"`
+	TimeoutS       int    `json:"timeout_s,omitempty" jsonschema:"Give up after this many seconds (default 30, max 300)"`
+	PollIntervalMs int    `json:"poll_interval_ms,omitempty" jsonschema:"How often to check for new output, in milliseconds (default 500, min 50)"`
+}
+
+// WaitForPatternResult is the JSON output of the wait_for_pattern tool.
+// Seq and MatchedLine are set unless it timed out.
+type WaitForPatternResult struct {
+	MatchedLine string  `json:"matched_line,omitempty"`
+	Seq         *uint64 `json:"seq,omitempty"`
+	ElapsedMs   int64   `json:"elapsed_ms"`
+	TimedOut    bool    `json:"timed_out,omitempty"`
 }
 
+// wait_for_pattern's poll interval, by default and at least.
+const (
+	defaultPollInterval = 500 * time.Millisecond
+	minPollInterval     = 50 * time.Millisecond
+)
+
 // WriteSessionInput is the input for the write_session tool.
 type WriteSessionInput struct {
+	Session string   `json:"session" jsonschema:"required,Session identifier: short ID, UUID, or title"`
+	Text    string   `json:"text,omitempty" jsonschema:"Raw text to write to the session PTY. Text is written byte-for-byte to the PTY. To press Enter/execute a command you MUST include an actual newline character at the end of your text (not a literal backslash-n), or add Enter to keys. Only works on collaborative sessions (started with --collab)."`
+	Keys    []string `json:"keys,omitempty" jsonschema:"Keys to press after text, in order, e.g. [\"C-c\"] to interrupt, [\"Up\", \"Enter\"] to rerun the last command, or [\"Escape\", \":\", \"q\", \"Enter\"] to quit vim. Names: Enter, Tab, Escape, Space, Backspace, Delete, Insert, Up, Down, Left, Right, Home, End, PageUp, PageDown, F1-F12; C-<letter> for Ctrl; M-<key> for Alt; or any single character"`
+	WaitMs  int      `json:"wait_ms,omitempty" jsonschema:"Wait up to this many milliseconds (max 10000) for the output that follows and return it as lines, with next_cursor to keep reading via query_session. Returns early once output has been quiet for 300ms"`
+}
+
+// KillSessionInput is the input for the kill_session tool.
+type KillSessionInput struct {
+	Session string `json:"session" jsonschema:"required,Session identifier: short ID, UUID, or title"`
+}
+
+// CreateSessionInput is the input for the create_session tool.
+type CreateSessionInput struct {
+	Title  string   `json:"title,omitempty" jsonschema:"Title for the new session, usable to refer to it"`
+	Shell  string   `json:"shell,omitempty" jsonschema:"Shell to run, e.g. /bin/bash. Default: the daemon's $SHELL"`
+	Collab bool     `json:"collab,omitempty" jsonschema:"Accept input from write_session, send_signal, and kill_session. Needed to run commands in the session"`
+	Tags   []string `json:"tags,omitempty" jsonschema:"Tags to filter list_sessions by"`
+}
+
+// DeleteSessionInput is the input for the delete_session tool.
+type DeleteSessionInput struct {
+	Session string `json:"session" jsonschema:"required,Session identifier: short ID, UUID, or title"`
+	Force   bool   `json:"force,omitempty" jsonschema:"Delete the session even if its terminal is still connected"`
+}
+
+// SendSignalInput is the input for the send_signal tool.
+type SendSignalInput struct {
+	Session string `json:"session" jsonschema:"required,Session identifier: short ID, UUID, or title"`
+	Signal  string `json:"signal" jsonschema:"required,Signal name: SIGINT, SIGTERM, SIGKILL, SIGHUP, SIGQUIT, SIGTSTP, SIGCONT, SIGUSR1, or SIGUSR2"`
+}
+
+// GetSessionEnvInput is the input for the get_session_env tool.
+type GetSessionEnvInput struct {
+	Session string   `json:"session" jsonschema:"required,Session identifier: short ID, UUID, or title"`
+	Keys    []string `json:"keys,omitempty" jsonschema:"Only return these variables, e.g. [\"PATH\", \"VIRTUAL_ENV\"]. Strongly recommended: the full environment is large"`
+}
+
+// RenameSessionInput is the input for the rename_session tool.
+type RenameSessionInput struct {
 	Session string `json:"session" jsonschema:"required,Session identifier: short ID, UUID, or title"`
-	Text    string `json:"text" jsonschema:"required,Raw text to write to the session PTY. Text is written byte-for-byte to the PTY. To press Enter/execute a command you MUST include an actual newline character at the end of your text (not a literal backslash-n). Only works on collaborative sessions (started with --collab)."`
+	Title   string `json:"title" jsonschema:"required,New title for the session. Must not be used by another session"`
 }
 
-// RegisterMCPTools registers list_sessions, query_session, and write_session on the MCP server.
-func RegisterMCPTools(server *mcp.Server, dc *DaemonClient) {
+// SetBufferSizeInput is the input for the set_buffer_size tool.
+type SetBufferSizeInput struct {
+	Session  string `json:"session" jsonschema:"required,Session identifier: short ID, UUID, or title"`
+	Capacity int    `json:"capacity" jsonschema:"required,New buffer capacity in lines (at most 1000000)"`
+}
+
+// SessionInfoInput is the input for the get_session_info tool.
+type SessionInfoInput struct {
+	Session string `json:"session" jsonschema:"required,Session identifier: short ID, UUID, or title"`
+}
+
+// SessionStatsInput is the input for the session_stats tool.
+type SessionStatsInput struct {
+	Session string `json:"session" jsonschema:"required,Session identifier: short ID, UUID, or title"`
+}
+
+// CommandHistoryInput is the input for the get_command_history tool.
+type CommandHistoryInput struct {
+	Session string `json:"session" jsonschema:"required,Session identifier: short ID, UUID, or title"`
+	Limit   int    `json:"limit,omitempty" jsonschema:"Number of most recent commands to return (default 20)"`
+}
+
+// ExportSessionInput is the input for the export_session tool.
+type ExportSessionInput struct {
+	Session   string `json:"session" jsonschema:"required,Session identifier: short ID, UUID, or title"`
+	Path      string `json:"path,omitempty" jsonschema:"Write the full output to this file instead of returning it. Use an absolute path on the machine running streamsh; the file is created or overwritten"`
+	StripANSI bool   `json:"strip_ansi,omitempty" jsonschema:"Remove ANSI escape sequences such as colors from the output"`
+	Format    string `json:"format,omitempty" jsonschema:"text (default): the lines as printed; jsonl: one {seq, line} JSON object per line, with sequence numbers usable as query_session cursors"`
+}
+
+// ExportSessionResult is the JSON output of the export_session tool.
+type ExportSessionResult struct {
+	Session    string `json:"session"`
+	TotalLines int    `json:"total_lines"`
+	Bytes      int64  `json:"bytes"`
+	Path       string `json:"path,omitempty"`
+	Text       string `json:"text,omitempty"`
+	Truncated  bool   `json:"truncated,omitempty"`
+}
+
+// exportInlineLimit caps the text export_session returns inline.
+const exportInlineLimit = 256 * 1024
+
+// exportSink counts exported lines and bytes, writing them to w or, if w
+// is nil, keeping the first exportInlineLimit bytes of whole lines.
+type exportSink struct {
+	w         io.Writer
+	buf       bytes.Buffer
+	lines     int
+	bytes     int64
+	truncated bool
+}
+
+func (s *exportSink) Write(p []byte) (int, error) {
+	s.lines += bytes.Count(p, []byte{'\n'})
+	s.bytes += int64(len(p))
+	if s.w != nil {
+		return s.w.Write(p)
+	}
+	if !s.truncated {
+		if room := exportInlineLimit - s.buf.Len(); len(p) <= room {
+			s.buf.Write(p)
+		} else {
+			s.buf.Write(p[:room])
+			s.truncated = true
+		}
+	}
+	return len(p), nil
+}
+
+// text returns the collected output, cut back to the last whole line if
+// it was truncated.
+func (s *exportSink) text() string {
+	b := s.buf.Bytes()
+	if s.truncated {
+		b = b[:bytes.LastIndexByte(b, '\n')+1]
+	}
+	return string(b)
+}
+
+// RegisterMCPTools registers list_sessions, query_session,
+// search_all_sessions, watch_session, wait_for_pattern, write_session,
+// send_signal, kill_session, create_session, delete_session,
+// rename_session, set_buffer_size, get_session_info, session_stats,
+// get_command_history, get_session_env, and export_session on the MCP
+// server. Each tool call checks out its own client from pool.
+func RegisterMCPTools(server *mcp.Server, pool *DaemonClientPool) {
 	mcp.AddTool(server, &mcp.Tool{
 		Name:        "list_sessions",
-		Description: "List all terminal sessions. Returns each session's ID, title, last command run, and connection status. Use this to find sessions relevant to your current task before querying their output.",
-	}, func(ctx context.Context, req *mcp.CallToolRequest, input ListSessionsInput) (*mcp.CallToolResult, any, error) {
-		infos, err := dc.ListSessions()
+		Description: "List all terminal sessions. Returns each session's ID, title, tags, last command run, its exit code once it has finished, idle_seconds since it last produced output (the session the user is working in is usually the least idle), working directory, shell_pid (the shell's process ID on the machine running the terminal), terminal size, connection status, and paused if the user has paused streaming. Sessions are listed most recently active first. Pass tags, connected_only, title_contains, or limit to narrow the list. Use this to find sessions relevant to your current task before querying their output.",
+	}, withClient(pool, func(ctx context.Context, req *mcp.CallToolRequest, input ListSessionsInput, dc *DaemonClient) (*mcp.CallToolResult, any, error) {
+		infos, err := dc.ListSessions(ctx, ListSessionsPayload{
+			Tags:          input.Tags,
+			MatchAll:      input.MatchAll,
+			ConnectedOnly: input.ConnectedOnly,
+			TitleContains: input.TitleContains,
+			Limit:         input.Limit,
+		})
 		if err != nil {
 			return &mcp.CallToolResult{
 				Content: []mcp.Content{
@@ -60,19 +334,34 @@ func RegisterMCPTools(server *mcp.Server, dc *DaemonClient) {
 				&mcp.TextContent{Text: string(result)},
 			},
 		}, nil, nil
-	})
+	}))
 
 	mcp.AddTool(server, &mcp.Tool{
 		Name:        "query_session",
-		Description: "Read output from a terminal session. Use last_n to get recent output (e.g. to check for errors after a change), search to find specific patterns in the output (e.g. error messages, stack traces), or cursor for paginated reading.",
-	}, func(ctx context.Context, req *mcp.CallToolRequest, input QuerySessionInput) (*mcp.CallToolResult, any, error) {
-		resp, err := dc.QuerySession(QuerySessionPayload{
-			Session:    input.Session,
-			Search:     input.Search,
-			LastN:      input.LastN,
-			Cursor:     input.Cursor,
-			Count:      input.Count,
-			MaxResults: input.MaxResults,
+		Description: "Read output from a terminal session. Use last_n to get recent output (e.g. to check for errors after a change), search or search_regex to find specific patterns in the output (e.g. error messages, stack traces), or cursor for paginated reading.",
+	}, withClient(pool, func(ctx context.Context, req *mcp.CallToolRequest, input QuerySessionInput, dc *DaemonClient) (*mcp.CallToolResult, any, error) {
+		resp, err := dc.QuerySession(ctx, QuerySessionPayload{
+			Session:           input.Session,
+			Tags:              input.Tags,
+			Search:            input.Search,
+			SearchRegex:       input.SearchRegex,
+			LastN:             input.LastN,
+			Cursor:            input.Cursor,
+			Count:             input.Count,
+			MaxResults:        input.MaxResults,
+			Context:           input.Context,
+			Before:            input.Before,
+			After:             input.After,
+			Since:             input.Since,
+			Until:             input.Until,
+			NewestFirst:       input.NewestFirst,
+			Exclude:           input.Exclude,
+			ExcludeRegex:      input.ExcludeRegex,
+			IncludeTimestamps: input.IncludeTimestamps,
+			CountOnly:         input.CountOnly,
+			Raw:               input.Raw,
+			IncludeCommands:   input.IncludeCommands,
+			LastCommandOutput: input.LastCommandOutput,
 		})
 		if err != nil {
 			return &mcp.CallToolResult{
@@ -83,6 +372,80 @@ func RegisterMCPTools(server *mcp.Server, dc *DaemonClient) {
 			}, nil, nil
 		}
 
+		result, _ := json.Marshal(resp)
+		return &mcp.CallToolResult{
+			Content: []mcp.Content{
+				&mcp.TextContent{Text: string(result)},
+			},
+		}, nil, nil
+	}))
+
+	mcp.AddTool(server, &mcp.Tool{
+		Name:        "search_all_sessions",
+		Description: "Search the output of every terminal session at once, e.g. to find which session printed an error or stack trace. Returns matching lines with their sequence numbers, grouped by session ID and title; sessions without matches are omitted. truncated is set if max_results or max_results_per_session cut matches off. Use query_session with the session and context to read around a match.",
+	}, withClient(pool, func(ctx context.Context, req *mcp.CallToolRequest, input SearchAllSessionsInput, dc *DaemonClient) (*mcp.CallToolResult, any, error) {
+		resp, err := dc.SearchAll(ctx, SearchAllPayload{
+			Search:               input.Search,
+			SearchRegex:          input.SearchRegex,
+			Tags:                 input.Tags,
+			ConnectedOnly:        input.ConnectedOnly,
+			MaxResults:           input.MaxResults,
+			MaxResultsPerSession: input.MaxResultsPerSession,
+			NewestFirst:          input.NewestFirst,
+		})
+		if err != nil {
+			return &mcp.CallToolResult{
+				Content: []mcp.Content{
+					&mcp.TextContent{Text: fmt.Sprintf("Error: %v", err)},
+				},
+				IsError: true,
+			}, nil, nil
+		}
+
+		result, _ := json.Marshal(resp)
+		return &mcp.CallToolResult{
+			Content: []mcp.Content{
+				&mcp.TextContent{Text: string(result)},
+			},
+		}, nil, nil
+	}))
+
+	mcp.AddTool(server, &mcp.Tool{
+		Name:        "watch_session",
+		Description: "Wait for a session's new output without polling, e.g. until a build or test run finishes. Returns after timeout_s seconds (default 30) or when the session's terminal disconnects, with the lines printed meanwhile as {seq, line} (the newest 1000), next_cursor, and why it ended. If your client sends a progress token, each line is also delivered as a progress notification as soon as it is printed. Pass from_seq, e.g. query_session's next_cursor, to include output printed since you last read.",
+	}, func(ctx context.Context, req *mcp.CallToolRequest, input WatchSessionInput) (*mcp.CallToolResult, any, error) {
+		resp, err := watchSession(ctx, req, pool, input)
+		if err != nil {
+			return &mcp.CallToolResult{
+				Content: []mcp.Content{
+					&mcp.TextContent{Text: fmt.Sprintf("Error: %v", err)},
+				},
+				IsError: true,
+			}, nil, nil
+		}
+
+		result, _ := json.Marshal(resp)
+		return &mcp.CallToolResult{
+			Content: []mcp.Content{
+				&mcp.TextContent{Text: string(result)},
+			},
+		}, nil, nil
+	})
+
+	mcp.AddTool(server, &mcp.Tool{
+		Name:        "wait_for_pattern",
+		Description: "Wait until a line matching pattern appears in a session's output, e.g. a server's \"listening on\" or a build's \"BUILD SUCCESSFUL\", instead of calling query_session repeatedly. Returns {matched_line, seq, elapsed_ms} as soon as one does, or {timed_out: true} after timeout_s seconds (default 30). Pass from_seq, e.g. write_session's next_cursor, so that output from before your command doesn't match.",
+	}, func(ctx context.Context, req *mcp.CallToolRequest, input WaitForPatternInput) (*mcp.CallToolResult, any, error) {
+		resp, err := waitForPattern(ctx, pool, input)
+		if err != nil {
+			return &mcp.CallToolResult{
+				Content: []mcp.Content{
+					&mcp.TextContent{Text: fmt.Sprintf("Error: %v", err)},
+				},
+				IsError: true,
+			}, nil, nil
+		}
+
 		result, _ := json.Marshal(resp)
 		return &mcp.CallToolResult{
 			Content: []mcp.Content{
@@ -93,11 +456,13 @@ func RegisterMCPTools(server *mcp.Server, dc *DaemonClient) {
 
 	mcp.AddTool(server, &mcp.Tool{
 		Name:        "write_session",
-		Description: "Send raw text input to a collaborative shell session's PTY. Text is written byte-for-byte — to press Enter and execute a command, include an actual newline character at the end of your text (not a literal backslash-n). Only works on sessions started with the --collab flag. The user sees all input in real-time.",
-	}, func(ctx context.Context, req *mcp.CallToolRequest, input WriteSessionInput) (*mcp.CallToolResult, any, error) {
-		resp, err := dc.WriteSession(WriteSessionPayload{
+		Description: "Send raw text input, or named keys such as C-c, Up, or Escape, to a collaborative shell session's PTY. Text is written byte-for-byte — to press Enter and execute a command, include an actual newline character at the end of your text (not a literal backslash-n). Use keys for control characters and navigating TUIs. Only works on sessions started with the --collab flag. The user sees all input in real-time.",
+	}, withClient(pool, func(ctx context.Context, req *mcp.CallToolRequest, input WriteSessionInput, dc *DaemonClient) (*mcp.CallToolResult, any, error) {
+		resp, err := dc.WriteSession(ctx, WriteSessionPayload{
 			Session: input.Session,
 			Text:    input.Text,
+			Keys:    input.Keys,
+			WaitMs:  input.WaitMs,
 		})
 		if err != nil {
 			return &mcp.CallToolResult{
@@ -114,7 +479,298 @@ func RegisterMCPTools(server *mcp.Server, dc *DaemonClient) {
 				&mcp.TextContent{Text: string(result)},
 			},
 		}, nil, nil
-	})
+	}))
+
+	mcp.AddTool(server, &mcp.Tool{
+		Name:        "send_signal",
+		Description: "Send a signal to the process running in the foreground of a collaborative session, e.g. SIGINT to interrupt a command the way Ctrl-C would, or SIGTERM to stop it. More reliable than writing a control character with write_session. Only works on sessions started with the --collab flag.",
+	}, withClient(pool, func(ctx context.Context, req *mcp.CallToolRequest, input SendSignalInput, dc *DaemonClient) (*mcp.CallToolResult, any, error) {
+		resp, err := dc.SendSignal(ctx, SendSignalPayload{
+			Session: input.Session,
+			Signal:  input.Signal,
+		})
+		if err != nil {
+			return &mcp.CallToolResult{
+				Content: []mcp.Content{
+					&mcp.TextContent{Text: fmt.Sprintf("Error: %v", err)},
+				},
+				IsError: true,
+			}, nil, nil
+		}
+
+		result, _ := json.Marshal(resp)
+		return &mcp.CallToolResult{
+			Content: []mcp.Content{
+				&mcp.TextContent{Text: string(result)},
+			},
+		}, nil, nil
+	}))
+
+	mcp.AddTool(server, &mcp.Tool{
+		Name:        "kill_session",
+		Description: "Terminate a session, e.g. a runaway process you started. For a connected collaborative session this closes the user's shell; any session is removed from the session list along with its output. Returns whether the shell was actually signaled. Only use this when the user asks or clearly expects it.",
+	}, withClient(pool, func(ctx context.Context, req *mcp.CallToolRequest, input KillSessionInput, dc *DaemonClient) (*mcp.CallToolResult, any, error) {
+		resp, err := dc.KillSession(ctx, input.Session)
+		if err != nil {
+			return &mcp.CallToolResult{
+				Content: []mcp.Content{
+					&mcp.TextContent{Text: fmt.Sprintf("Error: %v", err)},
+				},
+				IsError: true,
+			}, nil, nil
+		}
+
+		result, _ := json.Marshal(resp)
+		return &mcp.CallToolResult{
+			Content: []mcp.Content{
+				&mcp.TextContent{Text: string(result)},
+			},
+		}, nil, nil
+	}))
+
+	mcp.AddTool(server, &mcp.Tool{
+		Name:        "create_session",
+		Description: "Start a new shell session run by the streamsh daemon, to run commands in a fresh, isolated shell without asking the user to open a terminal. Set collab to run commands in it with write_session; its output is read like any other session's. The session ends when its shell exits or kill_session is used. Returns the new session's short ID. Fails unless the daemon was started with --allow-spawn.",
+	}, withClient(pool, func(ctx context.Context, req *mcp.CallToolRequest, input CreateSessionInput, dc *DaemonClient) (*mcp.CallToolResult, any, error) {
+		resp, err := dc.SpawnSession(ctx, SpawnPayload{
+			Title:  input.Title,
+			Shell:  input.Shell,
+			Collab: input.Collab,
+			Tags:   input.Tags,
+		})
+		if err != nil {
+			return &mcp.CallToolResult{
+				Content: []mcp.Content{
+					&mcp.TextContent{Text: fmt.Sprintf("Error: %v", err)},
+				},
+				IsError: true,
+			}, nil, nil
+		}
+
+		result, _ := json.Marshal(resp)
+		return &mcp.CallToolResult{
+			Content: []mcp.Content{
+				&mcp.TextContent{Text: string(result)},
+			},
+		}, nil, nil
+	}))
+
+	mcp.AddTool(server, &mcp.Tool{
+		Name:        "delete_session",
+		Description: "Remove a session and its output from the session list without touching its shell, e.g. to clean up finished sessions. Refuses sessions whose terminal is still connected unless force is set; a connected shell keeps running, but its output is no longer recorded. Use kill_session to end the shell as well. Only use this when the user asks or clearly expects it.",
+	}, withClient(pool, func(ctx context.Context, req *mcp.CallToolRequest, input DeleteSessionInput, dc *DaemonClient) (*mcp.CallToolResult, any, error) {
+		resp, err := dc.DeleteSession(ctx, DeleteSessionPayload{
+			Session: input.Session,
+			Force:   input.Force,
+		})
+		if err != nil {
+			return &mcp.CallToolResult{
+				Content: []mcp.Content{
+					&mcp.TextContent{Text: fmt.Sprintf("Error: %v", err)},
+				},
+				IsError: true,
+			}, nil, nil
+		}
+
+		result, _ := json.Marshal(resp)
+		return &mcp.CallToolResult{
+			Content: []mcp.Content{
+				&mcp.TextContent{Text: string(result)},
+			},
+		}, nil, nil
+	}))
+
+	mcp.AddTool(server, &mcp.Tool{
+		Name:        "rename_session",
+		Description: "Change a session's title, e.g. to give an auto-named session a descriptive label like \"backend tests\" once you know what it runs. The new title can be used to refer to the session immediately. Returns the old and new title.",
+	}, withClient(pool, func(ctx context.Context, req *mcp.CallToolRequest, input RenameSessionInput, dc *DaemonClient) (*mcp.CallToolResult, any, error) {
+		resp, err := dc.RenameSession(ctx, RenameSessionPayload{
+			Session: input.Session,
+			Title:   input.Title,
+		})
+		if err != nil {
+			return &mcp.CallToolResult{
+				Content: []mcp.Content{
+					&mcp.TextContent{Text: fmt.Sprintf("Error: %v", err)},
+				},
+				IsError: true,
+			}, nil, nil
+		}
+
+		result, _ := json.Marshal(resp)
+		return &mcp.CallToolResult{
+			Content: []mcp.Content{
+				&mcp.TextContent{Text: string(result)},
+			},
+		}, nil, nil
+	}))
+
+	mcp.AddTool(server, &mcp.Tool{
+		Name:        "set_buffer_size",
+		Description: "Change how many lines of output a session keeps. Growing keeps everything already buffered; shrinking drops the oldest lines. Cursors from earlier queries stay valid. Sessions whose daemon bounds buffers by bytes cannot be resized. Returns the new capacity and the number of lines retained.",
+	}, withClient(pool, func(ctx context.Context, req *mcp.CallToolRequest, input SetBufferSizeInput, dc *DaemonClient) (*mcp.CallToolResult, any, error) {
+		resp, err := dc.ResizeBuffer(ctx, ResizeBufferPayload{
+			Session:  input.Session,
+			Capacity: input.Capacity,
+		})
+		if err != nil {
+			return &mcp.CallToolResult{
+				Content: []mcp.Content{
+					&mcp.TextContent{Text: fmt.Sprintf("Error: %v", err)},
+				},
+				IsError: true,
+			}, nil, nil
+		}
+
+		result, _ := json.Marshal(resp)
+		return &mcp.CallToolResult{
+			Content: []mcp.Content{
+				&mcp.TextContent{Text: string(result)},
+			},
+		}, nil, nil
+	}))
+
+	mcp.AddTool(server, &mcp.Tool{
+		Name:        "get_session_env",
+		Description: "Get the environment variables a session's shell started with, e.g. PATH, GOPATH, or VIRTUAL_ENV, to understand which tools and versions a command would pick up. Pass keys to fetch only the variables you need. Values that look like secrets are redacted. Reflects the environment at session start, not later exports.",
+	}, withClient(pool, func(ctx context.Context, req *mcp.CallToolRequest, input GetSessionEnvInput, dc *DaemonClient) (*mcp.CallToolResult, any, error) {
+		resp, err := dc.GetEnvironment(ctx, GetEnvironmentPayload{
+			Session: input.Session,
+			Keys:    input.Keys,
+		})
+		if err != nil {
+			return &mcp.CallToolResult{
+				Content: []mcp.Content{
+					&mcp.TextContent{Text: fmt.Sprintf("Error: %v", err)},
+				},
+				IsError: true,
+			}, nil, nil
+		}
+
+		result, _ := json.Marshal(resp)
+		return &mcp.CallToolResult{
+			Content: []mcp.Content{
+				&mcp.TextContent{Text: string(result)},
+			},
+		}, nil, nil
+	}))
+
+	mcp.AddTool(server, &mcp.Tool{
+		Name:        "get_session_info",
+		Description: "Get everything known about one session: what list_sessions shows (title, tags, connection status, collab and read-only flags, last command and exit code, working directory, shell_pid, terminal size) plus its UUID, creation and last activity times, buffer capacity and usage, total lines ever received, the sequence number of the oldest line still buffered (oldest_seq; the newest is total_lines - 1), lines_per_minute printed in the last whole minute, and number of commands run. Use this instead of list_sessions when you already know which session you care about.",
+	}, withClient(pool, func(ctx context.Context, req *mcp.CallToolRequest, input SessionInfoInput, dc *DaemonClient) (*mcp.CallToolResult, any, error) {
+		resp, err := dc.SessionInfo(ctx, input.Session)
+		if err != nil {
+			return &mcp.CallToolResult{
+				Content: []mcp.Content{
+					&mcp.TextContent{Text: fmt.Sprintf("Error: %v", err)},
+				},
+				IsError: true,
+			}, nil, nil
+		}
+
+		result, _ := json.Marshal(resp)
+		return &mcp.CallToolResult{
+			Content: []mcp.Content{
+				&mcp.TextContent{Text: string(result)},
+			},
+		}, nil, nil
+	}))
+
+	mcp.AddTool(server, &mcp.Tool{
+		Name:        "session_stats",
+		Description: "Get a session's buffer utilization and throughput: buffer_capacity and buffer_used (lines), total_lines_ever received, oldest_seq and newest_seq of the lines still buffered, connected and collab flags, created_at, last_activity, last_command, terminal rows and cols, and avg_lines_per_minute, a rolling average over the last 60 seconds. Use this to tell whether a session is busy or quiet, or whether older output has already been evicted.",
+	}, withClient(pool, func(ctx context.Context, req *mcp.CallToolRequest, input SessionStatsInput, dc *DaemonClient) (*mcp.CallToolResult, any, error) {
+		resp, err := dc.GetSessionStats(ctx, input.Session)
+		if err != nil {
+			return &mcp.CallToolResult{
+				Content: []mcp.Content{
+					&mcp.TextContent{Text: fmt.Sprintf("Error: %v", err)},
+				},
+				IsError: true,
+			}, nil, nil
+		}
+
+		result, _ := json.Marshal(resp)
+		return &mcp.CallToolResult{
+			Content: []mcp.Content{
+				&mcp.TextContent{Text: string(result)},
+			},
+		}, nil, nil
+	}))
+
+	mcp.AddTool(server, &mcp.Tool{
+		Name:        "get_command_history",
+		Description: "Get the commands the user ran in a session, oldest first, with when each started and its exit code once it finished. Use this to reconstruct what happened in a session, e.g. which steps were tried before a failure, before reading the output itself.",
+	}, withClient(pool, func(ctx context.Context, req *mcp.CallToolRequest, input CommandHistoryInput, dc *DaemonClient) (*mcp.CallToolResult, any, error) {
+		limit := input.Limit
+		if limit <= 0 {
+			limit = 20
+		}
+		resp, err := dc.CommandHistory(ctx, CommandHistoryPayload{
+			Session: input.Session,
+			Limit:   limit,
+		})
+		if err != nil {
+			return &mcp.CallToolResult{
+				Content: []mcp.Content{
+					&mcp.TextContent{Text: fmt.Sprintf("Error: %v", err)},
+				},
+				IsError: true,
+			}, nil, nil
+		}
+
+		result, _ := json.Marshal(resp)
+		return &mcp.CallToolResult{
+			Content: []mcp.Content{
+				&mcp.TextContent{Text: string(result)},
+			},
+		}, nil, nil
+	}))
+
+	mcp.AddTool(server, &mcp.Tool{
+		Name:        "export_session",
+		Description: "Dump a session's entire scrollback in one shot, e.g. to attach a full build log to an issue. Returns the text inline (truncated to whole lines past 256 KiB), or writes it to path and returns the path. Use format jsonl to get each line's sequence number. Prefer query_session for reading specific parts of the output.",
+	}, withClient(pool, func(ctx context.Context, req *mcp.CallToolRequest, input ExportSessionInput, dc *DaemonClient) (*mcp.CallToolResult, any, error) {
+		sink := &exportSink{}
+		ep := ExportSessionPayload{Session: input.Session, StripANSI: input.StripANSI, Format: input.Format}
+		var err error
+		if input.Path != "" {
+			var f *os.File
+			f, err = os.OpenFile(input.Path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+			if err == nil {
+				sink.w = f
+				err = dc.ExportSession(ctx, ep, sink)
+				if closeErr := f.Close(); err == nil {
+					err = closeErr
+				}
+			}
+		} else {
+			err = dc.ExportSession(ctx, ep, sink)
+		}
+		if err != nil {
+			return &mcp.CallToolResult{
+				Content: []mcp.Content{
+					&mcp.TextContent{Text: fmt.Sprintf("Error: %v", err)},
+				},
+				IsError: true,
+			}, nil, nil
+		}
+
+		result, _ := json.Marshal(ExportSessionResult{
+			Session:    input.Session,
+			TotalLines: sink.lines,
+			Bytes:      sink.bytes,
+			Path:       input.Path,
+			Text:       sink.text(),
+			Truncated:  sink.truncated,
+		})
+		return &mcp.CallToolResult{
+			Content: []mcp.Content{
+				&mcp.TextContent{Text: string(result)},
+			},
+		}, nil, nil
+	}))
 }
 
 // serverInstructions tells consuming agents when and how to use streamsh tools.
@@ -125,20 +781,392 @@ Use these tools proactively when you have a reason to:
 - When the user mentions an error, unexpected behavior, or a failing build, check relevant sessions for logs and stack traces.
 - When debugging, search session output for error messages, warnings, or relevant log lines.
 - After the user runs a deploy, migration, or build, check the session to verify it succeeded.
+- To reconstruct what the user did in a session, use get_command_history rather than reading all of its output.
+- To wait for a long-running build or test run, use watch_session instead of polling query_session, or wait_for_pattern to wait for a specific line such as a server's "listening on". To follow a server over time, subscribe to its streamsh://session/<id> resource if your client supports it.
+- If your client shows log messages, streamsh logs each command that finishes in any session with its exit code; use them to act as soon as a build completes.
 
 Use list_sessions to see what's running (each session shows its last command), then query_session to read the output you need. Don't read sessions unless the output is relevant to what you're working on.`
 
-// NewMCPServer creates a configured MCP server with tools registered.
-func NewMCPServer(dc *DaemonClient) *mcp.Server {
+// waitForPattern polls a session's output for wait_for_pattern until a line
+// matches or the timeout passes. Each poll checks a client out of pool only
+// for as long as it takes, so a long wait doesn't hold one.
+func waitForPattern(ctx context.Context, pool *DaemonClientPool, input WaitForPatternInput) (*WaitForPatternResult, error) {
+	if input.Pattern == "" {
+		return nil, errors.New("pattern is required")
+	}
+	match := SubstringMatcher(input.Pattern)
+	if input.UseRegex {
+		var err error
+		if match, err = RegexMatcher(input.Pattern); err != nil {
+			return nil, err
+		}
+	}
+	timeout := defaultWatchTimeout
+	if input.TimeoutS > 0 {
+		timeout = min(time.Duration(input.TimeoutS)*time.Second, maxWatchTimeout)
+	}
+	interval := defaultPollInterval
+	if input.PollIntervalMs > 0 {
+		interval = max(time.Duration(input.PollIntervalMs)*time.Millisecond, minPollInterval)
+	}
+
+	start := time.Now()
+	waitCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	query := func(ctx context.Context, qp QuerySessionPayload) (*QuerySessionResponse, error) {
+		dc, err := pool.Get(ctx)
+		if err != nil {
+			return nil, err
+		}
+		defer pool.Put(dc)
+		return dc.QuerySession(ctx, qp)
+	}
+	found, err := pollForPattern(waitCtx, query, input.Session, input.FromSeq, interval, match)
+	result := &WaitForPatternResult{ElapsedMs: time.Since(start).Milliseconds()}
+	if err != nil {
+		// Only our own timeout is an answer; the caller going away is not.
+		// A request can fail on its socket deadline just before waitCtx
+		// itself expires.
+		if deadline, _ := waitCtx.Deadline(); ctx.Err() == nil && !time.Now().Before(deadline) {
+			result.TimedOut = true
+			return result, nil
+		}
+		return nil, err
+	}
+	result.MatchedLine, result.Seq = found.Line, &found.Seq
+	return result, nil
+}
+
+// watchSession follows a session's output for watch_session, sending each
+// line as a progress notification if the caller asked for progress.
+func watchSession(ctx context.Context, req *mcp.CallToolRequest, pool *DaemonClientPool, input WatchSessionInput) (*WatchSessionResult, error) {
+	timeout := defaultWatchTimeout
+	if input.TimeoutS > 0 {
+		timeout = min(time.Duration(input.TimeoutS)*time.Second, maxWatchTimeout)
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	dc, err := pool.Get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// The daemon streams the events in the background, so the client can
+	// serve other tool calls meanwhile
+	events, err := dc.Subscribe(ctx, SubscribePayload{Session: input.Session, FromSeq: input.FromSeq})
+	pool.Put(dc)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &WatchSessionResult{Session: input.Session, Lines: []WatchedLine{}, Ended: "timeout"}
+	token := req.Params.GetProgressToken()
+	seen := 0
+	var settle <-chan time.Time // set on disconnect, as the last lines may trail the event
+	for {
+		var ev EventPayload
+		var ok bool
+		select {
+		case ev, ok = <-events:
+		case <-settle:
+			return result, nil
+		}
+		if !ok {
+			// Subscribe closes events when ctx is done, too
+			if result.Ended == "timeout" && ctx.Err() == nil {
+				result.Ended = "closed"
+			}
+			return result, nil
+		}
+		if ev.SessionID != "" {
+			result.Session = ev.SessionID
+		}
+		if ev.Kind == SessionDisconnected && settle == nil {
+			result.Ended = "disconnected"
+			settle = time.After(writeOutputSettle)
+		}
+		for i, line := range ev.Lines {
+			wl := WatchedLine{Seq: ev.Seqs[i], Line: line}
+			seen++
+			if token != nil {
+				msg, _ := json.Marshal(wl)
+				req.Session.NotifyProgress(ctx, &mcp.ProgressNotificationParams{
+					ProgressToken: token,
+					Progress:      float64(seen),
+					Message:       string(msg),
+				})
+			}
+			if len(result.Lines) == maxWatchLines {
+				result.Lines = result.Lines[1:]
+				result.Truncated = true
+			}
+			result.Lines = append(result.Lines, wl)
+			result.NextCursor = wl.Seq + 1
+		}
+	}
+}
+
+// withClient adapts a tool handler to check a DaemonClient out of pool for
+// the duration of the call.
+func withClient[In any](pool *DaemonClientPool, h func(context.Context, *mcp.CallToolRequest, In, *DaemonClient) (*mcp.CallToolResult, any, error)) mcp.ToolHandlerFor[In, any] {
+	return func(ctx context.Context, req *mcp.CallToolRequest, input In) (*mcp.CallToolResult, any, error) {
+		dc, err := pool.Get(ctx)
+		if err != nil {
+			return &mcp.CallToolResult{
+				Content: []mcp.Content{
+					&mcp.TextContent{Text: fmt.Sprintf("Error: %v", err)},
+				},
+				IsError: true,
+			}, nil, nil
+		}
+		defer pool.Put(dc)
+		return h(ctx, req, input, dc)
+	}
+}
+
+// NewMCPServer creates a configured MCP server with tools and session
+// resources registered.
+func NewMCPServer(pool *DaemonClientPool) *mcp.Server {
+	res := &sessionResources{pool: pool, subs: make(map[string]context.CancelFunc)}
+	logger := &commandLogger{pool: pool}
 	server := mcp.NewServer(
 		&mcp.Implementation{
 			Name:    "streamsh",
 			Version: "0.1.0",
 		},
 		&mcp.ServerOptions{
-			Instructions: serverInstructions,
+			Instructions:       serverInstructions,
+			SubscribeHandler:   res.subscribe,
+			UnsubscribeHandler: res.unsubscribe,
+			InitializedHandler: logger.start,
 		},
 	)
-	RegisterMCPTools(server, dc)
+	res.server = server
+	logger.server = server
+	RegisterMCPTools(server, pool)
+	server.AddResourceTemplate(&mcp.ResourceTemplate{
+		Name:        "session",
+		Title:       "Terminal session output",
+		Description: "The most recent output of a streamsh session, identified by short ID, UUID, or title. Subscribe to be notified as new output arrives instead of polling query_session.",
+		MIMEType:    "text/plain",
+		URITemplate: sessionResourcePrefix + "{id}",
+	}, res.read)
 	return server
 }
+
+// sessionResourcePrefix is the URI prefix of session resources; the rest of
+// the URI identifies the session.
+const sessionResourcePrefix = "streamsh://session/"
+
+// sessionResourceLines is how many recent lines reading a session resource
+// returns.
+const sessionResourceLines = 200
+
+// resourceNotifyInterval is the minimum time between updated notifications
+// for one resource, so a chatty build doesn't flood the agent.
+const resourceNotifyInterval = time.Second
+
+// sessionResources serves session resources and turns resource
+// subscriptions into daemon subscriptions.
+type sessionResources struct {
+	pool   *DaemonClientPool
+	server *mcp.Server
+
+	mu   sync.Mutex
+	subs map[string]context.CancelFunc // by URI
+}
+
+// read returns a session's most recent output.
+func (r *sessionResources) read(ctx context.Context, req *mcp.ReadResourceRequest) (*mcp.ReadResourceResult, error) {
+	uri := req.Params.URI
+	id, ok := strings.CutPrefix(uri, sessionResourcePrefix)
+	if !ok || id == "" {
+		return nil, mcp.ResourceNotFoundError(uri)
+	}
+	dc, err := r.pool.Get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := dc.QuerySession(ctx, QuerySessionPayload{Session: id, LastN: sessionResourceLines})
+	r.pool.Put(dc)
+	if err != nil {
+		return nil, mcp.ResourceNotFoundError(uri)
+	}
+	var text strings.Builder
+	for _, line := range resp.Lines {
+		text.WriteString(line)
+		text.WriteByte('\n')
+	}
+	return &mcp.ReadResourceResult{
+		Contents: []*mcp.ResourceContents{
+			{URI: uri, MIMEType: "text/plain", Text: text.String()},
+		},
+	}, nil
+}
+
+// subscribe starts watching a session for new output. Subscribing to a
+// resource that is already watched is a no-op.
+func (r *sessionResources) subscribe(ctx context.Context, req *mcp.SubscribeRequest) error {
+	uri := req.Params.URI
+	id, ok := strings.CutPrefix(uri, sessionResourcePrefix)
+	if !ok || id == "" {
+		return mcp.ResourceNotFoundError(uri)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.subs[uri]; ok {
+		return nil
+	}
+	dc, err := r.pool.Get(ctx)
+	if err != nil {
+		return err
+	}
+	// The subscription outlives this request, so it doesn't use ctx. The
+	// daemon streams it in the background, so the client can go back to
+	// the pool and serve other requests meanwhile.
+	subCtx, cancel := context.WithCancel(context.Background())
+	events, err := dc.Subscribe(subCtx, SubscribePayload{Session: id})
+	r.pool.Put(dc)
+	if err != nil {
+		cancel()
+		return err
+	}
+	r.subs[uri] = cancel
+	go r.watch(subCtx, uri, events)
+	return nil
+}
+
+// unsubscribe stops watching a session.
+func (r *sessionResources) unsubscribe(ctx context.Context, req *mcp.UnsubscribeRequest) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if cancel, ok := r.subs[req.Params.URI]; ok {
+		cancel()
+		delete(r.subs, req.Params.URI)
+	}
+	return nil
+}
+
+// watch sends updated notifications for uri as output arrives, at most
+// once per resourceNotifyInterval, until events is closed.
+func (r *sessionResources) watch(ctx context.Context, uri string, events <-chan EventPayload) {
+	defer func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		// Forget the subscription if the session went away, unless it
+		// was already replaced
+		if ctx.Err() == nil {
+			r.subs[uri]()
+			delete(r.subs, uri)
+		}
+	}()
+
+	var pending bool
+	var lastSent time.Time
+	timer := time.NewTimer(resourceNotifyInterval)
+	timer.Stop()
+	for {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				return
+			}
+			if len(ev.Lines) == 0 || pending {
+				continue
+			}
+			pending = true
+			timer.Reset(resourceNotifyInterval - time.Since(lastSent))
+		case <-timer.C:
+			pending = false
+			lastSent = time.Now()
+			r.server.ResourceUpdated(ctx, &mcp.ResourceUpdatedNotificationParams{URI: uri})
+		}
+	}
+}
+
+// commandLogger sends a log message to the MCP clients when a command
+// finishes in any session, so an agent waiting on a build is told rather
+// than having to poll. Clients only receive it once they set a log level.
+type commandLogger struct {
+	pool   *DaemonClientPool
+	server *mcp.Server
+
+	mu      sync.Mutex
+	running bool
+}
+
+// start follows the daemon's session events, unless already doing so.
+func (l *commandLogger) start(context.Context, *mcp.InitializedRequest) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.running {
+		return
+	}
+	events, err := l.subscribe()
+	if err != nil {
+		return
+	}
+	l.running = true
+	go l.run(events)
+}
+
+// subscribe subscribes to every session's events. The subscription lasts
+// until the daemon connection does.
+func (l *commandLogger) subscribe() (<-chan EventPayload, error) {
+	getCtx, cancel := context.WithTimeout(context.Background(), DefaultRequestTimeout)
+	defer cancel()
+	dc, err := l.pool.Get(getCtx)
+	if err != nil {
+		return nil, err
+	}
+	defer l.pool.Put(dc)
+	return dc.Subscribe(context.Background(), SubscribePayload{AllSessions: true})
+}
+
+// run logs each finished command. Whenever the subscription ends, e.g.
+// because the daemon restarted, it subscribes again, backing off between
+// failed attempts, until the pool is closed.
+func (l *commandLogger) run(events <-chan EventPayload) {
+	defer func() {
+		l.mu.Lock()
+		l.running = false
+		l.mu.Unlock()
+	}()
+	b := newBackoff(0, 0, 0)
+	for {
+		l.log(events)
+		for {
+			select {
+			case <-l.pool.done:
+				return
+			case <-time.After(b.next()):
+			}
+			var err error
+			if events, err = l.subscribe(); err == nil {
+				b.reset()
+				break
+			}
+		}
+	}
+}
+
+// log logs each finished command until events is closed.
+func (l *commandLogger) log(events <-chan EventPayload) {
+	for ev := range events {
+		if ev.Kind != SessionExited || ev.ExitCode == nil {
+			continue
+		}
+		msg := fmt.Sprintf("session %s: command exited with code %d", ev.SessionID, *ev.ExitCode)
+		if ev.Command != "" {
+			msg = fmt.Sprintf("session %s: command %q exited with code %d", ev.SessionID, ev.Command, *ev.ExitCode)
+		}
+		level := mcp.LoggingLevel("info")
+		if *ev.ExitCode != 0 {
+			level = "warning"
+		}
+		for ss := range l.server.Sessions() {
+			ss.Log(context.Background(), &mcp.LoggingMessageParams{Level: level, Logger: "streamsh", Data: msg})
+		}
+	}
+}
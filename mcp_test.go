@@ -0,0 +1,260 @@
+package streamsh
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+)
+
+func TestExportSinkTruncates(t *testing.T) {
+	sink := &exportSink{}
+	line := strings.Repeat("x", 99) + "\n"
+	for range 3000 {
+		fmt.Fprint(sink, line)
+	}
+
+	if sink.lines != 3000 || sink.bytes != 300000 {
+		t.Errorf("lines=%d bytes=%d, want 3000 300000", sink.lines, sink.bytes)
+	}
+	if !sink.truncated {
+		t.Fatal("expected truncation past the inline limit")
+	}
+	text := sink.text()
+	if len(text) > exportInlineLimit || !strings.HasSuffix(text, "\n") || len(text)%100 != 0 {
+		t.Errorf("truncated text is %d bytes, want whole lines under %d", len(text), exportInlineLimit)
+	}
+}
+
+func TestMCPSessionResourceSubscription(t *testing.T) {
+	d, sock := startTestDaemon(t)
+	client, ack := registerTestSession(t, sock, RegisterPayload{Title: "build"})
+	client.send(t, MsgOutput, OutputPayload{Lines: []string{"compiling"}})
+	sess, _ := d.Store.Resolve(ack.ShortID)
+	waitFor(t, func() bool { return sess.Buffer.Len() == 1 })
+
+	pool, err := NewDaemonClientPool(sock, "", 0)
+	if err != nil {
+		t.Fatalf("daemon client pool: %v", err)
+	}
+	defer pool.Close()
+
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+	serverTransport, clientTransport := mcp.NewInMemoryTransports()
+	if _, err := NewMCPServer(pool).Connect(ctx, serverTransport, nil); err != nil {
+		t.Fatalf("server connect: %v", err)
+	}
+	updated := make(chan string, 10)
+	mc := mcp.NewClient(&mcp.Implementation{Name: "test"}, &mcp.ClientOptions{
+		ResourceUpdatedHandler: func(_ context.Context, req *mcp.ResourceUpdatedNotificationRequest) {
+			updated <- req.Params.URI
+		},
+	})
+	cs, err := mc.Connect(ctx, clientTransport, nil)
+	if err != nil {
+		t.Fatalf("client connect: %v", err)
+	}
+	defer cs.Close()
+
+	uri := sessionResourcePrefix + "build"
+	res, err := cs.ReadResource(ctx, &mcp.ReadResourceParams{URI: uri})
+	if err != nil {
+		t.Fatalf("read resource: %v", err)
+	}
+	if len(res.Contents) != 1 || res.Contents[0].Text != "compiling\n" {
+		t.Errorf("contents = %+v", res.Contents)
+	}
+	if err := cs.Subscribe(ctx, &mcp.SubscribeParams{URI: sessionResourcePrefix + "nope"}); err == nil {
+		t.Error("expected error subscribing to an unknown session")
+	}
+
+	if err := cs.Subscribe(ctx, &mcp.SubscribeParams{URI: uri}); err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+	client.send(t, MsgOutput, OutputPayload{Lines: []string{"error: boom"}})
+	select {
+	case got := <-updated:
+		if got != uri {
+			t.Errorf("updated %q, want %q", got, uri)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("no resource updated notification")
+	}
+}
+
+func TestMCPWatchSession(t *testing.T) {
+	d, sock := startTestDaemon(t)
+	client, ack := registerTestSession(t, sock, RegisterPayload{Title: "build"})
+	client.send(t, MsgOutput, OutputPayload{Lines: []string{"zero", "one", "two"}})
+	sess, _ := d.Store.Resolve(ack.ShortID)
+	waitFor(t, func() bool { return sess.Buffer.Len() == 3 })
+
+	pool, err := NewDaemonClientPool(sock, "", 0)
+	if err != nil {
+		t.Fatalf("daemon client pool: %v", err)
+	}
+	defer pool.Close()
+
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+	serverTransport, clientTransport := mcp.NewInMemoryTransports()
+	if _, err := NewMCPServer(pool).Connect(ctx, serverTransport, nil); err != nil {
+		t.Fatalf("server connect: %v", err)
+	}
+	progress := make(chan string, 10)
+	mc := mcp.NewClient(&mcp.Implementation{Name: "test"}, &mcp.ClientOptions{
+		ProgressNotificationHandler: func(_ context.Context, req *mcp.ProgressNotificationClientRequest) {
+			progress <- req.Params.Message
+		},
+	})
+	cs, err := mc.Connect(ctx, clientTransport, nil)
+	if err != nil {
+		t.Fatalf("client connect: %v", err)
+	}
+	defer cs.Close()
+
+	// Once the replayed lines are in, print one more and hang up
+	sent := make(chan error, 1)
+	go func() {
+		for range 3 {
+			<-progress
+		}
+		sent <- client.trySend(MsgOutput, OutputPayload{Lines: []string{"three"}})
+		client.Close()
+	}()
+
+	params := &mcp.CallToolParams{
+		Meta:      mcp.Meta{}, // SetProgressToken drops the token on a nil Meta
+		Name:      "watch_session",
+		Arguments: map[string]any{"session": "build", "from_seq": 0, "timeout_s": 10},
+	}
+	params.SetProgressToken("watch")
+	res, err := cs.CallTool(ctx, params)
+	if err := <-sent; err != nil {
+		t.Fatal(err)
+	}
+	if err != nil {
+		t.Fatalf("call tool: %v", err)
+	}
+	if res.IsError {
+		t.Fatalf("tool error: %+v", res.Content)
+	}
+	var got WatchSessionResult
+	if err := json.Unmarshal([]byte(res.Content[0].(*mcp.TextContent).Text), &got); err != nil {
+		t.Fatalf("decode result: %v", err)
+	}
+	want := []WatchedLine{{0, "zero"}, {1, "one"}, {2, "two"}, {3, "three"}}
+	if fmt.Sprint(got.Lines) != fmt.Sprint(want) {
+		t.Errorf("lines = %v, want %v", got.Lines, want)
+	}
+	if got.Ended != "disconnected" || got.NextCursor != 4 || got.Session != ack.ShortID {
+		t.Errorf("result = %+v", got)
+	}
+}
+
+func TestMCPCommandExitLogged(t *testing.T) {
+	d, sock := startTestDaemon(t)
+	client, ack := registerTestSession(t, sock, RegisterPayload{Title: "build"})
+
+	pool, err := NewDaemonClientPool(sock, "", 0)
+	if err != nil {
+		t.Fatalf("daemon client pool: %v", err)
+	}
+	defer pool.Close()
+
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+	serverTransport, clientTransport := mcp.NewInMemoryTransports()
+	if _, err := NewMCPServer(pool).Connect(ctx, serverTransport, nil); err != nil {
+		t.Fatalf("server connect: %v", err)
+	}
+	logged := make(chan *mcp.LoggingMessageParams, 10)
+	mc := mcp.NewClient(&mcp.Implementation{Name: "test"}, &mcp.ClientOptions{
+		LoggingMessageHandler: func(_ context.Context, req *mcp.LoggingMessageRequest) {
+			logged <- req.Params
+		},
+	})
+	cs, err := mc.Connect(ctx, clientTransport, nil)
+	if err != nil {
+		t.Fatalf("client connect: %v", err)
+	}
+	defer cs.Close()
+	if err := cs.SetLoggingLevel(ctx, &mcp.SetLoggingLevelParams{Level: "info"}); err != nil {
+		t.Fatalf("set logging level: %v", err)
+	}
+	waitFor(t, func() bool { return d.Store.watching(uuid.Nil) > 0 })
+
+	client.send(t, MsgCommand, CommandPayload{Command: "make test"})
+	client.send(t, MsgCommandResult, CommandResultPayload{ExitCode: 2})
+	select {
+	case got := <-logged:
+		want := fmt.Sprintf("session %s: command %q exited with code 2", ack.ShortID, "make test")
+		if got.Level != "warning" || got.Data != want {
+			t.Errorf("logged %s %v, want warning %q", got.Level, got.Data, want)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("no log message for the finished command")
+	}
+}
+
+func TestMCPCommandLoggerResubscribes(t *testing.T) {
+	d, sock := startTestDaemon(t)
+	pool, err := NewDaemonClientPool(sock, "", 0)
+	if err != nil {
+		t.Fatalf("daemon client pool: %v", err)
+	}
+	defer pool.Close()
+
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+	serverTransport, clientTransport := mcp.NewInMemoryTransports()
+	if _, err := NewMCPServer(pool).Connect(ctx, serverTransport, nil); err != nil {
+		t.Fatalf("server connect: %v", err)
+	}
+	logged := make(chan *mcp.LoggingMessageParams, 10)
+	mc := mcp.NewClient(&mcp.Implementation{Name: "test"}, &mcp.ClientOptions{
+		LoggingMessageHandler: func(_ context.Context, req *mcp.LoggingMessageRequest) {
+			logged <- req.Params
+		},
+	})
+	cs, err := mc.Connect(ctx, clientTransport, nil)
+	if err != nil {
+		t.Fatalf("client connect: %v", err)
+	}
+	defer cs.Close()
+	if err := cs.SetLoggingLevel(ctx, &mcp.SetLoggingLevelParams{Level: "info"}); err != nil {
+		t.Fatalf("set logging level: %v", err)
+	}
+	watching := func(d *Daemon) func() bool {
+		return func() bool { return d.Store.watching(uuid.Nil) > 0 }
+	}
+	waitFor(t, watching(d))
+
+	// The daemon restarts; commands finishing in the new one are logged too
+	d.Close()
+	restarted := &Daemon{Store: NewStore(), Logger: d.Logger}
+	if err := restarted.Listen(ctx, sock); err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(restarted.Close)
+	waitFor(t, watching(restarted))
+
+	client, ack := registerTestSession(t, sock, RegisterPayload{Title: "build"})
+	client.send(t, MsgCommand, CommandPayload{Command: "make"})
+	client.send(t, MsgCommandResult, CommandResultPayload{ExitCode: 0})
+	select {
+	case got := <-logged:
+		want := fmt.Sprintf("session %s: command %q exited with code 0", ack.ShortID, "make")
+		if got.Data != want {
+			t.Errorf("logged %v, want %q", got.Data, want)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("no log message after the daemon restarted")
+	}
+}
@@ -0,0 +1,74 @@
+package streamsh
+
+import (
+	"cmp"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"sync/atomic"
+)
+
+// metrics holds the daemon's counters. Gauges are computed from the Store
+// when scraped instead, so they can't drift from the sessions they
+// describe.
+type metrics struct {
+	sessionsTotal atomic.Uint64 // new (not reconnected) sessions registered
+	linesTotal    atomic.Uint64 // output lines appended across all sessions
+	connsRejected atomic.Uint64 // connections turned away by MaxConnections
+}
+
+func (m *metrics) sessionCreated() {
+	m.sessionsTotal.Add(1)
+}
+
+func (m *metrics) linesAppended(n int) {
+	m.linesTotal.Add(uint64(n))
+}
+
+func (m *metrics) connectionRejected() {
+	m.connsRejected.Add(1)
+}
+
+// WriteMetrics writes the daemon's metrics in the Prometheus text
+// exposition format.
+func (d *Daemon) WriteMetrics(w io.Writer) error {
+	sessions := d.Store.List()
+	slices.SortFunc(sessions, func(a, b *Session) int { return cmp.Compare(a.ShortID, b.ShortID) })
+	active := 0
+	for _, s := range sessions {
+		if s.Connected() {
+			active++
+		}
+	}
+
+	var b strings.Builder
+	writeMetric := func(name, typ, help string, value any) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", name, help, name, typ, name, value)
+	}
+	writeMetric("streamsh_sessions_total", "counter", "Sessions registered since the daemon started.", d.metrics.sessionsTotal.Load())
+	writeMetric("streamsh_sessions_active", "gauge", "Sessions with a connected client.", active)
+	writeMetric("streamsh_sessions", "gauge", "Sessions retained by the daemon, connected or not.", len(sessions))
+	writeMetric("streamsh_lines_total", "counter", "Output lines received across all sessions.", d.metrics.linesTotal.Load())
+	writeMetric("streamsh_connections_active", "gauge", "Open client connections, including MCP proxies.", d.activeConns.Load())
+	writeMetric("streamsh_connections_rejected_total", "counter", "Connections refused because of the connection limit.", d.metrics.connsRejected.Load())
+
+	b.WriteString("# HELP streamsh_buffer_bytes Bytes of output held in a session's buffer.\n")
+	b.WriteString("# TYPE streamsh_buffer_bytes gauge\n")
+	for _, s := range sessions {
+		fmt.Fprintf(&b, "streamsh_buffer_bytes{session=\"%s\",title=\"%s\"} %d\n",
+			s.ShortID, labelEscaper.Replace(s.Title()), s.Buffer.Bytes())
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// labelEscaper escapes a Prometheus label value.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func (d *Daemon) httpMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	d.WriteMetrics(w)
+}
@@ -0,0 +1,73 @@
+package streamsh
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// scrapeMetric returns the value of the first sample of name.
+func scrapeMetric(t *testing.T, d *Daemon, name string) int {
+	t.Helper()
+	var b strings.Builder
+	if err := d.WriteMetrics(&b); err != nil {
+		t.Fatalf("write metrics: %v", err)
+	}
+	for _, line := range strings.Split(b.String(), "\n") {
+		sample, value, ok := strings.Cut(line, " ")
+		if ok && (sample == name || strings.HasPrefix(sample, name+"{")) {
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				t.Fatalf("%s: %v", line, err)
+			}
+			return n
+		}
+	}
+	return -1
+}
+
+func TestMetricsAcrossSessionLifecycle(t *testing.T) {
+	d, sock := startTestDaemon(t)
+	a, ackA := registerTestSession(t, sock, RegisterPayload{Title: "a"})
+	registerTestSession(t, sock, RegisterPayload{Title: "b"})
+	a.send(t, MsgOutput, OutputPayload{Lines: []string{"one", "two", "three"}})
+	waitFor(t, func() bool { return scrapeMetric(t, d, "streamsh_lines_total") == 3 })
+
+	for name, want := range map[string]int{
+		"streamsh_sessions_total":  2,
+		"streamsh_sessions_active": 2,
+		"streamsh_sessions":        2,
+	} {
+		if got := scrapeMetric(t, d, name); got != want {
+			t.Errorf("%s = %d, want %d", name, got, want)
+		}
+	}
+
+	// Disconnect a, then prune it
+	sess, _ := d.Store.Resolve(ackA.ShortID)
+	a.Close()
+	waitFor(t, func() bool { return scrapeMetric(t, d, "streamsh_sessions_active") == 1 })
+	if got := scrapeMetric(t, d, "streamsh_sessions"); got != 2 {
+		t.Errorf("sessions after disconnect = %d, want 2", got)
+	}
+	sess.mu.Lock()
+	sess.lastActivity = time.Now().Add(-time.Hour)
+	sess.mu.Unlock()
+	d.Store.Prune(time.Minute)
+	if got := scrapeMetric(t, d, "streamsh_sessions"); got != 1 {
+		t.Errorf("sessions after prune = %d, want 1", got)
+	}
+	if got := scrapeMetric(t, d, "streamsh_buffer_bytes"); got != 0 {
+		t.Errorf("buffer bytes of remaining session = %d, want 0", got)
+	}
+
+	// Counters only go up
+	registerTestSession(t, sock, RegisterPayload{Title: "c"})
+	if got := scrapeMetric(t, d, "streamsh_sessions_total"); got != 3 {
+		t.Errorf("sessions_total = %d, want 3", got)
+	}
+	if got := scrapeMetric(t, d, "streamsh_lines_total"); got != 3 {
+		t.Errorf("lines_total = %d, want 3", got)
+	}
+}
@@ -0,0 +1,319 @@
+package streamsh
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// sessionSnapshot is the on-disk form of a Session.
+type sessionSnapshot struct {
+	ID           uuid.UUID         `json:"id"`
+	Title        string            `json:"title"`
+	CreatedAt    time.Time         `json:"created_at"`
+	LastActivity time.Time         `json:"last_activity"`
+	LastCommand  string            `json:"last_command,omitempty"`
+	LastExitCode *int              `json:"last_exit_code,omitempty"`
+	History      []CommandEntry    `json:"command_history,omitempty"`
+	Environment  map[string]string `json:"environment,omitempty"`
+	Cwd          string            `json:"cwd,omitempty"`
+	Collab       bool              `json:"collab,omitempty"`
+	Tags         []string          `json:"tags,omitempty"`
+	KeepANSI     bool              `json:"keep_ansi,omitempty"`
+	ReadOnly     bool              `json:"read_only,omitempty"`
+	TTL          time.Duration     `json:"ttl,omitempty"`
+	Buffer       json.RawMessage   `json:"buffer"`
+	// ClientSeqOffset keeps the client's numbering after a gap in a
+	// replay, so its next reconnect resumes from the right line.
+	ClientSeqOffset uint64 `json:"client_seq_offset,omitempty"`
+}
+
+// Save writes all sessions and their buffers to path. The file is written
+// atomically with mode 0600, since it contains raw terminal output.
+func (s *Store) Save(path string) error {
+	sessions := s.List()
+	snaps := make([]sessionSnapshot, len(sessions))
+	for i, sess := range sessions {
+		snaps[i] = newSessionSnapshot(sess)
+		snaps[i].Buffer = sess.Buffer.Snapshot()
+	}
+	data, err := json.Marshal(snaps)
+	if err != nil {
+		return fmt.Errorf("encoding sessions: %w", err)
+	}
+	return writeFileAtomic(path, data)
+}
+
+// Load restores sessions previously written by Save. Restored sessions are
+// marked disconnected until their client reconnects. Sessions already in the
+// store are left untouched. A missing file is not an error.
+func (s *Store) Load(path string) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("reading state file: %w", err)
+	}
+
+	var snaps []sessionSnapshot
+	if err := json.Unmarshal(data, &snaps); err != nil {
+		return fmt.Errorf("parsing state file: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, snap := range snaps {
+		if _, ok := s.sessions[snap.ID]; ok {
+			continue
+		}
+		buf, err := RestoreRingBuffer(snap.Buffer)
+		if err != nil {
+			return fmt.Errorf("restoring session %s: %w", snap.ID, err)
+		}
+		sess := snap.session(buf)
+		sess.historySize = s.HistorySize
+		s.sessions[snap.ID] = sess
+	}
+	return nil
+}
+
+// newSessionSnapshot captures sess's metadata, without its buffer.
+func newSessionSnapshot(sess *Session) sessionSnapshot {
+	lastCommand, _, lastExit := sess.LastCommand()
+	sess.mu.Lock()
+	offset := sess.clientSeqOffset
+	sess.mu.Unlock()
+	return sessionSnapshot{
+		ID:           sess.ID,
+		Title:        sess.Title(),
+		CreatedAt:    sess.CreatedAt,
+		LastActivity: sess.LastActivity(),
+		LastCommand:  lastCommand,
+		LastExitCode: lastExit,
+		History:      sess.RecentCommands(0),
+		Environment:  sess.Environment(),
+		Cwd:          sess.Cwd(),
+		Collab:       sess.Collab(),
+		Tags:         sess.Tags(),
+		KeepANSI:     sess.KeepANSI(),
+		ReadOnly:     sess.ReadOnly(),
+		TTL:          sess.TTL(),
+
+		ClientSeqOffset: offset,
+	}
+}
+
+// session builds a disconnected Session from the snapshot's metadata.
+func (snap sessionSnapshot) session(buf *RingBuffer) *Session {
+	return &Session{
+		ID:             snap.ID,
+		ShortID:        snap.ID.String()[:8],
+		title:          snap.Title,
+		CreatedAt:      snap.CreatedAt,
+		lastActivity:   snap.LastActivity,
+		lastCommand:    snap.LastCommand,
+		lastExitCode:   snap.LastExitCode,
+		CommandHistory: snap.History,
+		environment:    snap.Environment,
+		cwd:            snap.Cwd,
+		Buffer:         buf,
+		collab:         snap.Collab,
+		tags:           snap.Tags,
+		keepANSI:       snap.KeepANSI,
+		readOnly:       snap.ReadOnly,
+		ttl:            snap.TTL,
+
+		clientSeqOffset: snap.ClientSeqOffset,
+	}
+}
+
+// sessionFileExt is the extension of per-session files written by SaveDir.
+const sessionFileExt = ".ndjson"
+
+// sessionFileHeader is the first line of a per-session file. The buffer
+// snapshot carries no lines; those follow as one bufferLine per line.
+type sessionFileHeader struct {
+	sessionSnapshot
+	Buffer ringBufferSnapshot `json:"buffer"`
+}
+
+// bufferLine is one stored line in a per-session file.
+type bufferLine struct {
+	Line  string    `json:"line"`
+	Time  time.Time `json:"ts,omitzero"`
+	Count int       `json:"count,omitempty"`
+	Raw   string    `json:"raw,omitempty"` // the line with ANSI escapes, if kept
+}
+
+// SaveDir writes each session to its own newline-delimited JSON file in dir,
+// named by session ID: a header line with the session's metadata followed by
+// one line per buffered line, oldest first. Files for sessions no longer in
+// the store are removed.
+func (s *Store) SaveDir(dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("creating state directory: %w", err)
+	}
+
+	keep := make(map[string]bool)
+	var errs []error
+	for _, sess := range s.List() {
+		name := sess.ID.String() + sessionFileExt
+		keep[name] = true
+		if err := writeFileAtomic(filepath.Join(dir, name), encodeSessionFile(sess)); err != nil {
+			errs = append(errs, fmt.Errorf("saving session %s: %w", sess.ShortID, err))
+		}
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return errors.Join(append(errs, fmt.Errorf("reading state directory: %w", err))...)
+	}
+	for _, e := range entries {
+		if filepath.Ext(e.Name()) == sessionFileExt && !keep[e.Name()] {
+			os.Remove(filepath.Join(dir, e.Name()))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func encodeSessionFile(sess *Session) []byte {
+	snap := sess.Buffer.snapshot()
+	lines, times, counts, raws := snap.Lines, snap.Times, snap.Counts, snap.Raws
+	snap.Lines, snap.Times, snap.Counts, snap.Raws = nil, nil, nil, nil
+
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.Encode(sessionFileHeader{
+		sessionSnapshot: newSessionSnapshot(sess),
+		Buffer:          snap,
+	})
+	for i, line := range lines {
+		bl := bufferLine{Line: line}
+		if times != nil {
+			bl.Time = times[i]
+		}
+		if counts != nil {
+			bl.Count = counts[i]
+		}
+		if raws != nil {
+			bl.Raw = raws[i]
+		}
+		enc.Encode(bl)
+	}
+	return b.Bytes()
+}
+
+// LoadDir restores sessions from files written by SaveDir. As with Load,
+// restored sessions are disconnected and sessions already in the store are
+// left untouched. A missing directory is not an error; unreadable files are
+// skipped and reported in the returned error.
+func (s *Store) LoadDir(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("reading state directory: %w", err)
+	}
+
+	var errs []error
+	for _, e := range entries {
+		if e.IsDir() || filepath.Ext(e.Name()) != sessionFileExt {
+			continue
+		}
+		sess, err := decodeSessionFile(filepath.Join(dir, e.Name()))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("loading %s: %w", e.Name(), err))
+			continue
+		}
+
+		sess.historySize = s.HistorySize
+		s.mu.Lock()
+		if _, ok := s.sessions[sess.ID]; !ok {
+			s.sessions[sess.ID] = sess
+		}
+		s.mu.Unlock()
+	}
+	return errors.Join(errs...)
+}
+
+func decodeSessionFile(path string) (*Session, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	dec := json.NewDecoder(bufio.NewReader(f))
+	var hdr sessionFileHeader
+	if err := dec.Decode(&hdr); err != nil {
+		return nil, fmt.Errorf("parsing header: %w", err)
+	}
+	snap := hdr.Buffer
+	for {
+		var bl bufferLine
+		if err := dec.Decode(&bl); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("parsing line %d: %w", len(snap.Lines)+1, err)
+		}
+		snap.Lines = append(snap.Lines, bl.Line)
+		if snap.Timestamps {
+			snap.Times = append(snap.Times, bl.Time)
+		}
+		if snap.Dedup {
+			snap.Counts = append(snap.Counts, bl.Count)
+		}
+		snap.Raws = append(snap.Raws, bl.Raw)
+	}
+	if !slices.ContainsFunc(snap.Raws, func(raw string) bool { return raw != "" }) {
+		snap.Raws = nil
+	}
+
+	buf, err := restoreSnapshot(snap)
+	if err != nil {
+		return nil, err
+	}
+	return hdr.session(buf), nil
+}
+
+// writeFileAtomic writes data to a temporary file next to path and renames
+// it into place, so readers never observe a partially written file.
+func writeFileAtomic(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("creating state directory: %w", err)
+	}
+	f, err := os.CreateTemp(dir, filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("creating temp file: %w", err)
+	}
+	defer os.Remove(f.Name())
+
+	if err := f.Chmod(0600); err != nil {
+		f.Close()
+		return fmt.Errorf("setting permissions: %w", err)
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return fmt.Errorf("writing state: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("writing state: %w", err)
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return fmt.Errorf("replacing state file: %w", err)
+	}
+	return nil
+}
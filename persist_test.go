@@ -0,0 +1,106 @@
+package streamsh
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStoreSaveLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+
+	s := NewStore()
+	sess, _ := s.Create("dev-server", 10, true, nil)
+	sess.lastCommand = "make run"
+	sess.clientSeqOffset = 3
+	sess.Buffer.Append("listening on :8080")
+	sess.Buffer.Append("GET /health 200")
+
+	if err := s.Save(path); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("stat: %v", err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("state file mode = %o, want 600", perm)
+	}
+
+	loaded := NewStore()
+	if err := loaded.Load(path); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	got, ok := loaded.Get(sess.ID)
+	if !ok {
+		t.Fatal("session not restored")
+	}
+	if cmd, _, _ := got.LastCommand(); got.Title() != "dev-server" || cmd != "make run" || !got.Collab() {
+		t.Errorf("restored metadata = %+v", got)
+	}
+	if got.Connected() {
+		t.Error("restored session should be disconnected")
+	}
+	if seq := got.clientSeq(2); seq != 5 {
+		t.Errorf("restored client seq = %d, want 5", seq)
+	}
+	if lines := got.Buffer.AllLines(); len(lines) != 2 || lines[1] != "GET /health 200" {
+		t.Errorf("restored lines = %v", lines)
+	}
+}
+
+func TestStoreLoadMissingFile(t *testing.T) {
+	s := NewStore()
+	if err := s.Load(filepath.Join(t.TempDir(), "missing.json")); err != nil {
+		t.Errorf("expected no error for missing file, got %v", err)
+	}
+}
+
+func TestStoreSaveLoadDir(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "state")
+
+	s := NewStore()
+	sess, _ := s.Create("worker", 10, false, nil)
+	for i := range 15 {
+		sess.Buffer.Append(fmt.Sprintf("job %d", i))
+	}
+	gone, _ := s.Create("gone", 10, false, nil)
+
+	if err := s.SaveDir(dir); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	s.Remove(gone.ID)
+	if err := s.SaveDir(dir); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, gone.ID.String()+sessionFileExt)); !os.IsNotExist(err) {
+		t.Errorf("file for removed session still present: %v", err)
+	}
+
+	loaded := NewStore()
+	if err := loaded.LoadDir(dir); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if n := len(loaded.List()); n != 1 {
+		t.Fatalf("loaded %d sessions, want 1", n)
+	}
+	got, ok := loaded.Get(sess.ID)
+	if !ok {
+		t.Fatal("session not restored")
+	}
+	if got.Title() != "worker" || got.Buffer.TotalSeq() != 15 || got.Buffer.Cap() != 10 {
+		t.Errorf("restored title=%q totalSeq=%d cap=%d", got.Title(), got.Buffer.TotalSeq(), got.Buffer.Cap())
+	}
+	results := got.Buffer.Search("job 14", 1)
+	if len(results) != 1 || results[0].Seq != 14 || results[0].Timestamp.IsZero() {
+		t.Errorf("restored search = %+v", results)
+	}
+}
+
+func TestStoreLoadDirMissing(t *testing.T) {
+	s := NewStore()
+	if err := s.LoadDir(filepath.Join(t.TempDir(), "missing")); err != nil {
+		t.Errorf("expected no error for missing directory, got %v", err)
+	}
+}
@@ -1,14 +1,30 @@
 package streamsh
 
 import (
+	"bytes"
+	"compress/gzip"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 )
 
 // MsgType identifies the kind of message sent over the Unix socket.
 type MsgType string
 
 const (
+	// Handshake: a connecting client may send MsgHello before anything
+	// else; the daemon answers with MsgHelloAck, or MsgError and a closed
+	// connection if the versions are incompatible.
+	MsgHello    MsgType = "hello"
+	MsgHelloAck MsgType = "hello_ack"
+
 	MsgRegister   MsgType = "register"
 	MsgOutput     MsgType = "output"
 	MsgCommand    MsgType = "command"
@@ -17,12 +33,76 @@ const (
 	MsgAck        MsgType = "ack"
 	MsgError      MsgType = "error"
 
-	MsgReplay MsgType = "replay" // historical buffer replay on reconnect
+	MsgReplay       MsgType = "replay"        // historical buffer replay on reconnect
+	MsgResizeBuffer MsgType = "resize_buffer" // change the session's ring buffer capacity
+	MsgKill         MsgType = "kill"          // daemon → collab client: close the PTY and exit
+	MsgResize       MsgType = "resize"        // client → daemon: the PTY's dimensions changed
+	MsgEnvironment  MsgType = "environment"   // client → daemon: the shell's environment
+	MsgCwd          MsgType = "cwd"           // client → daemon: the shell's working directory changed
+	MsgPause        MsgType = "pause"         // client → daemon: streaming was paused or resumed
+	MsgSignal       MsgType = "signal"        // daemon → collab client: signal the foreground process
+	MsgShutdown     MsgType = "shutdown"      // daemon → any client: the daemon is closing, disconnect
+
+	MsgCommandResult MsgType = "command_result" // exit status of the last command
+
+	// Heartbeat: the daemon pings session clients, which answer with a
+	// pong. Any connection may also ping the daemon.
+	MsgPing MsgType = "ping"
+	MsgPong MsgType = "pong"
 
 	// MCP-proxy request types (MCP server → daemon)
-	MsgListSessions MsgType = "list_sessions"
-	MsgQuerySession MsgType = "query_session"
-	MsgWriteSession MsgType = "write_session"
+	MsgListSessions  MsgType = "list_sessions"
+	MsgQuerySession  MsgType = "query_session"
+	MsgWriteSession  MsgType = "write_session"
+	MsgKillSession   MsgType = "kill_session"
+	MsgDeleteSession MsgType = "delete_session"
+	MsgSendSignal    MsgType = "send_signal"
+	MsgRename        MsgType = "rename"
+	MsgSearchAll     MsgType = "search_all"
+	MsgSpawnSession  MsgType = "spawn_session" // start a shell owned by the daemon
+
+	MsgCommandHistory MsgType = "command_history"
+	MsgGetEnvironment MsgType = "get_environment"
+	MsgSessionInfo    MsgType = "session_info"
+	MsgQueryStats     MsgType = "query_stats"
+
+	// Export: the daemon answers MsgExportSession with a series of
+	// MsgExportChunk messages followed by a MsgAck.
+	MsgExportSession MsgType = "export_session"
+	MsgExportChunk   MsgType = "export_chunk"
+
+	// Streaming types: the daemon acks MsgSubscribe, then sends MsgEvent
+	// messages for the session tagged with the subscribe request's
+	// RequestID, alongside responses to other requests on the connection.
+	// MsgUnsubscribe stops the stream; MsgExpired ends it when the session
+	// is pruned.
+	MsgSubscribe   MsgType = "subscribe"
+	MsgUnsubscribe MsgType = "unsubscribe"
+	MsgEvent       MsgType = "event"
+	MsgExpired     MsgType = "expired"
+
+	// Admin request types
+	MsgQuiesce   MsgType = "quiesce"   // stop accepting new sessions
+	MsgUnquiesce MsgType = "unquiesce" // resume accepting new sessions
+)
+
+// Heartbeat defaults for Daemon.PingInterval and Daemon.PingTimeout, also
+// used by DaemonClient.
+const (
+	DefaultPingInterval = 30 * time.Second
+	DefaultPingTimeout  = 10 * time.Second
+)
+
+// ProtocolVersion is the wire protocol version exchanged in MsgHello, as
+// "major" or "major.minor". Peers with different major versions refuse to
+// talk to each other.
+const ProtocolVersion = "1"
+
+// Optional features negotiated in the handshake. A peer only uses a
+// capability if both sides listed it.
+const (
+	CapSubscribe = "subscribe" // MsgSubscribe event streams
+	CapGzip      = "gzip"      // gzip-compressed payloads, see Envelope.Compressed
 )
 
 // ErrDaemonAlreadyRunning is returned by Daemon.Listen when another daemon
@@ -30,24 +110,137 @@ const (
 var ErrDaemonAlreadyRunning = errors.New("daemon already running")
 
 // Envelope is the wire format for all IPC messages (newline-delimited JSON).
+// The daemon copies a request's RequestID into every message it sends in
+// response, so clients can keep several requests in flight on one
+// connection.
 type Envelope struct {
 	Type      MsgType         `json:"type"`
 	SessionID string          `json:"session_id,omitempty"`
+	RequestID string          `json:"request_id,omitempty"`
+	Token     string          `json:"token,omitempty"` // see Daemon.Token
 	Payload   json.RawMessage `json:"payload,omitempty"`
+
+	// Compressed means Payload is a JSON string holding the base64 of the
+	// gzipped payload. Only sent to peers that negotiated CapGzip.
+	Compressed bool `json:"compressed,omitempty"`
+}
+
+// DefaultCompressThreshold is the payload size, in bytes, above which the
+// client gzips MsgOutput payloads. Over a local socket compression mostly
+// costs CPU, so only large batches are worth it.
+const DefaultCompressThreshold = 64 * 1024
+
+// maxDecompressedPayload bounds the size of a decompressed payload, so a
+// small message can't expand without limit.
+const maxDecompressedPayload = 64 * 1024 * 1024
+
+// compressPayload returns env with its payload gzipped if the payload is
+// longer than threshold and compression makes it smaller.
+func compressPayload(env Envelope, threshold int) Envelope {
+	if len(env.Payload) <= threshold {
+		return env
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(env.Payload)
+	zw.Close()
+	packed, err := json.Marshal(buf.Bytes())
+	if err != nil || len(packed) >= len(env.Payload) {
+		return env
+	}
+	env.Payload = packed
+	env.Compressed = true
+	return env
+}
+
+// decompressPayload undoes compressPayload in place.
+func decompressPayload(env *Envelope) error {
+	var packed []byte
+	if err := json.Unmarshal(env.Payload, &packed); err != nil {
+		return fmt.Errorf("decoding compressed payload: %w", err)
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(packed))
+	if err != nil {
+		return fmt.Errorf("decompressing payload: %w", err)
+	}
+	payload, err := io.ReadAll(io.LimitReader(zr, maxDecompressedPayload+1))
+	if err != nil {
+		return fmt.Errorf("decompressing payload: %w", err)
+	}
+	if len(payload) > maxDecompressedPayload {
+		return fmt.Errorf("decompressed payload exceeds %d bytes", maxDecompressedPayload)
+	}
+	env.Payload = payload
+	env.Compressed = false
+	return nil
+}
+
+// ConnWriter serializes the messages written to one connection. Every
+// goroutine writing to a connection (request handling, heartbeats,
+// subscriptions, SendInput) must go through the same ConnWriter, so that
+// messages never interleave and break the newline-delimited framing.
+type ConnWriter struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// NewConnWriter returns a ConnWriter that encodes envelopes to w.
+func NewConnWriter(w io.Writer) *ConnWriter {
+	return &ConnWriter{enc: json.NewEncoder(w)}
+}
+
+// Write encodes env as a single line.
+func (w *ConnWriter) Write(env Envelope) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.enc.Encode(env)
+}
+
+// HelloPayload is the payload of MsgHello and MsgHelloAck. In the ack,
+// Version is the negotiated version and Capabilities those both sides
+// support.
+type HelloPayload struct {
+	Version      string   `json:"version"`
+	Capabilities []string `json:"capabilities,omitempty"`
+}
+
+// protocolMajor returns the major component of a protocol version.
+func protocolMajor(version string) string {
+	major, _, _ := strings.Cut(version, ".")
+	return major
+}
+
+// sharedCapabilities returns the capabilities present in both lists.
+func sharedCapabilities(a, b []string) []string {
+	var shared []string
+	for _, c := range a {
+		if slices.Contains(b, c) && !slices.Contains(shared, c) {
+			shared = append(shared, c)
+		}
+	}
+	return shared
 }
 
 // RegisterPayload is sent by the client to create a new session.
 type RegisterPayload struct {
-	Title      string `json:"title,omitempty"`
-	BufferSize int    `json:"buffer_size,omitempty"`
-	Collab     bool   `json:"collab,omitempty"`
-	SessionID  string `json:"session_id,omitempty"` // client-assigned UUID for reconnection
+	Title      string   `json:"title,omitempty"`
+	BufferSize int      `json:"buffer_size,omitempty"`
+	Collab     bool     `json:"collab,omitempty"`
+	SessionID  string   `json:"session_id,omitempty"` // client-assigned UUID for reconnection
+	Tags       []string `json:"tags,omitempty"`
+	Pid        int      `json:"pid,omitempty"`       // the shell's process ID on the client's host
+	KeepANSI   bool     `json:"keep_ansi,omitempty"` // store output with its ANSI escapes too
+	ReadOnly   bool     `json:"read_only,omitempty"` // the client refuses input
+	Dedup      bool     `json:"dedup,omitempty"`     // collapse repeated lines; see WithDedup
+	Paused     bool     `json:"paused,omitempty"`    // streaming is paused; see PausePayload
+	TTLMs      int64    `json:"ttl_ms,omitempty"`    // prune this long after disconnecting, overriding the daemon's SessionTTL
 }
 
 // RegisterAck is sent by the daemon after a successful registration.
 type RegisterAck struct {
 	SessionID string `json:"session_id"`
 	ShortID   string `json:"short_id"`
+	ResumeSeq uint64 `json:"resume_seq,omitempty"` // lines the daemon already holds; replay from here
 }
 
 // OutputPayload carries shell output lines from client to daemon.
@@ -57,7 +250,39 @@ type OutputPayload struct {
 
 // CommandPayload carries the last detected command from client to daemon.
 type CommandPayload struct {
-	Command string `json:"command"`
+	Command   string `json:"command"`
+	StartedAt int64  `json:"started_at,omitempty"` // unix nanoseconds; when the shell started it, if known, else when it was entered
+}
+
+// ResizePayload carries the PTY's dimensions from client to daemon.
+type ResizePayload struct {
+	Rows int `json:"rows"`
+	Cols int `json:"cols"`
+}
+
+// EnvironmentPayload carries the shell's environment, filtered and with
+// secret-looking values redacted, from client to daemon.
+type EnvironmentPayload struct {
+	Vars map[string]string `json:"vars"`
+}
+
+// CwdPayload carries the shell's working directory, as reported by its
+// prompt hook, from client to daemon.
+type CwdPayload struct {
+	Dir string `json:"dir"`
+}
+
+// PausePayload tells the daemon the client has paused streaming, so no
+// output or commands arrive until it resumes, or that it has resumed.
+type PausePayload struct {
+	Paused bool `json:"paused"`
+}
+
+// CommandResultPayload carries the exit status of a finished command, as
+// reported by the shell's prompt hook.
+type CommandResultPayload struct {
+	Command  string `json:"command"`
+	ExitCode int    `json:"exit_code"`
 }
 
 // InputPayload carries text from daemon to client to be written to the PTY.
@@ -73,9 +298,34 @@ type ErrorPayload struct {
 // ReplayPayload carries historical buffer content on reconnect.
 type ReplayPayload struct {
 	Lines       []string `json:"lines"`
+	Repeats     []int    `json:"repeats,omitempty"`  // times each line repeats, for deduplicating clients; see RingBuffer.ReadRangeRepeats
+	FromSeq     uint64   `json:"from_seq,omitempty"` // sequence number of Lines[0]
 	LastCommand string   `json:"last_command,omitempty"`
 }
 
+// ResizeBufferPayload is sent by a client to change its session's buffer
+// capacity, or by any connection to change that of the named Session.
+type ResizeBufferPayload struct {
+	Session  string `json:"session,omitempty"`
+	Capacity int    `json:"capacity"`
+}
+
+// ResizeBufferResponse is the daemon response for MsgResizeBuffer.
+type ResizeBufferResponse struct {
+	SessionID string `json:"session_id,omitempty"`
+	Capacity  int    `json:"capacity"`
+	Lines     int    `json:"lines"` // lines retained after resizing
+}
+
+// ListSessionsPayload is the optional request payload for MsgListSessions.
+type ListSessionsPayload struct {
+	Tags          []string `json:"tags,omitempty"`           // only sessions with any of these tags
+	MatchAll      bool     `json:"match_all,omitempty"`      // require all Tags instead of any
+	ConnectedOnly bool     `json:"connected_only,omitempty"` // skip sessions whose client is gone
+	TitleContains string   `json:"title_contains,omitempty"` // case-insensitive title substring
+	Limit         int      `json:"limit,omitempty"`          // at most this many, most recently active first
+}
+
 // ListSessionsResponse is the daemon response for MsgListSessions.
 type ListSessionsResponse struct {
 	Sessions []SessionInfo `json:"sessions"`
@@ -83,33 +333,295 @@ type ListSessionsResponse struct {
 
 // QuerySessionPayload is the request payload for MsgQuerySession.
 type QuerySessionPayload struct {
-	Session    string `json:"session"`
-	Search     string `json:"search,omitempty"`
-	LastN      int    `json:"last_n,omitempty"`
-	Cursor     uint64 `json:"cursor,omitempty"`
-	Count      int    `json:"count,omitempty"`
-	MaxResults int    `json:"max_results,omitempty"`
+	Session           string   `json:"session"`
+	Tags              []string `json:"tags,omitempty"` // pick the one session with all these tags if Session is empty
+	Search            string   `json:"search,omitempty"`
+	SearchRegex       string   `json:"search_regex,omitempty"`
+	LastN             int      `json:"last_n,omitempty"`
+	Cursor            uint64   `json:"cursor,omitempty"`
+	Count             int      `json:"count,omitempty"`
+	MaxResults        int      `json:"max_results,omitempty"`
+	Context           int      `json:"context,omitempty"`             // lines before and after each search hit
+	Before            int      `json:"before,omitempty"`              // overrides Context for preceding lines
+	After             int      `json:"after,omitempty"`               // overrides Context for following lines
+	Since             string   `json:"since,omitempty"`               // RFC3339 or unix seconds
+	Until             string   `json:"until,omitempty"`               // RFC3339 or unix seconds
+	NewestFirst       bool     `json:"newest_first,omitempty"`        // search from the most recent line backward
+	Exclude           string   `json:"exclude,omitempty"`             // drop lines containing this (case-insensitive)
+	ExcludeRegex      string   `json:"exclude_regex,omitempty"`       // drop lines matching this regex
+	IncludeTimestamps bool     `json:"include_timestamps,omitempty"`  // per-line append times in the response
+	CountOnly         bool     `json:"count_only,omitempty"`          // search mode: return only MatchCount
+	Raw               bool     `json:"raw,omitempty"`                 // keep ANSI escapes, for sessions registered with KeepANSI
+	IncludeCommands   bool     `json:"include_commands,omitempty"`    // index of command spans in the response
+	LastCommandOutput bool     `json:"last_command_output,omitempty"` // read the most recent command's output
 }
 
 // QuerySessionResponse is the daemon response for MsgQuerySession.
 type QuerySessionResponse struct {
-	SessionID  string   `json:"session_id"`
-	Title      string   `json:"title"`
-	TotalLines int      `json:"total_lines"`
-	Lines      []string `json:"lines"`
-	NextCursor uint64   `json:"next_cursor,omitempty"`
-	HasMore    bool     `json:"has_more"`
+	SessionID  string        `json:"session_id"`
+	Title      string        `json:"title"`
+	TotalLines int           `json:"total_lines"`
+	Lines      []string      `json:"lines"`
+	NextCursor uint64        `json:"next_cursor,omitempty"`
+	HasMore    bool          `json:"has_more"`
+	Timestamps []time.Time   `json:"timestamps,omitempty"`  // parallel to Lines, when requested
+	Matches    []SearchMatch `json:"matches,omitempty"`     // search hits with context, replaces Lines
+	MatchCount *int          `json:"match_count,omitempty"` // total search hits, for CountOnly requests
+	Rows       int           `json:"rows,omitempty"`        // terminal size, if the client reported it
+	Cols       int           `json:"cols,omitempty"`
+	Commands   []CommandSpan `json:"commands,omitempty"` // for IncludeCommands requests
+	Command    *CommandSpan  `json:"command,omitempty"`  // the command whose output Lines are, for LastCommandOutput
+}
+
+// SearchAllPayload is the request payload for MsgSearchAll. MaxResults
+// bounds the matches returned across all sessions, and
+// MaxResultsPerSession those from any one session.
+type SearchAllPayload struct {
+	Search               string   `json:"search,omitempty"`
+	SearchRegex          string   `json:"search_regex,omitempty"`
+	Tags                 []string `json:"tags,omitempty"` // only search sessions with any of these tags
+	ConnectedOnly        bool     `json:"connected_only,omitempty"`
+	MaxResults           int      `json:"max_results,omitempty"`
+	MaxResultsPerSession int      `json:"max_results_per_session,omitempty"`
+	NewestFirst          bool     `json:"newest_first,omitempty"` // within each session
+}
+
+// SearchAllResponse is the daemon response for MsgSearchAll. Only sessions
+// with matches are listed.
+type SearchAllResponse struct {
+	Sessions  []SessionMatches `json:"sessions"`
+	Truncated bool             `json:"truncated,omitempty"` // more matches exist beyond MaxResults or MaxResultsPerSession
+}
+
+// SessionMatches are the search hits in one session.
+type SessionMatches struct {
+	SessionID string         `json:"session_id"`
+	Title     string         `json:"title"`
+	Matches   []SearchResult `json:"matches"`
+}
+
+// CommandSpan locates one command's output in a session's buffer: lines
+// StartSeq up to, but not including, EndSeq. EndSeq is nil while the
+// command is running. Read it with Cursor StartSeq and Count
+// EndSeq-StartSeq.
+type CommandSpan struct {
+	Command  string  `json:"command"`
+	StartSeq uint64  `json:"start_seq"`
+	EndSeq   *uint64 `json:"end_seq,omitempty"`
+	ExitCode *int    `json:"exit_code,omitempty"`
 }
 
 // WriteSessionPayload is the request payload for MsgWriteSession.
 type WriteSessionPayload struct {
-	Session string `json:"session"`
-	Text    string `json:"text"`
+	Session string   `json:"session"`
+	Text    string   `json:"text"`
+	Keys    []string `json:"keys,omitempty"`    // key names, written after Text; see keySequence
+	WaitMs  int      `json:"wait_ms,omitempty"` // wait up to this long for output and return it
 }
 
 // WriteSessionResponse is the daemon response for MsgWriteSession.
 type WriteSessionResponse struct {
-	Success   bool   `json:"success"`
+	Success    bool     `json:"success"`
+	SessionID  string   `json:"session_id"`
+	BytesSent  int      `json:"bytes_sent"`
+	Lines      []string `json:"lines,omitempty"`       // output that followed the write, with WaitMs
+	NextCursor uint64   `json:"next_cursor,omitempty"` // sequence number after Lines, for query_session
+}
+
+// KillSessionPayload is the request payload for MsgKillSession.
+type KillSessionPayload struct {
+	Session string `json:"session"`
+}
+
+// KillSessionResponse is the daemon response for MsgKillSession. Signaled
+// is false if the session was only removed from the store, because its
+// client was disconnected or not collaborative.
+type KillSessionResponse struct {
+	SessionID string `json:"session_id"`
+	Connected bool   `json:"connected"`
+	Signaled  bool   `json:"signaled"`
+}
+
+// SpawnPayload is the request payload for MsgSpawnSession. Shell defaults
+// to the daemon's $SHELL, or /bin/sh. The daemon answers with a
+// RegisterAck for the new session.
+type SpawnPayload struct {
+	Title  string   `json:"title,omitempty"`
+	Shell  string   `json:"shell,omitempty"`
+	Collab bool     `json:"collab,omitempty"`
+	Tags   []string `json:"tags,omitempty"`
+}
+
+// DeleteSessionPayload is the request payload for MsgDeleteSession. A
+// session whose client is connected is only deleted with Force.
+type DeleteSessionPayload struct {
+	Session string `json:"session"`
+	Force   bool   `json:"force,omitempty"`
+}
+
+// DeleteSessionResponse is the daemon response for MsgDeleteSession.
+type DeleteSessionResponse struct {
+	SessionID string `json:"session_id"`
+	Title     string `json:"title"`
+	Connected bool   `json:"connected"` // the client was still connected
+}
+
+// SendSignalPayload is the request payload for MsgSendSignal.
+type SendSignalPayload struct {
+	Session string `json:"session"`
+	Signal  string `json:"signal"`
+}
+
+// SendSignalResponse is the daemon response for MsgSendSignal. Signal is
+// the normalized signal name.
+type SendSignalResponse struct {
+	SessionID string `json:"session_id"`
+	Signal    string `json:"signal"`
+}
+
+// SignalPayload carries a signal from the daemon to a collab client.
+type SignalPayload struct {
+	Signal string `json:"signal"`
+}
+
+// allowedSignals are the signals that may be sent to a session, by name.
+// Anything else, including raw signal numbers, is refused.
+var allowedSignals = map[string]syscall.Signal{
+	"SIGINT":  syscall.SIGINT,
+	"SIGTERM": syscall.SIGTERM,
+	"SIGKILL": syscall.SIGKILL,
+	"SIGHUP":  syscall.SIGHUP,
+	"SIGQUIT": syscall.SIGQUIT,
+	"SIGTSTP": syscall.SIGTSTP,
+	"SIGCONT": syscall.SIGCONT,
+	"SIGUSR1": syscall.SIGUSR1,
+	"SIGUSR2": syscall.SIGUSR2,
+}
+
+// parseSignal looks up a signal name such as "SIGINT", "sigint", or "INT"
+// in allowedSignals and returns its canonical name.
+func parseSignal(name string) (string, syscall.Signal, error) {
+	canon := strings.ToUpper(strings.TrimSpace(name))
+	if !strings.HasPrefix(canon, "SIG") {
+		canon = "SIG" + canon
+	}
+	sig, ok := allowedSignals[canon]
+	if !ok {
+		names := slices.Sorted(maps.Keys(allowedSignals))
+		return "", 0, fmt.Errorf("unsupported signal %q (allowed: %s)", name, strings.Join(names, ", "))
+	}
+	return canon, sig, nil
+}
+
+// RenameSessionPayload is the request payload for MsgRename.
+type RenameSessionPayload struct {
+	Session string `json:"session"`
+	Title   string `json:"title"`
+}
+
+// RenameSessionResponse is the daemon response for MsgRename.
+type RenameSessionResponse struct {
+	SessionID string `json:"session_id"`
+	OldTitle  string `json:"old_title"`
+	NewTitle  string `json:"new_title"`
+}
+
+// CommandHistoryPayload is the request payload for MsgCommandHistory.
+// Limit caps the number of commands returned; zero means all of them.
+type CommandHistoryPayload struct {
+	Session string `json:"session"`
+	Limit   int    `json:"limit,omitempty"`
+}
+
+// CommandHistoryResponse is the daemon response for MsgCommandHistory.
+// Commands are ordered oldest first.
+type CommandHistoryResponse struct {
+	SessionID string         `json:"session_id"`
+	Title     string         `json:"title"`
+	Commands  []CommandEntry `json:"commands"`
+}
+
+// SessionInfoPayload is the request payload for MsgSessionInfo. The
+// daemon answers with a SessionDetails.
+type SessionInfoPayload struct {
+	Session string `json:"session"`
+}
+
+// QueryStatsPayload is the request payload for MsgQueryStats. The daemon
+// answers with a SessionStats.
+type QueryStatsPayload struct {
+	Session string `json:"session"`
+}
+
+// GetEnvironmentPayload is the request payload for MsgGetEnvironment. If
+// Keys is set, only those variables are returned.
+type GetEnvironmentPayload struct {
+	Session string   `json:"session"`
+	Keys    []string `json:"keys,omitempty"`
+}
+
+// GetEnvironmentResponse is the daemon response for MsgGetEnvironment.
+type GetEnvironmentResponse struct {
+	SessionID string            `json:"session_id"`
+	Vars      map[string]string `json:"vars"`
+}
+
+// ExportSessionPayload is the request payload for MsgExportSession.
+// Format is "text" (the default) for the lines as they are, or "jsonl" for
+// one {"seq":N,"line":"..."} object per line.
+type ExportSessionPayload struct {
+	Session   string `json:"session"`
+	StripANSI bool   `json:"strip_ansi,omitempty"`
+	Format    string `json:"format,omitempty"`
+}
+
+// ExportChunkPayload carries a piece of exported output. Chunks concatenate
+// to newline-terminated lines, but a chunk may end mid-line.
+type ExportChunkPayload struct {
+	Data string `json:"data"`
+}
+
+// ExportSessionResponse is the final ack for MsgExportSession.
+type ExportSessionResponse struct {
 	SessionID string `json:"session_id"`
-	BytesSent int    `json:"bytes_sent"`
+	Bytes     int64  `json:"bytes"`
+}
+
+// SubscribePayload is the request payload for MsgSubscribe. If FromSeq is
+// non-zero, retained lines from that sequence number on are sent before new
+// output; otherwise the last LastN lines are, and zero for both follows
+// only new output. AllSessions follows the state changes of every session
+// instead, without output; Session, FromSeq, and LastN are then ignored.
+type SubscribePayload struct {
+	Session     string  `json:"session"`
+	FromSeq     *uint64 `json:"from_seq,omitempty"` // replay retained lines from here; if nil, the last LastN lines
+	LastN       int     `json:"last_n,omitempty"`
+	AllSessions bool    `json:"all_sessions,omitempty"`
+}
+
+// UnsubscribePayload is the request payload for MsgUnsubscribe.
+// SubscriptionID is the RequestID of the MsgSubscribe to cancel.
+type UnsubscribePayload struct {
+	SubscriptionID string `json:"subscription_id"`
+}
+
+// EventPayload carries newly appended lines, or a change in session state,
+// to a subscriber. Seqs holds the sequence number of each line in Lines.
+type EventPayload struct {
+	SessionID string           `json:"session_id"`
+	Kind      SessionEventKind `json:"kind,omitempty"` // empty for output lines
+	Lines     []string         `json:"lines,omitempty"`
+	Seqs      []uint64         `json:"seqs,omitempty"`
+	Command   string           `json:"command,omitempty"`   // for SessionNewCommand and SessionExited
+	ExitCode  *int             `json:"exit_code,omitempty"` // for SessionExited
+}
+
+// ExpiredPayload tells a subscriber its session was pruned.
+type ExpiredPayload struct {
+	SessionID string `json:"session_id"`
+}
+
+// QuiesceResponse is the daemon response for MsgQuiesce and MsgUnquiesce.
+type QuiesceResponse struct {
+	Quiesced bool `json:"quiesced"`
 }
@@ -0,0 +1,336 @@
+package streamsh
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// querySession answers a MsgQuerySession request against sess. Exactly one
+// read mode applies, in order of precedence: LastCommandOutput, search
+// (Search or SearchRegex), time range (Since/Until), LastN, then cursor
+// pagination. Exclude and ExcludeRegex drop matching lines in the last
+// command, search, LastN, and cursor modes.
+// With CountOnly, search mode reports only the number of matches. With Raw,
+// lines keep their ANSI escapes if the session stores them; matching and
+// context lines always use the stripped text.
+func querySession(sess *Session, p QuerySessionPayload) (QuerySessionResponse, error) {
+	resp := QuerySessionResponse{
+		SessionID:  sess.ShortID,
+		Title:      sess.Title(),
+		TotalLines: sess.Buffer.Len(),
+	}
+	resp.Rows, resp.Cols = sess.Size()
+	if p.IncludeCommands {
+		resp.Commands = sess.CommandSpans()
+	}
+
+	exclude, err := excludeMatcher(p)
+	if err != nil {
+		return resp, err
+	}
+	var keep func(string) bool
+	if exclude != nil {
+		keep = func(line string) bool { return !exclude(line) }
+	}
+
+	maxResults := p.MaxResults
+	if maxResults <= 0 {
+		maxResults = 50
+	}
+	count := p.Count
+	if count <= 0 {
+		count = 100
+	}
+
+	switch {
+	case p.LastCommandOutput:
+		readLastCommand(sess, p, keep, &resp)
+	case p.SearchRegex != "" || p.Search != "":
+		match := SubstringMatcher(p.Search)
+		if p.SearchRegex != "" {
+			if match, err = RegexMatcher(p.SearchRegex); err != nil {
+				return resp, err
+			}
+		}
+		if keep != nil {
+			include := match
+			match = func(line string) bool { return include(line) && keep(line) }
+		}
+		if p.CountOnly {
+			n := sess.Buffer.CountFunc(match)
+			resp.MatchCount = &n
+			break
+		}
+		results := sess.Buffer.SearchFunc(match, maxResults, p.NewestFirst)
+		if p.Raw {
+			useRawLines(results)
+		}
+		before, after := p.Before, p.After
+		if before <= 0 {
+			before = p.Context
+		}
+		if after <= 0 {
+			after = p.Context
+		}
+		if before > 0 || after > 0 {
+			resp.Matches = sess.Buffer.AddContext(results, before, after)
+			if p.IncludeTimestamps {
+				for i := range resp.Matches {
+					resp.Matches[i].Timestamp = results[i].Timestamp
+				}
+			}
+		} else {
+			resp.Lines, resp.Timestamps = formatSearchResults(results, p.IncludeTimestamps)
+		}
+	case p.Since != "" || p.Until != "":
+		if err := readTimeRange(sess.Buffer, p, &resp); err != nil {
+			return resp, err
+		}
+	case p.LastN > 0 && (keep != nil || p.IncludeTimestamps || p.Raw):
+		results := sess.Buffer.LastNFunc(p.LastN, keep)
+		if p.Raw {
+			useRawLines(results)
+		}
+		resp.Lines, resp.Timestamps = resultLines(results, p.IncludeTimestamps)
+	case p.LastN > 0:
+		resp.Lines = sess.Buffer.LastN(p.LastN)
+	case keep != nil || p.IncludeTimestamps || p.Raw:
+		var results []SearchResult
+		results, resp.NextCursor, resp.HasMore = sess.Buffer.ReadFunc(p.Cursor, count, keep)
+		if p.Raw {
+			useRawLines(results)
+		}
+		resp.Lines, resp.Timestamps = resultLines(results, p.IncludeTimestamps)
+	default:
+		resp.Lines, resp.NextCursor, resp.HasMore = sess.Buffer.ReadRange(p.Cursor, count)
+	}
+	return resp, nil
+}
+
+// searchAll answers a MsgSearchAll request against sessions, searched
+// most recently active first, as those are the likeliest to matter. Once
+// p.MaxResults matches (default 50) have been collected the search stops,
+// and Truncated reports whether any remain or p.MaxResultsPerSession left
+// any out.
+func searchAll(sessions []*Session, p SearchAllPayload) (SearchAllResponse, error) {
+	resp := SearchAllResponse{Sessions: []SessionMatches{}}
+
+	var match func(string) bool
+	switch {
+	case p.SearchRegex != "":
+		var err error
+		if match, err = RegexMatcher(p.SearchRegex); err != nil {
+			return resp, err
+		}
+	case p.Search != "":
+		match = SubstringMatcher(p.Search)
+	default:
+		return resp, errors.New("search or search_regex is required")
+	}
+	remaining := p.MaxResults
+	if remaining <= 0 {
+		remaining = 50
+	}
+
+	sessions = slices.Clone(sessions)
+	slices.SortFunc(sessions, byRecentActivity)
+	for _, sess := range sessions {
+		if remaining == 0 {
+			// Only find out whether anything was left out
+			if resp.Truncated || len(sess.Buffer.SearchFunc(match, 1, false)) > 0 {
+				resp.Truncated = true
+				break
+			}
+			continue
+		}
+		limit := remaining
+		if p.MaxResultsPerSession > 0 {
+			limit = min(limit, p.MaxResultsPerSession)
+		}
+		// Ask for one extra match to learn whether the limit cut anything off
+		results := sess.Buffer.SearchFunc(match, limit+1, p.NewestFirst)
+		if len(results) > limit {
+			results = results[:limit]
+			resp.Truncated = true
+		}
+		if len(results) > 0 {
+			resp.Sessions = append(resp.Sessions, SessionMatches{
+				SessionID: sess.ShortID,
+				Title:     sess.Title(),
+				Matches:   results,
+			})
+		}
+		remaining -= len(results)
+	}
+	return resp, nil
+}
+
+// Limits for LastCommandOutput reads.
+const (
+	maxLastCommandLines     = 1000 // per response, unless Count is set; page on with NextCursor
+	defaultLastCommandLines = 50   // read instead when no command boundaries are known
+)
+
+// readLastCommand fills resp with the output of the session's most recent
+// command, from the line it was typed at through the line before its exit
+// status was reported (or the newest line, if it is still running). If the
+// session has no command boundaries, e.g. because its shell has no prompt
+// hooks, it returns the last defaultLastCommandLines lines instead. A
+// p.Cursor within the command's output, as returned in NextCursor, resumes
+// reading from there.
+func readLastCommand(sess *Session, p QuerySessionPayload, keep func(string) bool, resp *QuerySessionResponse) {
+	spans := sess.CommandSpans()
+	if len(spans) == 0 {
+		results := sess.Buffer.LastNFunc(defaultLastCommandLines, keep)
+		if p.Raw {
+			useRawLines(results)
+		}
+		resp.Lines, resp.Timestamps = resultLines(results, p.IncludeTimestamps)
+		return
+	}
+
+	span := spans[len(spans)-1]
+	resp.Command = &span
+	end := sess.Buffer.TotalSeq()
+	if span.EndSeq != nil {
+		end = *span.EndSeq
+	}
+	start := span.StartSeq
+	if p.Cursor > start {
+		start = min(p.Cursor, end)
+	}
+	n := min(int(end-start), maxLastCommandLines)
+	if p.Count > 0 {
+		n = min(int(end-start), p.Count)
+	}
+	results, next, _ := sess.Buffer.ReadFunc(start, n, nil)
+	if keep != nil {
+		results = slices.DeleteFunc(results, func(r SearchResult) bool { return !keep(r.Line) })
+	}
+	if p.Raw {
+		useRawLines(results)
+	}
+	resp.Lines, resp.Timestamps = resultLines(results, p.IncludeTimestamps)
+	resp.NextCursor = next
+	resp.HasMore = next < end
+}
+
+// excludeMatcher builds the matcher for p.Exclude and p.ExcludeRegex, or
+// returns nil if neither is set.
+func excludeMatcher(p QuerySessionPayload) (func(string) bool, error) {
+	var matchers []func(string) bool
+	if p.Exclude != "" {
+		matchers = append(matchers, SubstringMatcher(p.Exclude))
+	}
+	if p.ExcludeRegex != "" {
+		re, err := RegexMatcher(p.ExcludeRegex)
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, re)
+	}
+	if len(matchers) == 0 {
+		return nil, nil
+	}
+	return func(line string) bool {
+		for _, m := range matchers {
+			if m(line) {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+// resultLines splits results into raw lines and, if withTS is set, their
+// timestamps.
+func resultLines(results []SearchResult, withTS bool) ([]string, []time.Time) {
+	lines := make([]string, len(results))
+	var stamps []time.Time
+	if withTS {
+		stamps = make([]time.Time, len(results))
+	}
+	for i, r := range results {
+		lines[i] = r.Line
+		if stamps != nil {
+			stamps[i] = r.Timestamp
+		}
+	}
+	return lines, stamps
+}
+
+// readTimeRange fills resp with the lines appended between p.Since and
+// p.Until, paginated by p.Count. NextCursor points past the last returned
+// line so callers can continue in cursor mode.
+func readTimeRange(buf *RingBuffer, p QuerySessionPayload, resp *QuerySessionResponse) error {
+	since, err := parseTimeParam(p.Since)
+	if err != nil {
+		return err
+	}
+	until, err := parseTimeParam(p.Until)
+	if err != nil {
+		return err
+	}
+	count := p.Count
+	if count <= 0 {
+		count = 100
+	}
+
+	results := buf.ReadTimeRange(since, until, count+1)
+	if len(results) > count {
+		results = results[:count]
+		resp.HasMore = true
+	}
+	if p.Raw {
+		useRawLines(results)
+	}
+	resp.Lines, resp.Timestamps = resultLines(results, p.IncludeTimestamps)
+	if len(results) > 0 {
+		resp.NextCursor = results[len(results)-1].Seq + 1
+	}
+	return nil
+}
+
+// parseTimeParam parses an RFC3339 timestamp or unix seconds (optionally
+// fractional). An empty string yields the zero time.
+func parseTimeParam(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t, nil
+	}
+	secs, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q: want RFC3339 or unix seconds", s)
+	}
+	return time.Unix(0, int64(secs*float64(time.Second))), nil
+}
+
+// useRawLines replaces each result's Line with its ANSI-colored form, where
+// one was kept.
+func useRawLines(results []SearchResult) {
+	for i := range results {
+		results[i].Line = results[i].RawLine()
+	}
+}
+
+// formatSearchResults renders search hits as "[seq] line" strings. If withTS
+// is set, the hits' timestamps are returned alongside.
+func formatSearchResults(results []SearchResult, withTS bool) ([]string, []time.Time) {
+	lines := make([]string, len(results))
+	var stamps []time.Time
+	if withTS {
+		stamps = make([]time.Time, len(results))
+	}
+	for i, r := range results {
+		lines[i] = fmt.Sprintf("[%d] %s", r.Seq, r.Line)
+		if stamps != nil {
+			stamps[i] = r.Timestamp
+		}
+	}
+	return lines, stamps
+}
@@ -0,0 +1,250 @@
+package streamsh
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestParseTimeParam(t *testing.T) {
+	want := time.Date(2024, 1, 15, 10, 23, 45, 0, time.UTC)
+	for _, in := range []string{"2024-01-15T10:23:45Z", "1705314225", "1705314225.0"} {
+		got, err := parseTimeParam(in)
+		if err != nil {
+			t.Errorf("parseTimeParam(%q): %v", in, err)
+			continue
+		}
+		if !got.Equal(want) {
+			t.Errorf("parseTimeParam(%q) = %v, want %v", in, got, want)
+		}
+	}
+
+	if got, err := parseTimeParam(""); err != nil || !got.IsZero() {
+		t.Errorf("empty input = %v, %v", got, err)
+	}
+	if _, err := parseTimeParam("yesterday"); err == nil {
+		t.Error("expected error for invalid time")
+	}
+}
+
+func TestQuerySessionExclude(t *testing.T) {
+	s := NewStore()
+	sess, _ := s.Create("server", 100, false, nil)
+	sess.Buffer.AppendBatch([]string{
+		"DEBUG tick",
+		"error: test fixture missing",
+		"INFO started",
+		"DEBUG tick",
+		"error: connection refused",
+		"INFO ready",
+	})
+
+	// Cursor mode pages over kept lines only
+	resp, err := querySession(sess, QuerySessionPayload{Exclude: "debug", Count: 2})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if fmt.Sprint(resp.Lines) != "[error: test fixture missing INFO started]" {
+		t.Errorf("cursor lines = %v", resp.Lines)
+	}
+	if resp.NextCursor != 3 || !resp.HasMore {
+		t.Errorf("next=%d hasMore=%v", resp.NextCursor, resp.HasMore)
+	}
+
+	// LastN counts kept lines
+	resp, _ = querySession(sess, QuerySessionPayload{ExcludeRegex: `^(DEBUG|INFO)`, LastN: 2})
+	if fmt.Sprint(resp.Lines) != "[error: test fixture missing error: connection refused]" {
+		t.Errorf("last_n lines = %v", resp.Lines)
+	}
+
+	// Composes with search
+	resp, _ = querySession(sess, QuerySessionPayload{Search: "error", Exclude: "test"})
+	if fmt.Sprint(resp.Lines) != "[[4] error: connection refused]" {
+		t.Errorf("search lines = %v", resp.Lines)
+	}
+
+	if _, err := querySession(sess, QuerySessionPayload{ExcludeRegex: "("}); err == nil {
+		t.Error("expected error for invalid exclude regex")
+	}
+}
+
+func TestQuerySessionCountOnly(t *testing.T) {
+	s := NewStore()
+	sess, _ := s.Create("tests", 100, false, nil)
+	for i := range 60 {
+		sess.Buffer.Append(fmt.Sprintf("--- FAIL: TestCase%d", i))
+	}
+	sess.Buffer.Append("ok")
+
+	// Counts are not capped by max_results
+	resp, err := querySession(sess, QuerySessionPayload{Search: "fail", CountOnly: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if resp.MatchCount == nil || *resp.MatchCount != 60 || len(resp.Lines) != 0 {
+		t.Errorf("match_count=%v lines=%d", resp.MatchCount, len(resp.Lines))
+	}
+
+	resp, _ = querySession(sess, QuerySessionPayload{SearchRegex: `TestCase\d$`, Exclude: "Case0", CountOnly: true})
+	if resp.MatchCount == nil || *resp.MatchCount != 9 {
+		t.Errorf("regex match_count=%v, want 9", resp.MatchCount)
+	}
+}
+
+func TestQuerySessionRaw(t *testing.T) {
+	s := NewStore()
+	sess, _ := s.Create("build", 100, false, nil)
+	sess.Buffer.AppendBatchANSI([]string{"\x1b[32mok\x1b[0m  pkg/a", "\x1b[31mFAIL\x1b[0m pkg/b"})
+
+	resp, _ := querySession(sess, QuerySessionPayload{LastN: 1})
+	if fmt.Sprint(resp.Lines) != "[FAIL pkg/b]" {
+		t.Errorf("stripped = %q", resp.Lines)
+	}
+	resp, _ = querySession(sess, QuerySessionPayload{LastN: 1, Raw: true})
+	if fmt.Sprint(resp.Lines) != "[\x1b[31mFAIL\x1b[0m pkg/b]" {
+		t.Errorf("raw last_n = %q", resp.Lines)
+	}
+	resp, _ = querySession(sess, QuerySessionPayload{Raw: true})
+	if len(resp.Lines) != 2 || resp.Lines[0] != "\x1b[32mok\x1b[0m  pkg/a" {
+		t.Errorf("raw cursor = %q", resp.Lines)
+	}
+	resp, _ = querySession(sess, QuerySessionPayload{Search: "FAIL pkg", Raw: true})
+	if fmt.Sprint(resp.Lines) != "[[1] \x1b[31mFAIL\x1b[0m pkg/b]" {
+		t.Errorf("raw search = %q", resp.Lines)
+	}
+}
+
+func TestQuerySessionContextTimestamps(t *testing.T) {
+	s := NewStore()
+	sess, _ := s.Create("build", 100, false, nil)
+	sess.Buffer = NewRingBuffer(100, WithTimestamps())
+	sess.Buffer.AppendBatch([]string{"cc a.c", "error: a", "cc b.c", "error: b"})
+
+	for _, newestFirst := range []bool{false, true} {
+		resp, err := querySession(sess, QuerySessionPayload{Search: "error", Context: 1, IncludeTimestamps: true, NewestFirst: newestFirst})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.Matches) != 2 {
+			t.Fatalf("newest first %v: %d matches", newestFirst, len(resp.Matches))
+		}
+		for _, m := range resp.Matches {
+			if m.Timestamp.IsZero() {
+				t.Errorf("newest first %v: match %d has no timestamp", newestFirst, m.Seq)
+			}
+		}
+	}
+
+	resp, _ := querySession(sess, QuerySessionPayload{Search: "error", Context: 1})
+	if len(resp.Matches) != 2 || !resp.Matches[0].Timestamp.IsZero() {
+		t.Errorf("timestamps returned without include_timestamps: %+v", resp.Matches)
+	}
+}
+
+func TestSearchAll(t *testing.T) {
+	s := NewStore()
+	build, _ := s.Create("build", 100, false, nil)
+	build.Buffer.AppendBatch([]string{"compiling", "panic: nil map", "done"})
+	tests, _ := s.Create("tests", 100, false, nil)
+	tests.Buffer.AppendBatch([]string{"PANIC: boom", "ok", "panic: again"})
+	quiet, _ := s.Create("quiet", 100, false, nil)
+	quiet.Buffer.Append("nothing here")
+
+	resp, err := searchAll(s.List(), SearchAllPayload{Search: "panic"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string][]string{}
+	for _, m := range resp.Sessions {
+		for _, r := range m.Matches {
+			got[m.Title] = append(got[m.Title], fmt.Sprintf("%d:%s", r.Seq, r.Line))
+		}
+	}
+	if len(resp.Sessions) != 2 || resp.Truncated ||
+		fmt.Sprint(got["build"]) != "[1:panic: nil map]" ||
+		fmt.Sprint(got["tests"]) != "[0:PANIC: boom 2:panic: again]" {
+		t.Errorf("matches = %v, truncated %v", got, resp.Truncated)
+	}
+
+	// The limit applies across sessions
+	for _, max := range []int{1, 2} {
+		resp, err = searchAll(s.List(), SearchAllPayload{SearchRegex: "(?i)^panic", MaxResults: max})
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := 0
+		for _, m := range resp.Sessions {
+			n += len(m.Matches)
+		}
+		if n != max || !resp.Truncated {
+			t.Errorf("max %d: got %d matches, truncated %v", max, n, resp.Truncated)
+		}
+	}
+
+	// The budget goes to the most recently active sessions first
+	tests.lastActivity = time.Now().Add(time.Minute)
+	resp, err = searchAll(s.List(), SearchAllPayload{Search: "panic", MaxResults: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Sessions) != 1 || resp.Sessions[0].Title != "tests" || !resp.Truncated {
+		t.Errorf("with tests most recent: sessions = %+v, truncated %v", resp.Sessions, resp.Truncated)
+	}
+
+	// So does the per-session limit, without starving later sessions
+	resp, err = searchAll(s.List(), SearchAllPayload{Search: "panic", MaxResultsPerSession: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Sessions) != 2 || len(resp.Sessions[0].Matches) != 1 || len(resp.Sessions[1].Matches) != 1 || !resp.Truncated {
+		t.Errorf("per-session limit: sessions = %+v, truncated %v", resp.Sessions, resp.Truncated)
+	}
+
+	if _, err := searchAll(s.List(), SearchAllPayload{}); err == nil {
+		t.Error("expected error without a pattern")
+	}
+}
+
+func TestQuerySessionLastCommandOutput(t *testing.T) {
+	s := NewStore()
+	sess, _ := s.Create("shell", 100, false, nil)
+
+	// Without command boundaries, fall back to the newest lines
+	for i := range 60 {
+		sess.Buffer.Append(fmt.Sprintf("line %d", i))
+	}
+	resp, err := querySession(sess, QuerySessionPayload{LastCommandOutput: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Command != nil || len(resp.Lines) != defaultLastCommandLines || resp.Lines[0] != "line 10" {
+		t.Errorf("fallback: command %v, %d lines from %q", resp.Command, len(resp.Lines), resp.Lines[0])
+	}
+
+	sess.AddCommand("make", time.Now())
+	sess.Buffer.AppendBatch([]string{"$ make", "DEBUG start", "cc main.c", "error: undefined"})
+	sess.SetExitCode(2)
+	sess.Buffer.Append("$ ")
+	resp, err = querySession(sess, QuerySessionPayload{LastCommandOutput: true, Exclude: "debug"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(resp.Lines) != "[$ make cc main.c error: undefined]" || resp.HasMore {
+		t.Errorf("lines = %q, has_more %v", resp.Lines, resp.HasMore)
+	}
+	if resp.Command == nil || resp.Command.Command != "make" || resp.Command.ExitCode == nil || *resp.Command.ExitCode != 2 {
+		t.Errorf("command = %+v", resp.Command)
+	}
+
+	// A running command's output so far, paged by count
+	sess.AddCommand("tail -f log", time.Now())
+	sess.Buffer.AppendBatch([]string{"$ tail -f log", "a", "b"})
+	resp, _ = querySession(sess, QuerySessionPayload{LastCommandOutput: true, Count: 2})
+	if fmt.Sprint(resp.Lines) != "[$ tail -f log a]" || !resp.HasMore || resp.NextCursor != 67 || resp.Command.EndSeq != nil {
+		t.Errorf("running: lines = %q, has_more %v, next %d", resp.Lines, resp.HasMore, resp.NextCursor)
+	}
+	resp, _ = querySession(sess, QuerySessionPayload{LastCommandOutput: true, Count: 2, Cursor: resp.NextCursor})
+	if fmt.Sprint(resp.Lines) != "[b]" || resp.HasMore || resp.NextCursor != 68 {
+		t.Errorf("next page: lines = %q, has_more %v, next %d", resp.Lines, resp.HasMore, resp.NextCursor)
+	}
+}
@@ -1,55 +1,391 @@
 package streamsh
 
 import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"slices"
 	"strings"
 	"sync"
+	"time"
+	"unsafe"
+
+	"github.com/acarl005/stripansi"
 )
 
 // SearchResult holds a matched line and its global sequence number.
+// Timestamp is set only when the buffer records timestamps.
 type SearchResult struct {
-	Seq  uint64 `json:"seq"`
-	Line string `json:"line"`
+	Seq       uint64    `json:"seq"`
+	Line      string    `json:"line"`
+	Timestamp time.Time `json:"timestamp,omitzero"`
+	Raw       string    `json:"-"` // Line with ANSI escapes, if the buffer kept them
+}
+
+// RawLine returns the line with ANSI escapes if they were kept, else Line.
+func (r SearchResult) RawLine() string {
+	if r.Raw != "" {
+		return r.Raw
+	}
+	return r.Line
+}
+
+// SearchMatch is a search hit grouped with its surrounding lines.
+// Before holds the lines immediately preceding Seq, After those following it.
+type SearchMatch struct {
+	Seq       uint64    `json:"seq"`
+	Line      string    `json:"line"`
+	Timestamp time.Time `json:"timestamp,omitzero"` // when Line was appended, if asked for
+	Before    []string  `json:"before,omitempty"`
+	After     []string  `json:"after,omitempty"`
+}
+
+// entry is a single stored line and the time it was appended.
+type entry struct {
+	line       string
+	raw        string // line with ANSI escapes, if appended by AppendBatchANSI and different
+	ts         time.Time
+	dedupCount int // times line was appended in a row, if > 1
+}
+
+// text returns the line as read back, with a repeat suffix for
+// deduplicated entries.
+func (e entry) text() string {
+	return e.withCount(e.line)
 }
 
-// RingBuffer is a fixed-capacity circular buffer of lines.
+// rawText is like text but keeps the line's ANSI escapes, if any.
+func (e entry) rawText() string {
+	if e.raw == "" {
+		return e.text()
+	}
+	return e.withCount(e.raw)
+}
+
+func (e entry) withCount(line string) string {
+	if e.dedupCount > 1 {
+		return fmt.Sprintf("%s (x%d)", line, e.dedupCount)
+	}
+	return line
+}
+
+// entryOverhead is what each stored line costs beyond its text, so that
+// byte-bounded buffers also bound how many empty or short lines they keep.
+const entryOverhead = int(unsafe.Sizeof(entry{}))
+
+// size is the number of bytes the entry counts against maxBytes.
+func (e entry) size() int {
+	return entryOverhead + len(e.line) + len(e.raw)
+}
+
+// result returns the entry as the SearchResult for seq.
+func (e entry) result(seq uint64) SearchResult {
+	r := SearchResult{Seq: seq, Line: e.text(), Timestamp: e.ts}
+	if e.raw != "" {
+		r.Raw = e.rawText()
+	}
+	return r
+}
+
+// RingBuffer is a circular buffer of lines, bounded either by line count
+// (NewRingBuffer) or by total bytes (NewRingBufferBytes).
 // Each appended line is assigned a monotonically increasing sequence number,
 // enabling cursor-based pagination even after old lines are evicted.
 // All methods are safe for concurrent use.
 type RingBuffer struct {
-	mu       sync.RWMutex
-	lines    []string
-	cap      int
-	head     int    // next write position
-	count    int    // current number of stored lines
-	totalSeq uint64 // total lines ever written
+	mu         sync.RWMutex
+	lines      []entry
+	cap        int
+	head       int        // next write position
+	count      int        // current number of stored lines
+	totalSeq   uint64     // total lines ever written
+	byteLen    int        // total bytes of stored lines
+	maxBytes   int        // if > 0, evict by bytes and grow lines as needed
+	timestamps bool       // record append time for each line
+	dedup      bool       // collapse consecutive identical lines
+	cond       *sync.Cond // broadcast on append, for Tail subscribers
+}
+
+// RingBufferOption configures optional RingBuffer behavior.
+type RingBufferOption func(*RingBuffer)
+
+// WithTimestamps makes the buffer record the time each line was appended.
+func WithTimestamps() RingBufferOption {
+	return func(rb *RingBuffer) {
+		rb.timestamps = true
+	}
+}
+
+// WithDedup makes the buffer collapse a line identical to the one appended
+// just before it into that entry, which is then read back as
+// "<line> (xN)". Repeats do not consume a new sequence number. Lines
+// appended with AppendBatchANSI are compared without their escapes; the
+// entry keeps the first one's.
+func WithDedup() RingBufferOption {
+	return func(rb *RingBuffer) {
+		rb.dedup = true
+	}
+}
+
+// SetDedup turns WithDedup on or off for lines appended from now on.
+func (rb *RingBuffer) SetDedup(on bool) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	rb.dedup = on
 }
 
 // NewRingBuffer creates a ring buffer with the given capacity.
-func NewRingBuffer(capacity int) *RingBuffer {
+func NewRingBuffer(capacity int, opts ...RingBufferOption) *RingBuffer {
 	if capacity <= 0 {
 		capacity = 100000
 	}
-	return &RingBuffer{
-		lines: make([]string, capacity),
+	rb := &RingBuffer{
+		lines: make([]entry, capacity),
 		cap:   capacity,
 	}
+	rb.cond = sync.NewCond(&rb.mu)
+	for _, opt := range opts {
+		opt(rb)
+	}
+	return rb
+}
+
+// NewRingBufferBytes creates a ring buffer that holds as many lines as fit
+// in maxBytes, evicting the oldest lines as new ones arrive. Each line also
+// counts a fixed overhead for its bookkeeping. A single line larger than
+// maxBytes is kept on its own until the next append.
+func NewRingBufferBytes(maxBytes int, opts ...RingBufferOption) *RingBuffer {
+	if maxBytes <= 0 {
+		maxBytes = 64 << 20
+	}
+	rb := NewRingBuffer(1024, opts...)
+	rb.maxBytes = maxBytes
+	return rb
 }
 
 // Append adds a line to the buffer and returns its global sequence number.
 func (rb *RingBuffer) Append(line string) uint64 {
 	rb.mu.Lock()
 	defer rb.mu.Unlock()
+	defer rb.cond.Broadcast()
+	return rb.appendLocked(entry{line: line, ts: rb.now()})
+}
+
+// AppendBatch adds lines under a single lock acquisition and returns their
+// sequence numbers, in order.
+func (rb *RingBuffer) AppendBatch(lines []string) []uint64 {
+	if len(lines) == 0 {
+		return nil
+	}
+
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	defer rb.cond.Broadcast()
+
+	now := rb.now()
+	seqs := make([]uint64, len(lines))
+	for i, line := range lines {
+		seqs[i] = rb.appendLocked(entry{line: line, ts: now})
+	}
+	return seqs
+}
+
+// AppendBatchANSI is like AppendBatch for lines that may contain ANSI
+// escapes. Each line is stored with its escapes stripped, which is what
+// reads and searches see, and as received, for readers that ask for it
+// (SearchResult.Raw). Both count against the buffer's byte limit.
+func (rb *RingBuffer) AppendBatchANSI(lines []string) []uint64 {
+	if len(lines) == 0 {
+		return nil
+	}
+
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	defer rb.cond.Broadcast()
+
+	now := rb.now()
+	seqs := make([]uint64, len(lines))
+	for i, line := range lines {
+		e := entry{line: stripansi.Strip(line), ts: now}
+		if e.line != line {
+			e.raw = line
+		}
+		seqs[i] = rb.appendLocked(e)
+	}
+	return seqs
+}
+
+// AppendRepeats appends each line as a new entry, even if it is the same as
+// the one before, read back as repeated repeats[i] times if that is more
+// than once. A nil or short repeats counts each line once. It returns the
+// sequence number assigned to each line.
+func (rb *RingBuffer) AppendRepeats(lines []string, repeats []int) []uint64 {
+	if len(lines) == 0 {
+		return nil
+	}
+
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	defer rb.cond.Broadcast()
+
+	now := rb.now()
+	seqs := make([]uint64, len(lines))
+	for i, line := range lines {
+		e := entry{line: line, ts: now}
+		if i < len(repeats) && repeats[i] > 1 {
+			e.dedupCount = repeats[i]
+		}
+		seqs[i] = rb.storeLocked(e)
+	}
+	return seqs
+}
+
+// now returns the timestamp for newly appended lines, or the zero time if
+// the buffer does not record timestamps.
+func (rb *RingBuffer) now() time.Time {
+	if !rb.timestamps {
+		return time.Time{}
+	}
+	return time.Now()
+}
+
+// appendLocked stores a new entry. The caller must hold the write lock.
+func (rb *RingBuffer) appendLocked(e entry) uint64 {
+	if rb.dedup && rb.count > 0 {
+		last := &rb.lines[(rb.head-1+rb.cap)%rb.cap]
+		if last.line == e.line {
+			last.dedupCount = max(last.dedupCount, 1) + 1
+			return rb.totalSeq - 1
+		}
+	}
+	return rb.storeLocked(e)
+}
+
+// storeLocked stores e as a new entry, evicting or growing as needed. The
+// caller must hold the write lock.
+func (rb *RingBuffer) storeLocked(e entry) uint64 {
+	if rb.maxBytes > 0 {
+		for rb.count > 0 && rb.byteLen+e.size() > rb.maxBytes {
+			rb.evictOldest()
+		}
+		if rb.count == rb.cap {
+			rb.relocate(rb.cap * 2)
+		}
+	} else if rb.count == rb.cap {
+		rb.evictOldest()
+	}
 
 	seq := rb.totalSeq
-	rb.lines[rb.head] = line
+	rb.lines[rb.head] = e
 	rb.head = (rb.head + 1) % rb.cap
-	if rb.count < rb.cap {
-		rb.count++
-	}
+	rb.count++
+	rb.byteLen += e.size()
 	rb.totalSeq++
 	return seq
 }
 
+// evictOldest drops the oldest stored line. The caller must hold the write lock.
+func (rb *RingBuffer) evictOldest() {
+	idx := (rb.head - rb.count + rb.cap) % rb.cap
+	rb.byteLen -= rb.lines[idx].size()
+	rb.lines[idx] = entry{}
+	rb.count--
+}
+
+// relocate copies the most recent min(count, newCap) lines into a new
+// backing slice of length newCap. The caller must hold the write lock.
+func (rb *RingBuffer) relocate(newCap int) {
+	n := min(rb.count, newCap)
+	lines := make([]entry, newCap)
+	start := (rb.head - n + rb.cap) % rb.cap
+	byteLen := 0
+	for i := 0; i < n; i++ {
+		lines[i] = rb.lines[(start+i)%rb.cap]
+		byteLen += lines[i].size()
+	}
+
+	rb.lines = lines
+	rb.cap = newCap
+	rb.count = n
+	rb.head = n % newCap
+	rb.byteLen = byteLen
+}
+
+// Tail streams lines appended after the call on the returned channel.
+// Each subscription keeps its own cursor; if the subscriber falls so far
+// behind that lines are evicted, those lines are skipped. The channel is
+// closed once ctx is cancelled.
+func (rb *RingBuffer) Tail(ctx context.Context) <-chan string {
+	results := rb.TailFrom(ctx, rb.TotalSeq())
+	ch := make(chan string, 256)
+	go func() {
+		defer close(ch)
+		for r := range results {
+			select {
+			case ch <- r.Line:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch
+}
+
+// TailFrom is like Tail but starts at sequence number from, first sending
+// any retained lines from there on, and reports each line's sequence
+// number. If from is older than the oldest retained line, it starts from
+// the oldest available.
+func (rb *RingBuffer) TailFrom(ctx context.Context, from uint64) <-chan SearchResult {
+	ch := make(chan SearchResult, 256)
+	cursor := from
+
+	// Wake the waiting goroutine when ctx is cancelled
+	stop := context.AfterFunc(ctx, func() {
+		rb.mu.Lock()
+		rb.cond.Broadcast()
+		rb.mu.Unlock()
+	})
+
+	go func() {
+		defer close(ch)
+		defer stop()
+		for {
+			rb.mu.Lock()
+			for ctx.Err() == nil {
+				if cursor > rb.totalSeq {
+					// Buffer was cleared; restart from its oldest line
+					cursor = rb.totalSeq - uint64(rb.count)
+				}
+				if cursor < rb.totalSeq {
+					break
+				}
+				rb.cond.Wait()
+			}
+			if ctx.Err() != nil {
+				rb.mu.Unlock()
+				return
+			}
+			cursor = max(cursor, rb.totalSeq-uint64(rb.count))
+			lines := rb.linesBetween(cursor, rb.totalSeq)
+			first := cursor
+			cursor = rb.totalSeq
+			rb.mu.Unlock()
+
+			for i, line := range lines {
+				select {
+				case ch <- SearchResult{Seq: first + uint64(i), Line: line}:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return ch
+}
+
 // Len returns the number of lines currently stored.
 func (rb *RingBuffer) Len() int {
 	rb.mu.RLock()
@@ -57,6 +393,14 @@ func (rb *RingBuffer) Len() int {
 	return rb.count
 }
 
+// FirstSeq returns the sequence number of the oldest retained line, or
+// TotalSeq if the buffer is empty.
+func (rb *RingBuffer) FirstSeq() uint64 {
+	rb.mu.RLock()
+	defer rb.mu.RUnlock()
+	return rb.totalSeq - uint64(rb.count)
+}
+
 // TotalSeq returns the total number of lines ever appended.
 func (rb *RingBuffer) TotalSeq() uint64 {
 	rb.mu.RLock()
@@ -80,7 +424,7 @@ func (rb *RingBuffer) LastN(n int) []string {
 	// Start index: head is the next write position, so the most recent line is at head-1.
 	start := (rb.head - n + rb.cap) % rb.cap
 	for i := 0; i < n; i++ {
-		result[i] = rb.lines[(start+i)%rb.cap]
+		result[i] = rb.lines[(start+i)%rb.cap].text()
 	}
 	return result
 }
@@ -89,11 +433,58 @@ func (rb *RingBuffer) LastN(n int) []string {
 // Returns the lines, the next cursor for pagination, and whether more lines exist.
 // If `from` is older than the oldest retained line, reading starts from the oldest available.
 func (rb *RingBuffer) ReadRange(from uint64, count int) ([]string, uint64, bool) {
+	lines, _, next, hasMore := rb.readRange(from, count, false)
+	return lines, next, hasMore
+}
+
+// ReadRangeWithTimestamps is like ReadRange but also returns the append time
+// of each line. The timestamps slice is nil if the buffer does not record them.
+func (rb *RingBuffer) ReadRangeWithTimestamps(from uint64, count int) ([]string, []time.Time, uint64, bool) {
+	return rb.readRange(from, count, true)
+}
+
+// ReadRangeRepeats is like ReadRange, but returns deduplicated lines without
+// their repeat suffix, and in repeats how many times each was appended. The
+// repeats slice is nil if no line in the range repeats. Together with
+// AppendRepeats, this copies lines without renumbering them.
+func (rb *RingBuffer) ReadRangeRepeats(from uint64, count int) ([]string, []int, uint64, bool) {
+	rb.mu.RLock()
+	defer rb.mu.RUnlock()
+
+	oldestSeq := rb.totalSeq - uint64(rb.count)
+	from = max(from, oldestSeq)
+	if count <= 0 || from >= rb.totalSeq {
+		return nil, nil, from, false
+	}
+	count = min(count, int(rb.totalSeq-from))
+
+	startIdx := (rb.head - rb.count + int(from-oldestSeq) + rb.cap) % rb.cap
+	lines := make([]string, count)
+	var repeats []int
+	for i := range count {
+		e := rb.lines[(startIdx+i)%rb.cap]
+		lines[i] = e.line
+		if e.dedupCount > 1 && repeats == nil {
+			repeats = make([]int, count)
+			for j := range i {
+				repeats[j] = 1
+			}
+		}
+		if repeats != nil {
+			repeats[i] = max(e.dedupCount, 1)
+		}
+	}
+
+	next := from + uint64(count)
+	return lines, repeats, next, next < rb.totalSeq
+}
+
+func (rb *RingBuffer) readRange(from uint64, count int, withTS bool) ([]string, []time.Time, uint64, bool) {
 	rb.mu.RLock()
 	defer rb.mu.RUnlock()
 
 	if rb.count == 0 || count <= 0 {
-		return nil, from, false
+		return nil, nil, from, false
 	}
 
 	oldestSeq := rb.totalSeq - uint64(rb.count)
@@ -105,7 +496,7 @@ func (rb *RingBuffer) ReadRange(from uint64, count int) ([]string, uint64, bool)
 
 	// If from is beyond what we have, nothing to return
 	if from >= rb.totalSeq {
-		return nil, from, false
+		return nil, nil, from, false
 	}
 
 	available := int(rb.totalSeq - from)
@@ -118,20 +509,138 @@ func (rb *RingBuffer) ReadRange(from uint64, count int) ([]string, uint64, bool)
 	startIdx := (rb.head - rb.count + offset + rb.cap) % rb.cap
 
 	result := make([]string, count)
+	var stamps []time.Time
+	if withTS && rb.timestamps {
+		stamps = make([]time.Time, count)
+	}
 	for i := 0; i < count; i++ {
-		result[i] = rb.lines[(startIdx+i)%rb.cap]
+		e := rb.lines[(startIdx+i)%rb.cap]
+		result[i] = e.text()
+		if stamps != nil {
+			stamps[i] = e.ts
+		}
 	}
 
 	nextCursor := from + uint64(count)
 	hasMore := nextCursor < rb.totalSeq
-	return result, nextCursor, hasMore
+	return result, stamps, nextCursor, hasMore
+}
+
+// ReadFunc returns up to count lines starting at global sequence `from`,
+// skipping lines for which keep returns false (a nil keep retains all).
+// The returned cursor is positioned after the last line examined, so
+// successive calls page through the buffer without revisiting lines.
+func (rb *RingBuffer) ReadFunc(from uint64, count int, keep func(string) bool) ([]SearchResult, uint64, bool) {
+	rb.mu.RLock()
+	defer rb.mu.RUnlock()
+
+	if rb.count == 0 || count <= 0 {
+		return nil, from, false
+	}
+
+	oldestSeq := rb.totalSeq - uint64(rb.count)
+	from = max(from, oldestSeq)
+
+	var results []SearchResult
+	seq := from
+	for ; seq < rb.totalSeq && len(results) < count; seq++ {
+		e := rb.lines[(rb.head-rb.count+int(seq-oldestSeq)+rb.cap)%rb.cap]
+		if keep == nil || keep(e.line) {
+			results = append(results, e.result(seq))
+		}
+	}
+	return results, seq, seq < rb.totalSeq
+}
+
+// LastNFunc returns the most recent n lines for which keep returns true
+// (a nil keep retains all), ordered oldest to newest.
+func (rb *RingBuffer) LastNFunc(n int, keep func(string) bool) []SearchResult {
+	if keep == nil {
+		keep = func(string) bool { return true }
+	}
+	results := rb.SearchFunc(keep, n, true)
+	slices.Reverse(results)
+	return results
+}
+
+// ReadTimeRange returns up to max lines appended within [since, until],
+// oldest first, with their sequence numbers and timestamps. A zero since or
+// until leaves that side of the range open. Buffers that do not record
+// timestamps return nil.
+func (rb *RingBuffer) ReadTimeRange(since, until time.Time, max int) []SearchResult {
+	rb.mu.RLock()
+	defer rb.mu.RUnlock()
+
+	if !rb.timestamps || rb.count == 0 || max <= 0 {
+		return nil
+	}
+
+	oldestSeq := rb.totalSeq - uint64(rb.count)
+	startIdx := (rb.head - rb.count + rb.cap) % rb.cap
+
+	var results []SearchResult
+	for i := 0; i < rb.count && len(results) < max; i++ {
+		e := rb.lines[(startIdx+i)%rb.cap]
+		if !since.IsZero() && e.ts.Before(since) {
+			continue
+		}
+		if !until.IsZero() && e.ts.After(until) {
+			break
+		}
+		results = append(results, e.result(oldestSeq+uint64(i)))
+	}
+	return results
 }
 
-// Cap returns the buffer's capacity.
+// Cap returns the buffer's line capacity. For buffers bounded by bytes this
+// is the current size of the backing slice, which grows as needed.
 func (rb *RingBuffer) Cap() int {
+	rb.mu.RLock()
+	defer rb.mu.RUnlock()
 	return rb.cap
 }
 
+// Bytes returns the total size in bytes of the lines currently stored,
+// including a fixed overhead per line.
+func (rb *RingBuffer) Bytes() int {
+	rb.mu.RLock()
+	defer rb.mu.RUnlock()
+	return rb.byteLen
+}
+
+// MaxBytes returns the byte limit of a buffer created with
+// NewRingBufferBytes, or 0 for buffers bounded by line count.
+func (rb *RingBuffer) MaxBytes() int {
+	rb.mu.RLock()
+	defer rb.mu.RUnlock()
+	return rb.maxBytes
+}
+
+// MaxBufferCapacity bounds the capacity a client may ask for, in Resize
+// or when registering, as the lines are allocated up front.
+const MaxBufferCapacity = 1_000_000
+
+// Resize changes the buffer's capacity, keeping the most recent
+// min(Len(), newCap) lines. Sequence numbers are preserved so existing
+// cursors remain valid. Buffers bounded by bytes cannot be resized.
+func (rb *RingBuffer) Resize(newCap int) error {
+	if newCap <= 0 {
+		return fmt.Errorf("invalid buffer capacity %d", newCap)
+	}
+	if newCap > MaxBufferCapacity {
+		return fmt.Errorf("buffer capacity %d exceeds the maximum of %d", newCap, MaxBufferCapacity)
+	}
+
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	if rb.maxBytes > 0 {
+		return fmt.Errorf("buffer is bounded by bytes (%d), not lines", rb.maxBytes)
+	}
+	rb.relocate(newCap)
+	return nil
+}
+
 // AllLines returns all lines currently in the buffer, from oldest to newest.
 func (rb *RingBuffer) AllLines() []string {
 	rb.mu.RLock()
@@ -144,11 +653,76 @@ func (rb *RingBuffer) AllLines() []string {
 	result := make([]string, rb.count)
 	start := (rb.head - rb.count + rb.cap) % rb.cap
 	for i := 0; i < rb.count; i++ {
-		result[i] = rb.lines[(start+i)%rb.cap]
+		result[i] = rb.lines[(start+i)%rb.cap].text()
 	}
 	return result
 }
 
+// WriteTo writes every line in the buffer to w, oldest first, each followed
+// by a newline. It implements io.WriterTo.
+func (rb *RingBuffer) WriteTo(w io.Writer) (int64, error) {
+	return rb.WriteLines(w, false)
+}
+
+// WriteLines is like WriteTo, optionally passing each line through
+// stripansi first. Lines are copied out in chunks so the lock is not held
+// while writing to w; lines appended after the call starts are not written.
+// It returns the number of bytes written and the first write error.
+func (rb *RingBuffer) WriteLines(w io.Writer, stripANSI bool) (int64, error) {
+	return rb.writeLines(w, stripANSI, false)
+}
+
+// WriteJSONLines is like WriteLines, but writes each line as a JSON object
+// {"seq":N,"line":"..."} on a line of its own.
+func (rb *RingBuffer) WriteJSONLines(w io.Writer, stripANSI bool) (int64, error) {
+	return rb.writeLines(w, stripANSI, true)
+}
+
+func (rb *RingBuffer) writeLines(w io.Writer, stripANSI, jsonl bool) (int64, error) {
+	const chunkSize = 1000
+
+	rb.mu.RLock()
+	cursor := rb.totalSeq - uint64(rb.count)
+	end := rb.totalSeq
+	rb.mu.RUnlock()
+
+	bw := bufio.NewWriter(w)
+	var n int64
+	for cursor < end {
+		rb.mu.RLock()
+		cursor = max(cursor, rb.totalSeq-uint64(rb.count)) // skip lines evicted meanwhile
+		chunk := rb.linesBetween(cursor, min(cursor+chunkSize, end))
+		rb.mu.RUnlock()
+		if len(chunk) == 0 {
+			break
+		}
+		first := cursor
+		cursor += uint64(len(chunk))
+
+		for i, line := range chunk {
+			if stripANSI {
+				line = stripansi.Strip(line)
+			}
+			if jsonl {
+				b, _ := json.Marshal(SearchResult{Seq: first + uint64(i), Line: line})
+				line = string(b)
+			}
+			m, err := bw.WriteString(line)
+			n += int64(m)
+			if err == nil {
+				err = bw.WriteByte('\n')
+				if err == nil {
+					n++
+				}
+			}
+			if err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, bw.Flush()
+}
+
 // Clear resets the ring buffer to an empty state.
 func (rb *RingBuffer) Clear() {
 	rb.mu.Lock()
@@ -156,14 +730,83 @@ func (rb *RingBuffer) Clear() {
 	rb.head = 0
 	rb.count = 0
 	rb.totalSeq = 0
+	rb.byteLen = 0
 	for i := range rb.lines {
-		rb.lines[i] = ""
+		rb.lines[i] = entry{}
 	}
 }
 
 // Search returns lines matching a case-insensitive substring search.
 // Results are ordered from oldest to newest, capped at maxResults.
 func (rb *RingBuffer) Search(pattern string, maxResults int) []SearchResult {
+	return rb.SearchFunc(SubstringMatcher(pattern), maxResults, false)
+}
+
+// SearchRegex returns lines matching a regular expression.
+// The pattern uses RE2 syntax and is applied to each line independently.
+// Results are ordered from oldest to newest, capped at maxResults.
+// An error is returned if the pattern fails to compile.
+func (rb *RingBuffer) SearchRegex(pattern string, maxResults int) ([]SearchResult, error) {
+	match, err := RegexMatcher(pattern)
+	if err != nil {
+		return nil, err
+	}
+	return rb.SearchFunc(match, maxResults, false), nil
+}
+
+// CountMatching returns the number of lines containing pattern
+// (case-insensitive), like len(Search(pattern, ...)) without a result cap
+// or allocating results.
+func (rb *RingBuffer) CountMatching(pattern string) int {
+	return rb.CountFunc(SubstringMatcher(pattern))
+}
+
+// CountMatchingRegex returns the number of lines matching a regular
+// expression. An error is returned if the pattern fails to compile.
+func (rb *RingBuffer) CountMatchingRegex(pattern string) (int, error) {
+	match, err := RegexMatcher(pattern)
+	if err != nil {
+		return 0, err
+	}
+	return rb.CountFunc(match), nil
+}
+
+// CountFunc returns the number of stored lines for which match returns true.
+func (rb *RingBuffer) CountFunc(match func(string) bool) int {
+	rb.mu.RLock()
+	defer rb.mu.RUnlock()
+
+	n := 0
+	start := (rb.head - rb.count + rb.cap) % rb.cap
+	for i := 0; i < rb.count; i++ {
+		if match(rb.lines[(start+i)%rb.cap].line) {
+			n++
+		}
+	}
+	return n
+}
+
+// SubstringMatcher returns a case-insensitive substring match function.
+func SubstringMatcher(pattern string) func(string) bool {
+	lowerPattern := strings.ToLower(pattern)
+	return func(line string) bool {
+		return strings.Contains(strings.ToLower(line), lowerPattern)
+	}
+}
+
+// RegexMatcher compiles an RE2 pattern into a match function.
+func RegexMatcher(pattern string) (func(string) bool, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid regex %q: %w", pattern, err)
+	}
+	return re.MatchString, nil
+}
+
+// SearchFunc returns lines for which match returns true, capped at
+// maxResults. Results are ordered oldest to newest, or newest to oldest if
+// newestFirst is set, in which case the most recent matches are returned.
+func (rb *RingBuffer) SearchFunc(match func(string) bool, maxResults int, newestFirst bool) []SearchResult {
 	rb.mu.RLock()
 	defer rb.mu.RUnlock()
 
@@ -171,19 +814,195 @@ func (rb *RingBuffer) Search(pattern string, maxResults int) []SearchResult {
 		return nil
 	}
 
-	lowerPattern := strings.ToLower(pattern)
 	oldestSeq := rb.totalSeq - uint64(rb.count)
 	startIdx := (rb.head - rb.count + rb.cap) % rb.cap
 
 	var results []SearchResult
-	for i := 0; i < rb.count && len(results) < maxResults; i++ {
-		idx := (startIdx + i) % rb.cap
-		if strings.Contains(strings.ToLower(rb.lines[idx]), lowerPattern) {
-			results = append(results, SearchResult{
-				Seq:  oldestSeq + uint64(i),
-				Line: rb.lines[idx],
-			})
+	for n := 0; n < rb.count && len(results) < maxResults; n++ {
+		i := n
+		if newestFirst {
+			i = rb.count - 1 - n
+		}
+		e := rb.lines[(startIdx+i)%rb.cap]
+		if match(e.line) {
+			results = append(results, e.result(oldestSeq+uint64(i)))
 		}
 	}
 	return results
 }
+
+// AddContext groups each search result with up to before/after surrounding
+// lines. Results must be ordered by Seq, ascending or descending; matches are
+// returned in the same order. Windows of neighbouring matches are merged so
+// that no line appears twice: lines between two close matches are attached
+// to the earlier match's After (up to its limit), then the later match's
+// Before.
+func (rb *RingBuffer) AddContext(results []SearchResult, before, after int) []SearchMatch {
+	if len(results) > 1 && results[0].Seq > results[len(results)-1].Seq {
+		asc := slices.Clone(results)
+		slices.Reverse(asc)
+		matches := rb.AddContext(asc, before, after)
+		slices.Reverse(matches)
+		return matches
+	}
+
+	rb.mu.RLock()
+	defer rb.mu.RUnlock()
+
+	if len(results) == 0 {
+		return nil
+	}
+
+	matches := make([]SearchMatch, len(results))
+	next := rb.totalSeq - uint64(rb.count) // first seq not yet shown
+	for i, r := range results {
+		start := next
+		if r.Seq >= uint64(before) && r.Seq-uint64(before) > start {
+			start = r.Seq - uint64(before)
+		}
+		end := r.Seq + 1 + uint64(after)
+		if i+1 < len(results) && results[i+1].Seq < end {
+			end = results[i+1].Seq
+		}
+		matches[i] = SearchMatch{
+			Seq:    r.Seq,
+			Line:   r.Line,
+			Before: rb.linesBetween(start, r.Seq),
+			After:  rb.linesBetween(r.Seq+1, end),
+		}
+		next = max(end, r.Seq+1)
+	}
+	return matches
+}
+
+// linesBetween returns the retained lines with seq in [from, to).
+// The caller must hold rb.mu.
+func (rb *RingBuffer) linesBetween(from, to uint64) []string {
+	oldestSeq := rb.totalSeq - uint64(rb.count)
+	from = max(from, oldestSeq)
+	to = min(to, rb.totalSeq)
+	if from >= to {
+		return nil
+	}
+
+	startIdx := (rb.head - rb.count + int(from-oldestSeq) + rb.cap) % rb.cap
+	result := make([]string, to-from)
+	for i := range result {
+		result[i] = rb.lines[(startIdx+i)%rb.cap].text()
+	}
+	return result
+}
+
+// ringBufferSnapshot is the serialized form of a RingBuffer.
+type ringBufferSnapshot struct {
+	Cap        int         `json:"cap"`
+	MaxBytes   int         `json:"max_bytes,omitempty"`
+	TotalSeq   uint64      `json:"total_seq"`
+	Timestamps bool        `json:"timestamps,omitempty"`
+	Dedup      bool        `json:"dedup,omitempty"`
+	Lines      []string    `json:"lines,omitempty"`
+	Times      []time.Time `json:"times,omitempty"`
+	Counts     []int       `json:"counts,omitempty"` // dedup repeat counts
+	Raws       []string    `json:"raws,omitempty"`   // lines with ANSI escapes, "" where none were kept
+}
+
+// Snapshot serializes the buffer's capacity, sequence counter, and current
+// lines (oldest first) so it can be rebuilt with RestoreRingBuffer.
+func (rb *RingBuffer) Snapshot() []byte {
+	b, err := json.Marshal(rb.snapshot())
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func (rb *RingBuffer) snapshot() ringBufferSnapshot {
+	rb.mu.RLock()
+	defer rb.mu.RUnlock()
+
+	snap := ringBufferSnapshot{
+		Cap:        rb.cap,
+		MaxBytes:   rb.maxBytes,
+		TotalSeq:   rb.totalSeq,
+		Timestamps: rb.timestamps,
+		Dedup:      rb.dedup,
+		Lines:      make([]string, rb.count),
+	}
+	if rb.timestamps {
+		snap.Times = make([]time.Time, rb.count)
+	}
+	if rb.dedup {
+		snap.Counts = make([]int, rb.count)
+	}
+	start := (rb.head - rb.count + rb.cap) % rb.cap
+	for i := 0; i < rb.count; i++ {
+		e := rb.lines[(start+i)%rb.cap]
+		snap.Lines[i] = e.line
+		if e.raw != "" {
+			if snap.Raws == nil {
+				snap.Raws = make([]string, rb.count)
+			}
+			snap.Raws[i] = e.raw
+		}
+		if rb.timestamps {
+			snap.Times[i] = e.ts
+		}
+		if rb.dedup {
+			snap.Counts[i] = e.dedupCount
+		}
+	}
+	return snap
+}
+
+// RestoreRingBuffer rebuilds a buffer from data produced by Snapshot.
+// The restored buffer keeps the original sequence numbers, so cursors
+// obtained before the snapshot remain valid.
+func RestoreRingBuffer(data []byte) (*RingBuffer, error) {
+	var snap ringBufferSnapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return nil, fmt.Errorf("parsing ring buffer snapshot: %w", err)
+	}
+	return restoreSnapshot(snap)
+}
+
+func restoreSnapshot(snap ringBufferSnapshot) (*RingBuffer, error) {
+	if snap.Cap <= 0 {
+		return nil, fmt.Errorf("invalid snapshot capacity %d", snap.Cap)
+	}
+	if len(snap.Lines) > snap.Cap || uint64(len(snap.Lines)) > snap.TotalSeq {
+		return nil, fmt.Errorf("snapshot holds %d lines, exceeding capacity %d or total %d",
+			len(snap.Lines), snap.Cap, snap.TotalSeq)
+	}
+	if snap.Times != nil && len(snap.Times) != len(snap.Lines) {
+		return nil, fmt.Errorf("snapshot has %d timestamps for %d lines", len(snap.Times), len(snap.Lines))
+	}
+	if snap.Counts != nil && len(snap.Counts) != len(snap.Lines) {
+		return nil, fmt.Errorf("snapshot has %d repeat counts for %d lines", len(snap.Counts), len(snap.Lines))
+	}
+	if snap.Raws != nil && len(snap.Raws) != len(snap.Lines) {
+		return nil, fmt.Errorf("snapshot has %d raw lines for %d lines", len(snap.Raws), len(snap.Lines))
+	}
+
+	rb := NewRingBuffer(snap.Cap)
+	rb.maxBytes = snap.MaxBytes
+	rb.timestamps = snap.Timestamps
+	rb.dedup = snap.Dedup
+	for i, line := range snap.Lines {
+		e := entry{line: line}
+		if snap.Times != nil {
+			e.ts = snap.Times[i]
+		}
+		if snap.Counts != nil {
+			e.dedupCount = snap.Counts[i]
+		}
+		if snap.Raws != nil {
+			e.raw = snap.Raws[i]
+		}
+		rb.lines[i] = e
+		rb.byteLen += e.size()
+	}
+	rb.count = len(snap.Lines)
+	rb.head = rb.count % rb.cap
+	rb.totalSeq = snap.TotalSeq
+	return rb, nil
+}
@@ -1,8 +1,12 @@
 package streamsh
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestRingBufferAppendAndLen(t *testing.T) {
@@ -22,6 +26,46 @@ func TestRingBufferAppendAndLen(t *testing.T) {
 	}
 }
 
+func TestRingBufferAppendBatch(t *testing.T) {
+	rb := NewRingBuffer(4)
+	rb.Append("first")
+
+	seqs := rb.AppendBatch([]string{"a", "b", "c", "d"})
+	if fmt.Sprint(seqs) != "[1 2 3 4]" {
+		t.Errorf("seqs = %v", seqs)
+	}
+	if got := fmt.Sprint(rb.AllLines()); got != "[a b c d]" {
+		t.Errorf("lines = %s", got)
+	}
+	if rb.AppendBatch(nil) != nil {
+		t.Error("expected nil seqs for empty batch")
+	}
+}
+
+func BenchmarkRingBufferAppend(b *testing.B) {
+	lines := make([]string, 500)
+	for i := range lines {
+		lines[i] = fmt.Sprintf("line %d", i)
+	}
+	rb := NewRingBuffer(100000, WithTimestamps())
+	for b.Loop() {
+		for _, line := range lines {
+			rb.Append(line)
+		}
+	}
+}
+
+func BenchmarkRingBufferAppendBatch(b *testing.B) {
+	lines := make([]string, 500)
+	for i := range lines {
+		lines[i] = fmt.Sprintf("line %d", i)
+	}
+	rb := NewRingBuffer(100000, WithTimestamps())
+	for b.Loop() {
+		rb.AppendBatch(lines)
+	}
+}
+
 func TestRingBufferEviction(t *testing.T) {
 	rb := NewRingBuffer(3)
 	for i := range 5 {
@@ -140,3 +184,620 @@ func TestRingBufferDefaultCapacity(t *testing.T) {
 		t.Errorf("expected default cap 100000, got %d", rb.cap)
 	}
 }
+
+func TestRingBufferSearchRegex(t *testing.T) {
+	rb := NewRingBuffer(10)
+	rb.Append("ERROR 42 connection refused")
+	rb.Append("info: all good")
+	rb.Append("[FATAL] goroutine panic: nil map")
+	rb.Append("error 7 lowercase")
+	rb.Append("prefix ERROR 99")
+
+	results, err := rb.SearchRegex(`ERROR\s+\d+`, 10)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("expected 2 results, got %d", len(results))
+	}
+	if results[0].Seq != 0 || results[1].Seq != 4 {
+		t.Errorf("unexpected seqs: %d, %d", results[0].Seq, results[1].Seq)
+	}
+
+	// Anchors apply per line
+	results, _ = rb.SearchRegex(`^ERROR`, 10)
+	if len(results) != 1 || results[0].Seq != 0 {
+		t.Errorf("anchored search got %v", results)
+	}
+	results, _ = rb.SearchRegex(`\d+$`, 10)
+	if len(results) != 1 || results[0].Seq != 4 {
+		t.Errorf("end-anchored search got %v", results)
+	}
+
+	// Case-insensitive flag
+	results, _ = rb.SearchRegex(`(?i)^error`, 10)
+	if len(results) != 2 {
+		t.Errorf("expected 2 case-insensitive results, got %d", len(results))
+	}
+
+	results, _ = rb.SearchRegex(`\[FATAL\].*panic`, 10)
+	if len(results) != 1 || results[0].Seq != 2 {
+		t.Errorf("FATAL search got %v", results)
+	}
+
+	// Max results cap
+	results, _ = rb.SearchRegex(`.`, 2)
+	if len(results) != 2 {
+		t.Errorf("expected 2 capped results, got %d", len(results))
+	}
+}
+
+func TestRingBufferSearchRegexDotAll(t *testing.T) {
+	rb := NewRingBuffer(10)
+	rb.Append("start\nend")
+
+	results, _ := rb.SearchRegex(`start.end`, 10)
+	if len(results) != 0 {
+		t.Errorf("expected dot not to match newline, got %v", results)
+	}
+	results, _ = rb.SearchRegex(`(?s)start.end`, 10)
+	if len(results) != 1 {
+		t.Errorf("expected (?s) to match across newline, got %v", results)
+	}
+}
+
+func TestRingBufferSearchRegexInvalid(t *testing.T) {
+	rb := NewRingBuffer(10)
+	rb.Append("anything")
+
+	if _, err := rb.SearchRegex(`(unclosed`, 10); err == nil {
+		t.Error("expected compile error")
+	}
+
+	// Compile errors are reported even when the buffer is empty
+	if _, err := NewRingBuffer(10).SearchRegex(`[`, 10); err == nil {
+		t.Error("expected compile error on empty buffer")
+	}
+}
+
+func FuzzRingBufferSearchRegex(f *testing.F) {
+	for _, seed := range []string{`^a`, `b$`, `(?s).*`, `(`, `[`, `\d+`, ``} {
+		f.Add(seed)
+	}
+	rb := NewRingBuffer(4)
+	for _, line := range []string{"abc", "", "123", "x\ny"} {
+		rb.Append(line)
+	}
+	f.Fuzz(func(t *testing.T, pattern string) {
+		results, err := rb.SearchRegex(pattern, 10)
+		if err != nil && results != nil {
+			t.Errorf("results should be nil on error")
+		}
+		if len(results) > rb.Len() {
+			t.Errorf("got %d results from %d lines", len(results), rb.Len())
+		}
+	})
+}
+
+func TestRingBufferTimestamps(t *testing.T) {
+	rb := NewRingBuffer(3, WithTimestamps())
+	before := time.Now()
+	for i := range 4 {
+		rb.Append(fmt.Sprintf("line %d", i))
+	}
+	after := time.Now()
+
+	lines, stamps, next, hasMore := rb.ReadRangeWithTimestamps(0, 10)
+	if len(lines) != 3 || len(stamps) != 3 {
+		t.Fatalf("expected 3 lines and stamps, got %d and %d", len(lines), len(stamps))
+	}
+	if next != 4 || hasMore {
+		t.Errorf("next=%d hasMore=%v", next, hasMore)
+	}
+	for i, ts := range stamps {
+		if ts.Before(before) || ts.After(after) {
+			t.Errorf("stamps[%d] = %v outside [%v, %v]", i, ts, before, after)
+		}
+	}
+
+	results := rb.Search("line 3", 10)
+	if len(results) != 1 || results[0].Timestamp.IsZero() {
+		t.Errorf("expected timestamped search result, got %v", results)
+	}
+}
+
+func TestRingBufferWithoutTimestamps(t *testing.T) {
+	rb := NewRingBuffer(3)
+	rb.Append("line")
+
+	lines, stamps, _, _ := rb.ReadRangeWithTimestamps(0, 10)
+	if len(lines) != 1 {
+		t.Fatalf("expected 1 line, got %d", len(lines))
+	}
+	if stamps != nil {
+		t.Errorf("expected nil timestamps, got %v", stamps)
+	}
+	if results := rb.Search("line", 10); !results[0].Timestamp.IsZero() {
+		t.Errorf("expected zero timestamp, got %v", results[0].Timestamp)
+	}
+}
+
+func TestRingBufferAddContext(t *testing.T) {
+	rb := NewRingBuffer(20)
+	for i := range 12 {
+		rb.Append(fmt.Sprintf("line %d", i))
+	}
+
+	// Isolated hits get full windows, clamped at the buffer edges
+	matches := rb.AddContext([]SearchResult{{Seq: 1, Line: "line 1"}, {Seq: 8, Line: "line 8"}}, 2, 2)
+	if len(matches) != 2 {
+		t.Fatalf("expected 2 matches, got %d", len(matches))
+	}
+	if fmt.Sprint(matches[0].Before) != "[line 0]" || fmt.Sprint(matches[0].After) != "[line 2 line 3]" {
+		t.Errorf("match 0 = %+v", matches[0])
+	}
+	if fmt.Sprint(matches[1].Before) != "[line 6 line 7]" || fmt.Sprint(matches[1].After) != "[line 9 line 10]" {
+		t.Errorf("match 1 = %+v", matches[1])
+	}
+
+	// Overlapping windows are merged without repeating lines
+	matches = rb.AddContext([]SearchResult{{Seq: 4, Line: "line 4"}, {Seq: 7, Line: "line 7"}}, 2, 2)
+	if fmt.Sprint(matches[0].After) != "[line 5 line 6]" {
+		t.Errorf("match 0 after = %v", matches[0].After)
+	}
+	if len(matches[1].Before) != 0 {
+		t.Errorf("match 1 before should be empty, got %v", matches[1].Before)
+	}
+
+	// Adjacent hits share no context between them
+	matches = rb.AddContext([]SearchResult{{Seq: 4, Line: "line 4"}, {Seq: 5, Line: "line 5"}}, 1, 1)
+	if len(matches[0].After) != 0 || len(matches[1].Before) != 0 {
+		t.Errorf("adjacent matches = %+v", matches)
+	}
+	if fmt.Sprint(matches[0].Before) != "[line 3]" || fmt.Sprint(matches[1].After) != "[line 6]" {
+		t.Errorf("adjacent matches = %+v", matches)
+	}
+}
+
+func TestRingBufferAddContextEvicted(t *testing.T) {
+	rb := NewRingBuffer(3)
+	for i := range 6 {
+		rb.Append(fmt.Sprintf("line %d", i))
+	}
+	// Retained lines are 3..5; context never reaches evicted lines
+	matches := rb.AddContext([]SearchResult{{Seq: 3, Line: "line 3"}}, 5, 5)
+	if len(matches[0].Before) != 0 {
+		t.Errorf("expected no before lines, got %v", matches[0].Before)
+	}
+	if fmt.Sprint(matches[0].After) != "[line 4 line 5]" {
+		t.Errorf("after = %v", matches[0].After)
+	}
+}
+
+func TestRingBufferResize(t *testing.T) {
+	rb := NewRingBuffer(5)
+	for i := range 7 {
+		rb.Append(fmt.Sprintf("line %d", i))
+	}
+	// Buffer has lines 2..6, totalSeq=7
+
+	// Shrink keeps the most recent lines and their seqs
+	if err := rb.Resize(3); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if rb.Len() != 3 || rb.Cap() != 3 || rb.TotalSeq() != 7 {
+		t.Fatalf("len=%d cap=%d totalSeq=%d", rb.Len(), rb.Cap(), rb.TotalSeq())
+	}
+	lines, next, _ := rb.ReadRange(4, 10)
+	if fmt.Sprint(lines) != "[line 4 line 5 line 6]" || next != 7 {
+		t.Errorf("after shrink got %v next=%d", lines, next)
+	}
+
+	// Grow retains everything and keeps appending in order
+	if err := rb.Resize(10); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	seq := rb.Append("line 7")
+	if seq != 7 {
+		t.Errorf("expected seq 7, got %d", seq)
+	}
+	if got := fmt.Sprint(rb.AllLines()); got != "[line 4 line 5 line 6 line 7]" {
+		t.Errorf("after grow got %s", got)
+	}
+
+	// Shrink to exactly the current count wraps head correctly
+	if err := rb.Resize(4); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	rb.Append("line 8")
+	if got := fmt.Sprint(rb.LastN(4)); got != "[line 5 line 6 line 7 line 8]" {
+		t.Errorf("after exact shrink got %s", got)
+	}
+
+	if err := rb.Resize(0); err == nil {
+		t.Error("expected error for zero capacity")
+	}
+	if err := rb.Resize(MaxBufferCapacity + 1); err == nil || rb.Cap() != 4 {
+		t.Errorf("resize past MaxBufferCapacity: err = %v, cap = %d", err, rb.Cap())
+	}
+}
+
+func TestRingBufferBytes(t *testing.T) {
+	lineSize := entryOverhead + 6
+	rb := NewRingBufferBytes(3*lineSize + 2)
+	for i := range 5 {
+		rb.Append(fmt.Sprintf("line %d", i)) // 6 bytes each
+	}
+	// Only three lines fit
+	if got := fmt.Sprint(rb.AllLines()); got != "[line 2 line 3 line 4]" {
+		t.Errorf("got %s", got)
+	}
+	if rb.Bytes() != 3*lineSize || rb.TotalSeq() != 5 {
+		t.Errorf("bytes=%d totalSeq=%d", rb.Bytes(), rb.TotalSeq())
+	}
+
+	// A line longer than the limit evicts everything else but is kept
+	long := strings.Repeat("x", 3*lineSize)
+	rb.Append(long)
+	if got := rb.AllLines(); len(got) != 1 || got[0] != long {
+		t.Errorf("expected only the long line, got %v", got)
+	}
+	rb.Append("short")
+	if got := fmt.Sprint(rb.AllLines()); got != "[short]" || rb.Bytes() != entryOverhead+5 {
+		t.Errorf("got %s bytes=%d", got, rb.Bytes())
+	}
+
+	if err := rb.Resize(10); err == nil {
+		t.Error("expected error resizing a byte-bounded buffer")
+	}
+}
+
+func TestRingBufferBytesGrows(t *testing.T) {
+	rb := NewRingBufferBytes(1 << 20)
+	for i := range 5000 {
+		rb.Append(fmt.Sprintf("line %d", i))
+	}
+	if rb.Len() != 5000 {
+		t.Fatalf("expected 5000 lines, got %d", rb.Len())
+	}
+	lines, next, _ := rb.ReadRange(4998, 10)
+	if fmt.Sprint(lines) != "[line 4998 line 4999]" || next != 5000 {
+		t.Errorf("got %v next=%d", lines, next)
+	}
+
+	restored, err := RestoreRingBuffer(rb.Snapshot())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored.MaxBytes() != 1<<20 || restored.Bytes() != rb.Bytes() {
+		t.Errorf("restored maxBytes=%d bytes=%d, want %d %d",
+			restored.MaxBytes(), restored.Bytes(), 1<<20, rb.Bytes())
+	}
+}
+
+func TestRingBufferBytesEmptyLines(t *testing.T) {
+	const maxBytes = 64 << 10
+	rb := NewRingBufferBytes(maxBytes)
+	for range 200000 {
+		rb.Append("")
+	}
+	// Empty lines still count their overhead, so they are evicted rather
+	// than growing the backing slice without bound
+	if want := maxBytes / entryOverhead; rb.Len() != want {
+		t.Errorf("Len = %d, want %d", rb.Len(), want)
+	}
+	if rb.Cap() > 2*maxBytes/entryOverhead {
+		t.Errorf("Cap = %d, want at most %d", rb.Cap(), 2*maxBytes/entryOverhead)
+	}
+}
+
+func TestRingBufferSnapshotRestore(t *testing.T) {
+	rb := NewRingBuffer(3, WithTimestamps())
+	for i := range 5 {
+		rb.Append(fmt.Sprintf("line %d", i))
+	}
+
+	restored, err := RestoreRingBuffer(rb.Snapshot())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if restored.Cap() != 3 || restored.Len() != 3 || restored.TotalSeq() != 5 {
+		t.Fatalf("cap=%d len=%d totalSeq=%d", restored.Cap(), restored.Len(), restored.TotalSeq())
+	}
+
+	// Cursors from before the snapshot still resolve to the same lines
+	lines, stamps, next, _ := restored.ReadRangeWithTimestamps(3, 10)
+	if fmt.Sprint(lines) != "[line 3 line 4]" || next != 5 {
+		t.Errorf("got %v next=%d", lines, next)
+	}
+	_, origStamps, _, _ := rb.ReadRangeWithTimestamps(3, 10)
+	for i := range stamps {
+		if !stamps[i].Equal(origStamps[i]) {
+			t.Errorf("stamps[%d] = %v, want %v", i, stamps[i], origStamps[i])
+		}
+	}
+
+	// Appends continue the original sequence
+	if seq := restored.Append("line 5"); seq != 5 {
+		t.Errorf("expected seq 5, got %d", seq)
+	}
+	if got := fmt.Sprint(restored.AllLines()); got != "[line 3 line 4 line 5]" {
+		t.Errorf("after append got %s", got)
+	}
+}
+
+func TestRestoreRingBufferInvalid(t *testing.T) {
+	for _, data := range []string{
+		`not json`,
+		`{"cap":0,"total_seq":0,"lines":[]}`,
+		`{"cap":1,"total_seq":2,"lines":["a","b"]}`,
+		`{"cap":5,"total_seq":1,"lines":["a","b"]}`,
+	} {
+		if _, err := RestoreRingBuffer([]byte(data)); err == nil {
+			t.Errorf("expected error for %s", data)
+		}
+	}
+}
+
+func TestRingBufferReadTimeRange(t *testing.T) {
+	rb := NewRingBuffer(10, WithTimestamps())
+	rb.Append("old 0")
+	rb.Append("old 1")
+	time.Sleep(5 * time.Millisecond)
+	mid := time.Now()
+	time.Sleep(5 * time.Millisecond)
+	rb.Append("new 2")
+	rb.Append("new 3")
+
+	results := rb.ReadTimeRange(mid, time.Time{}, 10)
+	if len(results) != 2 || results[0].Seq != 2 || results[1].Line != "new 3" {
+		t.Errorf("since mid got %v", results)
+	}
+
+	results = rb.ReadTimeRange(time.Time{}, mid, 10)
+	if len(results) != 2 || results[1].Line != "old 1" {
+		t.Errorf("until mid got %v", results)
+	}
+
+	results = rb.ReadTimeRange(time.Time{}, time.Time{}, 3)
+	if len(results) != 3 {
+		t.Errorf("expected 3 capped results, got %d", len(results))
+	}
+
+	if results := NewRingBuffer(10).ReadTimeRange(time.Time{}, time.Time{}, 10); results != nil {
+		t.Errorf("expected nil without timestamps, got %v", results)
+	}
+}
+
+func TestRingBufferSearchNewestFirst(t *testing.T) {
+	rb := NewRingBuffer(5)
+	for i := range 8 {
+		rb.Append(fmt.Sprintf("hit %d", i))
+	}
+	// Buffer has seqs 3..7
+
+	results := rb.SearchFunc(SubstringMatcher("hit"), 2, true)
+	if len(results) != 2 {
+		t.Fatalf("expected 2 results, got %d", len(results))
+	}
+	if results[0].Seq != 7 || results[0].Line != "hit 7" || results[1].Seq != 6 {
+		t.Errorf("newest-first got %v", results)
+	}
+
+	results = rb.SearchFunc(SubstringMatcher("hit"), 2, false)
+	if results[0].Seq != 3 || results[1].Seq != 4 {
+		t.Errorf("oldest-first got %v", results)
+	}
+
+	// Context windows keep the newest-first order
+	matches := rb.AddContext([]SearchResult{{Seq: 7, Line: "hit 7"}, {Seq: 4, Line: "hit 4"}}, 1, 1)
+	if matches[0].Seq != 7 || matches[1].Seq != 4 {
+		t.Fatalf("context order got %+v", matches)
+	}
+	if fmt.Sprint(matches[0].Before) != "[hit 6]" || fmt.Sprint(matches[1].After) != "[hit 5]" {
+		t.Errorf("context windows got %+v", matches)
+	}
+}
+
+func TestRingBufferTail(t *testing.T) {
+	rb := NewRingBuffer(10)
+	rb.Append("before subscribe")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	lines := rb.Tail(ctx)
+
+	rb.Append("one")
+	rb.AppendBatch([]string{"two", "three"})
+
+	for _, want := range []string{"one", "two", "three"} {
+		select {
+		case got := <-lines:
+			if got != want {
+				t.Errorf("got %q, want %q", got, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for %q", want)
+		}
+	}
+
+	cancel()
+	select {
+	case _, ok := <-lines:
+		if ok {
+			t.Error("expected channel to be closed")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("channel not closed after cancel")
+	}
+}
+
+func TestRingBufferWriteTo(t *testing.T) {
+	rb := NewRingBuffer(3)
+	for _, line := range []string{"evicted", "\x1b[32mok\x1b[0m", "two", "three"} {
+		rb.Append(line)
+	}
+
+	var buf bytes.Buffer
+	n, err := rb.WriteTo(&buf)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := "\x1b[32mok\x1b[0m\ntwo\nthree\n"
+	if buf.String() != want || n != int64(len(want)) {
+		t.Errorf("WriteTo wrote %q (n=%d), want %q", buf.String(), n, want)
+	}
+
+	buf.Reset()
+	if _, err := rb.WriteLines(&buf, true); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if buf.String() != "ok\ntwo\nthree\n" {
+		t.Errorf("WriteLines stripped = %q", buf.String())
+	}
+
+	buf.Reset()
+	n, err = rb.WriteJSONLines(&buf, true)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want = `{"seq":1,"line":"ok"}` + "\n" + `{"seq":2,"line":"two"}` + "\n" + `{"seq":3,"line":"three"}` + "\n"
+	if buf.String() != want || n != int64(len(want)) {
+		t.Errorf("WriteJSONLines wrote %q (n=%d), want %q", buf.String(), n, want)
+	}
+
+	buf.Reset()
+	if n, _ := NewRingBuffer(3).WriteTo(&buf); n != 0 || buf.Len() != 0 {
+		t.Errorf("empty buffer wrote %d bytes", n)
+	}
+}
+
+func TestRingBufferDedup(t *testing.T) {
+	rb := NewRingBuffer(5, WithDedup())
+	rb.Append("start")
+	for range 42 {
+		rb.Append("health ok")
+	}
+	seq := rb.Append("done")
+	if seq != 2 || rb.Len() != 3 {
+		t.Fatalf("seq=%d len=%d, want 2 3", seq, rb.Len())
+	}
+
+	want := "[start health ok (x42) done]"
+	lines, _, _ := rb.ReadRange(0, 10)
+	if got := fmt.Sprint(lines); got != want {
+		t.Errorf("ReadRange got %s, want %s", got, want)
+	}
+	if got := fmt.Sprint(rb.LastN(2)); got != "[health ok (x42) done]" {
+		t.Errorf("LastN got %s", got)
+	}
+	results := rb.Search("health", 10)
+	if len(results) != 1 || results[0].Line != "health ok (x42)" || results[0].Seq != 1 {
+		t.Errorf("Search got %+v", results)
+	}
+
+	// Non-consecutive repeats are stored separately
+	rb.Append("health ok")
+	if got := fmt.Sprint(rb.LastN(1)); got != "[health ok]" {
+		t.Errorf("got %s", got)
+	}
+
+	restored, err := RestoreRingBuffer(rb.Snapshot())
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored.Append("health ok")
+	if got := fmt.Sprint(restored.AllLines()); got != "[start health ok (x42) done health ok (x2)]" {
+		t.Errorf("restored got %s", got)
+	}
+}
+
+func TestRingBufferRepeats(t *testing.T) {
+	src := NewRingBuffer(10, WithDedup())
+	for _, line := range []string{"a", "b", "b", "b", "c"} {
+		src.Append(line)
+	}
+	lines, repeats, next, hasMore := src.ReadRangeRepeats(1, 10)
+	if fmt.Sprint(lines, repeats) != "[b c] [3 1]" || next != 3 || hasMore {
+		t.Fatalf("ReadRangeRepeats = %v %v, next %d, more %v", lines, repeats, next, hasMore)
+	}
+	if _, repeats, _, _ := src.ReadRangeRepeats(0, 1); repeats != nil {
+		t.Errorf("repeats without repeated lines = %v", repeats)
+	}
+
+	// Copies keep their seqs, even where a line matches the one before
+	dst := NewRingBuffer(10, WithDedup())
+	dst.Append("b")
+	seqs := dst.AppendRepeats(lines, repeats)
+	if fmt.Sprint(seqs) != "[1 2]" {
+		t.Errorf("AppendRepeats seqs = %v", seqs)
+	}
+	dst.Append("c")
+	if got := fmt.Sprint(dst.AllLines()); got != "[b b (x3) c (x2)]" {
+		t.Errorf("after AppendRepeats got %s", got)
+	}
+}
+
+func TestRingBufferDedupANSI(t *testing.T) {
+	rb := NewRingBuffer(5)
+	rb.AppendBatchANSI([]string{"tick", "tick"})
+	rb.SetDedup(true)
+	// Compared without escapes, so a recolored spinner still collapses
+	rb.AppendBatchANSI([]string{"\x1b[32mtick\x1b[0m", "\x1b[33mtick\x1b[0m"})
+
+	if rb.TotalSeq() != 2 {
+		t.Fatalf("TotalSeq = %d, want 2", rb.TotalSeq())
+	}
+	results, _, _ := rb.ReadFunc(0, 10, nil)
+	if len(results) != 2 || results[1].Line != "tick (x3)" || results[1].RawLine() != "tick (x3)" {
+		t.Errorf("results = %+v", results)
+	}
+}
+
+func TestRingBufferCountMatching(t *testing.T) {
+	rb := NewRingBuffer(4)
+	for _, line := range []string{"ERROR a", "ok", "error b", "warn", "Error c"} {
+		rb.Append(line)
+	}
+	// "ERROR a" has been evicted
+	if n := rb.CountMatching("error"); n != 2 {
+		t.Errorf("CountMatching = %d, want 2", n)
+	}
+	n, err := rb.CountMatchingRegex(`^(ok|warn)$`)
+	if err != nil || n != 2 {
+		t.Errorf("CountMatchingRegex = %d, %v", n, err)
+	}
+	if _, err := rb.CountMatchingRegex("["); err == nil {
+		t.Error("expected error for invalid regex")
+	}
+}
+
+func TestRingBufferAppendBatchANSI(t *testing.T) {
+	rb := NewRingBufferBytes(1000)
+	rb.AppendBatchANSI([]string{"\x1b[31mFAIL\x1b[0m pkg", "plain"})
+
+	if got := fmt.Sprint(rb.LastN(2)); got != "[FAIL pkg plain]" {
+		t.Errorf("LastN = %s", got)
+	}
+	if rb.Bytes() != 2*entryOverhead+len("FAIL pkg")+len("\x1b[31mFAIL\x1b[0m pkg")+len("plain") {
+		t.Errorf("Bytes = %d", rb.Bytes())
+	}
+
+	// Searches match the stripped text but carry the colored line
+	results := rb.SearchFunc(SubstringMatcher("FAIL pkg"), 10, false)
+	if len(results) != 1 || results[0].Line != "FAIL pkg" || results[0].RawLine() != "\x1b[31mFAIL\x1b[0m pkg" {
+		t.Errorf("search = %+v", results)
+	}
+	results, _, _ = rb.ReadFunc(1, 10, nil)
+	if len(results) != 1 || results[0].Raw != "" || results[0].RawLine() != "plain" {
+		t.Errorf("plain line = %+v", results)
+	}
+
+	restored, err := RestoreRingBuffer(rb.Snapshot())
+	if err != nil {
+		t.Fatalf("restore: %v", err)
+	}
+	results, _, _ = restored.ReadFunc(0, 10, nil)
+	if len(results) != 2 || results[0].RawLine() != "\x1b[31mFAIL\x1b[0m pkg" || restored.Bytes() != rb.Bytes() {
+		t.Errorf("restored = %+v, bytes %d", results, restored.Bytes())
+	}
+}
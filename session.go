@@ -1,9 +1,10 @@
 package streamsh
 
 import (
-	"encoding/json"
+	"cmp"
+	"errors"
 	"fmt"
-	"net"
+	"slices"
 	"strings"
 	"sync"
 	"time"
@@ -12,118 +13,605 @@ import (
 )
 
 // Session represents an active or recently disconnected shell session.
+// Fields that change while the session runs are unexported and read through
+// accessors, since the client's connection updates them while MCP and HTTP
+// handlers read them.
 type Session struct {
-	ID           uuid.UUID
-	ShortID      string
-	Title        string
-	CreatedAt    time.Time
-	LastActivity time.Time
-	LastCommand  string
-	Connected    bool
-	Buffer       *RingBuffer
-	Collab       bool
-	clientConn   net.Conn
-	connMu       sync.Mutex
+	ID        uuid.UUID
+	ShortID   string
+	CreatedAt time.Time
+	Buffer    *RingBuffer
+
+	mu           sync.Mutex // guards the fields below
+	title        string
+	lastActivity time.Time
+	collab       bool
+	tags         []string
+	ttl          time.Duration // if set, overrides the max age passed to Store.Prune
+	rows, cols   int           // terminal size reported by the client, zero if unknown
+	environment  map[string]string
+	cwd          string // working directory at the last prompt, empty if unknown
+	pid          int    // the shell's process ID on the client's host, zero if unknown
+	keepANSI     bool   // the buffer also keeps output with ANSI escapes, for raw reads
+	readOnly     bool   // the client refuses input, even if collab
+	paused       bool   // the client has paused streaming
+	// clientSeqOffset is the client's seq for a line minus the buffer's.
+	// It is nonzero once a replay skipped lines the client no longer had.
+	clientSeqOffset uint64
+
+	connMu       sync.Mutex // guards the fields below
+	connected    bool
+	client       *ConnWriter   // writer for the client's connection, if collab
+	disconnected chan struct{} // closed when the current client disconnects
+
+	expireMu sync.Mutex
+	expired  chan struct{} // closed when the session is pruned
+
+	historyMu    sync.Mutex // guards the fields below
+	lastCommand  string
+	lastExitCode *int // exit status of lastCommand, nil until it finishes
+	// lastCommandStarted is when lastCommand started running, as reported
+	// by the shell, or else when it was entered.
+	lastCommandStarted time.Time
+	// CommandHistory holds the most recent commands, oldest first, up to
+	// the store's HistorySize entries. Guarded by historyMu.
+	CommandHistory []CommandEntry
+	historySize    int // bound on CommandHistory, MaxCommandHistory if not positive
+
+	rate lineRate // output lines received per minute
+}
+
+// lineRate counts lines received in whole-minute windows, so the rate of
+// output over the last minute can be reported without keeping a time per
+// line.
+type lineRate struct {
+	mu       sync.Mutex
+	start    time.Time // when the current minute began
+	current  int64     // lines received since start
+	previous int64     // lines received in the minute before start
+}
+
+// add counts n lines received at now.
+func (r *lineRate) add(n int, now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.roll(now)
+	r.current += int64(n)
+}
+
+// perMinute returns the number of lines received in the last whole minute
+// before now.
+func (r *lineRate) perMinute(now time.Time) int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.roll(now)
+	return r.previous
+}
+
+// average returns the rate of lines received over the minute before now,
+// estimated by weighting the previous minute's count by how much of it
+// still falls inside that window.
+func (r *lineRate) average(now time.Time) float64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.roll(now)
+	if r.start.IsZero() {
+		return 0
+	}
+	outside := float64(now.Sub(r.start)) / float64(time.Minute)
+	return float64(r.previous)*(1-outside) + float64(r.current)
+}
+
+// roll moves the window forward to the minute containing now. r.mu must
+// be held.
+func (r *lineRate) roll(now time.Time) {
+	switch elapsed := now.Sub(r.start); {
+	case elapsed >= 2*time.Minute:
+		r.start, r.current, r.previous = now, 0, 0
+	case elapsed >= time.Minute:
+		r.start, r.current, r.previous = r.start.Add(time.Minute), 0, r.current
+	}
+}
+
+// MaxCommandHistory is the default bound on Session.CommandHistory.
+const MaxCommandHistory = 100
+
+// CommandEntry is one command run in a session. StartSeq and EndSeq
+// bound its output in the session's buffer; they are nil for entries
+// recorded before boundaries were tracked.
+type CommandEntry struct {
+	Command  string    `json:"command"`
+	Time     time.Time `json:"time"`
+	ExitCode *int      `json:"exit_code,omitempty"` // nil until the command finishes
+	StartSeq *uint64   `json:"start_seq,omitempty"` // first line of output, or the prompt line if the shell doesn't report starts
+	EndSeq   *uint64   `json:"end_seq,omitempty"`   // one past the last line, nil while running
 }
 
 // Store is a thread-safe collection of sessions.
 type Store struct {
+	// MaxBytes, if positive, bounds each new session's buffer by total
+	// bytes instead of by the line capacity passed to Create.
+	MaxBytes int
+	// MaxSessions, if positive, bounds the number of sessions. Creating a
+	// session beyond it evicts the least recently active disconnected
+	// session, or fails with ErrTooManySessions if all are connected.
+	MaxSessions int
+	// HistorySize, if positive, bounds the command history of each session
+	// instead of MaxCommandHistory.
+	HistorySize int
+
 	mu       sync.RWMutex
 	sessions map[uuid.UUID]*Session
+
+	watchMu  sync.Mutex
+	watchers map[uuid.UUID][]chan SessionEvent
+}
+
+// SessionEventKind identifies a change reported by Store.Watch.
+type SessionEventKind string
+
+const (
+	SessionConnected    SessionEventKind = "connected"
+	SessionDisconnected SessionEventKind = "disconnected"
+	SessionNewCommand   SessionEventKind = "command" // Line holds the command
+	SessionNewLine      SessionEventKind = "line"    // Line holds the output line
+	SessionExited       SessionEventKind = "exited"  // Line holds the command, ExitCode its status
+)
+
+// SessionEvent describes a change to a watched session.
+type SessionEvent struct {
+	Kind     SessionEventKind
+	Session  *Session
+	Line     string
+	ExitCode int
 }
 
 // NewStore creates an empty session store.
 func NewStore() *Store {
 	return &Store{
 		sessions: make(map[uuid.UUID]*Session),
+		watchers: make(map[uuid.UUID][]chan SessionEvent),
 	}
 }
 
+// ErrTooManySessions is returned when creating a session would exceed
+// Store.MaxSessions and no disconnected session can be evicted.
+var ErrTooManySessions = errors.New("too many sessions")
+
 // Create adds a new session to the store and returns it.
-func (s *Store) Create(title string, bufCap int, collab bool, conn net.Conn) *Session {
+func (s *Store) Create(title string, bufCap int, collab bool, client *ConnWriter) (*Session, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	if err := s.makeRoom(); err != nil {
+		return nil, err
+	}
 	id := uuid.New()
 	now := time.Now()
 	sess := &Session{
 		ID:           id,
 		ShortID:      id.String()[:8],
-		Title:        title,
+		title:        title,
 		CreatedAt:    now,
-		LastActivity: now,
-		Connected:    true,
-		Buffer:       NewRingBuffer(bufCap),
-		Collab:       collab,
-		clientConn:   conn,
+		lastActivity: now,
+		connected:    true,
+		Buffer:       s.newBuffer(bufCap),
+		collab:       collab,
+		client:       client,
+		historySize:  s.HistorySize,
 	}
 	s.sessions[id] = sess
-	return sess
+	return sess, nil
 }
 
 // CreateOrUpdate creates a session with the given ID, or updates an existing one
 // if a session with that ID already exists (reconnection). Returns the session
-// and whether this was a reconnection.
-func (s *Store) CreateOrUpdate(id uuid.UUID, title string, bufCap int, collab bool, conn net.Conn) (*Session, bool) {
+// and whether this was a reconnection. Reconnections are never refused.
+func (s *Store) CreateOrUpdate(id uuid.UUID, title string, bufCap int, collab bool, client *ConnWriter) (*Session, bool, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	if existing, ok := s.sessions[id]; ok {
-		existing.SetConn(conn)
-		existing.Collab = collab
-		if title != "" {
-			existing.Title = title
+		existing.SetConn(client)
+		existing.mu.Lock()
+		existing.collab = collab
+		// Keep the daemon's title, which may have been renamed since
+		if existing.title == "" {
+			existing.title = title
 		}
-		existing.LastActivity = time.Now()
-		return existing, true
+		existing.lastActivity = time.Now()
+		existing.mu.Unlock()
+		return existing, true, nil
 	}
 
+	if err := s.makeRoom(); err != nil {
+		return nil, false, err
+	}
 	now := time.Now()
 	sess := &Session{
 		ID:           id,
 		ShortID:      id.String()[:8],
-		Title:        title,
+		title:        title,
 		CreatedAt:    now,
-		LastActivity: now,
-		Connected:    true,
-		Buffer:       NewRingBuffer(bufCap),
-		Collab:       collab,
-		clientConn:   conn,
+		lastActivity: now,
+		connected:    true,
+		Buffer:       s.newBuffer(bufCap),
+		collab:       collab,
+		client:       client,
+		historySize:  s.HistorySize,
 	}
 	s.sessions[id] = sess
-	return sess, false
+	return sess, false, nil
+}
+
+// makeRoom evicts least recently active disconnected sessions until there is
+// room for one more under MaxSessions. s.mu must be held.
+func (s *Store) makeRoom() error {
+	if s.MaxSessions <= 0 {
+		return nil
+	}
+	for len(s.sessions) >= s.MaxSessions {
+		var lru *Session
+		for _, sess := range s.sessions {
+			if sess.Connected() {
+				continue
+			}
+			if lru == nil || sess.LastActivity().Before(lru.LastActivity()) {
+				lru = sess
+			}
+		}
+		if lru == nil {
+			return fmt.Errorf("%w: all %d sessions are connected", ErrTooManySessions, len(s.sessions))
+		}
+		delete(s.sessions, lru.ID)
+		lru.expire()
+	}
+	return nil
+}
+
+// newBuffer creates a session buffer, bounded by MaxBytes if set and by
+// bufCap lines otherwise.
+func (s *Store) newBuffer(bufCap int) *RingBuffer {
+	if s.MaxBytes > 0 {
+		return NewRingBufferBytes(s.MaxBytes, WithTimestamps())
+	}
+	return NewRingBuffer(bufCap, WithTimestamps())
 }
 
 // SendInput sends text to the session's PTY via the client connection.
 func (s *Session) SendInput(text string) error {
-	if !s.Collab {
+	if !s.Collab() {
+		return fmt.Errorf("session %s is not collaborative (start with --collab)", s.ShortID)
+	}
+	if s.ReadOnly() {
+		return fmt.Errorf("session %s is read-only (started with --read-only)", s.ShortID)
+	}
+	return s.sendToClient(Envelope{
+		Type:    MsgInput,
+		Payload: mustMarshal(InputPayload{Text: text}),
+	})
+}
+
+// Kill asks the session's client to close its PTY and exit. Like SendInput,
+// it only works for connected collaborative sessions.
+func (s *Session) Kill() error {
+	if !s.Collab() {
 		return fmt.Errorf("session %s is not collaborative (start with --collab)", s.ShortID)
 	}
+	return s.sendToClient(Envelope{Type: MsgKill})
+}
+
+// Signal asks the session's client to send the named signal to the shell's
+// foreground process and returns the signal's canonical name. Only
+// allowlisted signals are accepted. Like SendInput, it only works for
+// connected collaborative sessions.
+func (s *Session) Signal(name string) (string, error) {
+	canon, _, err := parseSignal(name)
+	if err != nil {
+		return "", err
+	}
+	if !s.Collab() {
+		return "", fmt.Errorf("session %s is not collaborative (start with --collab)", s.ShortID)
+	}
+	return canon, s.sendToClient(Envelope{
+		Type:    MsgSignal,
+		Payload: mustMarshal(SignalPayload{Signal: canon}),
+	})
+}
+
+func (s *Session) sendToClient(env Envelope) error {
 	s.connMu.Lock()
 	defer s.connMu.Unlock()
-	if !s.Connected || s.clientConn == nil {
+	if !s.connected || s.client == nil {
 		return fmt.Errorf("session %s is not connected", s.ShortID)
 	}
-	env := Envelope{
-		Type:    MsgInput,
-		Payload: mustMarshal(InputPayload{Text: text}),
+	return s.client.Write(env)
+}
+
+// AddCommand records a newly started command as the session's last command
+// and appends it to the history, dropping the oldest entry when full. Its
+// output starts at the buffer's next line, which also ends the previous
+// command's output if no exit status closed it.
+func (s *Session) AddCommand(cmd string, at time.Time) {
+	s.historyMu.Lock()
+	defer s.historyMu.Unlock()
+	s.lastCommand = cmd
+	s.lastCommandStarted = at
+	s.lastExitCode = nil
+	start := s.Buffer.TotalSeq()
+	if n := len(s.CommandHistory); n > 0 && s.CommandHistory[n-1].StartSeq != nil && s.CommandHistory[n-1].EndSeq == nil {
+		s.CommandHistory[n-1].EndSeq = &start
+	}
+	limit := s.historySize
+	if limit <= 0 {
+		limit = MaxCommandHistory
+	}
+	if len(s.CommandHistory) >= limit {
+		s.CommandHistory = slices.Delete(s.CommandHistory, 0, len(s.CommandHistory)-limit+1)
+	}
+	s.CommandHistory = append(s.CommandHistory, CommandEntry{Command: cmd, Time: at, StartSeq: &start})
+}
+
+// SetExitCode records the exit status of the last command, whose output
+// ends at the buffer's next line.
+func (s *Session) SetExitCode(code int) {
+	s.historyMu.Lock()
+	defer s.historyMu.Unlock()
+	s.lastExitCode = &code
+	if n := len(s.CommandHistory); n > 0 && s.CommandHistory[n-1].ExitCode == nil {
+		last := &s.CommandHistory[n-1]
+		last.ExitCode = &code
+		if last.StartSeq != nil && last.EndSeq == nil {
+			end := s.Buffer.TotalSeq()
+			last.EndSeq = &end
+		}
+	}
+}
+
+// CommandSpans returns the commands whose output is still at least partly
+// in the buffer, oldest first.
+func (s *Session) CommandSpans() []CommandSpan {
+	first := s.Buffer.FirstSeq()
+	s.historyMu.Lock()
+	defer s.historyMu.Unlock()
+	var spans []CommandSpan
+	for _, e := range s.CommandHistory {
+		if e.StartSeq == nil || (e.EndSeq != nil && *e.EndSeq <= first) {
+			continue
+		}
+		spans = append(spans, CommandSpan{
+			Command:  e.Command,
+			StartSeq: max(*e.StartSeq, first),
+			EndSeq:   e.EndSeq,
+			ExitCode: e.ExitCode,
+		})
+	}
+	return spans
+}
+
+// RecentCommands returns a copy of the last n history entries, oldest
+// first, or all of them if n <= 0.
+func (s *Session) RecentCommands(n int) []CommandEntry {
+	s.historyMu.Lock()
+	defer s.historyMu.Unlock()
+	h := s.CommandHistory
+	if n > 0 && n < len(h) {
+		h = h[len(h)-n:]
 	}
-	return json.NewEncoder(s.clientConn).Encode(env)
+	return slices.Clone(h)
 }
 
-// SetConn updates the client connection reference and marks the session connected.
-func (s *Session) SetConn(conn net.Conn) {
+// SetConn updates the writer for the client's connection and marks the
+// session connected. The writer must be the one the daemon uses for its own
+// replies on that connection.
+func (s *Session) SetConn(client *ConnWriter) {
 	s.connMu.Lock()
 	defer s.connMu.Unlock()
-	s.clientConn = conn
-	s.Connected = true
+	s.client = client
+	s.connected = true
 }
 
-// ClearConn removes the client connection reference.
+// ClearConn removes the client connection reference and marks the session
+// disconnected.
 func (s *Session) ClearConn() {
 	s.connMu.Lock()
 	defer s.connMu.Unlock()
-	s.clientConn = nil
+	s.client = nil
+	s.connected = false
+	if s.disconnected != nil {
+		close(s.disconnected)
+		s.disconnected = nil
+	}
+}
+
+// Disconnected returns a channel that is closed when the session's current
+// client disconnects, or nil if no client is connected.
+func (s *Session) Disconnected() <-chan struct{} {
+	s.connMu.Lock()
+	defer s.connMu.Unlock()
+	if !s.connected {
+		return nil
+	}
+	if s.disconnected == nil {
+		s.disconnected = make(chan struct{})
+	}
+	return s.disconnected
+}
+
+// Connected reports whether the session's client is connected.
+func (s *Session) Connected() bool {
+	s.connMu.Lock()
+	defer s.connMu.Unlock()
+	return s.connected
+}
+
+// LastCommand returns the command last entered in the session, when it
+// started, and its exit status, nil until it finishes.
+func (s *Session) LastCommand() (cmd string, started time.Time, exitCode *int) {
+	s.historyMu.Lock()
+	defer s.historyMu.Unlock()
+	return s.lastCommand, s.lastCommandStarted, s.lastExitCode
+}
+
+// setLastCommand records cmd as the last command without adding it to the
+// history, as when a reconnecting client reports it.
+func (s *Session) setLastCommand(cmd string) {
+	s.historyMu.Lock()
+	defer s.historyMu.Unlock()
+	s.lastCommand = cmd
+}
+
+// Title returns the session's title.
+func (s *Session) Title() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.title
+}
+
+// LastActivity returns when the session last received anything from its
+// client.
+func (s *Session) LastActivity() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lastActivity
+}
+
+// touch records activity from the client now and returns the time.
+func (s *Session) touch() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastActivity = time.Now()
+	return s.lastActivity
+}
+
+// Collab reports whether the session accepts input from agents.
+func (s *Session) Collab() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.collab
+}
+
+// ReadOnly reports whether the client refuses input, even if collab.
+func (s *Session) ReadOnly() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.readOnly
+}
+
+// KeepANSI reports whether the buffer also keeps output with ANSI escapes,
+// for raw reads.
+func (s *Session) KeepANSI() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.keepANSI
+}
+
+// Tags returns the session's tags. The slice must not be modified.
+func (s *Session) Tags() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tags
+}
+
+// Pid returns the shell's process ID on the client's host, zero if unknown.
+func (s *Session) Pid() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.pid
+}
+
+// TTL returns the session's own max age after disconnecting, which
+// overrides the one passed to Store.Prune, or zero if it has none.
+func (s *Session) TTL() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ttl
+}
+
+// Paused reports whether the client has paused streaming.
+func (s *Session) Paused() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.paused
+}
+
+func (s *Session) setPaused(paused bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.paused = paused
+}
+
+// Size returns the terminal size reported by the client, zero if unknown.
+func (s *Session) Size() (rows, cols int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rows, s.cols
+}
+
+func (s *Session) setSize(rows, cols int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rows, s.cols = rows, cols
+}
+
+// Cwd returns the working directory at the last prompt, empty if unknown.
+func (s *Session) Cwd() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.cwd
+}
+
+func (s *Session) setCwd(dir string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cwd = dir
+}
+
+// Environment returns the environment variables the client reported. The
+// map must not be modified.
+func (s *Session) Environment() map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.environment
+}
+
+func (s *Session) setEnvironment(vars map[string]string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.environment = vars
+}
+
+// clientSeq converts a seq in the session's buffer to the client's
+// numbering of the same line.
+func (s *Session) clientSeq(seq uint64) uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return seq + s.clientSeqOffset
+}
+
+func (s *Session) setClientSeqOffset(offset uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.clientSeqOffset = offset
+}
+
+// register applies the settings a client sends when it registers or
+// reconnects.
+func (s *Session) register(p RegisterPayload) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if p.Tags != nil {
+		s.tags = p.Tags
+	}
+	if p.Pid != 0 {
+		s.pid = p.Pid
+	}
+	s.keepANSI = p.KeepANSI
+	s.readOnly = p.ReadOnly
+	s.paused = p.Paused
+	if p.TTLMs > 0 {
+		s.ttl = time.Duration(p.TTLMs) * time.Millisecond
+	}
 }
 
 // Get returns a session by its full UUID.
@@ -134,27 +622,74 @@ func (s *Store) Get(id uuid.UUID) (*Session, bool) {
 	return sess, ok
 }
 
+// AmbiguousPrefixError is returned when a session prefix matches more than
+// one session. Its message lists the candidates, so the caller can retry
+// with a longer prefix or a title.
+type AmbiguousPrefixError struct {
+	Prefix  string
+	Matches []SessionInfo // ordered by short ID
+}
+
+func (e *AmbiguousPrefixError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "ambiguous prefix %q: matches ", e.Prefix)
+	for i, m := range e.Matches {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteString(m.ID)
+		if m.Title != "" {
+			fmt.Fprintf(&b, " (%s)", m.Title)
+		}
+	}
+	return b.String()
+}
+
 // FindByPrefix finds a session whose ShortID or full UUID string starts with prefix.
-// Returns an error if the prefix matches zero or multiple sessions.
+// Returns an error if the prefix matches zero sessions, or an
+// *AmbiguousPrefixError if it matches several.
 func (s *Store) FindByPrefix(prefix string) (*Session, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
 	prefix = strings.ToLower(prefix)
-	var match *Session
+	var matches []*Session
 	for _, sess := range s.sessions {
 		if strings.HasPrefix(strings.ToLower(sess.ID.String()), prefix) ||
 			strings.HasPrefix(strings.ToLower(sess.ShortID), prefix) {
+			matches = append(matches, sess)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return nil, fmt.Errorf("no session found with prefix %q", prefix)
+	case 1:
+		return matches[0], nil
+	}
+	slices.SortFunc(matches, func(a, b *Session) int { return cmp.Compare(a.ShortID, b.ShortID) })
+	err := &AmbiguousPrefixError{Prefix: prefix}
+	for _, sess := range matches {
+		err.Matches = append(err.Matches, sessionInfo(sess))
+	}
+	return nil, err
+}
+
+// findByShortID returns the one session whose ShortID equals id
+// (case-insensitive), or nil if there is none or several share it.
+func (s *Store) findByShortID(id string) *Session {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var match *Session
+	for _, sess := range s.sessions {
+		if strings.EqualFold(sess.ShortID, id) {
 			if match != nil {
-				return nil, fmt.Errorf("ambiguous prefix %q: matches multiple sessions", prefix)
+				return nil
 			}
 			match = sess
 		}
 	}
-	if match == nil {
-		return nil, fmt.Errorf("no session found with prefix %q", prefix)
-	}
-	return match, nil
+	return match
 }
 
 // FindByTitle finds a session with an exact (case-insensitive) title match.
@@ -164,14 +699,120 @@ func (s *Store) FindByTitle(title string) (*Session, error) {
 
 	lower := strings.ToLower(title)
 	for _, sess := range s.sessions {
-		if strings.ToLower(sess.Title) == lower {
+		if strings.ToLower(sess.Title()) == lower {
 			return sess, nil
 		}
 	}
 	return nil, fmt.Errorf("no session found with title %q", title)
 }
 
-// Resolve finds a session by UUID, short ID prefix, or title.
+// HasTag reports whether the session carries tag (case-insensitive).
+func (s *Session) HasTag(tag string) bool {
+	for _, t := range s.Tags() {
+		if strings.EqualFold(t, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// FindByTag returns all sessions carrying tag.
+func (s *Store) FindByTag(tag string) []*Session {
+	return s.FindByTags([]string{tag}, false)
+}
+
+// FindByTags returns sessions carrying any of tags, or all of them if all is
+// set.
+func (s *Store) FindByTags(tags []string, all bool) []*Session {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var result []*Session
+	for _, sess := range s.sessions {
+		if sess.matchesTags(tags, all) {
+			result = append(result, sess)
+		}
+	}
+	return result
+}
+
+// Filter returns the sessions matching p's tags, connection state, and
+// title, most recently active first. If p.Limit is positive, at most that
+// many are returned.
+func (s *Store) Filter(p ListSessionsPayload) []*Session {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	title := strings.ToLower(p.TitleContains)
+	var result []*Session
+	for _, sess := range s.sessions {
+		if len(p.Tags) > 0 && !sess.matchesTags(p.Tags, p.MatchAll) {
+			continue
+		}
+		if p.ConnectedOnly && !sess.Connected() {
+			continue
+		}
+		if title != "" && !strings.Contains(strings.ToLower(sess.Title()), title) {
+			continue
+		}
+		result = append(result, sess)
+	}
+	slices.SortFunc(result, byRecentActivity)
+	if p.Limit > 0 && len(result) > p.Limit {
+		result = result[:p.Limit]
+	}
+	return result
+}
+
+// byRecentActivity orders sessions most recently active first, then by
+// short ID.
+func byRecentActivity(a, b *Session) int {
+	if c := b.LastActivity().Compare(a.LastActivity()); c != 0 {
+		return c
+	}
+	return cmp.Compare(a.ShortID, b.ShortID)
+}
+
+func (s *Session) matchesTags(tags []string, all bool) bool {
+	for _, tag := range tags {
+		has := s.HasTag(tag)
+		if all && !has {
+			return false
+		}
+		if !all && has {
+			return true
+		}
+	}
+	return all
+}
+
+// ResolveWithTags is like Resolve, but if identifier is empty it selects the
+// single session carrying all of tags.
+func (s *Store) ResolveWithTags(identifier string, tags []string) (*Session, error) {
+	if identifier != "" || len(tags) == 0 {
+		return s.Resolve(identifier)
+	}
+	matches := s.FindByTags(tags, true)
+	switch len(matches) {
+	case 0:
+		return nil, fmt.Errorf("no session found with tags %v", tags)
+	case 1:
+		return matches[0], nil
+	default:
+		return nil, fmt.Errorf("%d sessions have tags %v, specify a session", len(matches), tags)
+	}
+}
+
+// Resolve finds a session by identifier, trying in order:
+//
+//  1. the full UUID
+//  2. the exact short ID
+//  3. a prefix of exactly one session's short ID or UUID
+//  4. the exact title (case-insensitive)
+//
+// An identifier that is also another session's title therefore resolves
+// by ID. An ambiguous prefix that is no session's title is returned as an
+// *AmbiguousPrefixError.
 func (s *Store) Resolve(identifier string) (*Session, error) {
 	// Try UUID first
 	if id, err := uuid.Parse(identifier); err == nil {
@@ -181,8 +822,14 @@ func (s *Store) Resolve(identifier string) (*Session, error) {
 		return nil, fmt.Errorf("no session found with ID %s", id)
 	}
 
+	// Try exact short ID
+	if sess := s.findByShortID(identifier); sess != nil {
+		return sess, nil
+	}
+
 	// Try prefix match
-	if sess, err := s.FindByPrefix(identifier); err == nil {
+	sess, prefixErr := s.FindByPrefix(identifier)
+	if prefixErr == nil {
 		return sess, nil
 	}
 
@@ -191,9 +838,39 @@ func (s *Store) Resolve(identifier string) (*Session, error) {
 		return sess, nil
 	}
 
+	var ambiguous *AmbiguousPrefixError
+	if errors.As(prefixErr, &ambiguous) {
+		return nil, prefixErr
+	}
 	return nil, fmt.Errorf("no session found matching %q", identifier)
 }
 
+// Rename changes a session's title and returns the previous one. Titles
+// must be non-empty and unique (case-insensitive) so they can be resolved.
+func (s *Store) Rename(id uuid.UUID, title string) (string, error) {
+	if strings.TrimSpace(title) == "" {
+		return "", fmt.Errorf("title must not be empty")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sess, ok := s.sessions[id]
+	if !ok {
+		return "", fmt.Errorf("no session found with ID %s", id)
+	}
+	for _, other := range s.sessions {
+		if other != sess && strings.EqualFold(other.Title(), title) {
+			return "", fmt.Errorf("session %s already has title %q", other.ShortID, other.Title())
+		}
+	}
+	sess.mu.Lock()
+	old := sess.title
+	sess.title = title
+	sess.mu.Unlock()
+	return old, nil
+}
+
 // Remove deletes a session from the store.
 func (s *Store) Remove(id uuid.UUID) {
 	s.mu.Lock()
@@ -201,6 +878,132 @@ func (s *Store) Remove(id uuid.UUID) {
 	delete(s.sessions, id)
 }
 
+// Prune removes disconnected sessions whose LastActivity is older than
+// their TTL, or than maxAge for sessions without one, and returns them.
+// A maxAge of zero only prunes sessions with a TTL.
+func (s *Store) Prune(maxAge time.Duration) []*Session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	var pruned []*Session
+	for id, sess := range s.sessions {
+		ttl := maxAge
+		if sessTTL := sess.TTL(); sessTTL > 0 {
+			ttl = sessTTL
+		}
+		if sess.Connected() || ttl <= 0 || now.Sub(sess.LastActivity()) <= ttl {
+			continue
+		}
+		delete(s.sessions, id)
+		sess.expire()
+		pruned = append(pruned, sess)
+	}
+	return pruned
+}
+
+// Watch returns a channel of events for the session with the given ID and a
+// function that stops watching and closes the channel. Events are dropped
+// rather than blocking the daemon if the watcher falls behind; use
+// RingBuffer.Tail to follow output without gaps.
+func (s *Store) Watch(id uuid.UUID) (<-chan SessionEvent, func(), error) {
+	if _, ok := s.Get(id); !ok {
+		return nil, nil, fmt.Errorf("no session found with ID %s", id)
+	}
+	ch, cancel := s.addWatcher(id)
+	return ch, cancel, nil
+}
+
+// WatchAll is like Watch, but reports the events of every session except
+// SessionNewLine, including sessions created later.
+func (s *Store) WatchAll() (<-chan SessionEvent, func()) {
+	return s.addWatcher(uuid.Nil)
+}
+
+// addWatcher registers a watcher for id, or for every session if id is
+// uuid.Nil.
+func (s *Store) addWatcher(id uuid.UUID) (<-chan SessionEvent, func()) {
+	ch := make(chan SessionEvent, 256)
+	s.watchMu.Lock()
+	s.watchers[id] = append(s.watchers[id], ch)
+	s.watchMu.Unlock()
+
+	var once sync.Once
+	cancel := func() {
+		once.Do(func() {
+			s.watchMu.Lock()
+			defer s.watchMu.Unlock()
+			chans := s.watchers[id]
+			for i, c := range chans {
+				if c == ch {
+					chans = append(chans[:i], chans[i+1:]...)
+					break
+				}
+			}
+			if len(chans) == 0 {
+				delete(s.watchers, id)
+			} else {
+				s.watchers[id] = chans
+			}
+			close(ch)
+		})
+	}
+	return ch, cancel
+}
+
+// watching returns the number of watchers of the session with the given ID,
+// or of all sessions if id is uuid.Nil.
+func (s *Store) watching(id uuid.UUID) int {
+	s.watchMu.Lock()
+	defer s.watchMu.Unlock()
+	return len(s.watchers[id])
+}
+
+// notify delivers ev to every watcher of the session with the given ID, and
+// to the watchers of all sessions.
+func (s *Store) notify(id uuid.UUID, ev SessionEvent) {
+	s.watchMu.Lock()
+	defer s.watchMu.Unlock()
+	for _, ch := range s.watchers[id] {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+	if ev.Kind == SessionNewLine {
+		return
+	}
+	for _, ch := range s.watchers[uuid.Nil] {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+// Expired returns a channel that is closed once the session is pruned.
+func (s *Session) Expired() <-chan struct{} {
+	s.expireMu.Lock()
+	defer s.expireMu.Unlock()
+	if s.expired == nil {
+		s.expired = make(chan struct{})
+	}
+	return s.expired
+}
+
+func (s *Session) expire() {
+	s.expireMu.Lock()
+	defer s.expireMu.Unlock()
+	if s.expired == nil {
+		s.expired = make(chan struct{})
+	}
+	select {
+	case <-s.expired:
+	default:
+		close(s.expired)
+	}
+}
+
 // List returns all sessions.
 func (s *Store) List() []*Session {
 	s.mu.RLock()
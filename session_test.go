@@ -1,17 +1,23 @@
 package streamsh
 
 import (
+	"errors"
+	"fmt"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/google/uuid"
 )
 
 func TestStoreCreateAndList(t *testing.T) {
 	s := NewStore()
-	sess := s.Create("test-session", 100, false, nil)
+	sess, _ := s.Create("test-session", 100, false, nil)
 
-	if sess.Title != "test-session" {
-		t.Errorf("title = %q, want %q", sess.Title, "test-session")
+	if sess.Title() != "test-session" {
+		t.Errorf("title = %q, want %q", sess.Title(), "test-session")
 	}
-	if !sess.Connected {
+	if !sess.Connected() {
 		t.Error("expected connected=true")
 	}
 	if len(sess.ShortID) != 8 {
@@ -26,7 +32,7 @@ func TestStoreCreateAndList(t *testing.T) {
 
 func TestStoreGet(t *testing.T) {
 	s := NewStore()
-	sess := s.Create("get-test", 100, false, nil)
+	sess, _ := s.Create("get-test", 100, false, nil)
 
 	found, ok := s.Get(sess.ID)
 	if !ok || found.ID != sess.ID {
@@ -36,7 +42,7 @@ func TestStoreGet(t *testing.T) {
 
 func TestStoreFindByPrefix(t *testing.T) {
 	s := NewStore()
-	sess := s.Create("prefix-test", 100, false, nil)
+	sess, _ := s.Create("prefix-test", 100, false, nil)
 
 	found, err := s.FindByPrefix(sess.ShortID[:4])
 	if err != nil {
@@ -59,6 +65,32 @@ func TestStoreFindByPrefixAmbiguous(t *testing.T) {
 	}
 }
 
+func TestStoreResolveAmbiguousListsMatches(t *testing.T) {
+	s := NewStore()
+	server, _ := s.Create("server", 100, false, nil)
+	tests, _ := s.Create("tests", 100, false, nil)
+	server.ShortID, tests.ShortID = "a1c3e5f7", "a1b2c3d4"
+
+	_, err := s.Resolve("A1")
+	var ambiguous *AmbiguousPrefixError
+	if !errors.As(err, &ambiguous) {
+		t.Fatalf("err = %v, want *AmbiguousPrefixError", err)
+	}
+	if len(ambiguous.Matches) != 2 || ambiguous.Matches[0].ID != "a1b2c3d4" {
+		t.Errorf("matches = %+v", ambiguous.Matches)
+	}
+	want := `ambiguous prefix "a1": matches a1b2c3d4 (tests), a1c3e5f7 (server)`
+	if err.Error() != want {
+		t.Errorf("err = %q, want %q", err, want)
+	}
+
+	// An exact title still wins over the ambiguous prefix
+	s.Rename(server.ID, "a1")
+	if sess, err := s.Resolve("a1"); err != nil || sess != server {
+		t.Errorf("resolve by title = %v, %v", sess, err)
+	}
+}
+
 func TestStoreFindByTitle(t *testing.T) {
 	s := NewStore()
 	s.Create("My Session", 100, false, nil)
@@ -67,14 +99,14 @@ func TestStoreFindByTitle(t *testing.T) {
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
-	if found.Title != "My Session" {
-		t.Errorf("title = %q, want %q", found.Title, "My Session")
+	if found.Title() != "My Session" {
+		t.Errorf("title = %q, want %q", found.Title(), "My Session")
 	}
 }
 
 func TestStoreResolve(t *testing.T) {
 	s := NewStore()
-	sess := s.Create("dev-server", 100, false, nil)
+	sess, _ := s.Create("dev-server", 100, false, nil)
 
 	// By full UUID
 	found, err := s.Resolve(sess.ID.String())
@@ -101,12 +133,363 @@ func TestStoreResolve(t *testing.T) {
 	}
 }
 
+func TestStoreResolveCollisions(t *testing.T) {
+	s := NewStore()
+	create := func(id, title string) *Session {
+		t.Helper()
+		sess, _, err := s.CreateOrUpdate(uuid.MustParse(id), title, 100, false, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sess
+	}
+	tests := create("a1b2c3d4-1111-4111-8111-111111111111", "tests")
+	create("a1b2ffff-2222-4222-8222-222222222222", "a1b2c3d4") // titled like tests' short ID
+	server := create("c0ffee00-3333-4333-8333-333333333333", "a1b2")
+	create("d00d0000-4444-4444-8444-444444444444", "c0ff") // titled like a prefix of server's ID
+
+	for _, c := range []struct {
+		identifier string
+		want       *Session
+	}{
+		{"a1b2c3d4-1111-4111-8111-111111111111", tests}, // full UUID
+		{"a1b2c3d4", tests},                             // short ID beats title
+		{"A1B2C3D4", tests},
+		{"c0ff", server}, // unique prefix beats title
+		{"a1b2", server}, // ambiguous prefix falls back to title
+		{"TESTS", tests},
+	} {
+		got, err := s.Resolve(c.identifier)
+		if err != nil || got != c.want {
+			t.Errorf("Resolve(%q) = %v, %v; want %s", c.identifier, got, err, c.want.ShortID)
+		}
+	}
+
+	// Sessions sharing a short ID are told apart by their full UUIDs
+	s = NewStore()
+	create("a1b2c3d4-1111-4111-8111-111111111111", "tests")
+	dup := create("a1b2c3d4-5555-4555-8555-555555555555", "dup")
+	var ambiguous *AmbiguousPrefixError
+	if _, err := s.Resolve("a1b2c3d4"); !errors.As(err, &ambiguous) {
+		t.Errorf("shared short ID: err = %v, want *AmbiguousPrefixError", err)
+	}
+	if got, err := s.Resolve(dup.ID.String()); err != nil || got != dup {
+		t.Errorf("resolve dup by UUID = %v, %v", got, err)
+	}
+}
+
 func TestStoreRemove(t *testing.T) {
 	s := NewStore()
-	sess := s.Create("to-remove", 100, false, nil)
+	sess, _ := s.Create("to-remove", 100, false, nil)
 	s.Remove(sess.ID)
 
 	if len(s.List()) != 0 {
 		t.Error("expected empty store after remove")
 	}
 }
+
+func TestStorePrune(t *testing.T) {
+	s := NewStore()
+	idle, _ := s.Create("idle", 100, false, nil)
+	idle.connected = false
+	idle.lastActivity = time.Now().Add(-2 * time.Hour)
+
+	connected, _ := s.Create("connected", 100, false, nil)
+	connected.lastActivity = time.Now().Add(-2 * time.Hour)
+
+	recent, _ := s.Create("recent", 100, false, nil)
+	recent.connected = false
+
+	short, _ := s.Create("short-ttl", 100, false, nil)
+	short.connected = false
+	short.ttl = time.Minute
+	short.lastActivity = time.Now().Add(-5 * time.Minute)
+
+	// With no default max age only sessions with their own TTL expire
+	if pruned := s.Prune(0); len(pruned) != 1 || pruned[0] != short {
+		t.Fatalf("Prune(0) removed %d sessions", len(pruned))
+	}
+	select {
+	case <-short.Expired():
+	default:
+		t.Error("pruned session not marked expired")
+	}
+
+	if pruned := s.Prune(time.Hour); len(pruned) != 1 || pruned[0] != idle {
+		t.Fatalf("Prune(1h) removed %d sessions", len(pruned))
+	}
+	if len(s.List()) != 2 {
+		t.Errorf("expected 2 sessions left, got %d", len(s.List()))
+	}
+}
+
+func TestStoreFilter(t *testing.T) {
+	s := NewStore()
+	now := time.Now()
+	api, _ := s.Create("API server", 100, false, nil)
+	api.connected, api.lastActivity = true, now.Add(-time.Minute)
+	tests, _ := s.Create("api tests", 100, false, nil)
+	tests.connected, tests.lastActivity = true, now
+	old, _ := s.Create("old api", 100, false, nil)
+	old.connected, old.lastActivity = false, now.Add(-time.Hour)
+	web, _ := s.Create("web", 100, false, nil)
+	web.connected, web.lastActivity = true, now.Add(-2*time.Minute)
+
+	titles := func(sessions []*Session) string {
+		var out []string
+		for _, sess := range sessions {
+			out = append(out, sess.Title())
+		}
+		return strings.Join(out, ", ")
+	}
+	if got := titles(s.Filter(ListSessionsPayload{})); got != "api tests, API server, web, old api" {
+		t.Errorf("all = %s, want most recent first", got)
+	}
+	if got := titles(s.Filter(ListSessionsPayload{TitleContains: "API", ConnectedOnly: true})); got != "api tests, API server" {
+		t.Errorf("connected api = %s", got)
+	}
+	if got := titles(s.Filter(ListSessionsPayload{TitleContains: "api", Limit: 2})); got != "api tests, API server" {
+		t.Errorf("limit 2 = %s", got)
+	}
+}
+
+func TestStoreFindByTags(t *testing.T) {
+	s := NewStore()
+	api, _ := s.Create("api", 100, false, nil)
+	api.tags = []string{"backend", "prod"}
+	worker, _ := s.Create("worker", 100, false, nil)
+	worker.tags = []string{"backend", "staging"}
+	web, _ := s.Create("web", 100, false, nil)
+	web.tags = []string{"frontend"}
+
+	if got := s.FindByTag("Backend"); len(got) != 2 {
+		t.Errorf("FindByTag(backend) = %d sessions, want 2", len(got))
+	}
+	if got := s.FindByTags([]string{"prod", "frontend"}, false); len(got) != 2 {
+		t.Errorf("any of prod,frontend = %d sessions, want 2", len(got))
+	}
+	if got := s.FindByTags([]string{"backend", "prod"}, true); len(got) != 1 || got[0] != api {
+		t.Errorf("all of backend,prod = %v, want api", got)
+	}
+
+	found, err := s.ResolveWithTags("", []string{"backend", "staging"})
+	if err != nil || found != worker {
+		t.Errorf("resolve by tags = %v, %v", found, err)
+	}
+	if _, err := s.ResolveWithTags("", []string{"backend"}); err == nil {
+		t.Error("expected error for ambiguous tags")
+	}
+	if found, err := s.ResolveWithTags("web", []string{"backend"}); err != nil || found != web {
+		t.Errorf("identifier should take precedence over tags, got %v, %v", found, err)
+	}
+}
+
+func TestStoreWatch(t *testing.T) {
+	s := NewStore()
+	sess, _ := s.Create("watched", 100, false, nil)
+	other, _ := s.Create("other", 100, false, nil)
+
+	events, cancel, err := s.Watch(sess.ID)
+	if err != nil {
+		t.Fatalf("watch: %v", err)
+	}
+	s.notify(other.ID, SessionEvent{Kind: SessionNewLine, Session: other, Line: "ignored"})
+	s.notify(sess.ID, SessionEvent{Kind: SessionNewCommand, Session: sess, Line: "make test"})
+
+	ev := <-events
+	if ev.Kind != SessionNewCommand || ev.Session != sess || ev.Line != "make test" {
+		t.Errorf("got %+v", ev)
+	}
+
+	cancel()
+	if _, ok := <-events; ok {
+		t.Error("expected channel closed after cancel")
+	}
+	cancel() // idempotent
+	s.notify(sess.ID, SessionEvent{Kind: SessionDisconnected, Session: sess})
+
+	if _, _, err := s.Watch(uuid.New()); err == nil {
+		t.Error("expected error watching unknown session")
+	}
+}
+
+func TestStoreRename(t *testing.T) {
+	s := NewStore()
+	sess, _ := s.Create("tests", 100, false, nil)
+	s.Create("server", 100, false, nil)
+
+	old, err := s.Rename(sess.ID, "backend tests")
+	if err != nil || old != "tests" {
+		t.Fatalf("rename = %q, %v", old, err)
+	}
+	if found, err := s.Resolve("backend tests"); err != nil || found != sess {
+		t.Errorf("resolve by new title = %v, %v", found, err)
+	}
+	if _, err := s.Resolve("tests"); err == nil {
+		t.Error("old title should no longer resolve")
+	}
+
+	if _, err := s.Rename(sess.ID, "Server"); err == nil {
+		t.Error("expected error renaming to a title in use")
+	}
+	if _, err := s.Rename(sess.ID, "  "); err == nil {
+		t.Error("expected error for empty title")
+	}
+}
+
+func TestSessionCommandHistory(t *testing.T) {
+	s := NewStore()
+	sess, _ := s.Create("history", 100, false, nil)
+
+	now := time.Now()
+	for i := range MaxCommandHistory + 5 {
+		sess.AddCommand(fmt.Sprintf("cmd %d", i), now)
+	}
+	sess.SetExitCode(2)
+
+	all := sess.RecentCommands(0)
+	if len(all) != MaxCommandHistory {
+		t.Fatalf("history length = %d, want %d", len(all), MaxCommandHistory)
+	}
+	if all[0].Command != "cmd 5" {
+		t.Errorf("oldest = %q, want cmd 5", all[0].Command)
+	}
+
+	last := sess.RecentCommands(2)
+	if len(last) != 2 || last[1].Command != fmt.Sprintf("cmd %d", MaxCommandHistory+4) {
+		t.Fatalf("recent = %+v", last)
+	}
+	if last[0].ExitCode != nil || last[1].ExitCode == nil || *last[1].ExitCode != 2 {
+		t.Errorf("exit codes = %v, %v", last[0].ExitCode, last[1].ExitCode)
+	}
+	if _, _, code := sess.LastCommand(); code == nil || *code != 2 {
+		t.Errorf("last exit code = %v, want 2", code)
+	}
+
+	// The store can keep a shorter history
+	s.HistorySize = 3
+	short, _, _ := s.CreateOrUpdate(uuid.New(), "short", 100, false, nil)
+	for i := range 5 {
+		short.AddCommand(fmt.Sprintf("cmd %d", i), now)
+	}
+	if got := short.RecentCommands(0); len(got) != 3 || got[0].Command != "cmd 2" {
+		t.Errorf("history with HistorySize 3 = %+v", got)
+	}
+
+	// A non-positive size means the default, not a panic
+	s.HistorySize = -1
+	unbounded, _, _ := s.CreateOrUpdate(uuid.New(), "default", 100, false, nil)
+	unbounded.AddCommand("ls", now)
+	if got := unbounded.RecentCommands(0); len(got) != 1 {
+		t.Errorf("history with HistorySize -1 = %+v", got)
+	}
+}
+
+func TestLineRate(t *testing.T) {
+	var r lineRate
+	start := time.Now()
+	r.add(10, start)
+	r.add(5, start.Add(30*time.Second))
+	if got := r.perMinute(start.Add(59 * time.Second)); got != 0 {
+		t.Errorf("rate within the first minute = %d, want 0", got)
+	}
+	if got := r.average(start.Add(59 * time.Second)); got != 15 {
+		t.Errorf("average within the first minute = %v, want 15", got)
+	}
+	r.add(7, start.Add(70*time.Second))
+	if got := r.perMinute(start.Add(90 * time.Second)); got != 15 {
+		t.Errorf("rate after one minute = %d, want 15", got)
+	}
+	// Half the previous minute is still inside the trailing window
+	if got := r.average(start.Add(90 * time.Second)); got != 14.5 {
+		t.Errorf("average after one minute = %v, want 14.5", got)
+	}
+	if got := r.perMinute(start.Add(125 * time.Second)); got != 7 {
+		t.Errorf("rate after two minutes = %d, want 7", got)
+	}
+	if got := r.perMinute(start.Add(5 * time.Minute)); got != 0 {
+		t.Errorf("rate after going quiet = %d, want 0", got)
+	}
+	if got := r.average(start.Add(5 * time.Minute)); got != 0 {
+		t.Errorf("average after going quiet = %v, want 0", got)
+	}
+	var empty lineRate
+	if got := empty.average(start); got != 0 {
+		t.Errorf("average with no lines = %v, want 0", got)
+	}
+}
+
+func TestSessionCommandSpans(t *testing.T) {
+	s := NewStore()
+	sess, _ := s.Create("spans", 4, false, nil)
+
+	now := time.Now()
+	sess.AddCommand("make", now)
+	sess.Buffer.AppendBatch([]string{"$ make", "cc main.c", "error"})
+	sess.SetExitCode(2)
+	sess.AddCommand("vim", now) // no exit status: ended by the next command
+	sess.Buffer.AppendBatch([]string{"$ vim"})
+	sess.AddCommand("ls", now)
+	sess.Buffer.AppendBatch([]string{"$ ls", "go.mod"})
+
+	// The buffer holds 4 lines, so make's first two have been evicted
+	var got []string
+	for _, span := range sess.CommandSpans() {
+		end, code := "-", "-"
+		if span.EndSeq != nil {
+			end = fmt.Sprint(*span.EndSeq)
+		}
+		if span.ExitCode != nil {
+			code = fmt.Sprint(*span.ExitCode)
+		}
+		got = append(got, fmt.Sprintf("%s %d-%s exit %s", span.Command, span.StartSeq, end, code))
+	}
+	if want := "[make 2-3 exit 2 vim 3-4 exit - ls 4-- exit -]"; fmt.Sprint(got) != want {
+		t.Errorf("spans = %v, want %s", got, want)
+	}
+
+	sess.Buffer.AppendBatch([]string{"a", "b", "c"})
+	if spans := sess.CommandSpans(); len(spans) != 1 || spans[0].Command != "ls" || spans[0].StartSeq != 5 {
+		t.Errorf("after eviction spans = %+v, want only ls from seq 5", spans)
+	}
+}
+
+func TestStoreMaxSessions(t *testing.T) {
+	s := NewStore()
+	s.MaxSessions = 3
+	older, _ := s.Create("older", 100, false, nil)
+	old, _ := s.Create("old", 100, false, nil)
+	live, _ := s.Create("live", 100, false, nil)
+	older.connected = false
+	older.lastActivity = time.Now().Add(-2 * time.Hour)
+	old.connected = false
+	old.lastActivity = time.Now().Add(-time.Hour)
+	live.lastActivity = time.Now().Add(-3 * time.Hour)
+
+	// The least recently active disconnected session makes room; live
+	// sessions are never evicted, however idle.
+	if _, err := s.Create("new", 100, false, nil); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if _, ok := s.Get(older.ID); ok {
+		t.Error("expected older to be evicted")
+	}
+	select {
+	case <-older.Expired():
+	default:
+		t.Error("evicted session not marked expired")
+	}
+	if _, _, err := s.CreateOrUpdate(uuid.New(), "newer", 100, false, nil); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if _, ok := s.Get(old.ID); ok {
+		t.Error("expected old to be evicted")
+	}
+
+	if _, err := s.Create("too-many", 100, false, nil); !errors.Is(err, ErrTooManySessions) {
+		t.Errorf("create with all sessions connected = %v, want ErrTooManySessions", err)
+	}
+	if _, reconnected, err := s.CreateOrUpdate(live.ID, "live", 100, false, nil); err != nil || !reconnected {
+		t.Errorf("reconnect at the limit = %v, %v", reconnected, err)
+	}
+}